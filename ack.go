@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rakoo/goax/pkg/envelope"
+	"github.com/rakoo/goax/pkg/ratchet"
+)
+
+// ack prints an encrypted acknowledgement for each device of peer, telling
+// it how many of its messages we decrypted, as counted by the Decrypted
+// stats of our session with it. Since it's a regular ratchet message, it
+// also lets peer renew their ratchet keys even if we have nothing else to
+// say.
+func ack(peer string, out blockWriter) {
+	sessions, err := openSessions(peer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !hasRatchet(sessions) {
+		fmt.Fprintf(os.Stderr, "No ratchet for %s, nothing to acknowledge\n", peer)
+		os.Exit(1)
+	}
+	ready := completeSessions(sessions)
+	if len(ready) == 0 {
+		fmt.Fprintf(os.Stderr, "The handshake with %s is not complete yet, there is nothing to acknowledge\n", peer)
+		os.Exit(1)
+	}
+
+	out.sendDevices(peer, false)
+	for _, s := range ready {
+		stats, err := loadDeliveryStats(s.name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		e, err := envelope.New(rand.Reader, envelope.Ack, "", encodeAck(stats.Decrypted))
+		if err != nil {
+			log.Fatal(err)
+		}
+		plaintext, err := e.Marshal()
+		if err != nil {
+			log.Fatal(err)
+		}
+		cipherText, err := s.r.Encrypt(plaintext)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := saveRatchet(s.r, s.name()); err != nil {
+			log.Fatal("Couldn't save ratchet: ", err)
+		}
+
+		if s.r.State() != ratchet.HandshakeConfirmed {
+			out.sendSessionRatchet(s.peerSession, s.r)
+		}
+		out.sendSessionMessage(s.peerSession, cipherText)
+	}
+}
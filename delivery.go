@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxSendsWithoutRatchet is the number of messages sent on the same
+	// chain after which we warn the user.
+	maxSendsWithoutRatchet = 20
+	// maxUnacknowledged is the number of messages not acknowledged by the
+	// peer after which we warn the user.
+	maxUnacknowledged = 10
+)
+
+// deliveryStats counts messages exchanged over a session, that is with
+// one device of a peer, and are kept under the name of the session. Each
+// device acknowledges with the Decrypted count of its session with us,
+// which we compare to the Sent count of our session with it.
+type deliveryStats struct {
+	// Sent is the number of messages we encrypted for the session.
+	Sent uint64 `json:"sent"`
+	// Decrypted is the number of text and file messages we decrypted
+	// with the session. It is a count, not a ratchet counter: duplicates
+	// and resent ciphertexts don't decrypt twice, so they aren't counted
+	// again, and it goes on across resets.
+	Decrypted uint64 `json:"received"`
+	// Acked is the highest Decrypted count the device acknowledged.
+	Acked uint64 `json:"acked"`
+	// DeviceList is the serial of the list of our devices we last sent
+	// to the peer; it is kept under the name of the peer.
+	DeviceList uint64 `json:"device_list,omitempty"`
+}
+
+// unacknowledged is the number of messages sent that the device hasn't
+// acknowledged.
+func (s deliveryStats) unacknowledged() uint64 {
+	if s.Acked > s.Sent {
+		return 0
+	}
+	return s.Sent - s.Acked
+}
+
+func deliveryPath(name string) string {
+	return path.Join("delivery", hex.EncodeToString([]byte(name)))
+}
+
+func loadDeliveryStats(name string) (s deliveryStats, err error) {
+	content, err := ioutil.ReadFile(deliveryPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return s, errors.Wrap(err, "Couldn't read delivery stats")
+	}
+	err = json.Unmarshal(content, &s)
+	return s, errors.Wrap(err, "Invalid delivery stats")
+}
+
+func saveDeliveryStats(name string, s deliveryStats) error {
+	os.MkdirAll("delivery", 0755)
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(ioutil.WriteFile(deliveryPath(name), content, 0600), "Couldn't write delivery stats")
+}
+
+// updateDeliveryStats loads the stats kept under name, applies update and
+// saves them back.
+func updateDeliveryStats(name string, update func(s *deliveryStats)) (deliveryStats, error) {
+	s, err := loadDeliveryStats(name)
+	if err != nil {
+		return s, err
+	}
+	update(&s)
+	return s, saveDeliveryStats(name, s)
+}
+
+// countSent counts a message sent with the session s, and returns its
+// stats.
+func countSent(s peerSession) deliveryStats {
+	stats, err := updateDeliveryStats(s.name(), func(s *deliveryStats) { s.Sent++ })
+	if err != nil {
+		log.Println("Couldn't update delivery stats:", err)
+	}
+	return stats
+}
+
+var errInvalidAck = errors.New("Invalid acknowledgement")
+
+// encodeAck encodes the content of an acknowledgement, which is the
+// Decrypted count of the session it is sent with.
+func encodeAck(decrypted uint64) []byte {
+	var ack [8]byte
+	binary.LittleEndian.PutUint64(ack[:], decrypted)
+	return ack[:]
+}
+
+func decodeAck(ack []byte) (uint64, error) {
+	if len(ack) != 8 {
+		return 0, errInvalidAck
+	}
+	return binary.LittleEndian.Uint64(ack), nil
+}
+
+// warnDeliveryHealth prints a warning if too many messages went out
+// without an answer from peer; unacknowledged is the most any of their
+// devices didn't acknowledge.
+func warnDeliveryHealth(peer string, sentWithoutRatchet uint32, unacknowledged uint64) {
+	if sentWithoutRatchet >= maxSendsWithoutRatchet {
+		fmt.Fprintf(os.Stderr, "Warning: %d messages were sent to %s since they last wrote back; they all depend on the same ratchet keys. Ask %s to run \"goax ack <you>\" and send you the result so that the keys get renewed.\n", sentWithoutRatchet, peer, peer)
+	}
+	if unacknowledged >= maxUnacknowledged {
+		fmt.Fprintf(os.Stderr, "Warning: %s hasn't acknowledged %d messages; some of them may be lost (see \"goax resend %s\")\n", peer, unacknowledged, peer)
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/crowsonkb/base58"
+	"github.com/pkg/errors"
+	"github.com/rakoo/goax/pkg/device"
+	"github.com/rakoo/goax/pkg/ratchet"
+	"github.com/rakoo/goax/pkg/session"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// Linked devices share a user key, kept in userkey, and the list of their
+// device keys signed by it, kept in devicelist. The key file of each
+// device is its device key. The verified lists of the devices of our
+// peers are kept in devices/<hex(peer)>.
+//
+// Once we know the devices of a peer, we have a session with each of
+// them, named peer/<hex(device key)>. Otherwise we have a single session
+// named after the peer.
+const (
+	userKeyFile    = "userkey"
+	deviceListFile = "devicelist"
+	USER_KEY_TYPE  = "GOAX USER KEY"
+)
+
+var errUnknownDevice = errors.New("Unknown device")
+
+// errForeignDevices is returned by updatePeerDevices for a first list of
+// devices that doesn't contain the device of our session with the peer.
+var errForeignDevices = errors.New("Device list without the device of our session")
+
+// myDevice returns the device key of this device.
+func myDevice() (public [32]byte) {
+	private := identityKey()
+	curve25519.ScalarBaseMult(&public, &private)
+	return public
+}
+
+// deviceName returns a short printable name for a device key.
+func deviceName(d [32]byte) string {
+	return base58.Encode(d[:])[:8]
+}
+
+func readDeviceList(file string) (*device.List, error) {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't read device list")
+	}
+	l := new(device.List)
+	if err := l.UnmarshalBinary(content); err != nil {
+		return nil, errors.Wrap(err, "Invalid device list")
+	}
+	return l, nil
+}
+
+func writeDeviceList(file string, l *device.List) error {
+	content, err := l.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(path.Dir(file), 0700)
+	return errors.Wrap(ioutil.WriteFile(file, content, 0600), "Couldn't write device list")
+}
+
+// loadOwnDevices returns the list of our devices, or nil if this device
+// isn't linked to any other.
+func loadOwnDevices() (*device.List, error) {
+	return readDeviceList(deviceListFile)
+}
+
+func peerDevicesPath(peer string) string {
+	return path.Join("devices", hex.EncodeToString([]byte(peer)))
+}
+
+// loadPeerDevices returns the list of the devices of peer, or nil if they
+// never sent it.
+func loadPeerDevices(peer string) (*device.List, error) {
+	return readDeviceList(peerDevicesPath(peer))
+}
+
+// updatePeerDevices keeps l, a verified list, as the list of the devices
+// of peer if it is newer than the one we have. Lists travel in the clear,
+// so the first list of a peer must contain the device of our session with
+// them, if we know it, and is only trusted with a warning otherwise; after
+// that, only lists signed by the same user key are.
+func updatePeerDevices(peer string, l *device.List) (changed bool, err error) {
+	current, err := loadPeerDevices(peer)
+	if err != nil {
+		return false, err
+	}
+	if current != nil {
+		err := current.CheckUpdate(l)
+		if err == device.ErrOldList || err == nil && l.Serial == current.Serial {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	} else if err := checkFirstDevices(peer, l); err != nil {
+		return false, err
+	}
+	return true, writeDeviceList(peerDevicesPath(peer), l)
+}
+
+// checkFirstDevices checks that l, the first list of devices of peer,
+// contains the device our session with them was made with.
+func checkFirstDevices(peer string, l *device.List) error {
+	var identity [32]byte
+	var known bool
+	rec, err := openRecord(peer)
+	if err != nil && err != errNoRatchet {
+		return err
+	}
+	if rec != nil {
+		identity, known = rec.Active.PeerIdentity()
+	}
+	if known && !l.Contains(identity) {
+		return errForeignDevices
+	}
+	if !known {
+		fmt.Fprintf(os.Stderr, "WARNING: nothing ties the list of devices %s sent to a session with them yet. Check with them that \"goax devices %s\" shows their devices.\n", peer, peer)
+	}
+	return nil
+}
+
+// loadUserKey returns our user key, or nil if this device isn't linked.
+func loadUserKey() (ed25519.PrivateKey, error) {
+	f, err := os.Open(userKeyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error opening user key")
+	}
+	defer f.Close()
+
+	block, err := armor.Decode(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error decoding user key")
+	}
+	seed, err := ioutil.ReadAll(block.Body)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("Error decoding user key")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func saveUserKey(key ed25519.PrivateKey) error {
+	var buf bytes.Buffer
+	encoder, err := armor.Encode(&buf, USER_KEY_TYPE, nil)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't create armored writer")
+	}
+	encoder.Write(key.Seed())
+	if err := encoder.Close(); err != nil {
+		return errors.Wrap(err, "Couldn't close encoder")
+	}
+	return errors.Wrap(ioutil.WriteFile(userKeyFile, buf.Bytes(), 0600), "Couldn't write user key")
+}
+
+// A peerSession is our session with a device of a peer or, if we don't
+// know their devices, with the peer as a whole.
+type peerSession struct {
+	peer string
+	// device is the device key of peer, zero for a session with the peer
+	// as a whole.
+	device [32]byte
+	// addressed tells if the blocks of the session are wrapped in device
+	// messages, which is the case when either of us has linked devices.
+	addressed bool
+}
+
+// name is the name of the ratchets and sent messages of the session.
+func (s peerSession) name() string {
+	if s.device == ([32]byte{}) {
+		return s.peer
+	}
+	return s.peer + "/" + hex.EncodeToString(s.device[:])
+}
+
+func (s peerSession) String() string {
+	if s.device == ([32]byte{}) {
+		return s.peer
+	}
+	return fmt.Sprintf("%s (device %s)", s.peer, deviceName(s.device))
+}
+
+// peerSessions returns our sessions with peer: one per device if we know
+// their devices.
+func peerSessions(peer string) ([]peerSession, error) {
+	own, err := loadOwnDevices()
+	if err != nil {
+		return nil, err
+	}
+	list, err := loadPeerDevices(peer)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		return []peerSession{{peer: peer, addressed: own != nil}}, nil
+	}
+	sessions := make([]peerSession, 0, len(list.Devices))
+	for _, d := range list.Devices {
+		if err := claimRecord(peer, d, false); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, peerSession{peer, d, true})
+	}
+	return sessions, nil
+}
+
+// deviceSession returns the session with the device of peer that sent us
+// a block, if it is one of their devices.
+func deviceSession(peer string, from [32]byte) (peerSession, error) {
+	list, err := loadPeerDevices(peer)
+	if err != nil {
+		return peerSession{}, err
+	}
+	if list == nil {
+		return peerSession{peer: peer}, nil
+	}
+	if !list.Contains(from) {
+		return peerSession{}, errUnknownDevice
+	}
+	return peerSession{peer, from, true}, claimRecord(peer, from, true)
+}
+
+// claimRecord makes our session with peer as a whole, if any, the session
+// with their device d: if it was with d, or if we can't tell and d is the
+// one who sent us something.
+func claimRecord(peer string, d [32]byte, fromDevice bool) error {
+	s := peerSession{peer: peer, device: d}
+	_, err := ratchets.Load(s.name())
+	if err != session.ErrNotFound {
+		return err
+	}
+	rec, err := openRecord(peer)
+	if err == errNoRatchet {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	identity, known := rec.Active.PeerIdentity()
+	if identity != d && (known || !fromDevice) {
+		return nil
+	}
+	if err := saveRecord(rec, s.name()); err != nil {
+		return err
+	}
+	if err := claimDeliveryStats(peer, s.name()); err != nil {
+		return err
+	}
+	return ratchets.Remove(peer)
+}
+
+// claimDeliveryStats moves the counts of the session with peer as a whole
+// to the session name, which replaces it.
+func claimDeliveryStats(peer, name string) error {
+	var claimed deliveryStats
+	_, err := updateDeliveryStats(peer, func(s *deliveryStats) {
+		claimed = deliveryStats{Sent: s.Sent, Decrypted: s.Decrypted, Acked: s.Acked}
+		*s = deliveryStats{DeviceList: s.DeviceList}
+	})
+	if err != nil {
+		return err
+	}
+	return saveDeliveryStats(name, claimed)
+}
+
+// A sessionRatchet is a session with its active ratchet, nil if we have
+// none yet.
+type sessionRatchet struct {
+	peerSession
+	r *ratchet.Ratchet
+}
+
+// openSessions returns the active ratchets of our sessions with peer.
+func openSessions(peer string) ([]sessionRatchet, error) {
+	sessions, err := peerSessions(peer)
+	if err != nil {
+		return nil, err
+	}
+	opened := make([]sessionRatchet, 0, len(sessions))
+	for _, s := range sessions {
+		r, err := openRatchet(s.name())
+		if err != nil && err != errNoRatchet {
+			return nil, err
+		}
+		opened = append(opened, sessionRatchet{s, r})
+	}
+	return opened, nil
+}
+
+// hasRatchet tells if any of sessions has a ratchet.
+func hasRatchet(sessions []sessionRatchet) bool {
+	for _, s := range sessions {
+		if s.r != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// completeSessions returns the sessions whose key exchange is complete.
+func completeSessions(sessions []sessionRatchet) []sessionRatchet {
+	var complete []sessionRatchet
+	for _, s := range sessions {
+		if s.r != nil && s.r.State() != ratchet.AwaitingKeyExchange {
+			complete = append(complete, s)
+		}
+	}
+	return complete
+}
+
+// sendDevices prints the list of our devices, if we have linked devices
+// and peer may not have it: if it changed since we last sent it to them,
+// or always if force.
+func (w blockWriter) sendDevices(peer string, force bool) {
+	own, err := loadOwnDevices()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if own == nil {
+		return
+	}
+	stats, err := loadDeliveryStats(peer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !force && stats.DeviceList == own.Serial {
+		return
+	}
+	content, err := own.MarshalBinary()
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.writeBlock(DEVICE_LIST_TYPE, content)
+	if _, err := updateDeliveryStats(peer, func(s *deliveryStats) { s.DeviceList = own.Serial }); err != nil {
+		log.Println("Couldn't update delivery stats:", err)
+	}
+}
+
+// linkDevice adds the device whose key is printed by its "goax mykey" to
+// our devices, and prints what it needs to join them.
+func linkDevice(key string, out blockWriter) {
+	d, err := decodeIdentityKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	userKey, err := loadUserKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	own, err := loadOwnDevices()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if userKey == nil {
+		userKey, err = newUserKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if own == nil {
+		own = &device.List{Devices: [][32]byte{myDevice()}}
+	}
+	if own.Contains(d) {
+		fmt.Fprintf(os.Stderr, "Device %s is already linked\n", deviceName(d))
+		os.Exit(1)
+	}
+
+	next, err := device.Sign(userKey, own.Serial+1, append(own.Devices, d))
+	if err != nil {
+		log.Fatal("Couldn't sign the device list: ", err)
+	}
+	link, err := device.NewLink(rand.Reader, userKey, next, d)
+	if err != nil {
+		log.Fatal("Couldn't link device: ", err)
+	}
+	content, err := link.MarshalBinary()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeDeviceList(deviceListFile, next); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Run \"goax link accept\" with this on the new device, and on your other devices if you have some. Your peers will learn about it with your next messages.\n\n")
+	out.writeBlock(DEVICE_LINK_TYPE, content)
+}
+
+// newUserKey creates our user key, when we link a first device.
+func newUserKey() (ed25519.PrivateKey, error) {
+	_, userKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't create user key")
+	}
+	return userKey, saveUserKey(userKey)
+}
+
+// unlinkDevice removes a device from our devices. Our peers stop
+// encrypting to it once they get the new list.
+func unlinkDevice(key string, out blockWriter) {
+	d, err := decodeIdentityKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	userKey, err := loadUserKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	own, err := loadOwnDevices()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if userKey == nil || own == nil || !own.Contains(d) {
+		fmt.Fprintf(os.Stderr, "Device %s isn't linked\n", deviceName(d))
+		os.Exit(1)
+	}
+	if d == myDevice() {
+		fmt.Fprintln(os.Stderr, "Can't remove this device; do it from another one")
+		os.Exit(1)
+	}
+
+	var kept [][32]byte
+	for _, other := range own.Devices {
+		if other != d {
+			kept = append(kept, other)
+		}
+	}
+	next, err := device.Sign(userKey, own.Serial+1, kept)
+	if err != nil {
+		log.Fatal("Couldn't sign the device list: ", err)
+	}
+	content, err := next.MarshalBinary()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeDeviceList(deviceListFile, next); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Run \"goax link accept\" with this on your other devices. Your peers will learn about it with your next messages.\n\n")
+	out.writeBlock(DEVICE_LIST_TYPE, content)
+}
+
+// acceptLink reads a link or a list of our devices printed by another of
+// our devices, and joins them or updates our list.
+func acceptLink() {
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal("Couldn't read from stdin: ", err)
+	}
+	var scanned bool
+	fragments := scanBlocks(stdin, "", func(blockType string, body []byte) {
+		switch blockType {
+		case DEVICE_LINK_TYPE:
+			scanned = true
+			var link device.Link
+			if err := link.UnmarshalBinary(body); err != nil {
+				log.Fatal("Invalid device link: ", err)
+			}
+			if link.Device == myDevice() {
+				joinDevices(&link)
+			} else {
+				updateOwnDevices(link.List)
+			}
+		case DEVICE_LIST_TYPE:
+			scanned = true
+			var l device.List
+			if err := l.UnmarshalBinary(body); err != nil {
+				log.Fatal("Invalid device list: ", err)
+			}
+			updateOwnDevices(&l)
+		default:
+			log.Println("Ignoring block of type", blockType)
+		}
+	})
+	if !fragments && !scanned {
+		fmt.Fprintln(os.Stderr, "The input you provided is invalid")
+		os.Exit(1)
+	}
+}
+
+// joinDevices makes this device one of the devices of link.
+func joinDevices(link *device.Link) {
+	private := identityKey()
+	userKey, err := link.UserKey(&private)
+	if err != nil {
+		log.Fatal("Couldn't open the user key: ", err)
+	}
+	current, err := loadUserKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if current != nil && !bytes.Equal(current, userKey) {
+		log.Fatal("This device is already linked to other devices")
+	}
+	if err := saveUserKey(userKey); err != nil {
+		log.Fatal(err)
+	}
+	if err := writeDeviceList(deviceListFile, link.List); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "This device is now linked to %d other device(s)\n", len(link.List.Devices)-1)
+}
+
+// updateOwnDevices replaces our list of devices by l, if it is a newer
+// list of the same user.
+func updateOwnDevices(l *device.List) {
+	own, err := loadOwnDevices()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if own == nil {
+		log.Fatal("This device isn't linked; run \"goax link add\" on one of your devices with the key of this one first")
+	}
+	if err := own.CheckUpdate(l); err != nil {
+		log.Fatal("This list of devices can't replace yours: ", err)
+	}
+	if !l.Contains(myDevice()) {
+		log.Fatal("This list of devices doesn't include this device anymore, ignoring it")
+	}
+	if l.Serial == own.Serial {
+		fmt.Fprintln(os.Stderr, "Your list of devices is already up to date")
+		return
+	}
+	if err := writeDeviceList(deviceListFile, l); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Your list of devices is updated, you now have %d device(s)\n", len(l.Devices))
+}
+
+// printDevices prints the devices of peer, or ours if peer is empty.
+func printDevices(peer string) {
+	var l *device.List
+	var err error
+	if peer == "" {
+		l, err = loadOwnDevices()
+	} else {
+		l, err = loadPeerDevices(peer)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if l == nil {
+		if peer == "" {
+			fmt.Println("This device isn't linked to any other; use \"goax link add\" with the key of another device to link it")
+		} else {
+			fmt.Printf("%s didn't send a list of devices\n", peer)
+		}
+		return
+	}
+	fmt.Printf("user key: %s\n", base58.Encode(l.User[:]))
+	fmt.Printf("serial: %d\n", l.Serial)
+	me := myDevice()
+	for _, d := range l.Devices {
+		if d == me {
+			fmt.Printf("%s (this device)\n", base58.Encode(d[:]))
+		} else {
+			fmt.Println(base58.Encode(d[:]))
+		}
+	}
+}
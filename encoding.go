@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/crowsonkb/base58"
+	"github.com/pkg/errors"
+)
+
+// Besides armor, blocks can be printed in encodings that survive
+// messengers better or can be read aloud. They all encode a byte telling
+// the type of the block followed by its content, and each can be
+// recognized on its own by receive:
+//
+//	goax:<base64url>    on one line
+//	goax58:<base58>     on one line
+//	aardvark adviser... PGP words, see wordlist.go
+
+// encoding is the way blocks are printed. It is a flag.Value.
+type encoding int
+
+const (
+	encodingArmor encoding = iota
+	encodingBase64
+	encodingBase58
+	encodingWords
+)
+
+var encodingNames = []string{
+	encodingArmor:  "armor",
+	encodingBase64: "base64",
+	encodingBase58: "base58",
+	encodingWords:  "words",
+}
+
+func (e encoding) String() string {
+	return encodingNames[e]
+}
+
+func (e *encoding) Set(s string) error {
+	for i, name := range encodingNames {
+		if name == s {
+			*e = encoding(i)
+			return nil
+		}
+	}
+	return errors.Errorf("unknown encoding %q, need one of %s", s, strings.Join(encodingNames, ", "))
+}
+
+const (
+	base64Prefix = "goax:"
+	base58Prefix = "goax58:"
+	// wordsPerLine is the number of words printed on each line with
+	// encodingWords.
+	wordsPerLine = 8
+)
+
+// blockTypeBytes maps the bytes identifying the type of a block to block
+// types.
+var blockTypeBytes = map[byte]string{
+	'M': ENCRYPTED_MESSAGE_TYPE,
+	'K': KEY_EXCHANGE_TYPE,
+	'D': DEVICE_MESSAGE_TYPE,
+	'L': DEVICE_LIST_TYPE,
+	'l': DEVICE_LINK_TYPE,
+	'G': GROUP_MESSAGE_TYPE,
+}
+
+// typedPayload returns content prefixed with the byte identifying
+// blockType.
+func typedPayload(blockType string, content []byte) ([]byte, error) {
+	for b, t := range blockTypeBytes {
+		if t == blockType {
+			return append([]byte{b}, content...), nil
+		}
+	}
+	return nil, errors.Errorf("Can't encode blocks of type %s", blockType)
+}
+
+// untypedPayload is the reverse of typedPayload.
+func untypedPayload(payload []byte) (blockType string, content []byte, err error) {
+	if len(payload) == 0 {
+		return "", nil, errors.New("Empty block")
+	}
+	blockType, ok := blockTypeBytes[payload[0]]
+	if !ok {
+		return "", nil, errors.Errorf("Unknown block type %q", payload[0])
+	}
+	return blockType, payload[1:], nil
+}
+
+// encodeBlock returns the text of a block in any encoding but
+// encodingArmor.
+func encodeBlock(enc encoding, blockType string, content []byte) (string, error) {
+	payload, err := typedPayload(blockType, content)
+	if err != nil {
+		return "", err
+	}
+	switch enc {
+	case encodingBase64:
+		return base64Prefix + base64.RawURLEncoding.EncodeToString(payload), nil
+	case encodingBase58:
+		return base58Prefix + base58.Encode(payload), nil
+	case encodingWords:
+		return encodeWords(payload), nil
+	default:
+		return "", errors.Errorf("Can't encode blocks as %s", enc)
+	}
+}
+
+// isOneLineBlock tells if line is a block encoded with encodingBase64 or
+// encodingBase58.
+func isOneLineBlock(line string) bool {
+	return strings.HasPrefix(line, base64Prefix) || strings.HasPrefix(line, base58Prefix)
+}
+
+// decodeLine decodes a block for which isOneLineBlock is true.
+func decodeLine(line string) (blockType string, content []byte, err error) {
+	var payload []byte
+	switch {
+	case strings.HasPrefix(line, base64Prefix):
+		payload, err = base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, base64Prefix))
+	case strings.HasPrefix(line, base58Prefix):
+		payload, err = base58.Decode(strings.TrimPrefix(line, base58Prefix))
+	default:
+		err = errors.New("Unknown encoding")
+	}
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Invalid block")
+	}
+	return untypedPayload(payload)
+}
+
+func encodeWords(payload []byte) string {
+	var out strings.Builder
+	for i, b := range payload {
+		switch {
+		case i == 0:
+		case i%wordsPerLine == 0:
+			out.WriteByte('\n')
+		default:
+			out.WriteByte(' ')
+		}
+		if i%2 == 0 {
+			out.WriteString(evenWords[b])
+		} else {
+			out.WriteString(oddWords[b])
+		}
+	}
+	return out.String()
+}
+
+var evenIndex, oddIndex = wordIndex(&evenWords), wordIndex(&oddWords)
+
+func wordIndex(words *[256]string) map[string]byte {
+	index := make(map[string]byte, len(words))
+	for i, w := range words {
+		index[strings.ToLower(w)] = byte(i)
+	}
+	return index
+}
+
+// looksLikeWords tells if text is only made of PGP words.
+func looksLikeWords(text string) bool {
+	words := strings.Fields(text)
+	for _, w := range words {
+		w = strings.ToLower(w)
+		if _, ok := evenIndex[w]; ok {
+			continue
+		}
+		if _, ok := oddIndex[w]; !ok {
+			return false
+		}
+	}
+	return len(words) > 0
+}
+
+func decodeWords(text string) ([]byte, error) {
+	words := strings.Fields(text)
+	payload := make([]byte, len(words))
+	for i, w := range words {
+		index := evenIndex
+		if i%2 == 1 {
+			index = oddIndex
+		}
+		b, ok := index[strings.ToLower(w)]
+		if !ok {
+			return nil, errors.Errorf("Word %d (%q) is out of place, one may be missing or repeated", i+1, w)
+		}
+		payload[i] = b
+	}
+	return payload, nil
+}
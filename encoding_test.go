@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEncodings(t *testing.T) {
+	content := make([]byte, 100)
+	io.ReadFull(rand.Reader, content)
+
+	for _, enc := range []encoding{encodingBase64, encodingBase58, encodingWords} {
+		encoded, err := encodeBlock(enc, ENCRYPTED_MESSAGE_TYPE, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var blockType string
+		var actual []byte
+		if enc == encodingWords {
+			if !looksLikeWords(encoded) {
+				t.Fatalf("words not recognized: %q", encoded)
+			}
+			payload, err := decodeWords(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blockType, actual, err = untypedPayload(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			if strings.Contains(encoded, "\n") || !isOneLineBlock(encoded) {
+				t.Fatalf("%s block not recognized: %q", enc, encoded)
+			}
+			blockType, actual, err = decodeLine(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if blockType != ENCRYPTED_MESSAGE_TYPE {
+			t.Fatalf("%s: bad block type %q", enc, blockType)
+		}
+		if !bytes.Equal(actual, content) {
+			t.Fatalf("%s: content doesn't match", enc)
+		}
+	}
+}
+
+func TestWordsOutOfPlace(t *testing.T) {
+	words := strings.Fields(encodeWords([]byte{1, 2, 3, 4}))
+	missing := strings.Join(append(words[:1:1], words[2:]...), " ")
+	if _, err := decodeWords(missing); err == nil {
+		t.Fatal("decoded words with one missing")
+	}
+	if looksLikeWords("hello aardvark") {
+		t.Fatal("plain text looks like words")
+	}
+}
+
+func TestEncodingFlag(t *testing.T) {
+	var enc encoding
+	if err := enc.Set("base58"); err != nil || enc != encodingBase58 {
+		t.Fatalf("couldn't set encoding: %v", err)
+	}
+	if err := enc.Set("rot13"); err == nil {
+		t.Fatal("unknown encoding was accepted")
+	}
+}
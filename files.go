@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rakoo/goax/pkg/attachment"
+	"github.com/rakoo/goax/pkg/envelope"
+)
+
+// Descriptions of the files peers sent us are kept in
+// files/<hex(peer)>/<message id> until the file is decrypted.
+
+func filesDir(peer string) string {
+	return path.Join("files", hex.EncodeToString([]byte(peer)))
+}
+
+func sendFile(peer, filename, output string, out blockWriter) {
+	sessions, err := openSessions(peer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !hasRatchet(sessions) {
+		fmt.Fprintf(os.Stderr, "No ratchet for %s, use \"goax send %s\" to start the handshake first\n", peer, peer)
+		os.Exit(1)
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	if output == "" {
+		output = filename + ".goax"
+	}
+	dst, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	e, err := envelope.New(rand.Reader, envelope.File, "application/json", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var key [32]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		log.Fatal(err)
+	}
+
+	src := bufio.NewReader(in)
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		head, _ := src.Peek(512)
+		contentType = http.DetectContentType(head)
+	}
+
+	size, digest, err := attachment.Encrypt(dst, src, e.ID, &key)
+	if err == nil {
+		err = dst.Close()
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(output)
+		log.Fatal("Couldn't encrypt file: ", err)
+	}
+
+	e.Content, err = json.Marshal(attachment.Description{
+		Name:        filepath.Base(filename),
+		Size:        size,
+		ContentType: contentType,
+		Key:         key[:],
+		Digest:      digest[:],
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Encrypted %s to %s. Send that file to %s along with the following message.\n", filename, output, peer)
+	sendEnvelope(peer, sessions, e, out)
+}
+
+// receiveFileDescription keeps the description of a file sent by peer
+// until they send us the file itself.
+func receiveFileDescription(peer string, e *envelope.Envelope) {
+	var desc attachment.Description
+	if err := json.Unmarshal(e.Content, &desc); err != nil {
+		log.Fatal("Invalid file description: ", err)
+	}
+
+	os.MkdirAll(filesDir(peer), 0700)
+	err := ioutil.WriteFile(path.Join(filesDir(peer), e.ID.String()), e.Content, 0600)
+	if err != nil {
+		log.Fatal("Couldn't save file description: ", err)
+	}
+
+	printHeaders(peer, e)
+	fmt.Println("")
+	fmt.Printf("%s sent you a file: %s (%s, %d bytes)\n", peer, desc.Name, desc.ContentType, desc.Size)
+	fmt.Printf("Use \"goax receive-file %s <encrypted file>\" when you get it.\n", peer)
+}
+
+func receiveFile(peer, filename, output string) {
+	in, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+
+	id, err := attachment.ReadID(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	descPath := path.Join(filesDir(peer), envelope.ID(id).String())
+	content, err := ioutil.ReadFile(descPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "No message from %s describes this file; \"receive\" it first\n", peer)
+			os.Exit(1)
+		}
+		log.Fatal(err)
+	}
+	var desc attachment.Description
+	if err := json.Unmarshal(content, &desc); err != nil {
+		log.Fatal("Invalid file description: ", err)
+	}
+	if len(desc.Key) != 32 {
+		log.Fatal("Invalid file description: bad key length")
+	}
+	var key [32]byte
+	copy(key[:], desc.Key)
+
+	if output == "" {
+		output = filepath.Base(desc.Name)
+		if output == "." || output == ".." || output == string(filepath.Separator) {
+			output = "attachment"
+		}
+	}
+	if _, err := os.Stat(output); err == nil {
+		fmt.Fprintf(os.Stderr, "%s already exists, use -o to write somewhere else\n", output)
+		os.Exit(1)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(output), ".goax-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	size, digest, err := attachment.Decrypt(tmp, in, &key)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil && (size != desc.Size || subtle.ConstantTimeCompare(digest[:], desc.Digest) != 1) {
+		err = errors.New("file doesn't match its description")
+	}
+	if err != nil {
+		tmp.Close()
+		log.Fatal("Couldn't decrypt file: ", err)
+	}
+
+	if err := os.Rename(tmp.Name(), output); err != nil {
+		log.Fatal(err)
+	}
+	os.Remove(descPath)
+	fmt.Fprintf(os.Stderr, "Wrote %s (%s, %d bytes)\n", output, desc.ContentType, desc.Size)
+}
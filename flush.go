@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rakoo/goax/pkg/ratchet"
+)
+
+// flush encrypts and prints all messages that were queued for peer while
+// the handshake wasn't complete.
+func flush(peer string, out blockWriter) {
+	sessions, err := openSessions(peer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !hasRatchet(sessions) {
+		fmt.Fprintf(os.Stderr, "No ratchet for %s, nothing to flush\n", peer)
+		os.Exit(1)
+	}
+
+	names, err := queuedMessages(peer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(names) == 0 {
+		fmt.Fprintf(os.Stderr, "No queued messages for %s\n", peer)
+		return
+	}
+
+	ready := completeSessions(sessions)
+	if len(ready) == 0 {
+		fmt.Fprintf(os.Stderr, "The handshake with %s is not complete yet, %d message(s) still queued. Use \"goax receive %s\" with their key exchange material first.\n", peer, len(names), peer)
+		os.Exit(1)
+	}
+
+	out.sendDevices(peer, false)
+	for _, s := range ready {
+		if s.r.State() != ratchet.HandshakeConfirmed {
+			out.sendSessionRatchet(s.peerSession, s.r)
+		}
+	}
+
+	for _, name := range names {
+		msg, err := readQueuedMessage(peer, name)
+		if err != nil {
+			log.Fatal("Couldn't read queued message: ", err)
+		}
+		cipherTexts := make([][]byte, len(ready))
+		for i, s := range ready {
+			if cipherTexts[i], err = s.r.Encrypt(msg); err != nil {
+				log.Fatal(err)
+			}
+			if err := saveRatchet(s.r, s.name()); err != nil {
+				log.Fatal("Couldn't save ratchet: ", err)
+			}
+		}
+		if err := dequeueMessage(peer, name); err != nil {
+			log.Fatal("Couldn't remove queued message: ", err)
+		}
+		for i, s := range ready {
+			if err := storeSent(s.name(), cipherTexts[i]); err != nil {
+				log.Println("Couldn't keep message for resending:", err)
+			}
+			countSent(s.peerSession)
+		}
+		for i, s := range ready {
+			out.sendSessionMessage(s.peerSession, cipherTexts[i])
+		}
+	}
+}
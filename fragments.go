@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A block can be cut in fragments that each fit on one short line, for
+// channels that mangle long or multi-line messages. Each fragment is
+//
+//	goax-frag:<id>:<index>/<count>:<data>
+//
+// where id identifies the block, index goes from 1 to count, and the
+// concatenation of all the data is the same as a block encoded with
+// encodingBase64, without the prefix.
+//
+// Fragments are kept in fragments/<hex(peer)>/<id>/ until they are all
+// received, or for maxFragmentAge.
+
+const fragmentPrefix = "goax-frag:"
+
+// maxFragmentAge is how long the fragments of an incomplete block are kept
+// after the last one arrived.
+const maxFragmentAge = 14 * 24 * time.Hour
+
+type fragment struct {
+	id           string
+	index, count int
+	data         string
+}
+
+func (f fragment) String() string {
+	return fmt.Sprintf("%s%s:%d/%d:%s", fragmentPrefix, f.id, f.index, f.count, f.data)
+}
+
+// splitBlock cuts a block in fragments of at most max characters.
+func splitBlock(blockType string, content []byte, max int) ([]string, error) {
+	payload, err := typedPayload(blockType, content)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(payload)
+	id := hex.EncodeToString(digest[:8])
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	// The size of the header depends on the number of digits of count
+	var count, perFragment int
+	for digits := 1; ; digits++ {
+		perFragment = max - len(fragment{id: id, index: pow10(digits) - 1, count: pow10(digits) - 1}.String())
+		if perFragment <= 0 {
+			return nil, errors.Errorf("Can't split in fragments of %d characters, that's too small", max)
+		}
+		count = (len(encoded) + perFragment - 1) / perFragment
+		if count < pow10(digits) {
+			break
+		}
+	}
+
+	lines := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * perFragment
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		f := fragment{id: id, index: i + 1, count: count, data: encoded[i*perFragment : end]}
+		lines = append(lines, f.String())
+	}
+	return lines, nil
+}
+
+func pow10(n int) int {
+	p := 1
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+var errInvalidFragment = errors.New("Invalid fragment")
+
+func parseFragment(line string) (f fragment, err error) {
+	parts := strings.Split(strings.TrimPrefix(line, fragmentPrefix), ":")
+	if !strings.HasPrefix(line, fragmentPrefix) || len(parts) != 3 {
+		return f, errInvalidFragment
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil || len(parts[0]) != 16 {
+		return f, errInvalidFragment
+	}
+	position := strings.Split(parts[1], "/")
+	if len(position) != 2 {
+		return f, errInvalidFragment
+	}
+	f.id, f.data = parts[0], parts[2]
+	f.index, err = strconv.Atoi(position[0])
+	if err != nil {
+		return f, errInvalidFragment
+	}
+	f.count, err = strconv.Atoi(position[1])
+	if err != nil || f.index < 1 || f.index > f.count {
+		return f, errInvalidFragment
+	}
+	return f, nil
+}
+
+// joinFragments returns the type and content of the block made of
+// fragments, which must all be there.
+func joinFragments(fragments []fragment) (blockType string, content []byte, err error) {
+	sort.Slice(fragments, func(i, j int) bool { return fragments[i].index < fragments[j].index })
+	var encoded strings.Builder
+	for i, f := range fragments {
+		if f.index != i+1 || f.count != len(fragments) || f.id != fragments[0].id {
+			return "", nil, errors.New("Incomplete or inconsistent fragments")
+		}
+		encoded.WriteString(f.data)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return "", nil, errInvalidFragment
+	}
+	digest := sha256.Sum256(payload)
+	if hex.EncodeToString(digest[:8]) != fragments[0].id {
+		return "", nil, errors.New("Fragments don't match their id")
+	}
+	return untypedPayload(payload)
+}
+
+func fragmentsDir(peer, id string) string {
+	return path.Join("fragments", hex.EncodeToString([]byte(peer)), id)
+}
+
+// storeFragment keeps f until all the fragments of its block are there.
+// It then returns them and forgets about them, as it does if they don't
+// agree on their count.
+func storeFragment(peer string, f fragment) ([]fragment, error) {
+	if err := pruneFragments(peer); err != nil {
+		return nil, err
+	}
+	dir := fragmentsDir(peer, f.id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "Couldn't create fragments directory")
+	}
+	err := ioutil.WriteFile(path.Join(dir, fmt.Sprintf("%d-%d", f.index, f.count)), []byte(f.data), 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't write fragment")
+	}
+
+	names, err := sortedNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	fragments := make([]fragment, 0, len(names))
+	for _, name := range names {
+		stored := fragment{id: f.id}
+		_, err := fmt.Sscanf(name, "%d-%d", &stored.index, &stored.count)
+		if err != nil || stored.count != f.count {
+			os.RemoveAll(dir)
+			return nil, errors.New("Inconsistent fragments, dropping them")
+		}
+		fragments = append(fragments, stored)
+	}
+	if len(fragments) < f.count {
+		return nil, nil
+	}
+	for i := range fragments {
+		data, err := ioutil.ReadFile(path.Join(dir, names[i]))
+		if err != nil {
+			return nil, errors.Wrap(err, "Couldn't read fragment")
+		}
+		fragments[i].data = string(data)
+	}
+	return fragments, os.RemoveAll(dir)
+}
+
+// pruneFragments forgets the incomplete blocks of peer whose last
+// fragment arrived more than maxFragmentAge ago.
+func pruneFragments(peer string) error {
+	dir := path.Join("fragments", hex.EncodeToString([]byte(peer)))
+	ids, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Couldn't list fragments")
+	}
+	oldest := time.Now().Add(-maxFragmentAge)
+	for _, id := range ids {
+		if id.ModTime().Before(oldest) {
+			if err := os.RemoveAll(path.Join(dir, id.Name())); err != nil {
+				return errors.Wrap(err, "Couldn't remove old fragments")
+			}
+		}
+	}
+	return nil
+}
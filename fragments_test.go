@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSplitBlock(t *testing.T) {
+	content := make([]byte, 300)
+	io.ReadFull(rand.Reader, content)
+
+	for _, max := range []int{40, 160, 1000} {
+		lines, err := splitBlock(ENCRYPTED_MESSAGE_TYPE, content, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var fragments []fragment
+		// Fragments may arrive in any order
+		for i := len(lines) - 1; i >= 0; i-- {
+			if len(lines[i]) > max {
+				t.Fatalf("fragment longer than %d: %q", max, lines[i])
+			}
+			f, err := parseFragment(lines[i])
+			if err != nil {
+				t.Fatalf("%q: %s", lines[i], err)
+			}
+			fragments = append(fragments, f)
+		}
+
+		blockType, actual, err := joinFragments(fragments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blockType != ENCRYPTED_MESSAGE_TYPE {
+			t.Fatalf("bad block type %q", blockType)
+		}
+		if !bytes.Equal(actual, content) {
+			t.Fatalf("content doesn't match with fragments of %d", max)
+		}
+	}
+}
+
+func TestSplitBlockTooSmall(t *testing.T) {
+	if _, err := splitBlock(ENCRYPTED_MESSAGE_TYPE, []byte("content"), 20); err == nil {
+		t.Fatal("splitting in fragments smaller than their header should fail")
+	}
+}
+
+func TestJoinIncompleteFragments(t *testing.T) {
+	lines, err := splitBlock(KEY_EXCHANGE_TYPE, bytes.Repeat([]byte("a"), 100), 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fragments []fragment
+	for _, line := range lines[1:] {
+		f, err := parseFragment(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fragments = append(fragments, f)
+	}
+	if _, _, err := joinFragments(fragments); err == nil {
+		t.Fatal("joined fragments with one missing")
+	}
+}
+
+func TestParseFragment(t *testing.T) {
+	for _, line := range []string{
+		"goax-frag:0123456789abcdef:1/2",
+		"goax-frag:0123456789abcdef:3/2:AAAA",
+		"goax-frag:0123456789abcdef:0/2:AAAA",
+		"goax-frag:nothex:1/2:AAAA",
+		"frag:0123456789abcdef:1/2:AAAA",
+	} {
+		if _, err := parseFragment(line); err == nil {
+			t.Errorf("%q shouldn't parse", line)
+		}
+	}
+}
+
+func TestStoreFragments(t *testing.T) {
+	inTempDir(t)
+	lines, err := splitBlock(KEY_EXCHANGE_TYPE, bytes.Repeat([]byte("a"), 100), 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fragments []fragment
+	for _, line := range lines {
+		f, err := parseFragment(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fragments = append(fragments, f)
+	}
+
+	// Fragments that don't agree on their count are dropped, so that the
+	// right ones can still be joined.
+	bad := fragments[0]
+	bad.count++
+	if stored, err := storeFragment("alice", bad); err != nil || stored != nil {
+		t.Fatalf("got %v, %v for the first fragment", stored, err)
+	}
+	if _, err := storeFragment("alice", fragments[1]); err == nil {
+		t.Fatal("stored inconsistent fragments")
+	}
+	if _, err := os.Stat(fragmentsDir("alice", bad.id)); !os.IsNotExist(err) {
+		t.Fatal("inconsistent fragments kept")
+	}
+	var stored []fragment
+	for _, f := range fragments {
+		if stored, err = storeFragment("alice", f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := joinFragments(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// Incomplete blocks expire.
+	if _, err := storeFragment("alice", fragments[0]); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-maxFragmentAge - time.Hour)
+	if err := os.Chtimes(fragmentsDir("alice", bad.id), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := pruneFragments("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fragmentsDir("alice", bad.id)); !os.IsNotExist(err) {
+		t.Fatal("old fragments kept")
+	}
+}
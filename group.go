@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rakoo/goax/pkg/envelope"
+	"github.com/rakoo/goax/pkg/senderkey"
+)
+
+// Groups use Sender Keys: our sender key in a group goes to each member
+// over our pairwise session with them, and each message we write is
+// encrypted once for the whole group. Groups are kept in
+// groups/<hex(group id)>; their name is local.
+
+// maxMemberKeys is the number of sender keys kept for each member, so that
+// messages sent before they replaced their key can still be read.
+const maxMemberKeys = 4
+
+var errNoGroup = errors.New("No such group")
+
+type group struct {
+	ID      [senderkey.GroupSize]byte `json:"-"`
+	Name    string                    `json:"name"`
+	Members []*groupMember            `json:"members"`
+	// Removed are the peers removed from the group, whose sender keys
+	// we don't accept anymore.
+	Removed []string `json:"removed,omitempty"`
+	// Pending are the peers who sent their sender key but aren't
+	// members, until "goax group add" makes them members.
+	Pending []*groupMember    `json:"pending,omitempty"`
+	Sender  *senderkey.Sender `json:"sender"`
+}
+
+type groupMember struct {
+	Peer string `json:"peer"`
+	// KeySent tells if the member has our current sender key.
+	KeySent bool `json:"key_sent"`
+	// Keys are the sender keys of the member, most recent first.
+	Keys []*senderkey.Receiver `json:"keys,omitempty"`
+}
+
+// senderKeyContent is the content of a SenderKey envelope.
+type senderKeyContent struct {
+	// Name is the name of the group for its sender.
+	Name string `json:"name"`
+	// Key is the binary senderkey.Distribution.
+	Key []byte `json:"key"`
+}
+
+func groupPath(id [senderkey.GroupSize]byte) string {
+	return path.Join("groups", hex.EncodeToString(id[:]))
+}
+
+func loadGroup(id [senderkey.GroupSize]byte) (*group, error) {
+	content, err := ioutil.ReadFile(groupPath(id))
+	if os.IsNotExist(err) {
+		return nil, errNoGroup
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't read group")
+	}
+	g := &group{ID: id}
+	return g, errors.Wrap(json.Unmarshal(content, g), "Invalid group")
+}
+
+// loadGroups returns all our groups.
+func loadGroups() ([]*group, error) {
+	names, err := sortedNames("groups")
+	if err != nil {
+		return nil, err
+	}
+	var groups []*group
+	for _, n := range names {
+		var id [senderkey.GroupSize]byte
+		decoded, err := hex.DecodeString(n)
+		if err != nil || len(decoded) != len(id) {
+			continue
+		}
+		copy(id[:], decoded)
+		g, err := loadGroup(id)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// findGroup returns the group called name.
+func findGroup(name string) (*group, error) {
+	groups, err := loadGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if g.Name == name {
+			return g, nil
+		}
+	}
+	return nil, errNoGroup
+}
+
+func saveGroup(g *group) error {
+	content, err := json.Marshal(g)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't marshal group")
+	}
+	os.MkdirAll("groups", 0700)
+	return errors.Wrap(ioutil.WriteFile(groupPath(g.ID), content, 0600), "Couldn't write group")
+}
+
+func (g *group) member(peer string) *groupMember {
+	for _, m := range g.Members {
+		if m.Peer == peer {
+			return m
+		}
+	}
+	return nil
+}
+
+// pending returns the keys sent by peer, who isn't a member.
+func (g *group) pending(peer string) *groupMember {
+	for _, p := range g.Pending {
+		if p.Peer == peer {
+			return p
+		}
+	}
+	return nil
+}
+
+// addKey keeps the sender key d of m, unless m already has it.
+func (m *groupMember) addKey(d senderkey.Distribution) bool {
+	for _, r := range m.Keys {
+		if r.KeyID() == d.KeyID {
+			return false
+		}
+	}
+	m.Keys = append([]*senderkey.Receiver{senderkey.NewReceiver(d)}, m.Keys...)
+	if len(m.Keys) > maxMemberKeys {
+		m.Keys = m.Keys[:maxMemberKeys]
+	}
+	return true
+}
+
+// mustFindGroup returns the group called name, or exits.
+func mustFindGroup(name string) *group {
+	g, err := findGroup(name)
+	if err == errNoGroup {
+		fmt.Fprintf(os.Stderr, "No group called %s\n", name)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return g
+}
+
+// createGroup creates a group with peers, and sends them our sender key.
+func createGroup(name string, peers []string, out blockWriter) {
+	if _, err := findGroup(name); err != errNoGroup {
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "There's already a group called %s\n", name)
+		os.Exit(1)
+	}
+	g := &group{Name: name}
+	if _, err := rand.Read(g.ID[:]); err != nil {
+		log.Fatal(err)
+	}
+	var err error
+	if g.Sender, err = senderkey.NewSender(rand.Reader, g.ID); err != nil {
+		log.Fatal("Couldn't create sender key: ", err)
+	}
+	for _, peer := range peers {
+		if g.member(peer) == nil {
+			g.Members = append(g.Members, &groupMember{Peer: peer})
+		}
+	}
+	if err := saveGroup(g); err != nil {
+		log.Fatal(err)
+	}
+	distributeSenderKey(g, out)
+}
+
+// addToGroup adds peers to a group, accepting the sender keys they already
+// sent, and sends them our sender key.
+func addToGroup(name string, peers []string, out blockWriter) {
+	g := mustFindGroup(name)
+	for _, peer := range peers {
+		if g.member(peer) == nil {
+			m := g.pending(peer)
+			if m == nil {
+				m = &groupMember{Peer: peer}
+			}
+			g.Members = append(g.Members, m)
+		}
+		g.Pending = removePending(g.Pending, peer)
+		g.Removed = removePeer(g.Removed, peer)
+	}
+	if err := saveGroup(g); err != nil {
+		log.Fatal(err)
+	}
+	distributeSenderKey(g, out)
+}
+
+// removeFromGroup removes peers from a group and replaces our sender key,
+// so that they can't read what we send next.
+func removeFromGroup(name string, peers []string, out blockWriter) {
+	g := mustFindGroup(name)
+	for _, peer := range peers {
+		if g.member(peer) == nil && g.pending(peer) == nil {
+			fmt.Fprintf(os.Stderr, "%s isn't a member of %s\n", peer, name)
+			os.Exit(1)
+		}
+		kept := g.Members[:0]
+		for _, m := range g.Members {
+			if m.Peer != peer {
+				kept = append(kept, m)
+			}
+		}
+		g.Members = kept
+		g.Pending = removePending(g.Pending, peer)
+		g.Removed = append(removePeer(g.Removed, peer), peer)
+	}
+
+	var err error
+	if g.Sender, err = senderkey.NewSender(rand.Reader, g.ID); err != nil {
+		log.Fatal("Couldn't create sender key: ", err)
+	}
+	for _, m := range g.Members {
+		m.KeySent = false
+	}
+	if err := saveGroup(g); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Your sender key for %s is replaced. The other members should remove %s too, or they can still read what the others send.\n", name, strings.Join(peers, ", "))
+	distributeSenderKey(g, out)
+}
+
+func removePeer(peers []string, peer string) []string {
+	kept := peers[:0]
+	for _, p := range peers {
+		if p != peer {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+func removePending(pending []*groupMember, peer string) []*groupMember {
+	kept := pending[:0]
+	for _, p := range pending {
+		if p.Peer != peer {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// distributeSenderKey sends our sender key to the members of g who don't
+// have it, over our session with each of them.
+func distributeSenderKey(g *group, out blockWriter) {
+	d := g.Sender.Distribution()
+	key, err := d.MarshalBinary()
+	if err != nil {
+		log.Fatal(err)
+	}
+	content, err := json.Marshal(senderKeyContent{Name: g.Name, Key: key})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, m := range g.Members {
+		if m.KeySent {
+			continue
+		}
+		sessions, err := openSessions(m.Peer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !hasRatchet(sessions) {
+			fmt.Fprintf(os.Stderr, "No ratchet for %s, use \"goax send %s\" to start the handshake first; they'll get your sender key for %s after that.\n", m.Peer, m.Peer, g.Name)
+			continue
+		}
+		e, err := envelope.New(rand.Reader, envelope.SenderKey, "application/json", content)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "For %s, your sender key for %s:\n\n", m.Peer, g.Name)
+		sendEnvelope(m.Peer, sessions, e, out)
+		m.KeySent = true
+		if err := saveGroup(g); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// sendToGroup encrypts what is on stdin for the whole group, after our
+// sender key for the members who don't have it.
+func sendToGroup(name string, out blockWriter) {
+	g := mustFindGroup(name)
+	content, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal("Couldn't read all stdin")
+	}
+	e, err := envelope.New(rand.Reader, envelope.Text, http.DetectContentType(content), content)
+	if err != nil {
+		log.Fatal(err)
+	}
+	msg, err := e.Marshal()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	distributeSenderKey(g, out)
+	cipherText, err := g.Sender.Encrypt(msg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := saveGroup(g); err != nil {
+		log.Fatal("Couldn't save group: ", err)
+	}
+	fmt.Fprintf(os.Stderr, "For everyone in %s:\n\n", g.Name)
+	out.writeBlock(GROUP_MESSAGE_TYPE, cipherText)
+}
+
+// receiveSenderKey keeps the sender key that peer sent us for a group. The
+// key of a peer who isn't a member, for a group we know or not, waits for
+// "goax group add" to make them one; until then they don't get our key.
+func receiveSenderKey(peer string, e *envelope.Envelope) {
+	var content senderKeyContent
+	if err := json.Unmarshal(e.Content, &content); err != nil {
+		log.Fatal("Invalid sender key: ", err)
+	}
+	var d senderkey.Distribution
+	if err := d.UnmarshalBinary(content.Key); err != nil {
+		log.Fatal("Invalid sender key: ", err)
+	}
+
+	g, err := loadGroup(d.Group)
+	invited := err == errNoGroup
+	switch err {
+	case nil:
+	case errNoGroup:
+		g = &group{ID: d.Group, Name: content.Name}
+		if _, err := findGroup(g.Name); err != errNoGroup {
+			g.Name = fmt.Sprintf("%s-%x", content.Name, d.Group[:4])
+		}
+		if g.Sender, err = senderkey.NewSender(rand.Reader, g.ID); err != nil {
+			log.Fatal("Couldn't create sender key: ", err)
+		}
+	default:
+		log.Fatal(err)
+	}
+	for _, removed := range g.Removed {
+		if removed == peer {
+			fmt.Fprintf(os.Stderr, "%s sent their sender key for %s, but you removed them from it; ignoring it\n", peer, g.Name)
+			return
+		}
+	}
+
+	m := g.member(peer)
+	if m == nil {
+		m = g.pending(peer)
+		if m == nil {
+			m = &groupMember{Peer: peer}
+			g.Pending = append(g.Pending, m)
+		}
+		m.addKey(d)
+		if err := saveGroup(g); err != nil {
+			log.Fatal(err)
+		}
+		if invited {
+			fmt.Fprintf(os.Stderr, "%s invites you to the group %s; \"goax group add %s %s\" joins it, and sends them your sender key.\n", peer, g.Name, g.Name, peer)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s sent their sender key for %s, but isn't a member of it; if they should be, \"goax group add %s %s\" accepts it and sends them yours.\n", peer, g.Name, g.Name, peer)
+		}
+		return
+	}
+	if !m.addKey(d) {
+		fmt.Fprintf(os.Stderr, "Skipping the sender key of %s for %s, which you already have\n", peer, g.Name)
+		return
+	}
+	if err := saveGroup(g); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Got the sender key of %s for %s\n", peer, g.Name)
+}
+
+// receiveGroup decrypts the group messages on stdin.
+func receiveGroup() {
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal("Couldn't read from stdin: ", err)
+	}
+	var scanned bool
+	fragments := scanBlocks(stdin, "", func(blockType string, body []byte) {
+		if blockType != GROUP_MESSAGE_TYPE {
+			log.Printf("Ignoring block of type %s, \"goax receive <peer>\" reads it", blockType)
+			return
+		}
+		scanned = true
+		receiveGroupMessage(body)
+	})
+	if !fragments && !scanned {
+		fmt.Fprintln(os.Stderr, "The input you provided is invalid")
+		os.Exit(1)
+	}
+}
+
+// receiveGroupMessage decrypts and prints a group message, with the sender
+// key of the member that matches.
+func receiveGroupMessage(cipherText []byte) {
+	id, keyID, err := senderkey.ParseHeader(cipherText)
+	if err != nil {
+		log.Fatal("Invalid group message: ", err)
+	}
+	g, err := loadGroup(id)
+	if err == errNoGroup {
+		log.Fatal("This message is for a group you aren't in")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, m := range g.Members {
+		for _, r := range m.Keys {
+			if r.KeyID() != keyID {
+				continue
+			}
+			plaintext, err := r.Decrypt(cipherText)
+			if err == senderkey.ErrWrongKey {
+				continue
+			}
+			if err == senderkey.ErrDuplicateMessage {
+				fmt.Fprintln(os.Stderr, "Skipping a message that was already received")
+				return
+			}
+			if err != nil {
+				log.Fatal("Couldn't decrypt group message: ", err)
+			}
+			if err := saveGroup(g); err != nil {
+				log.Fatal("Couldn't save group: ", err)
+			}
+			e, err := envelope.Unmarshal(plaintext)
+			if err != nil {
+				log.Fatal("Invalid message: ", err)
+			}
+			printHeaders(m.Peer, e)
+			fmt.Printf("Group: %s\n", g.Name)
+			fmt.Println("")
+			os.Stdout.Write(e.Content)
+			return
+		}
+	}
+	for _, p := range g.Pending {
+		for _, r := range p.Keys {
+			if r.KeyID() == keyID {
+				log.Fatalf("This message of %s is from %s, who isn't a member of it; \"goax group add %s %s\" accepts them", g.Name, p.Peer, g.Name, p.Peer)
+			}
+		}
+	}
+	log.Fatalf("This message of %s is from a sender key you don't have; ask its sender to send it to you", g.Name)
+}
+
+// listGroups prints the groups and their members.
+func listGroups() {
+	groups, err := loadGroups()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, g := range groups {
+		fmt.Printf("%s:\n", g.Name)
+		for _, m := range g.Members {
+			switch {
+			case len(m.Keys) == 0:
+				fmt.Printf("  %s (no sender key yet)\n", m.Peer)
+			case !m.KeySent:
+				fmt.Printf("  %s (doesn't have your sender key yet)\n", m.Peer)
+			default:
+				fmt.Printf("  %s\n", m.Peer)
+			}
+		}
+		for _, p := range g.Pending {
+			fmt.Printf("  %s (not a member, sent their sender key)\n", p.Peer)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/rakoo/goax/pkg/envelope"
+	"github.com/rakoo/goax/pkg/senderkey"
+)
+
+// inTempDir runs the test in an empty goax directory.
+func inTempDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func senderKeyEnvelope(t *testing.T, id [senderkey.GroupSize]byte, name string) *envelope.Envelope {
+	s, err := senderkey.NewSender(rand.Reader, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := s.Distribution()
+	key, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := json.Marshal(senderKeyContent{Name: name, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := envelope.New(rand.Reader, envelope.SenderKey, "application/json", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestReceiveSenderKeyNonMember(t *testing.T) {
+	inTempDir(t)
+
+	g := &group{Name: "team", Members: []*groupMember{{Peer: "barry", KeySent: true}}}
+	rand.Read(g.ID[:])
+	var err error
+	if g.Sender, err = senderkey.NewSender(rand.Reader, g.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveGroup(g); err != nil {
+		t.Fatal(err)
+	}
+
+	// mallory only knows the group ID, from the header of its messages
+	receiveSenderKey("mallory", senderKeyEnvelope(t, g.ID, "team"))
+	g, err = loadGroup(g.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Members) != 1 || g.member("mallory") != nil {
+		t.Fatal("a non-member became a member")
+	}
+	if p := g.pending("mallory"); p == nil || len(p.Keys) != 1 {
+		t.Fatal("the key of a non-member isn't pending")
+	}
+
+	// A group we don't know has no member until we add them
+	var unknown [senderkey.GroupSize]byte
+	rand.Read(unknown[:])
+	receiveSenderKey("mallory", senderKeyEnvelope(t, unknown, "team"))
+	invited, err := loadGroup(unknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invited.Members) != 0 || invited.pending("mallory") == nil {
+		t.Fatal("the inviter became a member")
+	}
+	if invited.Name == "team" {
+		t.Fatal("the invitation took the name of another group")
+	}
+}
+
+func TestReceiveSenderKeyRemoved(t *testing.T) {
+	inTempDir(t)
+
+	g := &group{Name: "team", Members: []*groupMember{{Peer: "barry", KeySent: true}}, Removed: []string{"mallory"}}
+	rand.Read(g.ID[:])
+	var err error
+	if g.Sender, err = senderkey.NewSender(rand.Reader, g.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveGroup(g); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key of a removed member is ignored, and the next one received
+	receiveSenderKey("mallory", senderKeyEnvelope(t, g.ID, "team"))
+	receiveSenderKey("barry", senderKeyEnvelope(t, g.ID, "team"))
+	g, err = loadGroup(g.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.member("mallory") != nil || g.pending("mallory") != nil {
+		t.Fatal("the key of a removed member was kept")
+	}
+	if m := g.member("barry"); m == nil || len(m.Keys) != 1 {
+		t.Fatal("the key received after the removed member's was lost")
+	}
+}
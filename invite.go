@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rakoo/goax/pkg/ratchet"
+)
+
+// invite prints our key exchange material for peer, creating the ratchet
+// if needed, without sending any message.
+func invite(peer string, showQR bool, out blockWriter) {
+	sessions, err := openSessions(peer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var unconfirmed []sessionRatchet
+	for _, s := range sessions {
+		if s.r == nil {
+			if s.r, err = createRatchet(s.name()); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if s.r.State() != ratchet.HandshakeConfirmed {
+			unconfirmed = append(unconfirmed, s)
+		}
+	}
+
+	if len(unconfirmed) == 0 {
+		fmt.Fprintf(os.Stderr, "The handshake with %s is already done, nothing more to do\n", peer)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Give this to %s, then \"goax receive %s\" their key exchange material\n\n", peer, peer)
+
+	if !showQR {
+		out.sendDevices(peer, true)
+		for _, s := range unconfirmed {
+			out.sendSessionRatchet(s.peerSession, s.r)
+		}
+		return
+	}
+	if len(unconfirmed) > 1 || unconfirmed[0].addressed {
+		log.Fatal("A QR code can't hold the key exchange material of linked devices, use another encoding")
+	}
+	kx, err := unconfirmed[0].r.GetKeyExchangeMaterial()
+	if err != nil {
+		log.Fatal("Couldn't get key exchange material ", err)
+	}
+	text, err := keyExchangeQRText(kx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := printQR(text); err != nil {
+		log.Fatal("Couldn't make QR code: ", err)
+	}
+	fmt.Println(text)
+}
@@ -2,49 +2,209 @@ package main
 
 import (
 	"crypto/rand"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/openpgp/armor"
 
 	"github.com/crowsonkb/base58"
 	"github.com/pkg/errors"
+	"github.com/rakoo/goax/pkg/envelope"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Need an action: one of mykey, send or receive")
+		fmt.Println("Need an action: one of mykey, invite, send, send-file, receive, receive-file, status, flush, resend, ack, reset, padding, link, devices or group")
 		os.Exit(1)
 	}
 
 	ensureIdentityKey()
 
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
 	switch os.Args[1] {
 	case "mykey":
-		printPublicKey()
+		showQR := flags.Bool("qr", false, "Show the key as a QR code")
+		parseFlags(flags, os.Args[2:])
+		printPublicKey(*showQR)
+	case "invite":
+		out := addOutputFlags(flags)
+		showQR := flags.Bool("qr", false, "Show the key exchange material as a QR code")
+		args := parseFlags(flags, os.Args[2:])
+		if len(args) < 1 {
+			fmt.Println("Need email adress of peer")
+			os.Exit(1)
+		}
+		invite(args[0], *showQR, *out)
 	case "send":
-		if len(os.Args) < 3 {
+		out := addOutputFlags(flags)
+		replyTo := flags.String("reply-to", "", "Message-Id of the message this one answers")
+		args := parseFlags(flags, os.Args[2:])
+		if len(args) < 1 {
 			fmt.Println("Need email adress of recipient")
 			os.Exit(1)
 		}
-		send(os.Args[2])
+		opts := sendOptions{out: *out}
+		if *replyTo != "" {
+			id, err := envelope.ParseID(*replyTo)
+			if err != nil {
+				fmt.Println("Invalid message id to reply to:", *replyTo)
+				os.Exit(1)
+			}
+			opts.replyTo = &id
+		}
+		send(args[0], opts)
+	case "send-file", "receive-file":
+		out := addOutputFlags(flags)
+		output := flags.String("o", "", "Where to write the output file")
+		args := parseFlags(flags, os.Args[2:])
+		if len(args) < 2 {
+			fmt.Printf("Usage: goax %s <peer> <file> [-o output]\n", os.Args[1])
+			os.Exit(1)
+		}
+		if os.Args[1] == "send-file" {
+			sendFile(args[0], args[1], *output, *out)
+		} else {
+			receiveFile(args[0], args[1], *output)
+		}
 	case "receive":
 		if len(os.Args) < 3 {
 			fmt.Println("Need email adress of sender")
 			os.Exit(1)
 		}
 		receive(os.Args[2])
+	case "status", "flush", "ack":
+		out := addOutputFlags(flags)
+		args := parseFlags(flags, os.Args[2:])
+		if len(args) < 1 {
+			fmt.Println("Need email adress of peer")
+			os.Exit(1)
+		}
+		switch os.Args[1] {
+		case "status":
+			status(args[0], *out)
+		case "flush":
+			flush(args[0], *out)
+		case "ack":
+			ack(args[0], *out)
+		}
+	case "resend":
+		out := addOutputFlags(flags)
+		args := parseFlags(flags, os.Args[2:])
+		if len(args) < 1 {
+			fmt.Println("Need email adress of recipient")
+			os.Exit(1)
+		}
+		var n int
+		if len(args) > 1 {
+			var err error
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				fmt.Println("The number of messages to resend must be a positive integer")
+				os.Exit(1)
+			}
+		}
+		resend(args[0], n, *out)
+	case "reset":
+		out := addOutputFlags(flags)
+		key := flags.String("key", "", "Identity key of the peer, as printed by their \"goax mykey\"")
+		args := parseFlags(flags, os.Args[2:])
+		if len(args) < 1 {
+			fmt.Println("Need email adress of peer")
+			os.Exit(1)
+		}
+		reset(args[0], *key, *out)
+	case "padding":
+		if len(os.Args) < 3 {
+			fmt.Println("Need email adress of peer")
+			os.Exit(1)
+		}
+		var scheme string
+		if len(os.Args) > 3 {
+			scheme = os.Args[3]
+		}
+		padding(os.Args[2], scheme)
+	case "link":
+		out := addOutputFlags(flags)
+		args := parseFlags(flags, os.Args[2:])
+		switch {
+		case len(args) == 1 && args[0] == "accept":
+			acceptLink()
+		case len(args) == 2 && args[0] == "add":
+			linkDevice(args[1], *out)
+		case len(args) == 2 && args[0] == "remove":
+			unlinkDevice(args[1], *out)
+		default:
+			fmt.Println("Usage: goax link add <device key> | goax link remove <device key> | goax link accept")
+			os.Exit(1)
+		}
+	case "group":
+		out := addOutputFlags(flags)
+		args := parseFlags(flags, os.Args[2:])
+		usage := func() {
+			fmt.Println("Usage: goax group create|add|remove <group> <peer>... | goax group send <group> | goax group receive | goax group list")
+			os.Exit(1)
+		}
+		if len(args) < 1 {
+			usage()
+		}
+		switch {
+		case args[0] == "create" && len(args) >= 2:
+			createGroup(args[1], args[2:], *out)
+		case args[0] == "add" && len(args) >= 3:
+			addToGroup(args[1], args[2:], *out)
+		case args[0] == "remove" && len(args) >= 3:
+			removeFromGroup(args[1], args[2:], *out)
+		case args[0] == "send" && len(args) == 2:
+			sendToGroup(args[1], *out)
+		case args[0] == "receive" && len(args) == 1:
+			receiveGroup()
+		case args[0] == "list" && len(args) == 1:
+			listGroups()
+		default:
+			usage()
+		}
+	case "devices":
+		var peer string
+		if len(os.Args) > 2 {
+			peer = os.Args[2]
+		}
+		printDevices(peer)
 	default:
 		fmt.Println("Unrecognized action:", os.Args[1])
-		fmt.Println("Need one of generate, send or receive")
+		fmt.Println("Need one of mykey, invite, send, send-file, receive, receive-file, status, flush, resend, ack, reset, padding, link, devices or group")
 		os.Exit(1)
 	}
 }
 
+// addOutputFlags adds to flags the options of commands that print blocks.
+func addOutputFlags(flags *flag.FlagSet) *blockWriter {
+	var out blockWriter
+	flags.IntVar(&out.split, "split", 0, "Cut blocks in fragments of at most this many characters")
+	flags.Var(&out.encoding, "encoding", "How to print blocks: armor, base64, base58 or words")
+	flags.BoolVar(&out.jsonKeyExchange, "json-kx", false, "Print key exchange material as JSON, for older versions of goax")
+	return &out
+}
+
+// parseFlags parses the flags in args, wherever they are, and returns the
+// remaining arguments.
+func parseFlags(flags *flag.FlagSet, args []string) (positional []string) {
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
 func ensureIdentityKey() {
 	_, err := os.Open("key")
 	if err != nil {
@@ -71,12 +231,18 @@ func ensureIdentityKey() {
 	}
 }
 
-func printPublicKey() {
+func printPublicKey(showQR bool) {
 	var myPublicKey [32]byte
 	var myPrivateKey [32]byte
 	copy(myPrivateKey[:], getPrivateKey())
 	curve25519.ScalarBaseMult(&myPublicKey, &myPrivateKey)
-	fmt.Println(base58.Encode(myPublicKey[:]))
+	encoded := base58.Encode(myPublicKey[:])
+	if showQR {
+		if err := printQR(encoded); err != nil {
+			log.Fatal("Couldn't make QR code: ", err)
+		}
+	}
+	fmt.Println(encoded)
 }
 
 func getPrivateKey() (pkey []byte) {
@@ -100,4 +266,8 @@ func getPrivateKey() (pkey []byte) {
 const (
 	ENCRYPTED_MESSAGE_TYPE string = "GOAX ENCRYPTED MESSAGE"
 	KEY_EXCHANGE_TYPE             = "KEY EXCHANGE MATERIAL"
+	DEVICE_MESSAGE_TYPE           = "GOAX DEVICE MESSAGE"
+	DEVICE_LIST_TYPE              = "GOAX DEVICE LIST"
+	DEVICE_LINK_TYPE              = "GOAX DEVICE LINK"
+	GROUP_MESSAGE_TYPE            = "GOAX GROUP MESSAGE"
 )
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The outbox holds plaintext messages written before the handshake with
+// a peer was complete. Each message is a file in outbox/<hex(peer)>/,
+// named after its creation time so that they are flushed in order.
+
+func outboxDir(peer string) string {
+	return path.Join("outbox", hex.EncodeToString([]byte(peer)))
+}
+
+func queueMessage(peer string, msg []byte) error {
+	dir := outboxDir(peer)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "Couldn't create outbox")
+	}
+	err := ioutil.WriteFile(path.Join(dir, timestampName(time.Now())), msg, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't write queued message")
+	}
+	return nil
+}
+
+// queuedMessages returns the names of the messages queued for peer, oldest
+// first.
+func queuedMessages(peer string) ([]string, error) {
+	return sortedNames(outboxDir(peer))
+}
+
+// sortedNames returns the sorted names of the files in dir. A missing
+// directory is considered empty.
+func sortedNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "Couldn't open directory")
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't list directory")
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func readQueuedMessage(peer, name string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(outboxDir(peer), name))
+}
+
+// timestampName returns a file name for t that sorts chronologically.
+func timestampName(t time.Time) string {
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+func dequeueMessage(peer, name string) error {
+	return os.Remove(path.Join(outboxDir(peer), name))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/rakoo/goax/pkg/device"
+	"github.com/rakoo/goax/pkg/ratchet"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// blockWriter prints the blocks the user copy-pastes to their peer.
+type blockWriter struct {
+	// split, if positive, is the maximum length of a line. Blocks are
+	// then printed as fragments, whatever the encoding.
+	split    int
+	encoding encoding
+	// jsonKeyExchange prints key exchange material in the legacy JSON
+	// form instead of the binary one.
+	jsonKeyExchange bool
+}
+
+func (w blockWriter) sendMessage(cipherText []byte) {
+	w.writeBlock(ENCRYPTED_MESSAGE_TYPE, cipherText)
+}
+
+// sendSessionRatchet prints the key exchange material of r, the ratchet of
+// the session s.
+func (w blockWriter) sendSessionRatchet(s peerSession, r *ratchet.Ratchet) {
+	kx, err := r.GetKeyExchangeMaterial()
+	if err != nil {
+		log.Fatal("Couldn't get key exchange material ", err)
+	}
+	if w.jsonKeyExchange && !s.addressed {
+		content, err := json.Marshal(kx)
+		if err != nil {
+			log.Fatal("Couldn't marshal key exchange material ", err)
+		}
+		w.writeBlock(KEY_EXCHANGE_TYPE, append(content, '\n'))
+		return
+	}
+	content, err := kx.MarshalBinary()
+	if err != nil {
+		log.Fatal("Couldn't marshal key exchange material ", err)
+	}
+	if s.addressed {
+		w.sendAddressed(s, device.KindKeyExchange, content)
+		return
+	}
+	w.writeBlock(KEY_EXCHANGE_TYPE, content)
+}
+
+// sendSessionMessage prints a ciphertext of the session s.
+func (w blockWriter) sendSessionMessage(s peerSession, cipherText []byte) {
+	if s.addressed {
+		w.sendAddressed(s, device.KindMessage, cipherText)
+		return
+	}
+	w.sendMessage(cipherText)
+}
+
+// sendAddressed prints payload in a device message from this device to
+// the device of s.
+func (w blockWriter) sendAddressed(s peerSession, kind byte, payload []byte) {
+	m := device.Message{Kind: kind, From: myDevice(), To: s.device, Payload: payload}
+	content, err := m.MarshalBinary()
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.writeBlock(DEVICE_MESSAGE_TYPE, content)
+}
+
+func (w blockWriter) writeBlock(blockType string, content []byte) {
+	if w.split > 0 {
+		lines, err := splitBlock(blockType, content, w.split)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return
+	}
+	if w.encoding != encodingArmor {
+		encoded, err := encodeBlock(w.encoding, blockType, content)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(encoded)
+		fmt.Println("")
+		return
+	}
+
+	encoder, err := armor.Encode(os.Stdout, blockType, nil)
+	if err != nil {
+		log.Fatal("Couldn't create armor encoder: ", err)
+	}
+
+	io.Copy(encoder, bytes.NewReader(content))
+	encoder.Close()
+	fmt.Println("")
+}
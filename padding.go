@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rakoo/goax/pkg/ratchet"
+)
+
+// padding prints the padding scheme used for peer, or sets it if scheme
+// isn't empty.
+func padding(peer, scheme string) {
+	sessions, err := openSessions(peer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !hasRatchet(sessions) {
+		fmt.Fprintf(os.Stderr, "No ratchet for %s\n", peer)
+		os.Exit(1)
+	}
+
+	for _, s := range sessions {
+		if s.r == nil {
+			continue
+		}
+		if scheme != "" {
+			p, err := ratchet.ParsePadding(scheme)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unknown padding scheme %q, need one of none, padme or buckets\n", scheme)
+				os.Exit(1)
+			}
+			s.r.SetPadding(p)
+			if err := saveRatchet(s.r, s.name()); err != nil {
+				log.Fatal("Couldn't save ratchet: ", err)
+			}
+		}
+		printPadding(s.String(), s.r)
+	}
+}
+
+func printPadding(peer string, r *ratchet.Ratchet) {
+	p, padded := r.Padding()
+	switch {
+	case padded:
+		fmt.Printf("padding: %s\n", p)
+	case r.State() == ratchet.AwaitingKeyExchange:
+		fmt.Printf("padding: %s, if %s supports it\n", p, peer)
+	default:
+		fmt.Printf("padding: unsupported by %s\n", peer)
+	}
+}
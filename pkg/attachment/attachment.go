@@ -0,0 +1,171 @@
+// Package attachment encrypts files with their own random key, so that
+// only a small description of the file has to go through the ratchet.
+//
+// An encrypted file starts with a header:
+//
+//	"GOAXFILE" | version | id (16)
+//
+// where id is the id of the message describing the file. It is followed
+// by chunks of at most ChunkSize bytes of plaintext, each sealed with
+// secretbox. The nonce of a chunk is its index, big endian, followed by a
+// byte set to 1 for the last chunk, so that chunks can't be reordered,
+// dropped or truncated without Decrypt noticing.
+package attachment
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// ChunkSize is the size of the plaintext in every chunk but the last.
+	ChunkSize = 64 * 1024
+	// Version is the version of the encrypted file format.
+	Version = 1
+
+	sealedChunkSize = ChunkSize + secretbox.Overhead
+	headerSize      = len(magic) + 1 + 16
+)
+
+const magic = "GOAXFILE"
+
+var (
+	// ErrNotAttachment is returned when a file doesn't start with the
+	// expected header.
+	ErrNotAttachment = errors.New("attachment: not an encrypted file")
+	// ErrCorrupt is returned when a chunk fails authentication or the
+	// file is truncated.
+	ErrCorrupt = errors.New("attachment: corrupt file")
+)
+
+// Description is what the recipient needs to decrypt and verify a file.
+type Description struct {
+	// Name is the name of the file, without any directory.
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	Key         []byte `json:"key"`
+	// Digest is the SHA-256 of the plaintext.
+	Digest []byte `json:"digest"`
+}
+
+func chunkNonce(nonce *[24]byte, index uint64, last bool) {
+	*nonce = [24]byte{}
+	binary.BigEndian.PutUint64(nonce[:8], index)
+	if last {
+		nonce[8] = 1
+	}
+}
+
+// Encrypt reads the whole of src and writes its encrypted form to dst. It
+// returns the size and SHA-256 digest of the plaintext.
+func Encrypt(dst io.Writer, src io.Reader, id [16]byte, key *[32]byte) (size int64, digest [32]byte, err error) {
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = append(header, Version)
+	header = append(header, id[:]...)
+	if _, err = dst.Write(header); err != nil {
+		return
+	}
+
+	h := sha256.New()
+	var nonce [24]byte
+	// Read one chunk ahead so that we know which one is the last
+	current := make([]byte, ChunkSize)
+	next := make([]byte, ChunkSize)
+	n, err := io.ReadFull(src, current)
+	sealed := make([]byte, 0, sealedChunkSize)
+	for index := uint64(0); ; index++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return
+		}
+		last := err != nil
+		var nextN int
+		if !last {
+			nextN, err = io.ReadFull(src, next)
+			if err == io.EOF {
+				last = true
+			}
+		}
+
+		h.Write(current[:n])
+		size += int64(n)
+		chunkNonce(&nonce, index, last)
+		sealed = secretbox.Seal(sealed[:0], current[:n], &nonce, key)
+		if _, err = dst.Write(sealed); err != nil {
+			return
+		}
+		if last {
+			h.Sum(digest[:0])
+			return size, digest, nil
+		}
+		current, next, n = next, current, nextN
+	}
+}
+
+// ReadID reads the header of an encrypted file and returns the id of the
+// message that describes it. src is left at the first chunk.
+func ReadID(src io.Reader) (id [16]byte, err error) {
+	var header [headerSize]byte
+	if _, err = io.ReadFull(src, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrNotAttachment
+		}
+		return
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) || header[len(magic)] != Version {
+		return id, ErrNotAttachment
+	}
+	copy(id[:], header[len(magic)+1:])
+	return id, nil
+}
+
+// Decrypt reads chunks from src, which must be positioned after the
+// header (see ReadID), and writes the plaintext to dst. It returns the
+// size and SHA-256 digest of the plaintext, which the caller must compare
+// to the Description.
+func Decrypt(dst io.Writer, src io.Reader, key *[32]byte) (size int64, digest [32]byte, err error) {
+	r := bufio.NewReaderSize(src, sealedChunkSize)
+	h := sha256.New()
+	var nonce [24]byte
+	sealed := make([]byte, sealedChunkSize)
+	plain := make([]byte, 0, ChunkSize)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(r, sealed)
+		if err == io.EOF {
+			// The last chunk is never empty, there's always the overhead
+			return size, digest, ErrCorrupt
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return size, digest, err
+		}
+		last := err == io.ErrUnexpectedEOF
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		chunkNonce(&nonce, index, last)
+		var ok bool
+		plain, ok = secretbox.Open(plain[:0], sealed[:n], &nonce, key)
+		if !ok {
+			return size, digest, ErrCorrupt
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return size, digest, err
+		}
+		h.Write(plain)
+		size += int64(len(plain))
+		if last {
+			h.Sum(digest[:0])
+			return size, digest, nil
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package attachment
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"testing"
+)
+
+func encrypt(t *testing.T, plaintext []byte, key *[32]byte) []byte {
+	var encrypted bytes.Buffer
+	size, digest, err := Encrypt(&encrypted, bytes.NewReader(plaintext), [16]byte{1, 2, 3}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(plaintext)) {
+		t.Fatalf("bad size; expected %d, got %d", len(plaintext), size)
+	}
+	if digest != sha256.Sum256(plaintext) {
+		t.Fatalf("bad digest for %d bytes", len(plaintext))
+	}
+	return encrypted.Bytes()
+}
+
+func decrypt(encrypted []byte, key *[32]byte) ([]byte, error) {
+	src := bytes.NewReader(encrypted)
+	if _, err := ReadID(src); err != nil {
+		return nil, err
+	}
+	var plaintext bytes.Buffer
+	_, _, err := Decrypt(&plaintext, src, key)
+	return plaintext.Bytes(), err
+}
+
+func TestRoundTrip(t *testing.T) {
+	var key [32]byte
+	io.ReadFull(rand.Reader, key[:])
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize} {
+		plaintext := make([]byte, size)
+		io.ReadFull(rand.Reader, plaintext)
+
+		encrypted := encrypt(t, plaintext, &key)
+
+		id, err := ReadID(bytes.NewReader(encrypted))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != [16]byte{1, 2, 3} {
+			t.Fatalf("bad id %x", id)
+		}
+
+		actual, err := decrypt(encrypted, &key)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		if !bytes.Equal(actual, plaintext) {
+			t.Fatalf("%d bytes: plaintext doesn't match", size)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var key [32]byte
+	io.ReadFull(rand.Reader, key[:])
+	plaintext := make([]byte, 2*ChunkSize)
+	encrypted := encrypt(t, plaintext, &key)
+
+	// Dropping the last chunk leaves a valid-looking, non-final chunk
+	if _, err := decrypt(encrypted[:headerSize+sealedChunkSize], &key); err != ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt for missing chunk, got %v", err)
+	}
+	if _, err := decrypt(encrypted[:len(encrypted)-1], &key); err != ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt for truncated chunk, got %v", err)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	var key [32]byte
+	io.ReadFull(rand.Reader, key[:])
+	encrypted := encrypt(t, []byte("some file"), &key)
+	encrypted[len(encrypted)-1] ^= 1
+
+	if _, err := decrypt(encrypted, &key); err != ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+
+	if _, err := ReadID(bytes.NewReader([]byte("not an encrypted file at all"))); err != ErrNotAttachment {
+		t.Fatalf("expected ErrNotAttachment, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Package device lets a user run goax on several devices, in the manner of
+// Sesame. The user has a long-term Ed25519 user key, shared by all their
+// devices, which signs the List of their devices. Each device keeps its own
+// curve25519 device key, with which it has its own sessions with each
+// device of its peers.
+package device
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+)
+
+// List is the list of the device keys of a user, signed by their user key.
+//
+// Its binary form is:
+//
+//	type | version | user key (32) | serial (8) | count (1) | devices (32 each) | signature (64)
+//
+// The signature covers everything before it.
+type List struct {
+	// User is the Ed25519 public user key.
+	User [32]byte
+	// Serial is increased each time the list changes, so that peers
+	// keep the latest one.
+	Serial  uint64
+	Devices [][32]byte
+	// Signature is the signature of the list by the user key.
+	Signature [64]byte
+}
+
+const (
+	binaryListType    = 0x4c // 'L'
+	binaryListVersion = 1
+
+	// MaxDevices is the maximum number of devices in a List.
+	MaxDevices = 255
+)
+
+var (
+	// ErrBadSignature is returned for a List whose signature is invalid.
+	ErrBadSignature = errors.New("device: bad signature")
+	// ErrUserChanged is returned by CheckUpdate when the new list is
+	// signed by another user key.
+	ErrUserChanged = errors.New("device: list signed by another user key")
+	// ErrOldList is returned by CheckUpdate when the new list is older
+	// than the current one.
+	ErrOldList = errors.New("device: list older than the current one")
+
+	errInvalidList = errors.New("device: invalid list")
+)
+
+// Sign returns the List of devices of the owner of userKey.
+func Sign(userKey ed25519.PrivateKey, serial uint64, devices [][32]byte) (*List, error) {
+	if len(devices) == 0 || len(devices) > MaxDevices {
+		return nil, errInvalidList
+	}
+	l := &List{Serial: serial, Devices: devices}
+	copy(l.User[:], userKey.Public().(ed25519.PublicKey))
+	copy(l.Signature[:], ed25519.Sign(userKey, l.signed()))
+	return l, nil
+}
+
+// signed returns the part of the binary form covered by the signature.
+func (l *List) signed() []byte {
+	out := make([]byte, 0, 2+32+8+1+32*len(l.Devices)+64)
+	out = append(out, binaryListType, binaryListVersion)
+	out = append(out, l.User[:]...)
+	var serial [8]byte
+	binary.BigEndian.PutUint64(serial[:], l.Serial)
+	out = append(out, serial[:]...)
+	out = append(out, byte(len(l.Devices)))
+	for _, d := range l.Devices {
+		out = append(out, d[:]...)
+	}
+	return out
+}
+
+// Verify checks the signature of the list.
+func (l *List) Verify() error {
+	if len(l.Devices) == 0 || len(l.Devices) > MaxDevices {
+		return errInvalidList
+	}
+	if !ed25519.Verify(l.User[:], l.signed(), l.Signature[:]) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Contains tells if device is in the list.
+func (l *List) Contains(device [32]byte) bool {
+	for _, d := range l.Devices {
+		if d == device {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckUpdate checks that next, a verified list, can replace l: it must be
+// signed by the same user key, and not be older.
+func (l *List) CheckUpdate(next *List) error {
+	if next.User != l.User {
+		return ErrUserChanged
+	}
+	if next.Serial < l.Serial {
+		return ErrOldList
+	}
+	return nil
+}
+
+// MarshalBinary makes the List an encoding.BinaryMarshaler.
+func (l *List) MarshalBinary() ([]byte, error) {
+	if len(l.Devices) == 0 || len(l.Devices) > MaxDevices {
+		return nil, errInvalidList
+	}
+	return append(l.signed(), l.Signature[:]...), nil
+}
+
+// UnmarshalBinary makes the *List an encoding.BinaryUnmarshaler. The
+// signature is verified, so that only authentic lists are ever decoded.
+func (l *List) UnmarshalBinary(in []byte) error {
+	if len(in) < 2+32+8+1 || in[0] != binaryListType || in[1] != binaryListVersion {
+		return errInvalidList
+	}
+	n := int(in[2+32+8])
+	if len(in) != 2+32+8+1+32*n+64 {
+		return errInvalidList
+	}
+	var decoded List
+	copy(decoded.User[:], in[2:34])
+	decoded.Serial = binary.BigEndian.Uint64(in[34:42])
+	devices := in[43:]
+	for i := 0; i < n; i++ {
+		var d [32]byte
+		copy(d[:], devices[32*i:])
+		decoded.Devices = append(decoded.Devices, d)
+	}
+	copy(decoded.Signature[:], in[len(in)-64:])
+	if err := decoded.Verify(); err != nil {
+		return err
+	}
+	*l = decoded
+	return nil
+}
@@ -0,0 +1,133 @@
+package device
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func newDevice(t *testing.T) (private, public [32]byte) {
+	if _, err := io.ReadFull(rand.Reader, private[:]); err != nil {
+		t.Fatal(err)
+	}
+	curve25519.ScalarBaseMult(&public, &private)
+	return private, public
+}
+
+func TestList(t *testing.T) {
+	_, userKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, laptop := newDevice(t)
+	_, desktop := newDevice(t)
+
+	l, err := Sign(userKey, 1, [][32]byte{laptop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := Sign(userKey, 2, [][32]byte{laptop, desktop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err := next.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded List
+	if err := decoded.UnmarshalBinary(marshalled); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.User != next.User || decoded.Serial != 2 || !decoded.Contains(laptop) || !decoded.Contains(desktop) {
+		t.Fatalf("Decoded list doesn't match: %+v", decoded)
+	}
+	if err := l.CheckUpdate(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.CheckUpdate(l); err != ErrOldList {
+		t.Fatalf("Expected ErrOldList, got %v", err)
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	other, err := Sign(otherKey, 3, [][32]byte{laptop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CheckUpdate(other); err != ErrUserChanged {
+		t.Fatalf("Expected ErrUserChanged, got %v", err)
+	}
+
+	for i := range marshalled {
+		tampered := append([]byte(nil), marshalled...)
+		tampered[i] ^= 1
+		if err := new(List).UnmarshalBinary(tampered); err == nil {
+			t.Fatalf("Accepted a list with byte %d changed", i)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	m := Message{Kind: KindMessage, Payload: []byte("ciphertext")}
+	_, m.From = newDevice(t)
+	_, m.To = newDevice(t)
+	marshalled, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Message
+	if err := decoded.UnmarshalBinary(marshalled); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Kind != m.Kind || decoded.From != m.From || decoded.To != m.To || !bytes.Equal(decoded.Payload, m.Payload) {
+		t.Fatalf("Decoded message doesn't match: %+v", decoded)
+	}
+	marshalled[2] = 'X'
+	if err := decoded.UnmarshalBinary(marshalled); err == nil {
+		t.Fatal("Accepted a message of unknown kind")
+	}
+}
+
+func TestLink(t *testing.T) {
+	_, userKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, laptop := newDevice(t)
+	desktopPrivate, desktop := newDevice(t)
+	l, err := Sign(userKey, 2, [][32]byte{laptop, desktop})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLink(rand.Reader, userKey, l, [32]byte{1}); err != ErrNotInList {
+		t.Fatalf("Expected ErrNotInList, got %v", err)
+	}
+	k, err := NewLink(rand.Reader, userKey, l, desktop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err := k.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Link
+	if err := decoded.UnmarshalBinary(marshalled); err != nil {
+		t.Fatal(err)
+	}
+	received, err := decoded.UserKey(&desktopPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, userKey) {
+		t.Fatal("The user key doesn't match")
+	}
+
+	laptopPrivate, _ := newDevice(t)
+	if _, err := decoded.UserKey(&laptopPrivate); err == nil {
+		t.Fatal("Another device could open the user key")
+	}
+}
@@ -0,0 +1,139 @@
+package device
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Link is what an existing device of a user gives to a new one: the List
+// that includes the new device, and the user key, encrypted for it so that
+// the link can go through the same channels as messages.
+//
+// Its binary form is:
+//
+//	type | version | device (32) | ephemeral (32) | sealed user key (48) | list
+//
+// The user key is sealed with secretbox, under a key derived from the DH
+// of an ephemeral key and the device key.
+type Link struct {
+	// Device is the key of the new device.
+	Device [32]byte
+	List   *List
+
+	ephemeral [32]byte
+	sealed    [sealedUserKeySize]byte
+}
+
+const (
+	binaryLinkType    = 0x6c // 'l'
+	binaryLinkVersion = 1
+
+	sealedUserKeySize = ed25519.SeedSize + secretbox.Overhead
+	linkHeaderSize    = 2 + 32 + 32 + sealedUserKeySize
+)
+
+var linkLabel = []byte("goax device link")
+
+var (
+	// ErrNotInList is returned by NewLink when the device isn't in the
+	// list it is given.
+	ErrNotInList = errors.New("device: device not in list")
+
+	errInvalidLink = errors.New("device: invalid link")
+)
+
+// NewLink returns the Link giving userKey and list to device, which must
+// be in list.
+func NewLink(rand io.Reader, userKey ed25519.PrivateKey, list *List, device [32]byte) (*Link, error) {
+	if !list.Contains(device) {
+		return nil, ErrNotInList
+	}
+	k := &Link{Device: device, List: list}
+
+	var private [32]byte
+	if _, err := io.ReadFull(rand, private[:]); err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&k.ephemeral, &private)
+	key, err := k.key(&private, &device)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	secretbox.Seal(k.sealed[:0], userKey.Seed(), &nonce, key)
+	return k, nil
+}
+
+// key derives the key sealing the user key from the DH of private and
+// public, the ephemeral key and the device key.
+func (k *Link) key(private, public *[32]byte) (*[32]byte, error) {
+	var shared [32]byte
+	curve25519.ScalarMult(&shared, private, public)
+	if shared == [32]byte{} {
+		return nil, errInvalidLink
+	}
+	info := append(append(append([]byte(nil), linkLabel...), k.ephemeral[:]...), k.Device[:]...)
+	key := new([32]byte)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared[:], nil, info), key[:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// UserKey decrypts the user key with the private key of Device.
+func (k *Link) UserKey(devicePrivate *[32]byte) (ed25519.PrivateKey, error) {
+	key, err := k.key(devicePrivate, &k.ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	seed, ok := secretbox.Open(nil, k.sealed[:], &nonce, key)
+	if !ok {
+		return nil, errInvalidLink
+	}
+	userKey := ed25519.NewKeyFromSeed(seed)
+	if string(userKey.Public().(ed25519.PublicKey)) != string(k.List.User[:]) {
+		return nil, errInvalidLink
+	}
+	return userKey, nil
+}
+
+// MarshalBinary makes the Link an encoding.BinaryMarshaler.
+func (k *Link) MarshalBinary() ([]byte, error) {
+	list, err := k.List.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, linkHeaderSize+len(list))
+	out = append(out, binaryLinkType, binaryLinkVersion)
+	out = append(out, k.Device[:]...)
+	out = append(out, k.ephemeral[:]...)
+	out = append(out, k.sealed[:]...)
+	return append(out, list...), nil
+}
+
+// UnmarshalBinary makes the *Link an encoding.BinaryUnmarshaler. As with
+// List, the signature of the list is verified.
+func (k *Link) UnmarshalBinary(in []byte) error {
+	if len(in) < linkHeaderSize || in[0] != binaryLinkType || in[1] != binaryLinkVersion {
+		return errInvalidLink
+	}
+	list := new(List)
+	if err := list.UnmarshalBinary(in[linkHeaderSize:]); err != nil {
+		return err
+	}
+	copy(k.Device[:], in[2:34])
+	if !list.Contains(k.Device) {
+		return ErrNotInList
+	}
+	copy(k.ephemeral[:], in[34:66])
+	copy(k.sealed[:], in[66:linkHeaderSize])
+	k.List = list
+	return nil
+}
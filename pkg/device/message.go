@@ -0,0 +1,60 @@
+package device
+
+import "errors"
+
+// Kinds of the payload of a Message.
+const (
+	// KindKeyExchange is for binary key exchange material.
+	KindKeyExchange = 'K'
+	// KindMessage is for a ratchet message.
+	KindMessage = 'M'
+)
+
+// Message is a key exchange or a ratchet message from a device to a device
+// of a peer. When a user has several devices, they all see what is sent to
+// the user, and keep what is addressed to them.
+//
+// Its binary form is:
+//
+//	type | version | kind | from (32) | to (32) | payload
+//
+// The addresses aren't authenticated, but the ratchets are: a message
+// with the wrong sender fails to decrypt.
+type Message struct {
+	Kind     byte
+	From, To [32]byte
+	Payload  []byte
+}
+
+const (
+	binaryMessageType    = 0x44 // 'D'
+	binaryMessageVersion = 1
+	messageHeaderSize    = 3 + 2*32
+)
+
+var errInvalidMessage = errors.New("device: invalid message")
+
+// MarshalBinary makes the Message an encoding.BinaryMarshaler.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 0, messageHeaderSize+len(m.Payload))
+	out = append(out, binaryMessageType, binaryMessageVersion, m.Kind)
+	out = append(out, m.From[:]...)
+	out = append(out, m.To[:]...)
+	return append(out, m.Payload...), nil
+}
+
+// UnmarshalBinary makes the *Message an encoding.BinaryUnmarshaler. The
+// payload is copied.
+func (m *Message) UnmarshalBinary(in []byte) error {
+	if len(in) < messageHeaderSize || in[0] != binaryMessageType || in[1] != binaryMessageVersion {
+		return errInvalidMessage
+	}
+	if in[2] != KindKeyExchange && in[2] != KindMessage {
+		return errInvalidMessage
+	}
+	m.Kind = in[2]
+	copy(m.From[:], in[3:35])
+	copy(m.To[:], in[35:67])
+	m.Payload = append([]byte(nil), in[messageHeaderSize:]...)
+	return nil
+}
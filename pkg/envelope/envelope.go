@@ -0,0 +1,185 @@
+// Package envelope implements the structure of the plaintext that goes
+// inside a ratchet message: some metadata followed by the actual content.
+//
+// An envelope is serialized as:
+//
+//	0x00 | version | type | flags | timestamp (8) | id (16) |
+//	[reply-to id (16)] | content type length (1) | content type | content
+//
+// Integers are big endian. The leading zero byte tells envelopes apart
+// from the raw text sent by older versions of goax.
+package envelope
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+)
+
+// Version is the version of the envelope format produced by this package.
+const Version = 1
+
+// Type is the kind of message an envelope carries.
+type Type uint8
+
+const (
+	// Text is a message written by the user.
+	Text Type = iota + 1
+	// File carries the description of an attached file.
+	File
+	// Ack acknowledges received messages.
+	Ack
+	// Control is for messages handled by goax itself.
+	Control
+	// SenderKey distributes the sender key of a member of a group.
+	SenderKey
+)
+
+func (t Type) String() string {
+	switch t {
+	case Text:
+		return "text"
+	case File:
+		return "file"
+	case Ack:
+		return "ack"
+	case Control:
+		return "control"
+	case SenderKey:
+		return "sender-key"
+	default:
+		return "unknown"
+	}
+}
+
+// ID uniquely identifies a message.
+type ID [16]byte
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ParseID parses the hex form of an ID, as returned by String.
+func ParseID(s string) (id ID, err error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != len(id) {
+		return id, errors.New("envelope: invalid id length")
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+const (
+	flagReplyTo = 1 << iota
+)
+
+// headerSize is the size of the fixed part of a serialized envelope.
+const headerSize = 1 /* zero */ + 1 /* version */ + 1 /* type */ + 1 /* flags */ + 8 /* timestamp */ + 16 /* id */
+
+var (
+	// ErrNotEnvelope is returned by Unmarshal when the input isn't an
+	// envelope at all, most likely because the peer runs an older version.
+	ErrNotEnvelope = errors.New("envelope: not an envelope")
+	// ErrUnknownVersion is returned by Unmarshal for envelopes of a
+	// version we don't understand.
+	ErrUnknownVersion = errors.New("envelope: unknown version")
+	errTruncated      = errors.New("envelope: truncated")
+)
+
+// Envelope is the plaintext of a ratchet message.
+type Envelope struct {
+	Type Type
+	// Timestamp is the sender's time when the message was written.
+	Timestamp time.Time
+	ID        ID
+	// ReplyTo is the ID of the message this one answers, if any.
+	ReplyTo *ID
+	// ContentType is the MIME type of Content.
+	ContentType string
+	Content     []byte
+}
+
+// New returns an envelope for content, with a random ID taken from rand
+// and the current time.
+func New(rand io.Reader, t Type, contentType string, content []byte) (*Envelope, error) {
+	e := &Envelope{
+		Type:        t,
+		Timestamp:   time.Now(),
+		ContentType: contentType,
+		Content:     content,
+	}
+	if _, err := io.ReadFull(rand, e.ID[:]); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Marshal serializes the envelope.
+func (e *Envelope) Marshal() ([]byte, error) {
+	if len(e.ContentType) > 255 {
+		return nil, errors.New("envelope: content type too long")
+	}
+
+	size := headerSize + 1 + len(e.ContentType) + len(e.Content)
+	if e.ReplyTo != nil {
+		size += len(e.ReplyTo)
+	}
+	out := make([]byte, headerSize, size)
+	out[1] = Version
+	out[2] = byte(e.Type)
+	if e.ReplyTo != nil {
+		out[3] |= flagReplyTo
+	}
+	binary.BigEndian.PutUint64(out[4:12], uint64(e.Timestamp.Unix()))
+	copy(out[12:], e.ID[:])
+	if e.ReplyTo != nil {
+		out = append(out, e.ReplyTo[:]...)
+	}
+	out = append(out, byte(len(e.ContentType)))
+	out = append(out, e.ContentType...)
+	return append(out, e.Content...), nil
+}
+
+// Unmarshal parses a serialized envelope. It returns ErrNotEnvelope if in
+// doesn't look like an envelope.
+func Unmarshal(in []byte) (*Envelope, error) {
+	if len(in) < 2 || in[0] != 0 {
+		return nil, ErrNotEnvelope
+	}
+	if in[1] != Version {
+		return nil, ErrUnknownVersion
+	}
+	if len(in) < headerSize {
+		return nil, errTruncated
+	}
+
+	e := &Envelope{
+		Type:      Type(in[2]),
+		Timestamp: time.Unix(int64(binary.BigEndian.Uint64(in[4:12])), 0),
+	}
+	flags := in[3]
+	copy(e.ID[:], in[12:headerSize])
+	in = in[headerSize:]
+
+	if flags&flagReplyTo != 0 {
+		if len(in) < len(ID{}) {
+			return nil, errTruncated
+		}
+		e.ReplyTo = new(ID)
+		copy(e.ReplyTo[:], in)
+		in = in[len(e.ReplyTo):]
+	}
+
+	if len(in) < 1 || len(in) < 1+int(in[0]) {
+		return nil, errTruncated
+	}
+	e.ContentType = string(in[1 : 1+int(in[0])])
+	e.Content = in[1+int(in[0]):]
+
+	return e, nil
+}
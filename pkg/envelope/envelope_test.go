@@ -0,0 +1,88 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	e, err := New(rand.Reader, Text, "text/plain; charset=utf-8", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyTo := ID{1, 2, 3}
+	e.ReplyTo = &replyTo
+
+	marshalled, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := Unmarshal(marshalled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual.Type != e.Type {
+		t.Fatalf("Type doesn't match; expected %s, got %s", e.Type, actual.Type)
+	}
+	if !actual.Timestamp.Equal(e.Timestamp.Truncate(1e9)) {
+		t.Fatalf("Timestamp doesn't match; expected %s, got %s", e.Timestamp, actual.Timestamp)
+	}
+	if actual.ID != e.ID {
+		t.Fatalf("ID doesn't match; expected %s, got %s", e.ID, actual.ID)
+	}
+	if actual.ReplyTo == nil || *actual.ReplyTo != replyTo {
+		t.Fatalf("ReplyTo doesn't match; expected %s, got %v", replyTo, actual.ReplyTo)
+	}
+	if actual.ContentType != e.ContentType {
+		t.Fatalf("ContentType doesn't match; expected %q, got %q", e.ContentType, actual.ContentType)
+	}
+	if !bytes.Equal(actual.Content, e.Content) {
+		t.Fatalf("Content doesn't match; expected %q, got %q", e.Content, actual.Content)
+	}
+}
+
+func TestNoReplyTo(t *testing.T) {
+	e, err := New(rand.Reader, Ack, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := Unmarshal(marshalled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual.ReplyTo != nil {
+		t.Fatalf("unexpected ReplyTo %s", actual.ReplyTo)
+	}
+	if len(actual.Content) != 0 {
+		t.Fatalf("unexpected content %q", actual.Content)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	if _, err := Unmarshal([]byte("Hello from goax !\n")); err != ErrNotEnvelope {
+		t.Fatalf("expected ErrNotEnvelope for raw text, got %v", err)
+	}
+	if _, err := Unmarshal([]byte{0, Version + 1, 0}); err != ErrUnknownVersion {
+		t.Fatalf("expected ErrUnknownVersion, got %v", err)
+	}
+
+	e, err := New(rand.Reader, Text, "text/plain", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < headerSize+1+len("text/plain"); i++ {
+		if _, err := Unmarshal(marshalled[:i]); err == nil {
+			t.Fatalf("truncated envelope of length %d was accepted", i)
+		}
+	}
+}
@@ -0,0 +1,630 @@
+package ratchet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// DoubleRatchet implements the Double Ratchet algorithm as specified by
+// Signal (https://signal.org/docs/specifications/doubleratchet/), as an
+// alternative to the Pond-derived Ratchet for talking to other
+// implementations. It uses the functions recommended by the spec:
+//
+//   - KDF_RK is HKDF-SHA256, with the root key as salt
+//   - KDF_CK is HMAC-SHA256 of the constants 0x01 and 0x02
+//   - ENCRYPT is AES-256-CBC with PKCS#7 padding, authenticated with
+//     HMAC-SHA256; the keys and IV come from HKDF-SHA256 of the message
+//     key
+//
+// The default HKDF info strings are those of libsignal, so that both
+// derive the same keys. Header encryption, from section 4 of the spec,
+// is optional; headers are then sealed with AES-256-GCM.
+//
+// Unlike Ratchet, a DoubleRatchet doesn't perform the initial key
+// agreement: the parties must already share a secret key and Alice must
+// know Bob's ratchet public key, for example thanks to X3DH.
+//
+// A message is serialized as:
+//
+//	header | ciphertext | mac (32)
+//
+// where header is dh (32) | pn (4) | n (4), integers in big endian.
+// With header encryption, the header is replaced by:
+//
+//	nonce (12) | sealed header
+type DoubleRatchet struct {
+	rootInfo, messageInfo []byte
+	headerEncryption      bool
+
+	dhsPrivate, dhsPublic [32]byte
+	dhr                   [32]byte
+	hasDHr                bool
+
+	rootKey                    [32]byte
+	sendChainKey, recvChainKey [32]byte
+	hasSendChain, hasRecvChain bool
+	ns, nr, pn                 uint32
+
+	// Header keys, only used with header encryption
+	hks, hkr, nhks, nhkr [32]byte
+	hasHKs, hasHKr       bool
+
+	// skipped holds the keys of skipped messages, indexed by the ratchet
+	// public key of their chain or, with header encryption, by their
+	// header key. skippedOrder holds the indexes, oldest first.
+	skipped      map[skippedMessage][32]byte
+	skippedOrder []skippedMessage
+
+	rand io.Reader
+}
+
+type skippedMessage struct {
+	key [32]byte
+	n   uint32
+}
+
+// DoubleRatchetConfig holds the parameters both parties of a
+// DoubleRatchet must agree on. The zero value uses the libsignal info
+// strings and no header encryption.
+type DoubleRatchetConfig struct {
+	// RootInfo is the HKDF info of KDF_RK.
+	RootInfo []byte
+	// MessageInfo is the HKDF info used to expand message keys.
+	MessageInfo []byte
+
+	// HeaderEncryption enables header encryption, with the initial
+	// header keys the parties agreed on.
+	HeaderEncryption    bool
+	SharedHeaderKey     [32]byte
+	SharedNextHeaderKey [32]byte
+}
+
+var (
+	defaultRootInfo    = []byte("WhisperRatchet")
+	defaultMessageInfo = []byte("WhisperMessageKeys")
+)
+
+const (
+	// maxSkip is the maximum number of message keys skipped in a
+	// single chain.
+	maxSkip = 1000
+	// maxSkippedKeys is the maximum number of message keys kept over all
+	// chains. Past that, the oldest are forgotten.
+	maxSkippedKeys = 2000
+
+	drHeaderSize       = 32 + 4 + 4
+	drHeaderNonceSize  = 12
+	drSealedHeaderSize = drHeaderNonceSize + drHeaderSize + 16
+	drMACSize          = sha256.Size
+)
+
+var errDoubleRatchetCorrupt = errors.New("ratchet: corrupt message")
+
+func newDoubleRatchet(rand io.Reader, sharedKey [32]byte, config *DoubleRatchetConfig) *DoubleRatchet {
+	if config == nil {
+		config = new(DoubleRatchetConfig)
+	}
+	r := &DoubleRatchet{
+		rootInfo:         config.RootInfo,
+		messageInfo:      config.MessageInfo,
+		headerEncryption: config.HeaderEncryption,
+		rootKey:          sharedKey,
+		skipped:          make(map[skippedMessage][32]byte),
+		rand:             rand,
+	}
+	if r.rootInfo == nil {
+		r.rootInfo = defaultRootInfo
+	}
+	if r.messageInfo == nil {
+		r.messageInfo = defaultMessageInfo
+	}
+	return r
+}
+
+// NewDoubleRatchetAlice returns the DoubleRatchet of the party that sends
+// the first message, to Bob whose ratchet public key is bobPublic.
+func NewDoubleRatchetAlice(rand io.Reader, sharedKey, bobPublic [32]byte, config *DoubleRatchetConfig) (*DoubleRatchet, error) {
+	r := newDoubleRatchet(rand, sharedKey, config)
+	if r.headerEncryption {
+		r.hks, r.hasHKs = config.SharedHeaderKey, true
+		r.nhkr = config.SharedNextHeaderKey
+	}
+	if err := r.generateDH(); err != nil {
+		return nil, err
+	}
+	r.dhr, r.hasDHr = bobPublic, true
+	dhOut, err := dh(&r.dhsPrivate, &r.dhr)
+	if err != nil {
+		return nil, err
+	}
+	r.kdfRK(dhOut, &r.sendChainKey, &r.nhks)
+	r.hasSendChain = true
+	return r, nil
+}
+
+// NewDoubleRatchetBob returns the DoubleRatchet of the party that receives
+// the first message. bobPrivate is the private part of the ratchet key
+// Alice knows.
+func NewDoubleRatchetBob(rand io.Reader, sharedKey, bobPrivate [32]byte, config *DoubleRatchetConfig) (*DoubleRatchet, error) {
+	r := newDoubleRatchet(rand, sharedKey, config)
+	if r.headerEncryption {
+		r.nhks = config.SharedNextHeaderKey
+		r.nhkr = config.SharedHeaderKey
+	}
+	public, err := curve25519.X25519(bobPrivate[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	r.dhsPrivate = bobPrivate
+	copy(r.dhsPublic[:], public)
+	return r, nil
+}
+
+func (r *DoubleRatchet) generateDH() error {
+	if _, err := io.ReadFull(r.rand, r.dhsPrivate[:]); err != nil {
+		return err
+	}
+	public, err := curve25519.X25519(r.dhsPrivate[:], curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	copy(r.dhsPublic[:], public)
+	return nil
+}
+
+// dh returns the DH of private and public. It fails with
+// ErrInvalidPublicKey if public is of low order.
+func dh(private, public *[32]byte) ([]byte, error) {
+	out, err := curve25519.X25519(private[:], public[:])
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	return out, nil
+}
+
+// kdfRK is KDF_RK: it updates the root key and derives a chain key and,
+// with header encryption, the next header key. dhOut is wiped.
+func (r *DoubleRatchet) kdfRK(dhOut []byte, chainKey, nextHeaderKey *[32]byte) {
+	size := 64
+	if r.headerEncryption {
+		size = 96
+	}
+	out := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dhOut, r.rootKey[:], r.rootInfo), out); err != nil {
+		panic(err)
+	}
+	copy(r.rootKey[:], out[:32])
+	copy(chainKey[:], out[32:64])
+	if r.headerEncryption {
+		copy(nextHeaderKey[:], out[64:])
+	}
+	wipe(out)
+	wipe(dhOut)
+}
+
+// kdfCK is KDF_CK: it steps chainKey and returns the message key.
+func kdfCK(chainKey *[32]byte) (messageKey [32]byte) {
+	h := hmac.New(sha256.New, chainKey[:])
+	h.Write([]byte{1})
+	h.Sum(messageKey[:0])
+	h.Reset()
+	h.Write([]byte{2})
+	h.Sum(chainKey[:0])
+	return
+}
+
+// messageKeys expands a message key into out, and returns the keys and IV
+// of ENCRYPT from it.
+func (r *DoubleRatchet) messageKeys(messageKey *[32]byte, out *[80]byte) (encKey, authKey, iv []byte) {
+	if _, err := io.ReadFull(hkdf.New(sha256.New, messageKey[:], nil, r.messageInfo), out[:]); err != nil {
+		panic(err)
+	}
+	return out[:32], out[32:64], out[64:]
+}
+
+func (r *DoubleRatchet) encrypt(out []byte, messageKey *[32]byte, plaintext, ad []byte) []byte {
+	var keys [80]byte
+	defer wipe(keys[:])
+	encKey, authKey, iv := r.messageKeys(messageKey, &keys)
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		panic(err)
+	}
+
+	padLen := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := make([]byte, len(plaintext)+padLen)
+	copy(padded, plaintext)
+	for i := len(plaintext); i < len(padded); i++ {
+		padded[i] = byte(padLen)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write(ad)
+	mac.Write(padded)
+	out = append(out, padded...)
+	return mac.Sum(out)
+}
+
+func (r *DoubleRatchet) decrypt(messageKey *[32]byte, ciphertext, ad []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize+drMACSize || (len(ciphertext)-drMACSize)%aes.BlockSize != 0 {
+		return nil, errDoubleRatchetCorrupt
+	}
+	var keys [80]byte
+	defer wipe(keys[:])
+	encKey, authKey, iv := r.messageKeys(messageKey, &keys)
+	ciphertext, tag := ciphertext[:len(ciphertext)-drMACSize], ciphertext[len(ciphertext)-drMACSize:]
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write(ad)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return nil, errDoubleRatchetCorrupt
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		panic(err)
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	padLen := int(plaintext[len(plaintext)-1])
+	if padLen == 0 || padLen > aes.BlockSize {
+		return nil, errDoubleRatchetCorrupt
+	}
+	for _, b := range plaintext[len(plaintext)-padLen:] {
+		if int(b) != padLen {
+			return nil, errDoubleRatchetCorrupt
+		}
+	}
+	return plaintext[:len(plaintext)-padLen], nil
+}
+
+type drHeader struct {
+	dh    [32]byte
+	pn, n uint32
+}
+
+func (h *drHeader) marshal() []byte {
+	out := make([]byte, drHeaderSize)
+	copy(out, h.dh[:])
+	binary.BigEndian.PutUint32(out[32:36], h.pn)
+	binary.BigEndian.PutUint32(out[36:40], h.n)
+	return out
+}
+
+func (h *drHeader) unmarshal(in []byte) bool {
+	if len(in) != drHeaderSize {
+		return false
+	}
+	copy(h.dh[:], in)
+	h.pn = binary.BigEndian.Uint32(in[32:36])
+	h.n = binary.BigEndian.Uint32(in[36:40])
+	return true
+}
+
+func (r *DoubleRatchet) sealHeader(header []byte) ([]byte, error) {
+	nonce := make([]byte, drHeaderNonceSize, drSealedHeaderSize)
+	if _, err := io.ReadFull(r.rand, nonce); err != nil {
+		return nil, err
+	}
+	return newGCM(&r.hks).Seal(nonce, nonce, header, nil), nil
+}
+
+func openHeader(headerKey *[32]byte, sealed []byte) (h drHeader, ok bool) {
+	header, err := newGCM(headerKey).Open(nil, sealed[:drHeaderNonceSize], sealed[drHeaderNonceSize:], nil)
+	if err != nil {
+		return h, false
+	}
+	return h, h.unmarshal(header)
+}
+
+// Encrypt encrypts msg and authenticates it along with ad. Bob can only
+// encrypt after having decrypted a message from Alice; before that, the
+// error is ErrHandshakeNotComplete.
+func (r *DoubleRatchet) Encrypt(msg, ad []byte) ([]byte, error) {
+	if !r.hasSendChain {
+		return nil, ErrHandshakeNotComplete
+	}
+
+	header := drHeader{dh: r.dhsPublic, pn: r.pn, n: r.ns}
+	out := header.marshal()
+	if r.headerEncryption {
+		var err error
+		if out, err = r.sealHeader(out); err != nil {
+			return nil, err
+		}
+	}
+	messageKey := kdfCK(&r.sendChainKey)
+	defer wipe(messageKey[:])
+	r.ns++
+	return r.encrypt(out, &messageKey, msg, append(append([]byte(nil), ad...), out...)), nil
+}
+
+// Decrypt decrypts a message from the peer, authenticating ad along with
+// it. The state of the ratchet doesn't change if decryption fails.
+func (r *DoubleRatchet) Decrypt(msg, ad []byte) ([]byte, error) {
+	headerSize := drHeaderSize
+	if r.headerEncryption {
+		headerSize = drSealedHeaderSize
+	}
+	if len(msg) < headerSize {
+		return nil, errors.New("ratchet: header too small to be valid")
+	}
+	rawHeader, ciphertext := msg[:headerSize], msg[headerSize:]
+	ad = append(append([]byte(nil), ad...), rawHeader...)
+
+	var header drHeader
+	var ratchetStep bool
+	if r.headerEncryption {
+		if plaintext, ok, err := r.trySkippedHE(rawHeader, ciphertext, ad); ok {
+			return plaintext, err
+		}
+		var ok bool
+		if r.hasHKr {
+			header, ok = openHeader(&r.hkr, rawHeader)
+		}
+		if !ok {
+			if header, ok = openHeader(&r.nhkr, rawHeader); !ok {
+				return nil, errors.New("ratchet: cannot decrypt header")
+			}
+			ratchetStep = true
+		}
+	} else {
+		header.unmarshal(rawHeader)
+		key := skippedMessage{header.dh, header.n}
+		if messageKey, ok := r.skipped[key]; ok {
+			plaintext, err := r.decrypt(&messageKey, ciphertext, ad)
+			if err == nil {
+				r.deleteSkipped(key)
+			}
+			return plaintext, err
+		}
+		ratchetStep = !r.hasDHr || header.dh != r.dhr
+	}
+
+	// Work on a copy, so that a forged message can't alter the state
+	s := r.clone()
+	if ratchetStep {
+		if err := s.skipMessageKeys(header.pn); err != nil {
+			return nil, err
+		}
+		if err := s.dhRatchet(&header); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.skipMessageKeys(header.n); err != nil {
+		return nil, err
+	}
+	messageKey := kdfCK(&s.recvChainKey)
+	defer wipe(messageKey[:])
+	s.nr++
+	plaintext, err := s.decrypt(&messageKey, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	*r = *s
+	return plaintext, nil
+}
+
+// trySkippedHE tries the header keys of the skipped messages, once per
+// run of keys of the same chain.
+func (r *DoubleRatchet) trySkippedHE(rawHeader, ciphertext, ad []byte) (plaintext []byte, ok bool, err error) {
+	for i, key := range r.skippedOrder {
+		if i > 0 && r.skippedOrder[i-1].key == key.key {
+			continue
+		}
+		header, ok := openHeader(&key.key, rawHeader)
+		if !ok {
+			continue
+		}
+		key.n = header.n
+		messageKey, ok := r.skipped[key]
+		if !ok {
+			continue
+		}
+		plaintext, err := r.decrypt(&messageKey, ciphertext, ad)
+		if err == nil {
+			r.deleteSkipped(key)
+		}
+		return plaintext, true, err
+	}
+	return nil, false, nil
+}
+
+// addSkipped keeps the key of a skipped message, forgetting the oldest
+// ones past maxSkippedKeys.
+func (r *DoubleRatchet) addSkipped(key skippedMessage, messageKey [32]byte) {
+	r.skipped[key] = messageKey
+	r.skippedOrder = append(r.skippedOrder, key)
+	for len(r.skippedOrder) > maxSkippedKeys {
+		delete(r.skipped, r.skippedOrder[0])
+		r.skippedOrder = r.skippedOrder[1:]
+	}
+}
+
+func (r *DoubleRatchet) deleteSkipped(key skippedMessage) {
+	delete(r.skipped, key)
+	for i := range r.skippedOrder {
+		if r.skippedOrder[i] == key {
+			r.skippedOrder = append(r.skippedOrder[:i], r.skippedOrder[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *DoubleRatchet) clone() *DoubleRatchet {
+	s := *r
+	s.skipped = make(map[skippedMessage][32]byte, len(r.skipped))
+	for k, v := range r.skipped {
+		s.skipped[k] = v
+	}
+	s.skippedOrder = append([]skippedMessage(nil), r.skippedOrder...)
+	return &s
+}
+
+func (r *DoubleRatchet) skipMessageKeys(until uint32) error {
+	if !r.hasRecvChain {
+		return nil
+	}
+	if until > r.nr+maxSkip {
+		return errors.New("ratchet: message exceeds reordering limit")
+	}
+	chain := r.dhr
+	if r.headerEncryption {
+		chain = r.hkr
+	}
+	for ; r.nr < until; r.nr++ {
+		r.addSkipped(skippedMessage{chain, r.nr}, kdfCK(&r.recvChainKey))
+	}
+	return nil
+}
+
+func (r *DoubleRatchet) dhRatchet(header *drHeader) error {
+	r.pn = r.ns
+	r.ns, r.nr = 0, 0
+	if r.headerEncryption {
+		r.hks, r.hasHKs = r.nhks, true
+		r.hkr, r.hasHKr = r.nhkr, true
+	}
+	r.dhr, r.hasDHr = header.dh, true
+	dhOut, err := dh(&r.dhsPrivate, &r.dhr)
+	if err != nil {
+		return err
+	}
+	r.kdfRK(dhOut, &r.recvChainKey, &r.nhkr)
+	r.hasRecvChain = true
+
+	if err := r.generateDH(); err != nil {
+		return err
+	}
+	if dhOut, err = dh(&r.dhsPrivate, &r.dhr); err != nil {
+		return err
+	}
+	r.kdfRK(dhOut, &r.sendChainKey, &r.nhks)
+	r.hasSendChain = true
+	return nil
+}
+
+type doubleRatchetState struct {
+	RootInfo         []byte                 `json:"root_info"`
+	MessageInfo      []byte                 `json:"message_info"`
+	HeaderEncryption bool                   `json:"header_encryption,omitempty"`
+	DHsPrivate       []byte                 `json:"dhs_private"`
+	DHr              []byte                 `json:"dhr,omitempty"`
+	RootKey          []byte                 `json:"root_key"`
+	SendChainKey     []byte                 `json:"send_chain_key,omitempty"`
+	RecvChainKey     []byte                 `json:"recv_chain_key,omitempty"`
+	Ns               uint32                 `json:"ns,omitempty"`
+	Nr               uint32                 `json:"nr,omitempty"`
+	Pn               uint32                 `json:"pn,omitempty"`
+	HKs              []byte                 `json:"hks,omitempty"`
+	HKr              []byte                 `json:"hkr,omitempty"`
+	NHKs             []byte                 `json:"nhks,omitempty"`
+	NHKr             []byte                 `json:"nhkr,omitempty"`
+	Skipped          []doubleRatchetSkipped `json:"skipped,omitempty"`
+}
+
+type doubleRatchetSkipped struct {
+	Key        []byte `json:"key"`
+	Num        uint32 `json:"num"`
+	MessageKey []byte `json:"message_key"`
+}
+
+func dupIf(ok bool, key *[32]byte) []byte {
+	if !ok {
+		return nil
+	}
+	return dup(key)
+}
+
+func (r *DoubleRatchet) MarshalJSON() ([]byte, error) {
+	s := doubleRatchetState{
+		RootInfo:         r.rootInfo,
+		MessageInfo:      r.messageInfo,
+		HeaderEncryption: r.headerEncryption,
+		DHsPrivate:       dup(&r.dhsPrivate),
+		DHr:              dupIf(r.hasDHr, &r.dhr),
+		RootKey:          dup(&r.rootKey),
+		SendChainKey:     dupIf(r.hasSendChain, &r.sendChainKey),
+		RecvChainKey:     dupIf(r.hasRecvChain, &r.recvChainKey),
+		Ns:               r.ns,
+		Nr:               r.nr,
+		Pn:               r.pn,
+		HKs:              dupIf(r.hasHKs, &r.hks),
+		HKr:              dupIf(r.hasHKr, &r.hkr),
+		NHKs:             dupIf(r.headerEncryption, &r.nhks),
+		NHKr:             dupIf(r.headerEncryption, &r.nhkr),
+	}
+	for _, key := range r.skippedOrder {
+		messageKey := r.skipped[key]
+		s.Skipped = append(s.Skipped, doubleRatchetSkipped{
+			Key:        dup(&key.key),
+			Num:        key.n,
+			MessageKey: dup(&messageKey),
+		})
+	}
+	return json.Marshal(s)
+}
+
+// unmarshalOptionalKey is like unmarshalKey, but accepts an absent key.
+func unmarshalOptionalKey(dst *[32]byte, present *bool, src []byte) bool {
+	*present = len(src) > 0
+	return !*present || unmarshalKey(dst, src)
+}
+
+func (r *DoubleRatchet) UnmarshalJSON(in []byte) error {
+	var s doubleRatchetState
+	if err := json.Unmarshal(in, &s); err != nil {
+		return err
+	}
+
+	var hasNHKs, hasNHKr bool
+	if !unmarshalKey(&r.dhsPrivate, s.DHsPrivate) ||
+		!unmarshalKey(&r.rootKey, s.RootKey) ||
+		!unmarshalOptionalKey(&r.dhr, &r.hasDHr, s.DHr) ||
+		!unmarshalOptionalKey(&r.sendChainKey, &r.hasSendChain, s.SendChainKey) ||
+		!unmarshalOptionalKey(&r.recvChainKey, &r.hasRecvChain, s.RecvChainKey) ||
+		!unmarshalOptionalKey(&r.hks, &r.hasHKs, s.HKs) ||
+		!unmarshalOptionalKey(&r.hkr, &r.hasHKr, s.HKr) ||
+		!unmarshalOptionalKey(&r.nhks, &hasNHKs, s.NHKs) ||
+		!unmarshalOptionalKey(&r.nhkr, &hasNHKr, s.NHKr) {
+		return badSerialisedKeyLengthErr
+	}
+	public, err := curve25519.X25519(r.dhsPrivate[:], curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	copy(r.dhsPublic[:], public)
+
+	r.rootInfo = s.RootInfo
+	r.messageInfo = s.MessageInfo
+	r.headerEncryption = s.HeaderEncryption
+	r.ns, r.nr, r.pn = s.Ns, s.Nr, s.Pn
+	r.skipped = make(map[skippedMessage][32]byte, len(s.Skipped))
+	r.skippedOrder = nil
+	for _, skipped := range s.Skipped {
+		var key skippedMessage
+		var messageKey [32]byte
+		if !unmarshalKey(&key.key, skipped.Key) || !unmarshalKey(&messageKey, skipped.MessageKey) {
+			return badSerialisedKeyLengthErr
+		}
+		key.n = skipped.Num
+		r.addSkipped(key, messageKey)
+	}
+	return nil
+}
+
+// SetRand sets the source of randomness of a DoubleRatchet restored with
+// UnmarshalJSON.
+func (r *DoubleRatchet) SetRand(rand io.Reader) {
+	r.rand = rand
+}
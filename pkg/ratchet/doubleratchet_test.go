@@ -0,0 +1,372 @@
+package ratchet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// The vectors in testdata/doubleratchet_kdf.json are checked against an
+// independent implementation of the KDFs recommended by the spec, using
+// the libsignal info strings, and the X25519 vector is the one of RFC
+// 7748. libsignal doesn't publish vectors for whole messages, and wraps
+// them in protobufs that DoubleRatchet doesn't produce, so the
+// conversations in testdata/doubleratchet_messages.json come from the
+// same implementation, testdata/doubleratchet_gen.py: a Python version of
+// sections 3 and 4 of the spec, with its own AES, GCM and X25519 checked
+// against FIPS 197, the GCM spec and RFC 7748, serializing messages as
+// DoubleRatchet documents.
+type drVectors struct {
+	RootInfo    string `json:"root_info"`
+	MessageInfo string `json:"message_info"`
+	X25519      struct {
+		AlicePrivate hexBytes `json:"alice_private"`
+		AlicePublic  hexBytes `json:"alice_public"`
+		BobPrivate   hexBytes `json:"bob_private"`
+		BobPublic    hexBytes `json:"bob_public"`
+		Shared       hexBytes `json:"shared"`
+	} `json:"x25519"`
+	KDF []struct {
+		RootKey  hexBytes `json:"root_key"`
+		DHOutput hexBytes `json:"dh_output"`
+		KDFRK    struct {
+			RootKey  hexBytes `json:"root_key"`
+			ChainKey hexBytes `json:"chain_key"`
+		} `json:"kdf_rk"`
+		KDFRKHE struct {
+			RootKey       hexBytes `json:"root_key"`
+			ChainKey      hexBytes `json:"chain_key"`
+			NextHeaderKey hexBytes `json:"next_header_key"`
+		} `json:"kdf_rk_he"`
+		ChainKey hexBytes `json:"chain_key"`
+		KDFCK    struct {
+			MessageKey hexBytes `json:"message_key"`
+			ChainKey   hexBytes `json:"chain_key"`
+		} `json:"kdf_ck"`
+		MessageKey  hexBytes `json:"message_key"`
+		MessageKeys struct {
+			EncryptionKey     hexBytes `json:"encryption_key"`
+			AuthenticationKey hexBytes `json:"authentication_key"`
+			IV                hexBytes `json:"iv"`
+		} `json:"message_keys"`
+	} `json:"kdf"`
+}
+
+type hexBytes []byte
+
+func (h *hexBytes) UnmarshalJSON(in []byte) error {
+	var s string
+	if err := json.Unmarshal(in, &s); err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(s)
+	*h = b
+	return err
+}
+
+func key32(b []byte) (k [32]byte) {
+	copy(k[:], b)
+	return
+}
+
+func TestDoubleRatchetVectors(t *testing.T) {
+	in, err := ioutil.ReadFile("testdata/doubleratchet_kdf.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v drVectors
+	if err := json.Unmarshal(in, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := NewDoubleRatchetBob(rand.Reader, [32]byte{}, key32(v.X25519.AlicePrivate), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(alice.dhsPublic[:], v.X25519.AlicePublic) {
+		t.Fatalf("bad public key %x", alice.dhsPublic)
+	}
+	bobPublic := key32(v.X25519.BobPublic)
+	shared, err := dh(&alice.dhsPrivate, &bobPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(shared, v.X25519.Shared) {
+		t.Fatalf("bad shared key %x", shared)
+	}
+
+	for i, test := range v.KDF {
+		var chainKey, nextHeaderKey [32]byte
+		r := newDoubleRatchet(rand.Reader, key32(test.RootKey), &DoubleRatchetConfig{RootInfo: []byte(v.RootInfo), MessageInfo: []byte(v.MessageInfo)})
+		r.kdfRK(append([]byte(nil), test.DHOutput...), &chainKey, &nextHeaderKey)
+		if !bytes.Equal(r.rootKey[:], test.KDFRK.RootKey) || !bytes.Equal(chainKey[:], test.KDFRK.ChainKey) {
+			t.Fatalf("#%d: bad KDF_RK output %x %x", i, r.rootKey, chainKey)
+		}
+
+		r = newDoubleRatchet(rand.Reader, key32(test.RootKey), &DoubleRatchetConfig{HeaderEncryption: true})
+		r.kdfRK(append([]byte(nil), test.DHOutput...), &chainKey, &nextHeaderKey)
+		if !bytes.Equal(r.rootKey[:], test.KDFRKHE.RootKey) || !bytes.Equal(chainKey[:], test.KDFRKHE.ChainKey) || !bytes.Equal(nextHeaderKey[:], test.KDFRKHE.NextHeaderKey) {
+			t.Fatalf("#%d: bad KDF_RK output with header encryption %x %x %x", i, r.rootKey, chainKey, nextHeaderKey)
+		}
+
+		chainKey = key32(test.ChainKey)
+		messageKey := kdfCK(&chainKey)
+		if !bytes.Equal(messageKey[:], test.KDFCK.MessageKey) || !bytes.Equal(chainKey[:], test.KDFCK.ChainKey) {
+			t.Fatalf("#%d: bad KDF_CK output %x %x", i, messageKey, chainKey)
+		}
+
+		messageKey = key32(test.MessageKey)
+		encKey, authKey, iv := r.messageKeys(&messageKey, new([80]byte))
+		if !bytes.Equal(encKey, test.MessageKeys.EncryptionKey) || !bytes.Equal(authKey, test.MessageKeys.AuthenticationKey) || !bytes.Equal(iv, test.MessageKeys.IV) {
+			t.Fatalf("#%d: bad message keys %x %x %x", i, encKey, authKey, iv)
+		}
+	}
+}
+
+// drConversation is a conversation between Alice and Bob: messages are
+// encrypted in order, and delivered in the order of the decrypt events.
+// The randomness each party draws, for ratchet keys and header nonces, is
+// given.
+type drConversation struct {
+	Description         string   `json:"description"`
+	HeaderEncryption    bool     `json:"header_encryption"`
+	SharedKey           hexBytes `json:"shared_key"`
+	BobPrivate          hexBytes `json:"bob_private"`
+	SharedHeaderKey     hexBytes `json:"shared_header_key"`
+	SharedNextHeaderKey hexBytes `json:"shared_next_header_key"`
+	AssociatedData      hexBytes `json:"associated_data"`
+	AliceRandom         hexBytes `json:"alice_random"`
+	BobRandom           hexBytes `json:"bob_random"`
+	Messages            []struct {
+		Sender     string   `json:"sender"`
+		Plaintext  hexBytes `json:"plaintext"`
+		Ciphertext hexBytes `json:"ciphertext"`
+	} `json:"messages"`
+	Events []struct {
+		Encrypt *int `json:"encrypt"`
+		Decrypt *int `json:"decrypt"`
+	} `json:"events"`
+}
+
+func TestDoubleRatchetMessageVectors(t *testing.T) {
+	in, err := ioutil.ReadFile("testdata/doubleratchet_messages.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conversations []drConversation
+	if err := json.Unmarshal(in, &conversations); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range conversations {
+		config := &DoubleRatchetConfig{
+			HeaderEncryption:    c.HeaderEncryption,
+			SharedHeaderKey:     key32(c.SharedHeaderKey),
+			SharedNextHeaderKey: key32(c.SharedNextHeaderKey),
+		}
+		bobPublic, err := curve25519.X25519(c.BobPrivate, curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aliceRand, bobRand := bytes.NewReader(c.AliceRandom), bytes.NewReader(c.BobRandom)
+		alice, err := NewDoubleRatchetAlice(aliceRand, key32(c.SharedKey), key32(bobPublic), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob, err := NewDoubleRatchetBob(bobRand, key32(c.SharedKey), key32(c.BobPrivate), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parties := map[string]*DoubleRatchet{"alice": alice, "bob": bob}
+		peers := map[string]*DoubleRatchet{"alice": bob, "bob": alice}
+
+		for _, e := range c.Events {
+			if e.Encrypt != nil {
+				m := c.Messages[*e.Encrypt]
+				ciphertext, err := parties[m.Sender].Encrypt(m.Plaintext, c.AssociatedData)
+				if err != nil {
+					t.Fatalf("%s: message %d: %v", c.Description, *e.Encrypt, err)
+				}
+				if !bytes.Equal(ciphertext, m.Ciphertext) {
+					t.Fatalf("%s: message %d: bad ciphertext %x", c.Description, *e.Encrypt, ciphertext)
+				}
+				continue
+			}
+			m := c.Messages[*e.Decrypt]
+			plaintext, err := peers[m.Sender].Decrypt(m.Ciphertext, c.AssociatedData)
+			if err != nil {
+				t.Fatalf("%s: message %d: %v", c.Description, *e.Decrypt, err)
+			}
+			if !bytes.Equal(plaintext, m.Plaintext) {
+				t.Fatalf("%s: message %d: bad plaintext %x", c.Description, *e.Decrypt, plaintext)
+			}
+		}
+		if aliceRand.Len() != 0 || bobRand.Len() != 0 {
+			t.Fatalf("%s: randomness left over", c.Description)
+		}
+	}
+}
+
+func pairedDoubleRatchets(t *testing.T, config *DoubleRatchetConfig) (alice, bob *DoubleRatchet) {
+	var sharedKey, bobPrivate [32]byte
+	io.ReadFull(rand.Reader, sharedKey[:])
+	io.ReadFull(rand.Reader, bobPrivate[:])
+	bobPublic, err := curve25519.X25519(bobPrivate[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err = NewDoubleRatchetAlice(rand.Reader, sharedKey, key32(bobPublic), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = NewDoubleRatchetBob(rand.Reader, sharedKey, bobPrivate, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+func reinitDoubleRatchet(t *testing.T, r *DoubleRatchet) *DoubleRatchet {
+	state, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newR := new(DoubleRatchet)
+	if err := json.Unmarshal(state, newR); err != nil {
+		t.Fatal(err)
+	}
+	newR.SetRand(rand.Reader)
+	return newR
+}
+
+func TestDoubleRatchet(t *testing.T) {
+	for _, config := range []*DoubleRatchetConfig{
+		nil,
+		{HeaderEncryption: true, SharedHeaderKey: [32]byte{1}, SharedNextHeaderKey: [32]byte{2}},
+	} {
+		alice, bob := pairedDoubleRatchets(t, config)
+		if _, err := bob.Encrypt([]byte("too early"), nil); err != ErrHandshakeNotComplete {
+			t.Fatalf("expected ErrHandshakeNotComplete, got %v", err)
+		}
+
+		ad := []byte("alice and bob")
+		var delayed [][]byte
+		for round := 0; round < 4; round++ {
+			for i := 0; i < 3; i++ {
+				msg := []byte{byte(round), byte(i)}
+				encrypted, err := alice.Encrypt(msg, ad)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i == 1 {
+					delayed = append(delayed, encrypted)
+					continue
+				}
+				bob = reinitDoubleRatchet(t, bob)
+				result, err := bob.Decrypt(encrypted, ad)
+				if err != nil {
+					t.Fatalf("round %d, message %d: %s", round, i, err)
+				}
+				if !bytes.Equal(result, msg) {
+					t.Fatalf("bad message: got %x, not %x", result, msg)
+				}
+			}
+			alice, bob = bob, alice
+		}
+
+		// Delayed messages come from both sides and from old chains
+		for i, encrypted := range delayed {
+			receiver := bob
+			if i%2 == 1 {
+				receiver = alice
+			}
+			result, err := receiver.Decrypt(encrypted, ad)
+			if err != nil {
+				t.Fatalf("delayed message %d: %s", i, err)
+			}
+			if !bytes.Equal(result, []byte{byte(i), 1}) {
+				t.Fatalf("bad delayed message: got %x", result)
+			}
+			if _, err := receiver.Decrypt(encrypted, ad); err == nil {
+				t.Fatalf("delayed message %d decrypted twice", i)
+			}
+		}
+	}
+}
+
+func TestDoubleRatchetSkippedLimit(t *testing.T) {
+	for _, config := range []*DoubleRatchetConfig{nil, {HeaderEncryption: true}} {
+		alice, bob := pairedDoubleRatchets(t, config)
+
+		// Each round skips all but the last message of a new chain
+		var first [][]byte
+		for round := 0; round*maxSkip < maxSkippedKeys+maxSkip; round++ {
+			var encrypted []byte
+			for i := 0; i <= maxSkip; i++ {
+				var err error
+				if encrypted, err = alice.Encrypt([]byte{byte(i)}, nil); err != nil {
+					t.Fatal(err)
+				}
+				if i == 0 {
+					first = append(first, encrypted)
+				}
+			}
+			if _, err := bob.Decrypt(encrypted, nil); err != nil {
+				t.Fatalf("round %d: %s", round, err)
+			}
+			reply, err := bob.Encrypt(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := alice.Decrypt(reply, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(bob.skipped) != maxSkippedKeys || len(bob.skippedOrder) != maxSkippedKeys {
+			t.Fatalf("%d skipped keys kept, expected %d", len(bob.skipped), maxSkippedKeys)
+		}
+		if _, err := bob.Decrypt(first[0], nil); err == nil {
+			t.Fatal("the oldest skipped key wasn't forgotten")
+		}
+		bob = reinitDoubleRatchet(t, bob)
+		if _, err := bob.Decrypt(first[len(first)-1], nil); err != nil {
+			t.Fatalf("the newest skipped key was forgotten: %s", err)
+		}
+	}
+}
+
+func TestDoubleRatchetForgery(t *testing.T) {
+	for _, config := range []*DoubleRatchetConfig{nil, {HeaderEncryption: true}} {
+		alice, bob := pairedDoubleRatchets(t, config)
+		encrypted, err := alice.Encrypt([]byte("hello"), []byte("ad"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := bob.Decrypt(encrypted, []byte("other ad")); err == nil {
+			t.Fatal("message was accepted with the wrong associated data")
+		}
+		tampered := append([]byte(nil), encrypted...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err := bob.Decrypt(tampered, []byte("ad")); err == nil {
+			t.Fatal("tampered message was accepted")
+		}
+
+		// The failures didn't change the state
+		result, err := bob.Decrypt(encrypted, []byte("ad"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != "hello" {
+			t.Fatalf("bad message %q", result)
+		}
+	}
+}
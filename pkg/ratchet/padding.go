@@ -0,0 +1,99 @@
+package ratchet
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// Padding is a scheme to hide the length of messages. Whatever the
+// scheme, a padded message is the message followed by a 0x80 byte and as
+// many zero bytes as needed, so the receiver doesn't need to know which
+// scheme the sender uses.
+type Padding int
+
+const (
+	// PadPadme pads to the sizes described in "Reducing Metadata Leakage
+	// from Encrypted Files and Communication with PURBs": at most 12%
+	// overhead, and only O(log log L) bits of the length L leak.
+	PadPadme Padding = iota
+	// PadNone only adds the padding marker.
+	PadNone
+	// PadBuckets pads to the next power of two, starting at 64 bytes.
+	PadBuckets
+)
+
+func (p Padding) String() string {
+	switch p {
+	case PadNone:
+		return "none"
+	case PadPadme:
+		return "padme"
+	case PadBuckets:
+		return "buckets"
+	default:
+		return "unknown"
+	}
+}
+
+// ParsePadding returns the Padding named s, as returned by String.
+func ParsePadding(s string) (Padding, error) {
+	for _, p := range []Padding{PadNone, PadPadme, PadBuckets} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, errors.New("ratchet: unknown padding scheme")
+}
+
+// minBucketSize is the smallest size with PadBuckets.
+const minBucketSize = 64
+
+// paddedLen returns the size of a message of length l, marker included,
+// once padded.
+func (p Padding) paddedLen(l int) int {
+	switch p {
+	case PadPadme:
+		if l < 2 {
+			return l
+		}
+		e := bits.Len(uint(l)) - 1
+		s := bits.Len(uint(e))
+		mask := 1<<uint(e-s) - 1
+		return (l + mask) &^ mask
+	case PadBuckets:
+		size := minBucketSize
+		for size < l {
+			size *= 2
+		}
+		return size
+	default:
+		return l
+	}
+}
+
+// pad appends msg, padded according to p, to out.
+func (p Padding) pad(out, msg []byte) []byte {
+	out = append(out, msg...)
+	out = append(out, 0x80)
+	for n := p.paddedLen(len(msg) + 1); n > len(msg)+1; n-- {
+		out = append(out, 0)
+	}
+	return out
+}
+
+var errInvalidPadding = errors.New("ratchet: invalid padding")
+
+// unpad strips the padding from msg.
+func unpad(msg []byte) ([]byte, error) {
+	for i := len(msg) - 1; i >= 0; i-- {
+		switch msg[i] {
+		case 0:
+			continue
+		case 0x80:
+			return msg[:i], nil
+		default:
+			return nil, errInvalidPadding
+		}
+	}
+	return nil, errInvalidPadding
+}
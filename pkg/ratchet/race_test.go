@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package ratchet
+
+// The race detector makes allocations that AllocsPerRun would count.
+const raceEnabled = true
@@ -32,42 +32,65 @@ package ratchet
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"hash"
 	"io"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/curve25519"
-	"golang.org/x/crypto/nacl/secretbox"
 )
 
 const (
-	// headerSize is the size, in bytes, of a header's plaintext contents.
-	headerSize = 4 /* uint32 message count */ +
-		4 /* uint32 previous message count */ +
-		32 /* curve25519 ratchet public */ +
-		24 /* nonce for message */
-	// sealedHeader is the size, in bytes, of an encrypted header.
-	sealedHeaderSize = 24 /* nonce */ + headerSize + secretbox.Overhead
 	// nonceInHeaderOffset is the offset of the message nonce in the
 	// header's plaintext.
 	nonceInHeaderOffset = 4 + 4 + 32
 	// maxMissingMessages is the maximum number of missing messages that
 	// we'll keep track of.
 	maxMissingMessages = 8
+	// maxSavedChains is the maximum number of receiving chains whose
+	// missing messages we keep the keys of. Past that, the keys of the
+	// least recently used chain are forgotten.
+	maxSavedChains = 64
+	// maxSeenResets is the maximum number of replaced sessions whose key
+	// exchange we remember, see Follow.
+	maxSeenResets = 32
 )
 
 type KeyExchange struct {
 	IdentityPublic [32]byte `bencode:"identity"`
 	Dh             [32]byte `bencode:"dh"`
 	Dh1            [32]byte `bencode:"dh1"`
+	// Features is a bitmask of the optional Feature* supported by the
+	// sender. It is absent from the key exchange of older peers.
+	Features uint32 `bencode:"features"`
+	// Suites is a bitmask, indexed by Suite, of the cipher suites
+	// supported by the sender. It is absent from the key exchange of
+	// older peers, which only support SuiteLegacy.
+	Suites uint32 `bencode:"suites"`
+	// ResetMAC is set when the key exchange replaces an existing session
+	// between the peers, see Ratchet.MarkReset. It authenticates the key
+	// exchange with the identity keys of both peers. It is zero in other
+	// key exchanges.
+	ResetMAC [32]byte `bencode:"reset"`
 }
 
+// IsReset tells if the key exchange resets a previous session.
+func (k KeyExchange) IsReset() bool {
+	return !isZeroKey(&k.ResetMAC)
+}
+
+const (
+	// FeaturePadding means messages are padded, see Padding. It is used
+	// only if both peers support it.
+	FeaturePadding uint32 = 1 << iota
+)
+
+// supportedFeatures are the features advertised by new ratchets.
+const supportedFeatures = FeaturePadding
+
 // MarshalJSON makes the KeyExchange a json.Marshaler by hex-ing fields
 // before putting them in the json
 func (k KeyExchange) MarshalJSON() ([]byte, error) {
@@ -75,10 +98,18 @@ func (k KeyExchange) MarshalJSON() ([]byte, error) {
 		IdentityPublic string `json:"idpub"`
 		Dh             string `json:"dh"`
 		Dh1            string `json:"dh1"`
+		Features       uint32 `json:"features,omitempty"`
+		Suites         uint32 `json:"suites,omitempty"`
+		ResetMAC       string `json:"reset,omitempty"`
 	}{
 		IdentityPublic: hex.EncodeToString(k.IdentityPublic[:]),
 		Dh:             hex.EncodeToString(k.Dh[:]),
 		Dh1:            hex.EncodeToString(k.Dh1[:]),
+		Features:       k.Features,
+		Suites:         k.Suites,
+	}
+	if k.IsReset() {
+		hexified.ResetMAC = hex.EncodeToString(k.ResetMAC[:])
 	}
 
 	return json.Marshal(hexified)
@@ -91,6 +122,9 @@ func (k *KeyExchange) UnmarshalJSON(in []byte) error {
 		IdentityPublic string `json:"idpub"`
 		Dh             string `json:"dh"`
 		Dh1            string `json:"dh1"`
+		Features       uint32 `json:"features"`
+		Suites         uint32 `json:"suites"`
+		ResetMAC       string `json:"reset"`
 	}
 	var h hexified
 	err := json.Unmarshal(in, &h)
@@ -110,19 +144,132 @@ func (k *KeyExchange) UnmarshalJSON(in []byte) error {
 	if err != nil {
 		return err
 	}
+	resetMAC, err := hex.DecodeString(h.ResetMAC)
+	if err != nil {
+		return err
+	}
 
 	copy(k.IdentityPublic[:], idpub)
 	copy(k.Dh[:], dh)
 	copy(k.Dh1[:], dh1)
+	k.Features = h.Features
+	k.Suites = h.Suites
+	if len(resetMAC) != 0 && len(resetMAC) != resetMACSize {
+		return errors.New("ratchet: invalid reset MAC")
+	}
+	k.ResetMAC = [32]byte{}
+	copy(k.ResetMAC[:], resetMAC)
+
+	return nil
+}
+
+// The binary form of a KeyExchange is:
+//
+//	type | version | flags | features (4) | identity | dh | dh1 | sections
+//
+// Integers are big endian. Each bit set in flags announces an optional
+// section, appended in the order of the bits and prefixed with its
+// length on two bytes, so that decoders can skip the sections they don't
+// know about. The first bits are reserved for signatures and prekeys.
+const (
+	binaryKeyExchangeType    = 0x4b // 'K'
+	binaryKeyExchangeVersion = 1
+
+	kxFlagSignature = 1 << 0
+	kxFlagPrekey    = 1 << 1
+	// kxFlagSuites announces the Suites, on 4 bytes.
+	kxFlagSuites = 1 << 2
+	// kxFlagReset announces the ResetMAC, on 32 bytes.
+	kxFlagReset = 1 << 3
+)
+
+// binaryKeyExchangeSize is the size of the fixed part of a KeyExchange in
+// binary form.
+const binaryKeyExchangeSize = 1 /* type */ + 1 /* version */ + 1 /* flags */ + 4 /* features */ + 3*32
+
+var errInvalidBinaryKeyExchange = errors.New("ratchet: invalid binary key exchange")
+
+// MarshalBinary makes the KeyExchange an encoding.BinaryMarshaler. The
+// binary form is much more compact than the JSON one.
+func (k KeyExchange) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 7, binaryKeyExchangeSize)
+	out[0] = binaryKeyExchangeType
+	out[1] = binaryKeyExchangeVersion
+	binary.BigEndian.PutUint32(out[3:7], k.Features)
+	out = append(out, k.IdentityPublic[:]...)
+	out = append(out, k.Dh[:]...)
+	out = append(out, k.Dh1[:]...)
+	if k.Suites != 0 {
+		out[2] |= kxFlagSuites
+		out = append(out, 0, 4, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(out[len(out)-4:], k.Suites)
+	}
+	if k.IsReset() {
+		out[2] |= kxFlagReset
+		out = append(out, 0, resetMACSize)
+		out = append(out, k.ResetMAC[:]...)
+	}
+	return out, nil
+}
 
+// UnmarshalBinary makes the *KeyExchange an encoding.BinaryUnmarshaler.
+func (k *KeyExchange) UnmarshalBinary(in []byte) error {
+	if len(in) < binaryKeyExchangeSize || in[0] != binaryKeyExchangeType || in[1] != binaryKeyExchangeVersion {
+		return errInvalidBinaryKeyExchange
+	}
+	flags := in[2]
+	k.Features = binary.BigEndian.Uint32(in[3:7])
+	copy(k.IdentityPublic[:], in[7:39])
+	copy(k.Dh[:], in[39:71])
+	copy(k.Dh1[:], in[71:103])
+
+	k.Suites = 0
+	k.ResetMAC = [32]byte{}
+
+	// Read the optional sections, skipping the unknown ones
+	in = in[binaryKeyExchangeSize:]
+	for ; flags != 0; flags &= flags - 1 {
+		if len(in) < 2 {
+			return errInvalidBinaryKeyExchange
+		}
+		n := int(binary.BigEndian.Uint16(in))
+		if len(in) < 2+n {
+			return errInvalidBinaryKeyExchange
+		}
+		section := in[2 : 2+n]
+		in = in[2+n:]
+
+		// The lowest bit set is the flag of this section
+		switch flags & -flags {
+		case kxFlagSuites:
+			if n != 4 {
+				return errInvalidBinaryKeyExchange
+			}
+			k.Suites = binary.BigEndian.Uint32(section)
+		case kxFlagReset:
+			if n != resetMACSize {
+				return errInvalidBinaryKeyExchange
+			}
+			copy(k.ResetMAC[:], section)
+		}
+	}
+	if len(in) != 0 {
+		return errInvalidBinaryKeyExchange
+	}
 	return nil
 }
 
-// Ratchet contains the per-contact, crypto state.
+// Ratchet contains the per-contact, crypto state. Its methods are safe for
+// concurrent use.
 type Ratchet struct {
+	// mu protects all the fields below.
+	mu sync.Mutex
+
 	// myIdentityPrivate and TheirIdentityPublic contain the primary,
 	// curve25519 identity keys.
 	myIdentityPrivate, theirIdentityPublic [32]byte
+	// myIdentityPublic is computed from myIdentityPrivate.
+	myIdentityPublic [32]byte
 
 	// rootKey gets updated by the DH ratchet.
 	rootKey [32]byte
@@ -132,28 +279,66 @@ type Ratchet struct {
 	// Chain keys are used for forward secrecy updating.
 	sendChainKey, recvChainKey            [32]byte
 	sendRatchetPrivate, recvRatchetPublic [32]byte
-	sendCount, recvCount                  uint32
-	prevSendCount                         uint32
+	// sendRatchetPublic is computed from sendRatchetPrivate.
+	sendRatchetPublic    [32]byte
+	sendCount, recvCount uint32
+	prevSendCount        uint32
 	// ratchet is true if we will send a new ratchet value in the next message.
 	ratchet bool
 
-	// saved is a map from a header key to a map from sequence number to
-	// message key.
-	saved map[[32]byte]map[uint32]savedKey
+	// saved holds the keys of missing messages by receiving chain, most
+	// recently used first.
+	saved []savedChain
 
 	// kxPrivate0 and kxPrivate1 contain curve25519 private values during
-	// the key exchange phase.
+	// the key exchange phase. They are wiped and set to nil once it is
+	// complete.
 	kxPrivate0, kxPrivate1 *[32]byte
+	// kxPublic0 and kxPublic1 are their public values, kept so that our
+	// key exchange can be sent again until the peer confirms it.
+	kxPublic0, kxPublic1 [32]byte
 
 	// isHandshakeComplete tells if the key exchange was completed in
 	// both directions
 	isHandshakeComplete bool
 
+	// kxFeatures are the features we advertise in our key exchange.
+	// Ratchets created by older versions advertised none.
+	kxFeatures uint32
+	// padded is true if both peers support FeaturePadding.
+	padded bool
+	// padding is the scheme used to pad our messages, if padded.
+	padding Padding
+
+	// kxSuites are the suites we advertise in our key exchange. Ratchets
+	// created by older versions advertised none.
+	kxSuites uint32
+	// suite is the suite negotiated with the peer.
+	suite Suite
+	// amAlice is true if we were Alice in the key exchange.
+	amAlice bool
+	// reset is true if our key exchange resets a previous session with
+	// theirIdentityPublic, see MarkReset.
+	reset bool
+	// peerReset is true if the key exchange that completed the ratchet
+	// was a reset from the peer.
+	peerReset bool
+	// theirKxPublic0 is the first DH value of the key exchange that
+	// completed the ratchet, so that it isn't taken for a new reset when
+	// received again.
+	theirKxPublic0 [32]byte
+	// seenResets are the first DH values of the key exchanges that
+	// created the last sessions this one replaced, oldest first, see
+	// Follow.
+	seenResets [][32]byte
+
 	rand io.Reader
 }
 
 // MyPriv returns the hex-encoded private DH key
 func (r *Ratchet) MyPriv() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	return hex.EncodeToString(r.myIdentityPrivate[:])
 }
 
@@ -165,53 +350,119 @@ type savedKey struct {
 	timestamp time.Time
 }
 
-func (r *Ratchet) randBytes(buf []byte) {
-	if _, err := io.ReadFull(r.rand, buf); err != nil {
-		panic(err)
-	}
+// savedChain contains the saved keys of a receiving chain, indexed by
+// message number.
+type savedChain struct {
+	headerKey [32]byte
+	keys      map[uint32]savedKey
 }
 
-func New(rand io.Reader, myPriv [32]byte) *Ratchet {
+func (r *Ratchet) randBytes(buf []byte) error {
+	_, err := io.ReadFull(r.rand, buf)
+	return err
+}
+
+// New returns a Ratchet for the identity private key myPriv, ready for the
+// key exchange. The error, if any, comes from rand.
+func New(rand io.Reader, myPriv [32]byte) (*Ratchet, error) {
 	r := &Ratchet{
 		rand:              rand,
 		kxPrivate0:        new([32]byte),
 		kxPrivate1:        new([32]byte),
-		saved:             make(map[[32]byte]map[uint32]savedKey),
 		myIdentityPrivate: myPriv,
+		kxFeatures:        supportedFeatures,
+		kxSuites:          supportedSuites,
 	}
 
-	r.randBytes(r.kxPrivate0[:])
-	r.randBytes(r.kxPrivate1[:])
+	curve25519.ScalarBaseMult(&r.myIdentityPublic, &r.myIdentityPrivate)
+	if err := r.randBytes(r.kxPrivate0[:]); err != nil {
+		return nil, err
+	}
+	if err := r.randBytes(r.kxPrivate1[:]); err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&r.kxPublic0, r.kxPrivate0)
+	curve25519.ScalarBaseMult(&r.kxPublic1, r.kxPrivate1)
 
-	return r
+	return r, nil
 }
 
 // GetKeyExchangeMaterial returns key exchange information from the
 // ratchet.
 func (r *Ratchet) GetKeyExchangeMaterial() (kx KeyExchange, err error) {
-
-	var public0, public1, myIdentity [32]byte
-	curve25519.ScalarBaseMult(&public0, r.kxPrivate0)
-	curve25519.ScalarBaseMult(&public1, r.kxPrivate1)
-	curve25519.ScalarBaseMult(&myIdentity, &r.myIdentityPrivate)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if isZeroKey(&r.kxPublic0) || isZeroKey(&r.kxPublic1) {
+		return kx, errors.New("ratchet: key exchange material is gone")
+	}
 
 	kx = KeyExchange{
-		IdentityPublic: myIdentity,
-		Dh:             public0,
-		Dh1:            public1,
+		IdentityPublic: r.myIdentityPublic,
+		Dh:             r.kxPublic0,
+		Dh1:            r.kxPublic1,
+		Features:       r.kxFeatures,
+		Suites:         r.kxSuites,
+	}
+	if r.reset {
+		err = resetMAC(&kx.ResetMAC, &r.myIdentityPrivate, &r.theirIdentityPublic, &kx)
 	}
 
 	return
 }
 
-// deriveKey takes an HMAC object and a label and calculates out = HMAC(k, label).
-func deriveKey(out *[32]byte, label []byte, h hash.Hash) {
-	h.Reset()
-	h.Write(label)
-	n := h.Sum(out[:0])
-	if &n[0] != &out[0] {
-		panic("hash function too large")
+// Suite returns the cipher suite negotiated with the peer. It is only
+// meaningful once the key exchange is complete.
+func (r *Ratchet) Suite() Suite {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.suite
+}
+
+func (r *Ratchet) cipherSuite() *cipherSuite {
+	return cipherSuites[r.suite]
+}
+
+// SetPadding sets the scheme used to pad the messages we send. It has no
+// effect if the peer doesn't support padding.
+func (r *Ratchet) SetPadding(p Padding) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.padding = p
+}
+
+// Padding returns the padding scheme, and whether messages are padded at
+// all.
+func (r *Ratchet) Padding() (p Padding, padded bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.padding, r.padded
+}
+
+// SentWithoutRatchet returns the number of messages encrypted since our
+// last DH ratchet step. A DH ratchet step only happens when we encrypt
+// after having received a message from the peer, so this grows for as
+// long as the peer doesn't reply; all those messages are encrypted with
+// keys derived from the same DH output.
+func (r *Ratchet) SentWithoutRatchet() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ratchet {
+		// Our next message will start a new chain.
+		return 0
 	}
+	return r.sendCount
+}
+
+// ReceivedWithoutReply returns the number of messages received on the
+// peer's current chain that we haven't replied to. Replying lets the peer
+// perform a DH ratchet step.
+func (r *Ratchet) ReceivedWithoutReply() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.ratchet {
+		return 0
+	}
+	return r.recvCount
 }
 
 // These constants are used as the label argument to deriveKey to derive
@@ -230,15 +481,97 @@ var (
 var ErrHandshakeComplete = errors.New("ratchet: handshake already complete")
 var ErrHandshakeNotComplete = errors.New("ratchet: handshake not complete yet")
 
+// ErrDuplicateMessage is returned by Decrypt for a message of the current
+// receiving chain that was already decrypted, or whose key expired.
+var ErrDuplicateMessage = errors.New("ratchet: duplicate message or message delayed longer than tolerance")
+
+// ErrCannotDecrypt is returned by Decrypt when no key of the session opens
+// the header of a message, or when it is of another cipher suite: it was
+// sent by another session, or our state is older than the peer's.
+var ErrCannotDecrypt = errors.New("ratchet: cannot decrypt")
+
+// ErrInvalidPublicKey is returned when a public key from the peer is of low
+// order, which would make the result of DH with it predictable.
+var ErrInvalidPublicKey = errors.New("ratchet: invalid public key")
+
+// lowOrderScalar, once clamped, is a multiple of the order of every low
+// order point, and of no other.
+var lowOrderScalar = [32]byte{1}
+
+// validPublicKey returns false if public is a point of low order, with
+// which DH gives zero whatever the private key.
+func validPublicKey(public *[32]byte) bool {
+	var out [32]byte
+	curve25519.ScalarMult(&out, &lowOrderScalar, public)
+	return !isZeroKey(&out)
+}
+
+// dhShared sets out to the DH of private and public. It fails with
+// ErrInvalidPublicKey if the result is zero, because public is of low
+// order.
+func dhShared(out, private, public *[32]byte) error {
+	curve25519.ScalarMult(out, private, public)
+	if isZeroKey(out) {
+		return ErrInvalidPublicKey
+	}
+	return nil
+}
+
+// HandshakeState tells how far along the key exchange a Ratchet is.
+type HandshakeState int
+
+const (
+	// AwaitingKeyExchange means we haven't received the peer's key
+	// exchange material yet; nothing can be encrypted or decrypted.
+	AwaitingKeyExchange HandshakeState = iota
+	// HandshakeUnconfirmed means the key exchange is complete on our
+	// side, but we don't know if the peer has completed it on theirs.
+	// Messages can be sent, but the peer may need our key exchange
+	// material again.
+	HandshakeUnconfirmed
+	// HandshakeConfirmed means we have decrypted at least one message
+	// from the peer, so they have completed the key exchange as well.
+	HandshakeConfirmed
+)
+
+func (s HandshakeState) String() string {
+	switch s {
+	case AwaitingKeyExchange:
+		return "awaiting key exchange"
+	case HandshakeUnconfirmed:
+		return "handshake unconfirmed"
+	case HandshakeConfirmed:
+		return "handshake confirmed"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns the current HandshakeState of the ratchet.
+func (r *Ratchet) State() HandshakeState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case !r.isHandshakeComplete:
+		return AwaitingKeyExchange
+	case r.recvCount == 0:
+		// Every successful Decrypt leaves recvCount strictly positive
+		return HandshakeUnconfirmed
+	default:
+		return HandshakeConfirmed
+	}
+}
+
 // CompleteKeyExchange takes a KeyExchange message from the other party and
 // establishes the ratchet.
 func (r *Ratchet) CompleteKeyExchange(kx KeyExchange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.isHandshakeComplete {
 		return ErrHandshakeComplete
 	}
 
-	var public0 [32]byte
-	curve25519.ScalarBaseMult(&public0, r.kxPrivate0)
+	public0 := r.kxPublic0
 
 	if len(kx.Dh) != len(public0) {
 		return errors.New("ratchet: peer's key exchange is invalid")
@@ -247,13 +580,18 @@ func (r *Ratchet) CompleteKeyExchange(kx KeyExchange) error {
 		return errors.New("ratchet: peer using old-form key exchange")
 	}
 
-	var myIdentity [32]byte
-	curve25519.ScalarBaseMult(&myIdentity, &r.myIdentityPrivate)
-
-	if len(kx.IdentityPublic) != len(myIdentity) {
+	if len(kx.IdentityPublic) != len(r.myIdentityPublic) {
 		return errors.New("Invalid identity length")
 	}
-	copy(r.theirIdentityPublic[:], kx.IdentityPublic[:])
+	for _, public := range []*[32]byte{&kx.IdentityPublic, &kx.Dh, &kx.Dh1} {
+		if !validPublicKey(public) {
+			return ErrInvalidPublicKey
+		}
+	}
+	if r.reset && kx.IdentityPublic != r.theirIdentityPublic {
+		return ErrInvalidReset
+	}
+	theirIdentity := kx.IdentityPublic
 
 	var amAlice bool
 	switch bytes.Compare(public0[:], []byte(kx.Dh[:])) {
@@ -269,151 +607,263 @@ func (r *Ratchet) CompleteKeyExchange(kx KeyExchange) error {
 	copy(theirDH[:], kx.Dh[:])
 
 	keyMaterial := make([]byte, 0, 32*5)
+	defer wipe(keyMaterial[:cap(keyMaterial)])
 	var sharedKey [32]byte
-	curve25519.ScalarMult(&sharedKey, r.kxPrivate0, &theirDH)
+	defer wipe(sharedKey[:])
+	if err := dhShared(&sharedKey, r.kxPrivate0, &theirDH); err != nil {
+		return err
+	}
 	keyMaterial = append(keyMaterial, sharedKey[:]...)
 
 	if amAlice {
-		curve25519.ScalarMult(&sharedKey, &r.myIdentityPrivate, &theirDH)
+		if err := dhShared(&sharedKey, &r.myIdentityPrivate, &theirDH); err != nil {
+			return err
+		}
 		keyMaterial = append(keyMaterial, sharedKey[:]...)
-		curve25519.ScalarMult(&sharedKey, r.kxPrivate0, &r.theirIdentityPublic)
+		if err := dhShared(&sharedKey, r.kxPrivate0, &theirIdentity); err != nil {
+			return err
+		}
 		keyMaterial = append(keyMaterial, sharedKey[:]...)
 	} else {
-		curve25519.ScalarMult(&sharedKey, r.kxPrivate0, &r.theirIdentityPublic)
+		if err := dhShared(&sharedKey, r.kxPrivate0, &theirIdentity); err != nil {
+			return err
+		}
 		keyMaterial = append(keyMaterial, sharedKey[:]...)
-		curve25519.ScalarMult(&sharedKey, &r.myIdentityPrivate, &theirDH)
+		if err := dhShared(&sharedKey, &r.myIdentityPrivate, &theirDH); err != nil {
+			return err
+		}
 		keyMaterial = append(keyMaterial, sharedKey[:]...)
 	}
 
-	h := hmac.New(sha256.New, keyMaterial)
-	deriveKey(&r.rootKey, rootKeyLabel, h)
+	// The key exchange is valid: nothing changed before this point
+	r.theirIdentityPublic = theirIdentity
+	r.theirKxPublic0 = kx.Dh
+	r.peerReset = kx.IsReset()
+	r.suite = negotiateSuite(r.kxSuites, kx.Suites)
+	cs := r.cipherSuite()
+	sc := getScratch()
+	defer putScratch(sc)
+	var prk [32]byte
+	defer wipe(prk[:])
+	keyMaterial = cs.handshakeSecret(sc, &prk, keyMaterial)
+	cs.deriveKey(sc, &r.rootKey, keyMaterial, rootKeyLabel)
 	if amAlice {
-		deriveKey(&r.recvHeaderKey, headerKeyLabel, h)
-		deriveKey(&r.nextSendHeaderKey, sendHeaderKeyLabel, h)
-		deriveKey(&r.nextRecvHeaderKey, nextRecvHeaderKeyLabel, h)
-		deriveKey(&r.recvChainKey, chainKeyLabel, h)
+		cs.deriveKey(sc, &r.recvHeaderKey, keyMaterial, headerKeyLabel)
+		cs.deriveKey(sc, &r.nextSendHeaderKey, keyMaterial, sendHeaderKeyLabel)
+		cs.deriveKey(sc, &r.nextRecvHeaderKey, keyMaterial, nextRecvHeaderKeyLabel)
+		cs.deriveKey(sc, &r.recvChainKey, keyMaterial, chainKeyLabel)
 		copy(r.recvRatchetPublic[:], kx.Dh1[:])
 	} else {
-		deriveKey(&r.sendHeaderKey, headerKeyLabel, h)
-		deriveKey(&r.nextRecvHeaderKey, sendHeaderKeyLabel, h)
-		deriveKey(&r.nextSendHeaderKey, nextRecvHeaderKeyLabel, h)
-		deriveKey(&r.sendChainKey, chainKeyLabel, h)
+		cs.deriveKey(sc, &r.sendHeaderKey, keyMaterial, headerKeyLabel)
+		cs.deriveKey(sc, &r.nextRecvHeaderKey, keyMaterial, sendHeaderKeyLabel)
+		cs.deriveKey(sc, &r.nextSendHeaderKey, keyMaterial, nextRecvHeaderKeyLabel)
+		cs.deriveKey(sc, &r.sendChainKey, keyMaterial, chainKeyLabel)
 		copy(r.sendRatchetPrivate[:], r.kxPrivate1[:])
+		curve25519.ScalarBaseMult(&r.sendRatchetPublic, &r.sendRatchetPrivate)
 	}
 
 	r.ratchet = amAlice
+	r.amAlice = amAlice
 	r.isHandshakeComplete = true
+	r.padded = r.kxFeatures&kx.Features&FeaturePadding != 0
+	r.wipeKeyExchange()
 
 	return nil
 }
 
-// Encrypt acts like append() but appends an encrypted version of msg to
-// out. If the handshake is not complete yet, the error will be
-// ErrHandshakeNotComplete; otherwise it is nil.
+// wipeKeyExchange drops the private values of the key exchange.
+func (r *Ratchet) wipeKeyExchange() {
+	if r.kxPrivate0 != nil {
+		wipe(r.kxPrivate0[:])
+	}
+	if r.kxPrivate1 != nil {
+		wipe(r.kxPrivate1[:])
+	}
+	r.kxPrivate0, r.kxPrivate1 = nil, nil
+}
+
+// Encrypt returns an encrypted version of msg. If the handshake is not
+// complete yet, the error will be ErrHandshakeNotComplete; otherwise it
+// comes from the random source, and the ratchet is left unchanged.
 func (r *Ratchet) Encrypt(msg []byte) ([]byte, error) {
+	return r.seal(nil, msg, nil)
+}
+
+// EncryptAD is like Encrypt, but also authenticates ad, which the peer
+// must give to DecryptAD. ad isn't part of the ciphertext.
+func (r *Ratchet) EncryptAD(msg, ad []byte) ([]byte, error) {
+	return r.seal(nil, msg, ad)
+}
+
+// Seal acts like append() and appends an encrypted version of msg to out,
+// like Encrypt. It doesn't allocate when out has enough capacity, except
+// for the DH ratchet steps and with SuiteAESGCM.
+func (r *Ratchet) Seal(out, msg []byte) ([]byte, error) {
+	return r.seal(out, msg, nil)
+}
+
+func (r *Ratchet) seal(out, msg, ad []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if !r.isHandshakeComplete {
 		return nil, ErrHandshakeNotComplete
 	}
+	cs := r.cipherSuite()
+	sc := getScratch()
+	defer putScratch(sc)
+
+	if r.padded {
+		sc.padded = r.padding.pad(sc.padded[:0], msg)
+		msg = sc.padded
+	}
+
+	// Read all the random bytes first, so that the ratchet is unchanged
+	// if rand fails.
+	random := sc.random[:2*cs.nonceSize]
+	if r.ratchet {
+		random = sc.random[:2*cs.nonceSize+32]
+	}
+	if err := r.randBytes(random); err != nil {
+		return nil, err
+	}
+	headerNonce, messageNonce := random[:cs.nonceSize], random[cs.nonceSize:2*cs.nonceSize]
 
 	if r.ratchet {
-		r.randBytes(r.sendRatchetPrivate[:])
+		copy(r.sendRatchetPrivate[:], random[2*cs.nonceSize:])
+		curve25519.ScalarBaseMult(&r.sendRatchetPublic, &r.sendRatchetPrivate)
 		copy(r.sendHeaderKey[:], r.nextSendHeaderKey[:])
 
 		var sharedKey, keyMaterial [32]byte
 		curve25519.ScalarMult(&sharedKey, &r.sendRatchetPrivate, &r.recvRatchetPublic)
-		sha := sha256.New()
-		sha.Write(rootKeyUpdateLabel)
-		sha.Write(r.rootKey[:])
-		sha.Write(sharedKey[:])
-
-		sha.Sum(keyMaterial[:0])
-		h := hmac.New(sha256.New, keyMaterial[:])
-		deriveKey(&r.rootKey, rootKeyLabel, h)
-		deriveKey(&r.nextSendHeaderKey, sendHeaderKeyLabel, h)
-		deriveKey(&r.sendChainKey, chainKeyLabel, h)
+		cs.rootUpdate(sc, &keyMaterial, &r.rootKey, &sharedKey)
+		cs.deriveKey(sc, &r.rootKey, keyMaterial[:], rootKeyLabel)
+		cs.deriveKey(sc, &r.nextSendHeaderKey, keyMaterial[:], sendHeaderKeyLabel)
+		cs.deriveKey(sc, &r.sendChainKey, keyMaterial[:], chainKeyLabel)
+		wipe(sharedKey[:])
+		wipe(keyMaterial[:])
 		r.prevSendCount, r.sendCount = r.sendCount, 0
 		r.ratchet = false
 	}
 
-	h := hmac.New(sha256.New, r.sendChainKey[:])
 	var messageKey [32]byte
-	deriveKey(&messageKey, messageKeyLabel, h)
-	deriveKey(&r.sendChainKey, chainKeyStepLabel, h)
-
-	var sendRatchetPublic [32]byte
-	curve25519.ScalarBaseMult(&sendRatchetPublic, &r.sendRatchetPrivate)
-	var header [headerSize]byte
-	var headerNonce, messageNonce [24]byte
-	r.randBytes(headerNonce[:])
-	r.randBytes(messageNonce[:])
+	cs.deriveKey(sc, &messageKey, r.sendChainKey[:], messageKeyLabel)
+	cs.deriveKey(sc, &r.sendChainKey, r.sendChainKey[:], chainKeyStepLabel)
 
+	header := sc.header[:cs.headerSize()]
 	binary.LittleEndian.PutUint32(header[0:4], r.sendCount)
 	binary.LittleEndian.PutUint32(header[4:8], r.prevSendCount)
-	copy(header[8:], sendRatchetPublic[:])
-	copy(header[nonceInHeaderOffset:], messageNonce[:])
-	out := make([]byte, len(headerNonce))
-	copy(out, headerNonce[:])
-	out = secretbox.Seal(out, header[:], &headerNonce, &r.sendHeaderKey)
+	copy(header[8:], r.sendRatchetPublic[:])
+	copy(header[nonceInHeaderOffset:], messageNonce)
+
+	start := len(out)
+	if cs.versioned {
+		out = append(out, byte(r.suite))
+	}
+	prefix := out[start:]
+	out = append(out, headerNonce...)
+	out = cs.seal(sc, out, header, headerNonce, &r.sendHeaderKey, prefix)
 	r.sendCount++
-	return secretbox.Seal(out, msg, &messageNonce, &messageKey), nil
+	ad = r.associatedData(sc, ad, out[start:])
+	out = cs.seal(sc, out, msg, messageNonce, &messageKey, ad)
+	wipe(messageKey[:])
+	return out, nil
 }
 
-// trySavedKeys tries to decrypt ciphertext using keys saved for missing messages.
-func (r *Ratchet) trySavedKeys(ciphertext []byte) ([]byte, error) {
-	if len(ciphertext) < sealedHeaderSize {
-		return nil, errors.New("ratchet: header too small to be valid")
+// associatedData returns the additional data authenticated with a
+// message whose header, suite byte included, is header. Except with
+// SuiteLegacy, it binds the identity keys of both peers, as in Signal:
+//
+//	identity of Alice | identity of Bob | ad | header
+func (r *Ratchet) associatedData(sc *scratch, ad, header []byte) []byte {
+	if r.suite == SuiteLegacy {
+		return ad
+	}
+	alice, bob := &r.theirIdentityPublic, &r.myIdentityPublic
+	if r.amAlice {
+		alice, bob = bob, alice
 	}
 
-	sealedHeader := ciphertext[:sealedHeaderSize]
-	var nonce [24]byte
-	copy(nonce[:], sealedHeader)
-	sealedHeader = sealedHeader[len(nonce):]
+	sc.ad = append(sc.ad[:0], alice[:]...)
+	sc.ad = append(sc.ad, bob[:]...)
+	sc.ad = append(sc.ad, ad...)
+	sc.ad = append(sc.ad, header...)
+	return sc.ad
+}
 
-	for headerKey, messageKeys := range r.saved {
-		header, ok := secretbox.Open(nil, sealedHeader, &nonce, &headerKey)
-		if !ok {
+// trySavedKeys decrypts a message of a previous receiving chain. The
+// header keys of the saved chains are tried in most recently used order.
+func (r *Ratchet) trySavedKeys(sc *scratch, out, prefix, nonce, sealedHeader, sealedMessage, ad []byte) ([]byte, error) {
+	cs := r.cipherSuite()
+	for i := range r.saved {
+		if r.saved[i].headerKey == r.recvHeaderKey {
+			// already tried by decrypt
 			continue
 		}
-		if len(header) != headerSize {
+		header, ok := cs.open(sc, sc.header[:0], sealedHeader, nonce, &r.saved[i].headerKey, prefix)
+		if !ok || len(header) != cs.headerSize() {
 			continue
 		}
-		msgNum := binary.LittleEndian.Uint32(header[:4])
-		msgKey, ok := messageKeys[msgNum]
-		if !ok {
-			// This is a fairly common case: the message key might
-			// not have been saved because it's the next message
-			// key.
-			return nil, nil
-		}
+		return r.openSaved(sc, out, i, header, sealedMessage, ad)
+	}
+	return nil, ErrCannotDecrypt
+}
 
-		sealedMessage := ciphertext[sealedHeaderSize:]
-		copy(nonce[:], header[nonceInHeaderOffset:])
-		msg, ok := secretbox.Open(nil, sealedMessage, &nonce, &msgKey.key)
-		if !ok {
-			return nil, errors.New("ratchet: corrupt message")
-		}
-		delete(messageKeys, msgNum)
-		if len(messageKeys) == 0 {
-			delete(r.saved, headerKey)
+// openSaved decrypts a message of the saved chain at index i in r.saved,
+// given its decrypted header.
+func (r *Ratchet) openSaved(sc *scratch, out []byte, i int, header, sealedMessage, ad []byte) ([]byte, error) {
+	chain := &r.saved[i]
+	msgNum := binary.LittleEndian.Uint32(header[:4])
+	msgKey, ok := chain.keys[msgNum]
+	if !ok {
+		// Either the message was already received, or it was
+		// received before msgNum was skipped.
+		return nil, ErrDuplicateMessage
+	}
+
+	msg, ok := r.cipherSuite().open(sc, out, sealedMessage, header[nonceInHeaderOffset:], &msgKey.key, ad)
+	wipe(msgKey.key[:])
+	if !ok {
+		return nil, errors.New("ratchet: corrupt message")
+	}
+	delete(chain.keys, msgNum)
+	if len(chain.keys) == 0 {
+		copy(r.saved[i:], r.saved[i+1:])
+		r.saved[len(r.saved)-1] = savedChain{}
+		r.saved = r.saved[:len(r.saved)-1]
+	} else {
+		r.useSaved(i)
+	}
+	return msg, nil
+}
+
+// findSaved returns the index of the chain of headerKey in r.saved, or -1.
+func (r *Ratchet) findSaved(headerKey *[32]byte) int {
+	for i := range r.saved {
+		if r.saved[i].headerKey == *headerKey {
+			return i
 		}
-		return msg, nil
 	}
+	return -1
+}
 
-	return nil, nil
+// useSaved moves the chain at index i to the front of r.saved.
+func (r *Ratchet) useSaved(i int) {
+	chain := r.saved[i]
+	copy(r.saved[1:i+1], r.saved[:i])
+	r.saved[0] = chain
 }
 
-// saveKeys takes a header key, the current chain key, a received message
-// number and the expected message number and advances the chain key as needed.
-// It returns the message key for given given message number and the new chain
-// key. If any messages have been skipped over, it also returns savedKeys, a
-// map suitable for merging with r.saved, that contains the message keys for
-// the missing messages.
-func (r *Ratchet) saveKeys(headerKey, recvChainKey *[32]byte, messageNum, receivedCount uint32) (provisionalChainKey, messageKey [32]byte, savedKeys map[[32]byte]map[uint32]savedKey, err error) {
+// saveKeys takes the current chain key, a received message number and the
+// expected message number and advances the chain key as needed. It returns
+// the message key for given given message number and the new chain key.
+// If any messages have been skipped over, it also returns savedKeys, the
+// keys of the missing messages, to be given to mergeSavedKeys.
+func (r *Ratchet) saveKeys(sc *scratch, recvChainKey *[32]byte, messageNum, receivedCount uint32) (provisionalChainKey, messageKey [32]byte, savedKeys map[uint32]savedKey, err error) {
 	if messageNum < receivedCount {
 		// This is a message from the past, but we didn't have a saved
 		// key for it, which means that it's a duplicate message or we
 		// expired the save key.
-		err = errors.New("ratchet: duplicate message or message delayed longer than tolerance")
+		err = ErrDuplicateMessage
 		return
 	}
 
@@ -423,46 +873,54 @@ func (r *Ratchet) saveKeys(headerKey, recvChainKey *[32]byte, messageNum, receiv
 		return
 	}
 
-	// messageKeys maps from message number to message key.
-	var messageKeys map[uint32]savedKey
 	now := time.Now()
 	if missingMessages > 0 {
-		messageKeys = make(map[uint32]savedKey)
+		savedKeys = make(map[uint32]savedKey)
 	}
 
 	copy(provisionalChainKey[:], recvChainKey[:])
 
+	cs := r.cipherSuite()
 	for n := receivedCount; n <= messageNum; n++ {
-		h := hmac.New(sha256.New, provisionalChainKey[:])
-		deriveKey(&messageKey, messageKeyLabel, h)
-		deriveKey(&provisionalChainKey, chainKeyStepLabel, h)
+		cs.deriveKey(sc, &messageKey, provisionalChainKey[:], messageKeyLabel)
+		cs.deriveKey(sc, &provisionalChainKey, provisionalChainKey[:], chainKeyStepLabel)
 		if n < messageNum {
-			messageKeys[n] = savedKey{messageKey, now}
+			savedKeys[n] = savedKey{messageKey, now}
 		}
 	}
 
-	if messageKeys != nil {
-		savedKeys = make(map[[32]byte]map[uint32]savedKey)
-		savedKeys[*headerKey] = messageKeys
-	}
-
 	return
 }
 
-// mergeSavedKeys takes a map of saved message keys from saveKeys and merges it
-// into r.saved.
-func (r *Ratchet) mergeSavedKeys(newKeys map[[32]byte]map[uint32]savedKey) {
-	for headerKey, newMessageKeys := range newKeys {
-		messageKeys, ok := r.saved[headerKey]
-		if !ok {
-			r.saved[headerKey] = newMessageKeys
-			continue
-		}
+// mergeSavedKeys adds keys from saveKeys to the saved chain of headerKey,
+// and makes it the most recently used one. When a new chain doesn't fit,
+// it replaces the least recently used one.
+func (r *Ratchet) mergeSavedKeys(headerKey *[32]byte, keys map[uint32]savedKey) {
+	if len(keys) == 0 {
+		return
+	}
 
-		for n, messageKey := range newMessageKeys {
-			messageKeys[n] = messageKey
+	i := r.findSaved(headerKey)
+	if i < 0 {
+		if len(r.saved) < maxSavedChains {
+			r.saved = append(r.saved, savedChain{})
+		}
+		i = len(r.saved) - 1
+		r.saved[i] = savedChain{*headerKey, keys}
+	} else {
+		for n, key := range keys {
+			r.saved[i].keys[n] = key
 		}
 	}
+	r.useSaved(i)
+}
+
+// wipe overwrites b with zeros. It is a best effort to not leave secrets
+// in memory: the runtime may have made copies that are out of reach.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
 }
 
 // isZeroKey returns true if key is all zeros.
@@ -475,51 +933,95 @@ func isZeroKey(key *[32]byte) bool {
 	return x == 0
 }
 
+// Decrypt decrypts a message from the peer and strips its padding.
 func (r *Ratchet) Decrypt(ciphertext []byte) ([]byte, error) {
+	return r.open(nil, ciphertext, nil)
+}
+
+// DecryptAD is like Decrypt for messages encrypted by EncryptAD. It fails
+// if ad isn't the one given to EncryptAD.
+func (r *Ratchet) DecryptAD(ciphertext, ad []byte) ([]byte, error) {
+	return r.open(nil, ciphertext, ad)
+}
+
+// Open acts like append() and appends the decrypted version of
+// ciphertext to out, like Decrypt. It doesn't allocate when out has
+// enough capacity, except for the DH ratchet steps, for messages that
+// arrive out of order and with SuiteAESGCM.
+func (r *Ratchet) Open(out, ciphertext []byte) ([]byte, error) {
+	return r.open(out, ciphertext, nil)
+}
+
+func (r *Ratchet) open(out, ciphertext, ad []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sc := getScratch()
+	defer putScratch(sc)
+
+	msg, err := r.decrypt(sc, out, ciphertext, ad)
+	if err != nil || !r.padded {
+		return msg, err
+	}
+	unpadded, err := unpad(msg[len(out):])
+	if err != nil {
+		return nil, err
+	}
+	return msg[:len(out)+len(unpadded)], nil
+}
+
+func (r *Ratchet) decrypt(sc *scratch, out, ciphertext, ad []byte) ([]byte, error) {
 	if !r.isHandshakeComplete {
 		return nil, ErrHandshakeNotComplete
 	}
 
-	msg, err := r.trySavedKeys(ciphertext)
-	if err != nil || msg != nil {
-		return msg, err
+	cs := r.cipherSuite()
+	prefix, sealedHeader, sealedMessage, err := cs.split(ciphertext, r.suite)
+	if err != nil {
+		return nil, err
 	}
+	ad = r.associatedData(sc, ad, ciphertext[:len(ciphertext)-len(sealedMessage)])
+	nonce := sealedHeader[:cs.nonceSize]
+	sealedHeader = sealedHeader[cs.nonceSize:]
 
-	sealedHeader := ciphertext[:sealedHeaderSize]
-	sealedMessage := ciphertext[sealedHeaderSize:]
-	var nonce [24]byte
-	copy(nonce[:], sealedHeader)
-	sealedHeader = sealedHeader[len(nonce):]
-
-	header, ok := secretbox.Open(nil, sealedHeader, &nonce, &r.recvHeaderKey)
+	header, ok := cs.open(sc, sc.header[:0], sealedHeader, nonce, &r.recvHeaderKey, prefix)
 	ok = ok && !isZeroKey(&r.recvHeaderKey)
 	if ok {
-		if len(header) != headerSize {
+		if len(header) != cs.headerSize() {
 			return nil, errors.New("ratchet: incorrect header size")
 		}
 		messageNum := binary.LittleEndian.Uint32(header[:4])
-		provisionalChainKey, messageKey, savedKeys, err := r.saveKeys(&r.recvHeaderKey, &r.recvChainKey, messageNum, r.recvCount)
+		if messageNum < r.recvCount {
+			// This is a message from the past, which can only be
+			// decrypted if it was skipped.
+			i := r.findSaved(&r.recvHeaderKey)
+			if i < 0 {
+				return nil, ErrDuplicateMessage
+			}
+			return r.openSaved(sc, out, i, header, sealedMessage, ad)
+		}
+		provisionalChainKey, messageKey, savedKeys, err := r.saveKeys(sc, &r.recvChainKey, messageNum, r.recvCount)
 		if err != nil {
 			return nil, err
 		}
+		defer wipe(provisionalChainKey[:])
+		defer wipe(messageKey[:])
 
-		copy(nonce[:], header[nonceInHeaderOffset:])
-		msg, ok := secretbox.Open(nil, sealedMessage, &nonce, &messageKey)
+		msg, ok := cs.open(sc, out, sealedMessage, header[nonceInHeaderOffset:], &messageKey, ad)
 		if !ok {
 			return nil, errors.New("ratchet: corrupt message")
 		}
 
 		copy(r.recvChainKey[:], provisionalChainKey[:])
-		r.mergeSavedKeys(savedKeys)
+		r.mergeSavedKeys(&r.recvHeaderKey, savedKeys)
 		r.recvCount = messageNum + 1
 		return msg, nil
 	}
 
-	header, ok = secretbox.Open(nil, sealedHeader, &nonce, &r.nextRecvHeaderKey)
+	header, ok = cs.open(sc, sc.header[:0], sealedHeader, nonce, &r.nextRecvHeaderKey, prefix)
 	if !ok {
-		return nil, errors.New("ratchet: cannot decrypt")
+		return r.trySavedKeys(sc, out, prefix, nonce, sealedHeader, sealedMessage, ad)
 	}
-	if len(header) != headerSize {
+	if len(header) != cs.headerSize() {
 		return nil, errors.New("ratchet: incorrect header size")
 	}
 
@@ -530,51 +1032,48 @@ func (r *Ratchet) Decrypt(ciphertext []byte) ([]byte, error) {
 	messageNum := binary.LittleEndian.Uint32(header[:4])
 	prevMessageCount := binary.LittleEndian.Uint32(header[4:8])
 
-	_, _, oldSavedKeys, err := r.saveKeys(&r.recvHeaderKey, &r.recvChainKey, prevMessageCount, r.recvCount)
+	_, _, oldSavedKeys, err := r.saveKeys(sc, &r.recvChainKey, prevMessageCount, r.recvCount)
 	if err != nil {
 		return nil, err
 	}
 
 	var dhPublic, sharedKey, rootKey, chainKey, keyMaterial [32]byte
+	defer wipe(sharedKey[:])
+	defer wipe(rootKey[:])
+	defer wipe(chainKey[:])
+	defer wipe(keyMaterial[:])
 	copy(dhPublic[:], header[8:])
 
-	curve25519.ScalarMult(&sharedKey, &r.sendRatchetPrivate, &dhPublic)
-
-	sha := sha256.New()
-	sha.Write(rootKeyUpdateLabel)
-	sha.Write(r.rootKey[:])
-	sha.Write(sharedKey[:])
-
-	var rootKeyHMAC hash.Hash
+	if err := dhShared(&sharedKey, &r.sendRatchetPrivate, &dhPublic); err != nil {
+		return nil, err
+	}
 
-	sha.Sum(keyMaterial[:0])
-	rootKeyHMAC = hmac.New(sha256.New, keyMaterial[:])
-	deriveKey(&rootKey, rootKeyLabel, rootKeyHMAC)
-	deriveKey(&chainKey, chainKeyLabel, rootKeyHMAC)
+	cs.rootUpdate(sc, &keyMaterial, &r.rootKey, &sharedKey)
+	cs.deriveKey(sc, &rootKey, keyMaterial[:], rootKeyLabel)
+	cs.deriveKey(sc, &chainKey, keyMaterial[:], chainKeyLabel)
 
-	provisionalChainKey, messageKey, savedKeys, err := r.saveKeys(&r.nextRecvHeaderKey, &chainKey, messageNum, 0)
+	provisionalChainKey, messageKey, savedKeys, err := r.saveKeys(sc, &chainKey, messageNum, 0)
 	if err != nil {
 		return nil, err
 	}
+	defer wipe(provisionalChainKey[:])
+	defer wipe(messageKey[:])
 
-	copy(nonce[:], header[nonceInHeaderOffset:])
-	msg, ok = secretbox.Open(nil, sealedMessage, &nonce, &messageKey)
+	msg, ok := cs.open(sc, out, sealedMessage, header[nonceInHeaderOffset:], &messageKey, ad)
 	if !ok {
 		return nil, errors.New("ratchet: corrupt message")
 	}
 
+	r.mergeSavedKeys(&r.recvHeaderKey, oldSavedKeys)
+	r.mergeSavedKeys(&r.nextRecvHeaderKey, savedKeys)
 	copy(r.rootKey[:], rootKey[:])
 	copy(r.recvChainKey[:], provisionalChainKey[:])
 	copy(r.recvHeaderKey[:], r.nextRecvHeaderKey[:])
-	deriveKey(&r.nextRecvHeaderKey, sendHeaderKeyLabel, rootKeyHMAC)
-	for i := range r.sendRatchetPrivate {
-		r.sendRatchetPrivate[i] = 0
-	}
+	cs.deriveKey(sc, &r.nextRecvHeaderKey, keyMaterial[:], sendHeaderKeyLabel)
+	wipe(r.sendRatchetPrivate[:])
 	copy(r.recvRatchetPublic[:], dhPublic[:])
 
 	r.recvCount = messageNum + 1
-	r.mergeSavedKeys(oldSavedKeys)
-	r.mergeSavedKeys(savedKeys)
 	r.ratchet = true
 
 	return msg, nil
@@ -607,7 +1106,20 @@ type ratchetState struct {
 	V2                  bool                     `json:"v2,omitempty"`
 	Private0            []byte                   `json:"private0,omitempty"`
 	Private1            []byte                   `json:"private1,omitempty"`
+	Public0             []byte                   `json:"public0,omitempty"`
+	Public1             []byte                   `json:"public1,omitempty"`
 	IsHandshakeComplete bool                     `json:"isHandshakeComplete,omitempty"`
+	KxFeatures          uint32                   `json:"kx_features,omitempty"`
+	Padded              bool                     `json:"padded,omitempty"`
+	Padding             Padding                  `json:"padding,omitempty"`
+	KxSuites            uint32                   `json:"kx_suites,omitempty"`
+	Suite               Suite                    `json:"suite,omitempty"`
+	AmAlice             bool                     `json:"am_alice,omitempty"`
+	TheirIdentityPublic []byte                   `json:"their_identity_public,omitempty"`
+	Reset               bool                     `json:"reset,omitempty"`
+	PeerReset           bool                     `json:"peer_reset,omitempty"`
+	TheirPublic0        []byte                   `json:"their_public0,omitempty"`
+	SeenResets          [][]byte                 `json:"seen_resets,omitempty"`
 	SavedKeys           []ratchetState_SavedKeys `json:"saved_keys,omitempty"`
 	XXX_unrecognized    []byte                   `json:"-"`
 }
@@ -626,6 +1138,8 @@ type ratchetState_SavedKeys_MessageKey struct {
 }
 
 func (r *Ratchet) MarshalJSON() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	s := ratchetState{
 		RootKey:             dup(&r.rootKey),
 		SendHeaderKey:       dup(&r.sendHeaderKey),
@@ -643,11 +1157,29 @@ func (r *Ratchet) MarshalJSON() ([]byte, error) {
 		Private0:            dup(r.kxPrivate0),
 		Private1:            dup(r.kxPrivate1),
 		IsHandshakeComplete: r.isHandshakeComplete,
+		KxFeatures:          r.kxFeatures,
+		Padded:              r.padded,
+		Padding:             r.padding,
+		KxSuites:            r.kxSuites,
+		Suite:               r.suite,
+		AmAlice:             r.amAlice,
+		TheirIdentityPublic: dup(&r.theirIdentityPublic),
+		Reset:               r.reset,
+		PeerReset:           r.peerReset,
+	}
+	if !isZeroKey(&r.theirKxPublic0) {
+		s.TheirPublic0 = dup(&r.theirKxPublic0)
+	}
+	if !isZeroKey(&r.kxPublic0) {
+		s.Public0, s.Public1 = dup(&r.kxPublic0), dup(&r.kxPublic1)
+	}
+	for i := range r.seenResets {
+		s.SeenResets = append(s.SeenResets, dup(&r.seenResets[i]))
 	}
 
-	for headerKey, messageKeys := range r.saved {
-		keys := make([]ratchetState_SavedKeys_MessageKey, 0, len(messageKeys))
-		for messageNum, savedKey := range messageKeys {
+	for _, chain := range r.saved {
+		keys := make([]ratchetState_SavedKeys_MessageKey, 0, len(chain.keys))
+		for messageNum, savedKey := range chain.keys {
 			keys = append(keys, ratchetState_SavedKeys_MessageKey{
 				Num:          messageNum,
 				Key:          dup(&savedKey.key),
@@ -655,7 +1187,7 @@ func (r *Ratchet) MarshalJSON() ([]byte, error) {
 			})
 		}
 		s.SavedKeys = append(s.SavedKeys, ratchetState_SavedKeys{
-			HeaderKey:   dup(&headerKey),
+			HeaderKey:   dup(&chain.headerKey),
 			MessageKeys: keys,
 		})
 	}
@@ -674,6 +1206,8 @@ func unmarshalKey(dst *[32]byte, src []byte) bool {
 var badSerialisedKeyLengthErr = errors.New("ratchet: bad serialised key length")
 
 func (r *Ratchet) UnmarshalJSON(in []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	var s ratchetState
 	err := json.Unmarshal(in, &s)
 	if err != nil {
@@ -691,39 +1225,90 @@ func (r *Ratchet) UnmarshalJSON(in []byte) error {
 		!unmarshalKey(&r.recvRatchetPublic, s.RecvRatchetPublic) {
 		return badSerialisedKeyLengthErr
 	}
+	curve25519.ScalarBaseMult(&r.sendRatchetPublic, &r.sendRatchetPrivate)
 
 	r.sendCount = s.SendCount
 	r.recvCount = s.RecvCount
 	r.prevSendCount = s.PrevSendCount
 	r.ratchet = s.Ratchet
 	r.isHandshakeComplete = s.IsHandshakeComplete
+	r.kxFeatures = s.KxFeatures
+	r.padded = s.Padded
+	r.padding = s.Padding
+	r.kxSuites = s.KxSuites
+	r.suite = s.Suite
+	r.amAlice = s.AmAlice
+	r.reset = s.Reset
+	r.peerReset = s.PeerReset
+	if len(s.TheirPublic0) > 0 && !unmarshalKey(&r.theirKxPublic0, s.TheirPublic0) {
+		return badSerialisedKeyLengthErr
+	}
+	if len(s.SeenResets) > maxSeenResets {
+		s.SeenResets = s.SeenResets[len(s.SeenResets)-maxSeenResets:]
+	}
+	r.seenResets = make([][32]byte, len(s.SeenResets))
+	for i, dh := range s.SeenResets {
+		if !unmarshalKey(&r.seenResets[i], dh) {
+			return badSerialisedKeyLengthErr
+		}
+	}
+	// Older states don't have the peer's identity, which only matters
+	// for suites that came later
+	if len(s.TheirIdentityPublic) > 0 && !unmarshalKey(&r.theirIdentityPublic, s.TheirIdentityPublic) {
+		return badSerialisedKeyLengthErr
+	}
+	if _, ok := cipherSuites[r.suite]; !ok {
+		return errUnknownSuite
+	}
 
 	if len(s.Private0) > 0 {
+		if r.kxPrivate0 == nil || r.kxPrivate1 == nil {
+			r.kxPrivate0, r.kxPrivate1 = new([32]byte), new([32]byte)
+		}
 		if !unmarshalKey(r.kxPrivate0, s.Private0) ||
 			!unmarshalKey(r.kxPrivate1, s.Private1) {
 			return badSerialisedKeyLengthErr
 		}
+		wipe(s.Private0)
+		wipe(s.Private1)
+		curve25519.ScalarBaseMult(&r.kxPublic0, r.kxPrivate0)
+		curve25519.ScalarBaseMult(&r.kxPublic1, r.kxPrivate1)
 	} else {
-		r.kxPrivate0 = nil
-		r.kxPrivate1 = nil
+		r.wipeKeyExchange()
+		r.kxPublic0, r.kxPublic1 = [32]byte{}, [32]byte{}
+		if len(s.Public0) > 0 {
+			if !unmarshalKey(&r.kxPublic0, s.Public0) ||
+				!unmarshalKey(&r.kxPublic1, s.Public1) {
+				return badSerialisedKeyLengthErr
+			}
+		}
+	}
+	if r.isHandshakeComplete {
+		// Older versions kept the private values after the key
+		// exchange.
+		r.wipeKeyExchange()
 	}
 
+	r.saved = nil
 	for _, saved := range s.SavedKeys {
-		var headerKey [32]byte
-		if !unmarshalKey(&headerKey, saved.HeaderKey) {
+		if len(r.saved) == maxSavedChains {
+			break
+		}
+		var chain savedChain
+		if !unmarshalKey(&chain.headerKey, saved.HeaderKey) {
 			return badSerialisedKeyLengthErr
 		}
-		messageKeys := make(map[uint32]savedKey)
+		chain.keys = make(map[uint32]savedKey)
 		for _, messageKey := range saved.MessageKeys {
 			var savedKey savedKey
 			if !unmarshalKey(&savedKey.key, messageKey.Key) {
 				return badSerialisedKeyLengthErr
 			}
 			savedKey.timestamp = time.Unix(messageKey.CreationTime, 0)
-			messageKeys[messageKey.Num] = savedKey
+			chain.keys[messageKey.Num] = savedKey
 		}
 
-		r.saved[headerKey] = messageKeys
+		r.saved = append(r.saved, chain)
 	}
 
 	return nil
@@ -30,18 +30,32 @@ package ratchet
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"testing"
+
+	"golang.org/x/crypto/hkdf"
 )
 
+func mustNew(priv [32]byte) *Ratchet {
+	r, err := New(rand.Reader, priv)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
 func pairedRatchet() (a, b *Ratchet) {
 	var privA, privB [32]byte
 	io.ReadFull(rand.Reader, privA[:])
 	io.ReadFull(rand.Reader, privB[:])
 
-	a, b = New(rand.Reader, privA), New(rand.Reader, privB)
+	a, b = mustNew(privA), mustNew(privB)
 
 	kxA, err := a.GetKeyExchangeMaterial()
 	if err != nil {
@@ -65,7 +79,10 @@ func TestExchange(t *testing.T) {
 	a, b := pairedRatchet()
 
 	msg := []byte("test message")
-	encrypted := a.Encrypt(msg)
+	encrypted, err := a.Encrypt(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
 	result, err := b.Decrypt(encrypted)
 	if err != nil {
 		t.Fatal(err)
@@ -103,11 +120,10 @@ func reinitRatchet(t *testing.T, r *Ratchet) *Ratchet {
 		t.Fatalf("Failed to marshal: %s", err)
 	}
 
-	newR := New(rand.Reader, r.myIdentityPrivate)
+	newR := mustNew(r.myIdentityPrivate)
 	if err := json.Unmarshal(state, newR); err != nil {
 		t.Fatalf("Failed to unmarshal: %s", err)
 	}
-	newR.theirIdentityPublic = r.theirIdentityPublic
 
 	return newR
 }
@@ -131,7 +147,10 @@ func testScript(t *testing.T, script []scriptAction) {
 
 			var msg [20]byte
 			rand.Reader.Read(msg[:])
-			encrypted := sender.Encrypt(msg[:])
+			encrypted, err := sender.Encrypt(msg[:])
+			if err != nil {
+				t.Fatalf("#%d: sender returned error: %s", i, err)
+			}
 
 			switch action.result {
 			case deliver:
@@ -219,7 +238,7 @@ func TestDrop(t *testing.T) {
 func TestMarshal(t *testing.T) {
 	var priv [32]byte
 	io.ReadFull(rand.Reader, priv[:])
-	ratchet := New(rand.Reader, priv)
+	ratchet := mustNew(priv)
 	kx, err := ratchet.GetKeyExchangeMaterial()
 	if err != nil {
 		t.Fatal(err)
@@ -252,7 +271,7 @@ func TestMarshal(t *testing.T) {
 func TestCantDecryptUntilHandshakeComplete(t *testing.T) {
 	var privA [32]byte
 	io.ReadFull(rand.Reader, privA[:])
-	a := New(rand.Reader, privA)
+	a := mustNew(privA)
 	kx, err := a.GetKeyExchangeMaterial()
 	if err != nil {
 		t.Fatal(err)
@@ -260,12 +279,1224 @@ func TestCantDecryptUntilHandshakeComplete(t *testing.T) {
 
 	var privB [32]byte
 	io.ReadFull(rand.Reader, privB[:])
-	b := New(rand.Reader, privB)
+	b := mustNew(privB)
 	b.CompleteKeyExchange(kx)
-	msg := b.Encrypt([]byte("some message"))
+	msg, err := b.Encrypt([]byte("some message"))
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// a hasn't finished handshake yet, decrypting is not allowed
 	if _, err := a.Decrypt(msg); err == nil {
 		t.Fatal("shouldn't be able to decrypt yet")
 	}
 }
+
+func TestHandshakeState(t *testing.T) {
+	var privA, privB [32]byte
+	io.ReadFull(rand.Reader, privA[:])
+	io.ReadFull(rand.Reader, privB[:])
+	a, b := mustNew(privA), mustNew(privB)
+
+	if s := a.State(); s != AwaitingKeyExchange {
+		t.Fatalf("new ratchet should be awaiting key exchange, got %s", s)
+	}
+
+	kxA, err := a.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kxB, err := b.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CompleteKeyExchange(kxB); err != nil {
+		t.Fatal(err)
+	}
+	if s := a.State(); s != HandshakeUnconfirmed {
+		t.Fatalf("expected unconfirmed handshake, got %s", s)
+	}
+
+	msg, err := a.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := a.State(); s != HandshakeUnconfirmed {
+		t.Fatalf("sending shouldn't confirm the handshake, got %s", s)
+	}
+
+	if err := b.CompleteKeyExchange(kxA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Decrypt(msg); err != nil {
+		t.Fatal(err)
+	}
+	b = reinitRatchet(t, b)
+	if s := b.State(); s != HandshakeConfirmed {
+		t.Fatalf("expected confirmed handshake after decrypting, got %s", s)
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	a, b := pairedRatchet()
+
+	first, err := a.Encrypt([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := a.Encrypt([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range [][]byte{first, second} {
+		if _, err := b.Decrypt(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, msg := range [][]byte{first, second} {
+		if _, err := b.Decrypt(msg); err != ErrDuplicateMessage {
+			t.Fatalf("expected ErrDuplicateMessage, got %v", err)
+		}
+	}
+
+	third, err := a.Encrypt([]byte("third"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.Decrypt(third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, []byte("third")) {
+		t.Fatalf("bad message after duplicates: %q", result)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	a, b := pairedRatchet()
+
+	const n = 100
+	msgs := make(chan []byte, n)
+	done := make(chan error)
+	go func() {
+		for i := 0; i < n; i++ {
+			msg, err := a.Encrypt([]byte("concurrent"))
+			if err != nil {
+				done <- err
+				return
+			}
+			msgs <- msg
+		}
+		close(msgs)
+		done <- nil
+	}()
+	go func() {
+		for msg := range msgs {
+			if _, err := b.Decrypt(msg); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := json.Marshal(a); err != nil {
+				done <- err
+				return
+			}
+			if _, err := json.Marshal(b); err != nil {
+				done <- err
+				return
+			}
+			b.State()
+		}
+		done <- nil
+	}()
+
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var errRandom = errors.New("random source failed")
+
+// failingReader returns n random bytes, then fails with errRandom.
+type failingReader struct {
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errRandom
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	f.n -= len(p)
+	return rand.Read(p)
+}
+
+func TestNewRandFailure(t *testing.T) {
+	var priv [32]byte
+	for _, n := range []int{0, 32} {
+		if _, err := New(&failingReader{n}, priv); err != errRandom {
+			t.Fatalf("%d random bytes: got %v, want errRandom", n, err)
+		}
+	}
+}
+
+func TestEncryptRandFailure(t *testing.T) {
+	a, b := pairedRatchet()
+
+	for i, sender := range []*Ratchet{a, b, a} {
+		receiver := b
+		if sender == b {
+			receiver = a
+		}
+
+		before, err := json.Marshal(sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The random bytes needed by Encrypt
+		need := 2 * sender.cipherSuite().nonceSize
+		if sender.ratchet {
+			need += 32
+		}
+		for _, n := range []int{0, 1, need - 1} {
+			sender.rand = &failingReader{n}
+			if _, err := sender.Encrypt([]byte("lost")); err != errRandom {
+				t.Fatalf("#%d: %d random bytes: got %v, want errRandom", i, n, err)
+			}
+		}
+		after, err := json.Marshal(sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before, after) {
+			t.Fatalf("#%d: ratchet changed by a failed Encrypt", i)
+		}
+
+		sender.rand = rand.Reader
+		msg, err := sender.Encrypt([]byte("sent"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := receiver.Decrypt(msg)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !bytes.Equal(result, []byte("sent")) {
+			t.Fatalf("#%d: bad message: %q", i, result)
+		}
+	}
+}
+
+func TestKeyExchangeWiped(t *testing.T) {
+	var privA, privB [32]byte
+	io.ReadFull(rand.Reader, privA[:])
+	io.ReadFull(rand.Reader, privB[:])
+	a, b := mustNew(privA), mustNew(privB)
+	kxA, _ := a.GetKeyExchangeMaterial()
+	kxB, _ := b.GetKeyExchangeMaterial()
+	private0, private1 := *a.kxPrivate0, *a.kxPrivate1
+
+	if err := a.CompleteKeyExchange(kxB); err != nil {
+		t.Fatal(err)
+	}
+	if a.kxPrivate0 != nil || a.kxPrivate1 != nil {
+		t.Fatal("key exchange private values kept after the key exchange")
+	}
+
+	state, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(state, []byte(`"private0"`)) || bytes.Contains(state, []byte(`"private1"`)) {
+		t.Fatal("serialized state contains key exchange private values")
+	}
+	secrets := [][32]byte{private0}
+	if a.amAlice {
+		// Otherwise private1 became our first ratchet key.
+		secrets = append(secrets, private1)
+	}
+	for _, secret := range secrets {
+		encoded, _ := json.Marshal(secret[:])
+		if bytes.Contains(state, bytes.Trim(encoded, `"`)) {
+			t.Fatal("serialized state contains a key exchange private value")
+		}
+	}
+
+	// Our key exchange can still be sent again.
+	a = reinitRatchet(t, a)
+	kx, err := a.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kx != kxA {
+		t.Fatal("key exchange changed after it was completed")
+	}
+}
+
+func TestKeyExchangeWipedOnLoad(t *testing.T) {
+	var priv [32]byte
+	io.ReadFull(rand.Reader, priv[:])
+	a, b := mustNew(priv), mustNew(priv)
+	kxA, _ := a.GetKeyExchangeMaterial()
+	kxB, _ := b.GetKeyExchangeMaterial()
+	private0, private1 := dup(a.kxPrivate0), dup(a.kxPrivate1)
+	if err := a.CompleteKeyExchange(kxB); err != nil {
+		t.Fatal(err)
+	}
+
+	// States saved by older versions have the private values, and no
+	// public ones.
+	state, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(state, &fields); err != nil {
+		t.Fatal(err)
+	}
+	delete(fields, "public0")
+	delete(fields, "public1")
+	fields["private0"], fields["private1"] = private0, private1
+	if state, err = json.Marshal(fields); err != nil {
+		t.Fatal(err)
+	}
+
+	a = mustNew(priv)
+	if err := json.Unmarshal(state, a); err != nil {
+		t.Fatal(err)
+	}
+	if a.kxPrivate0 != nil || a.kxPrivate1 != nil {
+		t.Fatal("key exchange private values kept when loading a complete ratchet")
+	}
+	if kx, err := a.GetKeyExchangeMaterial(); err != nil || kx != kxA {
+		t.Fatalf("key exchange not recovered from the private values: %v", err)
+	}
+}
+
+func TestScratchWipe(t *testing.T) {
+	sc := getScratch()
+	var key [32]byte
+	io.ReadFull(rand.Reader, key[:])
+	sc.mac(&sc.key, key[:], []byte("label"))
+	sc.ad = append(sc.ad, key[:]...)
+	sc.wipe()
+
+	for _, b := range [][]byte{sc.ipad[:], sc.opad[:], sc.sum[:], sc.key[:], sc.ad[:cap(sc.ad)]} {
+		for _, v := range b {
+			if v != 0 {
+				t.Fatal("scratch not wiped")
+			}
+		}
+	}
+}
+
+// x25519Vectors are the vectors of testdata/x25519_test.json, in the
+// format of Wycheproof's xdh tests. They were computed with an independent
+// implementation of RFC 7748; low-order public keys are invalid.
+type x25519Vectors struct {
+	TestGroups []struct {
+		Tests []struct {
+			TcID    int      `json:"tcId"`
+			Comment string   `json:"comment"`
+			Public  hexBytes `json:"public"`
+			Private hexBytes `json:"private"`
+			Shared  hexBytes `json:"shared"`
+			Result  string   `json:"result"`
+		} `json:"tests"`
+	} `json:"testGroups"`
+}
+
+func loadX25519Vectors(t *testing.T) x25519Vectors {
+	in, err := ioutil.ReadFile("testdata/x25519_test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v x25519Vectors
+	if err := json.Unmarshal(in, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// lowOrderPoints returns the invalid public keys of the X25519 vectors.
+func lowOrderPoints(t *testing.T) (points [][32]byte) {
+	for _, group := range loadX25519Vectors(t).TestGroups {
+		for _, test := range group.Tests {
+			if test.Result == "invalid" {
+				points = append(points, key32(test.Public))
+			}
+		}
+	}
+	return points
+}
+
+func TestX25519Vectors(t *testing.T) {
+	for _, group := range loadX25519Vectors(t).TestGroups {
+		for _, test := range group.Tests {
+			private, public := key32(test.Private), key32(test.Public)
+			var shared [32]byte
+			err := dhShared(&shared, &private, &public)
+			drShared, drErr := dh(&private, &public)
+
+			if test.Result == "invalid" {
+				if err != ErrInvalidPublicKey || drErr != ErrInvalidPublicKey || validPublicKey(&public) {
+					t.Errorf("#%d (%s): invalid public key accepted", test.TcID, test.Comment)
+				}
+				continue
+			}
+			if err != nil || drErr != nil || !validPublicKey(&public) {
+				t.Errorf("#%d (%s): valid public key rejected", test.TcID, test.Comment)
+				continue
+			}
+			if !bytes.Equal(shared[:], test.Shared) || !bytes.Equal(drShared, test.Shared) {
+				t.Errorf("#%d (%s): bad shared key %x", test.TcID, test.Comment, shared)
+			}
+		}
+	}
+}
+
+func TestLowOrderKeyExchange(t *testing.T) {
+	var privA, privB [32]byte
+	io.ReadFull(rand.Reader, privA[:])
+	io.ReadFull(rand.Reader, privB[:])
+	a, b := mustNew(privA), mustNew(privB)
+	kxB, err := b.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, point := range lowOrderPoints(t) {
+		for i := 0; i < 3; i++ {
+			kx := kxB
+			switch i {
+			case 0:
+				kx.IdentityPublic = point
+			case 1:
+				kx.Dh = point
+			case 2:
+				kx.Dh1 = point
+			}
+			if err := a.CompleteKeyExchange(kx); err != ErrInvalidPublicKey {
+				t.Fatalf("low-order key %x in field %d: got %v, want ErrInvalidPublicKey", point, i, err)
+			}
+		}
+	}
+
+	// An echo of our own key exchange passes the checks above, but is
+	// rejected with the others
+	kxA, err := a.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CompleteKeyExchange(kxA); err == nil {
+		t.Fatal("echoed key exchange accepted")
+	}
+	if !isZeroKey(&a.theirIdentityPublic) || !isZeroKey(&a.theirKxPublic0) {
+		t.Fatal("the echoed key exchange was kept")
+	}
+
+	// The rejected key exchanges left a unchanged.
+	if err := a.CompleteKeyExchange(kxB); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLowOrderRatchetStep(t *testing.T) {
+	a, b := pairedRatchet()
+	if !a.amAlice {
+		a, b = b, a
+	}
+
+	// Alice's first message starts a new chain, whose public key the
+	// peer replaces with a low-order one.
+	msg, err := a.Encrypt([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := b.cipherSuite()
+	prefix, sealedHeader, sealedMessage, err := cs.split(msg, b.suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := sealedHeader[:cs.nonceSize]
+	sc := getScratch()
+	defer putScratch(sc)
+	header, ok := cs.open(sc, nil, sealedHeader[cs.nonceSize:], nonce, &b.nextRecvHeaderKey, prefix)
+	if !ok {
+		t.Fatal("cannot open the header")
+	}
+
+	for _, point := range lowOrderPoints(t) {
+		copy(header[8:], point[:])
+		forged := append(append([]byte(nil), prefix...), nonce...)
+		forged = cs.seal(sc, forged, header, nonce, &b.nextRecvHeaderKey, prefix)
+		forged = append(forged, sealedMessage...)
+		if _, err := b.Decrypt(forged); err != ErrInvalidPublicKey {
+			t.Fatalf("low-order key %x: got %v, want ErrInvalidPublicKey", point, err)
+		}
+	}
+
+	result, err := b.Decrypt(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, []byte("first")) {
+		t.Fatalf("bad message: %q", result)
+	}
+}
+
+func TestRatchetCounters(t *testing.T) {
+	a, b := pairedRatchet()
+
+	for i := 0; i < 3; i++ {
+		msg, err := a.Encrypt([]byte("one way"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Decrypt(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := a.SentWithoutRatchet(); n != 3 {
+		t.Fatalf("expected 3 messages sent without ratchet, got %d", n)
+	}
+	if n := b.ReceivedWithoutReply(); n != 3 {
+		t.Fatalf("expected 3 messages received without reply, got %d", n)
+	}
+
+	reply, err := b.Encrypt([]byte("reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := b.ReceivedWithoutReply(); n != 0 {
+		t.Fatalf("expected no message received without reply, got %d", n)
+	}
+	if _, err := a.Decrypt(reply); err != nil {
+		t.Fatal(err)
+	}
+	if n := a.SentWithoutRatchet(); n != 0 {
+		t.Fatalf("expected pending ratchet after reply, got %d messages without ratchet", n)
+	}
+
+	if _, err := a.Encrypt([]byte("after ratchet")); err != nil {
+		t.Fatal(err)
+	}
+	if n := a.SentWithoutRatchet(); n != 1 {
+		t.Fatalf("expected 1 message sent since ratchet, got %d", n)
+	}
+}
+
+func TestPadmeLengths(t *testing.T) {
+	for _, test := range []struct{ in, out int }{
+		{1, 1},
+		{9, 10},
+		{100, 104},
+		{1000, 1024},
+		{1025, 1088},
+	} {
+		if actual := PadPadme.paddedLen(test.in); actual != test.out {
+			t.Errorf("padme(%d): expected %d, got %d", test.in, test.out, actual)
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	a, b := pairedRatchet()
+	if _, padded := a.Padding(); !padded {
+		t.Fatal("padding wasn't negotiated")
+	}
+	a.SetPadding(PadBuckets)
+
+	short, err := a.Encrypt([]byte("yes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := a.Encrypt(bytes.Repeat([]byte("a"), 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(short) != len(long) {
+		t.Fatalf("messages in the same bucket have different lengths: %d and %d", len(short), len(long))
+	}
+
+	for _, msg := range []struct {
+		ciphertext, plaintext []byte
+	}{
+		{short, []byte("yes")},
+		{long, bytes.Repeat([]byte("a"), 50)},
+	} {
+		result, err := b.Decrypt(msg.ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, msg.plaintext) {
+			t.Fatalf("bad message: got %q, not %q", result, msg.plaintext)
+		}
+	}
+}
+
+func TestPaddingNotNegotiated(t *testing.T) {
+	var privA, privB [32]byte
+	io.ReadFull(rand.Reader, privA[:])
+	io.ReadFull(rand.Reader, privB[:])
+	a, b := mustNew(privA), mustNew(privB)
+	// b is an older peer that doesn't know about padding
+	b.kxFeatures = 0
+
+	kxA, err := a.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kxB, err := b.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err := json.Marshal(kxB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(marshalled, []byte("features")) {
+		t.Fatalf("older key exchange shouldn't have features: %s", marshalled)
+	}
+	if err := a.CompleteKeyExchange(kxB); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CompleteKeyExchange(kxA); err != nil {
+		t.Fatal(err)
+	}
+	if _, padded := a.Padding(); padded {
+		t.Fatal("padding was used with an older peer")
+	}
+
+	msg := []byte("no padding")
+	encrypted, err := a.Encrypt(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, msg) {
+		t.Fatalf("bad message: got %q, not %q", result, msg)
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	var priv [32]byte
+	io.ReadFull(rand.Reader, priv[:])
+	kx, err := mustNew(priv).GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	marshalled, err := kx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kxActual KeyExchange
+	if err := kxActual.UnmarshalBinary(marshalled); err != nil {
+		t.Fatal(err)
+	}
+	if kxActual != kx {
+		t.Fatalf("KeyExchange doesn't match; expected %+v, got %+v", kx, kxActual)
+	}
+
+	if err := kxActual.UnmarshalBinary(marshalled[:len(marshalled)-1]); err == nil {
+		t.Fatal("truncated key exchange was accepted")
+	}
+	if err := kxActual.UnmarshalBinary(append(marshalled, 0)); err == nil {
+		t.Fatal("key exchange with trailing data was accepted")
+	}
+
+	// Sections announced by flags are skipped, whatever they contain
+	withSections := append([]byte(nil), marshalled[:binaryKeyExchangeSize]...)
+	withSections[2] |= kxFlagSignature | kxFlagPrekey
+	withSections = append(withSections, 0, 3, 'a', 'b', 'c', 0, 0)
+	withSections = append(withSections, marshalled[binaryKeyExchangeSize:]...)
+	kxActual = KeyExchange{}
+	if err := kxActual.UnmarshalBinary(withSections); err != nil {
+		t.Fatal(err)
+	}
+	if kxActual != kx {
+		t.Fatalf("KeyExchange doesn't match; expected %+v, got %+v", kx, kxActual)
+	}
+	if err := kxActual.UnmarshalBinary(withSections[:len(withSections)-1]); err == nil {
+		t.Fatal("key exchange with truncated section was accepted")
+	}
+}
+
+func TestSuites(t *testing.T) {
+	for _, test := range []struct {
+		suitesA, suitesB uint32
+		expected         Suite
+	}{
+		{supportedSuites, supportedSuites, SuiteAESGCM},
+		{supportedSuites, 1 << SuiteSecretbox, SuiteSecretbox},
+		{supportedSuites, 0, SuiteLegacy},
+		{0, 0, SuiteLegacy},
+	} {
+		var privA, privB [32]byte
+		io.ReadFull(rand.Reader, privA[:])
+		io.ReadFull(rand.Reader, privB[:])
+		a, b := mustNew(privA), mustNew(privB)
+		a.kxSuites, b.kxSuites = test.suitesA, test.suitesB
+
+		kxA, err := a.GetKeyExchangeMaterial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		kxB, err := b.GetKeyExchangeMaterial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.CompleteKeyExchange(kxB); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.CompleteKeyExchange(kxA); err != nil {
+			t.Fatal(err)
+		}
+		if a.Suite() != test.expected || b.Suite() != test.expected {
+			t.Fatalf("%b/%b: expected %s, got %s and %s", test.suitesA, test.suitesB, test.expected, a.Suite(), b.Suite())
+		}
+
+		for i := 0; i < 4; i++ {
+			msg := []byte("hello")
+			encrypted, err := a.Encrypt(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expected != SuiteLegacy && Suite(encrypted[0]) != test.expected {
+				t.Fatalf("%s: message starts with %d", test.expected, encrypted[0])
+			}
+			b = reinitRatchet(t, b)
+			result, err := b.Decrypt(encrypted)
+			if err != nil {
+				t.Fatalf("%s: %s", test.expected, err)
+			}
+			if !bytes.Equal(result, msg) {
+				t.Fatalf("%s: bad message: got %q, not %q", test.expected, result, msg)
+			}
+			a, b = b, a
+		}
+	}
+}
+
+func TestSuiteMismatch(t *testing.T) {
+	a, b := pairedRatchet()
+	encrypted, err := a.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted[0] = byte(SuiteSecretbox)
+	if _, err := b.Decrypt(encrypted); err == nil {
+		t.Fatal("message with another suite was accepted")
+	}
+}
+
+func TestAssociatedData(t *testing.T) {
+	for _, suites := range []uint32{0, 1 << SuiteSecretbox, 1 << SuiteAESGCM} {
+		var privA, privB [32]byte
+		io.ReadFull(rand.Reader, privA[:])
+		io.ReadFull(rand.Reader, privB[:])
+		a, b := mustNew(privA), mustNew(privB)
+		a.kxSuites, b.kxSuites = suites, suites
+		kxA, _ := a.GetKeyExchangeMaterial()
+		kxB, _ := b.GetKeyExchangeMaterial()
+		if err := a.CompleteKeyExchange(kxB); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.CompleteKeyExchange(kxA); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			encrypted, err := a.EncryptAD([]byte("hello"), []byte("context"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.DecryptAD(encrypted, []byte("other context")); err == nil {
+				t.Fatalf("%s: message was accepted with the wrong associated data", a.Suite())
+			}
+			if _, err := b.Decrypt(encrypted); err == nil {
+				t.Fatalf("%s: message was accepted without associated data", a.Suite())
+			}
+			result, err := b.DecryptAD(encrypted, []byte("context"))
+			if err != nil {
+				t.Fatalf("%s: %s", a.Suite(), err)
+			}
+			if string(result) != "hello" {
+				t.Fatalf("%s: bad message %q", a.Suite(), result)
+			}
+			a, b = b, a
+		}
+
+		if a.Suite() == SuiteLegacy {
+			continue
+		}
+		// The identity keys are bound to every message
+		encrypted, err := a.Encrypt([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		theirIdentity := b.theirIdentityPublic
+		b.theirIdentityPublic[0] ^= 1
+		if _, err := b.Decrypt(encrypted); err == nil {
+			t.Fatalf("%s: message was accepted with another identity", a.Suite())
+		}
+		b.theirIdentityPublic = theirIdentity
+		if _, err := b.Decrypt(encrypted); err != nil {
+			t.Fatalf("%s: %s", a.Suite(), err)
+		}
+	}
+}
+
+func TestSuiteKDF(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, 96)
+	root, shared := [32]byte{1}, [32]byte{2}
+	sc := scratches.Get().(*scratch)
+	defer scratches.Put(sc)
+
+	var out, expected [32]byte
+	cipherSuites[SuiteSecretbox].deriveKey(sc, &out, secret, chainKeyLabel)
+	h := hmac.New(sha256.New, secret)
+	h.Write(chainKeyLabel)
+	h.Sum(expected[:0])
+	if out != expected {
+		t.Fatalf("bad HMAC derivation %x, expected %x", out, expected)
+	}
+
+	cipherSuites[SuiteAESGCM].deriveKey(sc, &out, secret[:32], chainKeyLabel)
+	io.ReadFull(hkdf.Expand(sha256.New, secret[:32], chainKeyLabel), expected[:])
+	if out != expected {
+		t.Fatalf("bad HKDF derivation %x, expected %x", out, expected)
+	}
+
+	if prk := cipherSuites[SuiteSecretbox].handshakeSecret(sc, &out, secret); !bytes.Equal(prk, secret) {
+		t.Fatal("the HMAC handshake secret isn't the key material")
+	}
+	prk := cipherSuites[SuiteAESGCM].handshakeSecret(sc, &out, secret)
+	if !bytes.Equal(prk, hkdf.Extract(sha256.New, secret, nil)) {
+		t.Fatalf("bad HKDF handshake secret %x", prk)
+	}
+
+	cipherSuites[SuiteSecretbox].rootUpdate(sc, &out, &root, &shared)
+	sha := sha256.New()
+	sha.Write(rootKeyUpdateLabel)
+	sha.Write(root[:])
+	sha.Write(shared[:])
+	sha.Sum(expected[:0])
+	if out != expected {
+		t.Fatalf("bad root update %x, expected %x", out, expected)
+	}
+
+	cipherSuites[SuiteAESGCM].rootUpdate(sc, &out, &root, &shared)
+	copy(expected[:], hkdf.Extract(sha256.New, shared[:], root[:]))
+	if out != expected {
+		t.Fatalf("bad HKDF root update %x, expected %x", out, expected)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	a, b := pairedRatchet()
+	b.SetPadding(PadNone)
+	for i := 0; i < 4; i++ {
+		prefix := []byte("prefix")
+		sealed, err := a.Seal(prefix, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(sealed, prefix) {
+			t.Fatal("Seal didn't append to out")
+		}
+		opened, err := b.Open(prefix, sealed[len(prefix):])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(opened) != "prefixhello" {
+			t.Fatalf("bad message %q", opened)
+		}
+		a, b = b, a
+	}
+}
+
+func benchmarkSealOpen(b *testing.B, suites uint32, reuse bool) {
+	var privA, privB [32]byte
+	io.ReadFull(rand.Reader, privA[:])
+	io.ReadFull(rand.Reader, privB[:])
+	alice, bob := mustNew(privA), mustNew(privB)
+	alice.kxSuites, bob.kxSuites = suites, suites
+	kxA, _ := alice.GetKeyExchangeMaterial()
+	kxB, _ := bob.GetKeyExchangeMaterial()
+	alice.CompleteKeyExchange(kxB)
+	bob.CompleteKeyExchange(kxA)
+
+	msg := make([]byte, 1024)
+	sealed := make([]byte, 0, 2048)
+	opened := make([]byte, 0, 2048)
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if reuse {
+			sealed, err = alice.Seal(sealed[:0], msg)
+			if err == nil {
+				opened, err = bob.Open(opened[:0], sealed)
+			}
+		} else {
+			sealed, err = alice.Encrypt(msg)
+			if err == nil {
+				opened, err = bob.Decrypt(sealed)
+			}
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestSealOpenAllocs checks that, once the ratchets are established,
+// sealing and opening with the secretbox suites doesn't allocate.
+func TestSealOpenAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are counted wrongly with the race detector")
+	}
+	for _, suites := range []uint32{0, 1 << SuiteSecretbox} {
+		var privA, privB [32]byte
+		io.ReadFull(rand.Reader, privA[:])
+		io.ReadFull(rand.Reader, privB[:])
+		alice, bob := mustNew(privA), mustNew(privB)
+		alice.kxSuites, bob.kxSuites = suites, suites
+		kxA, _ := alice.GetKeyExchangeMaterial()
+		kxB, _ := bob.GetKeyExchangeMaterial()
+		alice.CompleteKeyExchange(kxB)
+		bob.CompleteKeyExchange(kxA)
+
+		msg := make([]byte, 1024)
+		sealed := make([]byte, 0, 2048)
+		opened := make([]byte, 0, 2048)
+		allocs := testing.AllocsPerRun(100, func() {
+			var err error
+			sealed, err = alice.Seal(sealed[:0], msg)
+			if err == nil {
+				opened, err = bob.Open(opened[:0], sealed)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("%s: %v allocations per Seal and Open", negotiateSuite(suites, suites), allocs)
+		}
+	}
+}
+
+func BenchmarkEncryptDecrypt(b *testing.B) { benchmarkSealOpen(b, supportedSuites, false) }
+func BenchmarkSealOpen(b *testing.B)       { benchmarkSealOpen(b, supportedSuites, true) }
+func BenchmarkEncryptDecryptSecretbox(b *testing.B) {
+	benchmarkSealOpen(b, 1<<SuiteSecretbox, false)
+}
+func BenchmarkSealOpenSecretbox(b *testing.B) { benchmarkSealOpen(b, 1<<SuiteSecretbox, true) }
+
+// skippedRatchets returns a pair of ratchets where b has saved the keys of
+// maxMissingMessages skipped messages in each of chains receiving chains.
+// skipped holds the skipped messages of each chain, oldest chain first.
+func skippedRatchets(tb testing.TB, chains int) (a, b *Ratchet, skipped [][][]byte) {
+	a, b = pairedRatchet()
+	for i := 0; i < chains; i++ {
+		var last []byte
+		var chain [][]byte
+		for j := 0; j <= maxMissingMessages; j++ {
+			var err error
+			if last, err = a.Encrypt([]byte("skipped")); err != nil {
+				tb.Fatal(err)
+			}
+			if j < maxMissingMessages {
+				chain = append(chain, last)
+			}
+		}
+		skipped = append(skipped, chain)
+		if _, err := b.Decrypt(last); err != nil {
+			tb.Fatal(err)
+		}
+		reply, err := b.Encrypt([]byte("reply"))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := a.Decrypt(reply); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return a, b, skipped
+}
+
+func TestSavedChainsLimit(t *testing.T) {
+	_, b, skipped := skippedRatchets(t, maxSavedChains+2)
+	if len(b.saved) != maxSavedChains {
+		t.Fatalf("%d saved chains, want %d", len(b.saved), maxSavedChains)
+	}
+	b = reinitRatchet(t, b)
+
+	// The two oldest chains were forgotten.
+	if _, err := b.Decrypt(skipped[1][0]); err == nil {
+		t.Fatal("decrypted a message of a forgotten chain")
+	}
+
+	oldest := skipped[2][0]
+	if result, err := b.Decrypt(oldest); err != nil || string(result) != "skipped" {
+		t.Fatalf("delayed message: %q, %v", result, err)
+	}
+	if _, err := b.Decrypt(oldest); err != ErrDuplicateMessage {
+		t.Fatalf("expected ErrDuplicateMessage, got %v", err)
+	}
+	// The chain of the delayed message is now the most recently used.
+	for _, chain := range b.saved[1:] {
+		if chain.headerKey == b.saved[0].headerKey {
+			t.Fatal("chain saved twice")
+		}
+	}
+	if len(b.saved[0].keys) != maxMissingMessages-1 {
+		t.Fatalf("most recently used chain has %d keys, want %d", len(b.saved[0].keys), maxMissingMessages-1)
+	}
+	b = reinitRatchet(t, b)
+	if len(b.saved[0].keys) != maxMissingMessages-1 {
+		t.Fatal("order of saved chains not kept when marshaling")
+	}
+}
+
+func benchmarkSkippedKeys(b *testing.B, delayed bool) {
+	alice, bob, _ := skippedRatchets(b, 50)
+	msg := make([]byte, 1024)
+	var first, second, opened []byte
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if first, err = alice.Seal(first[:0], msg); err != nil {
+			b.Fatal(err)
+		}
+		if delayed {
+			if second, err = alice.Seal(second[:0], msg); err != nil {
+				b.Fatal(err)
+			}
+			if opened, err = bob.Open(opened[:0], second); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if opened, err = bob.Open(opened[:0], first); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSkippedKeys decrypts messages in order while 400 keys of
+// skipped messages are saved.
+func BenchmarkSkippedKeys(b *testing.B) { benchmarkSkippedKeys(b, false) }
+
+// BenchmarkSkippedKeysDelayed decrypts messages out of order while 400
+// keys of skipped messages are saved.
+func BenchmarkSkippedKeysDelayed(b *testing.B) { benchmarkSkippedKeys(b, true) }
+
+// BenchmarkSkippedKeysOldChains decrypts delayed messages of older
+// chains while maxSavedChains chains are saved. Each message is from the
+// least recently used chain, so the header keys of all the others are
+// tried first.
+func BenchmarkSkippedKeysOldChains(b *testing.B) {
+	var bob *Ratchet
+	var delayed [][]byte
+	var opened []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if len(delayed) == 0 {
+			b.StopTimer()
+			var skipped [][][]byte
+			_, bob, skipped = skippedRatchets(b, maxSavedChains)
+			// Leave out the current receiving chain, and take the
+			// chains round-robin, oldest first.
+			for j := 0; j < maxMissingMessages; j++ {
+				for _, chain := range skipped[:len(skipped)-1] {
+					delayed = append(delayed, chain[j])
+				}
+			}
+			b.StartTimer()
+		}
+		var err error
+		if opened, err = bob.Open(opened[:0], delayed[0]); err != nil {
+			b.Fatal(err)
+		}
+		delayed = delayed[1:]
+	}
+}
+
+func TestReset(t *testing.T) {
+	a, b := pairedRatchet()
+
+	// a lost its state, and starts a new session with b
+	newA := mustNew(a.myIdentityPrivate)
+	if err := newA.MarkReset(b.myIdentityPublic); err != nil {
+		t.Fatal(err)
+	}
+	kx, err := newA.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kx.IsReset() {
+		t.Fatal("key exchange isn't marked as a reset")
+	}
+	if err := b.CheckReset(kx); err != nil {
+		t.Fatal(err)
+	}
+	if identity, ok := newA.PeerIdentity(); !ok || identity != b.myIdentityPublic {
+		t.Fatal("wrong peer identity after MarkReset")
+	}
+
+	// The MAC survives both encodings
+	marshalled, err := kx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromBinary KeyExchange
+	if err := fromBinary.UnmarshalBinary(marshalled); err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err = json.Marshal(kx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON KeyExchange
+	if err := json.Unmarshal(marshalled, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if fromBinary != kx || fromJSON != kx {
+		t.Fatalf("KeyExchange doesn't match; expected %+v, got %+v and %+v", kx, fromBinary, fromJSON)
+	}
+
+	// A key exchange without MAC, or changed after the MAC, or
+	// from someone else, is not a reset of the session with a.
+	plain, err := mustNew(a.myIdentityPrivate).GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := kx
+	tampered.Suites = 1 << SuiteLegacy
+	other := mustNew([32]byte{1})
+	other.MarkReset(b.myIdentityPublic)
+	otherKX, err := other.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []KeyExchange{plain, tampered, otherKX} {
+		if err := b.CheckReset(invalid); err != ErrInvalidReset {
+			t.Fatalf("got %v, want ErrInvalidReset", err)
+		}
+	}
+
+	// The new session works, and the state of newA survives a reload
+	newB := mustNew(b.myIdentityPrivate)
+	kxB, err := newB.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newB.CompleteKeyExchange(kx); err != nil {
+		t.Fatal(err)
+	}
+	if err := reinitRatchet(t, newB).CheckReset(kx); err != ErrHandshakeComplete {
+		t.Fatalf("got %v for the reset that created the session, want ErrHandshakeComplete", err)
+	}
+	newA = reinitRatchet(t, newA)
+	if kxAgain, err := newA.GetKeyExchangeMaterial(); err != nil || kxAgain != kx {
+		t.Fatal("key exchange changed after reload")
+	}
+	if err := newA.CompleteKeyExchange(kxB); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := newB.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newA.Decrypt(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old session can't decrypt messages of the new one
+	if _, err := a.Decrypt(msg); err != ErrCannotDecrypt {
+		t.Fatalf("got %v, want ErrCannotDecrypt", err)
+	}
+
+	// A reset only completes with the peer it was meant for
+	wrongPeer := mustNew(a.myIdentityPrivate)
+	wrongPeer.MarkReset(b.myIdentityPublic)
+	if err := wrongPeer.CompleteKeyExchange(otherKX); err != ErrInvalidReset {
+		t.Fatalf("got %v, want ErrInvalidReset", err)
+	}
+}
+
+func TestResetReplay(t *testing.T) {
+	a, b := pairedRatchet()
+
+	// a resets the session twice; each new session of b follows the
+	// one it replaces
+	var kxs []KeyExchange
+	for i := 0; i < 2; i++ {
+		newA := mustNew(a.myIdentityPrivate)
+		if err := newA.MarkReset(b.myIdentityPublic); err != nil {
+			t.Fatal(err)
+		}
+		kx, err := newA.GetKeyExchangeMaterial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.CheckReset(kx); err != nil {
+			t.Fatal(err)
+		}
+		newB := mustNew(b.myIdentityPrivate)
+		newB.Follow(b)
+		if err := newB.CompleteKeyExchange(kx); err != nil {
+			t.Fatal(err)
+		}
+		b = newB
+		kxs = append(kxs, kx)
+	}
+
+	b = reinitRatchet(t, b)
+	if err := b.CheckReset(kxs[0]); err != ErrInvalidReset {
+		t.Fatalf("got %v for a replayed reset, want ErrInvalidReset", err)
+	}
+	if err := b.CheckReset(kxs[1]); err != ErrHandshakeComplete {
+		t.Fatalf("got %v for the reset that created the session, want ErrHandshakeComplete", err)
+	}
+	for _, kx := range kxs {
+		if b.IsNewKeyExchange(kx) {
+			t.Fatal("a known key exchange was taken for a new one")
+		}
+	}
+	newA := mustNew(a.myIdentityPrivate)
+	kx, err := newA.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.IsNewKeyExchange(kx) {
+		t.Fatal("a new key exchange was taken for a known one")
+	}
+
+	// Only the last sessions are remembered
+	for i := 0; i < maxSeenResets; i++ {
+		old := mustNew(b.myIdentityPrivate)
+		old.theirKxPublic0[0] = byte(i + 1)
+		b.Follow(old)
+	}
+	if len(b.seenResets) != maxSeenResets || b.seenReset(&kxs[0].Dh) {
+		t.Fatalf("%d replaced sessions remembered, want the last %d", len(b.seenResets), maxSeenResets)
+	}
+}
@@ -0,0 +1,156 @@
+package ratchet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// A reset replaces a session that one of the peers can't use anymore, for
+// example because they lost their state or restored an old backup. The
+// peer who lost it can't send anything through the old session, so the
+// new key exchange is authenticated with the DH of both identity keys,
+// which only the two peers can compute:
+//
+//	ResetMAC = HMAC-SHA256(DH(identities), label | identity | dh | dh1 | features | suites)
+
+// resetMACSize is the size of KeyExchange.ResetMAC.
+const resetMACSize = sha256.Size
+
+var resetLabel = []byte("goax session reset")
+
+// ErrInvalidReset is returned by CheckReset when a key exchange is not a
+// reset of the session, or its MAC is wrong.
+var ErrInvalidReset = errors.New("ratchet: invalid session reset")
+
+// resetMAC sets out to the reset MAC of kx, exchanged between the owners
+// of two identity keys. One of them is given by its private part.
+func resetMAC(out, myIdentityPrivate, theirIdentityPublic *[32]byte, kx *KeyExchange) error {
+	var shared [32]byte
+	defer wipe(shared[:])
+	if err := dhShared(&shared, myIdentityPrivate, theirIdentityPublic); err != nil {
+		return err
+	}
+
+	var ints [8]byte
+	binary.BigEndian.PutUint32(ints[:4], kx.Features)
+	binary.BigEndian.PutUint32(ints[4:], kx.Suites)
+
+	mac := hmac.New(sha256.New, shared[:])
+	mac.Write(resetLabel)
+	mac.Write(kx.IdentityPublic[:])
+	mac.Write(kx.Dh[:])
+	mac.Write(kx.Dh1[:])
+	mac.Write(ints[:])
+	mac.Sum(out[:0])
+	return nil
+}
+
+// MarkReset makes the key exchange of r a reset of the session with the
+// peer whose identity key is theirIdentity: GetKeyExchangeMaterial adds a
+// ResetMAC, and only a key exchange from that peer is accepted.
+func (r *Ratchet) MarkReset(theirIdentity [32]byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.isHandshakeComplete {
+		return ErrHandshakeComplete
+	}
+	if !validPublicKey(&theirIdentity) {
+		return ErrInvalidPublicKey
+	}
+	r.theirIdentityPublic = theirIdentity
+	r.reset = true
+	return nil
+}
+
+// CheckReset verifies that kx resets the session of r: it must come from
+// the same peer and carry a valid ResetMAC. It returns ErrInvalidReset
+// otherwise, or if kx created a session that r replaced, and
+// ErrHandshakeComplete if kx is the key exchange that created the session
+// of r.
+func (r *Ratchet) CheckReset(kx KeyExchange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.isHandshakeComplete || isZeroKey(&r.theirIdentityPublic) ||
+		kx.IdentityPublic != r.theirIdentityPublic || !kx.IsReset() {
+		return ErrInvalidReset
+	}
+	if kx.Dh == r.theirKxPublic0 {
+		return ErrHandshakeComplete
+	}
+	if r.seenReset(&kx.Dh) {
+		// An older reset, replayed.
+		return ErrInvalidReset
+	}
+	var mac [32]byte
+	err := resetMAC(&mac, &r.myIdentityPrivate, &r.theirIdentityPublic, &kx)
+	if err != nil || !hmac.Equal(mac[:], kx.ResetMAC[:]) {
+		return ErrInvalidReset
+	}
+	return nil
+}
+
+// Follow records that r replaces the session of old, so that CheckReset
+// rejects the key exchanges that created old and the sessions it replaced,
+// up to the last maxSeenResets of them.
+func (r *Ratchet) Follow(old *Ratchet) {
+	old.mu.Lock()
+	seen := append([][32]byte(nil), old.seenResets...)
+	if !isZeroKey(&old.theirKxPublic0) {
+		seen = append(seen, old.theirKxPublic0)
+	}
+	old.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range seen {
+		if !r.seenReset(&seen[i]) {
+			r.seenResets = append(r.seenResets, seen[i])
+		}
+	}
+	if len(r.seenResets) > maxSeenResets {
+		r.seenResets = append([][32]byte(nil), r.seenResets[len(r.seenResets)-maxSeenResets:]...)
+	}
+}
+
+func (r *Ratchet) seenReset(dh *[32]byte) bool {
+	for i := range r.seenResets {
+		if r.seenResets[i] == *dh {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNewKeyExchange tells if kx is another key exchange than the one that
+// completed the session of r, or those of the sessions it replaced. It is
+// false for sessions completed by older versions, which didn't keep it.
+func (r *Ratchet) IsNewKeyExchange(kx KeyExchange) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.isHandshakeComplete || isZeroKey(&r.theirKxPublic0) {
+		return false
+	}
+	return kx.Dh != r.theirKxPublic0 && !r.seenReset(&kx.Dh)
+}
+
+// IsReset tells if the session of r is a reset of a previous one, started
+// by either peer.
+func (r *Ratchet) IsReset() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reset || r.peerReset
+}
+
+// PeerIdentity returns the identity key of the peer, if known: after the
+// key exchange, or after MarkReset. Ratchets completed by older versions
+// didn't keep it.
+func (r *Ratchet) PeerIdentity() (identity [32]byte, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.isHandshakeComplete && !r.reset {
+		return identity, false
+	}
+	return r.theirIdentityPublic, !isZeroKey(&r.theirIdentityPublic)
+}
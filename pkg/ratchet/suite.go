@@ -0,0 +1,313 @@
+package ratchet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"sync"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Suite identifies the primitives a ratchet uses to derive keys and to
+// encrypt messages. Both peers advertise the suites they support in
+// their key exchange, and the ratchet uses the highest one they have in
+// common.
+//
+// Messages of every suite but SuiteLegacy start with the suite byte:
+//
+//	suite | header nonce | sealed header | sealed message
+type Suite uint8
+
+const (
+	// SuiteLegacy is the original construction, used with peers that
+	// don't advertise any suite: secretbox with keys derived by
+	// HMAC-SHA256. Its messages have no leading suite byte.
+	SuiteLegacy Suite = iota
+	// SuiteSecretbox is the same construction as SuiteLegacy, with the
+	// leading suite byte. Since secretbox has no additional data, keys
+	// are replaced by HMAC-SHA256(key, additional data) when there is
+	// some.
+	SuiteSecretbox
+	// SuiteAESGCM uses AES-256-GCM to encrypt and HKDF-SHA256 to derive
+	// keys. The suite byte and the sealed header are authenticated as
+	// additional data of the message.
+	SuiteAESGCM
+)
+
+func (s Suite) String() string {
+	switch s {
+	case SuiteLegacy:
+		return "legacy"
+	case SuiteSecretbox:
+		return "secretbox-hmac-sha256"
+	case SuiteAESGCM:
+		return "aes256gcm-hkdf-sha256"
+	default:
+		return "unknown"
+	}
+}
+
+// supportedSuites is the bitmask, indexed by Suite, of the suites
+// advertised by new ratchets. SuiteLegacy is always supported and never
+// advertised.
+const supportedSuites = 1<<SuiteSecretbox | 1<<SuiteAESGCM
+
+// negotiateSuite returns the highest suite in both bitmasks. It is
+// symmetric, so both peers agree on the result.
+func negotiateSuite(ours, theirs uint32) Suite {
+	common := ours & theirs
+	for s := SuiteAESGCM; s > SuiteLegacy; s-- {
+		if common&(1<<s) != 0 {
+			return s
+		}
+	}
+	return SuiteLegacy
+}
+
+var errUnknownSuite = errors.New("ratchet: unknown cipher suite")
+
+type kdfKind int
+
+const (
+	// kdfHMAC derives keys as HMAC-SHA256(secret, label).
+	kdfHMAC kdfKind = iota
+	// kdfHKDFExpand derives keys with HKDF-Expand-SHA256, the secret being
+	// the pseudorandom key and the label the info. HKDF-Extract is only
+	// done on DH outputs, in handshakeSecret and rootUpdate: the secrets
+	// given to deriveKey are already pseudorandom keys, so it is skipped
+	// for them as RFC 5869 section 3.3 allows.
+	kdfHKDFExpand
+)
+
+type aeadKind int
+
+const (
+	aeadSecretbox aeadKind = iota
+	aeadAESGCM
+)
+
+// cipherSuite holds the primitives of a Suite. They are selected with
+// switches rather than function values, so that the compiler can keep
+// the buffers given to them on the stack.
+type cipherSuite struct {
+	// versioned is true if messages start with the suite byte.
+	versioned bool
+	kdf       kdfKind
+	aead      aeadKind
+	nonceSize int
+	overhead  int
+}
+
+// maxHeaderSize is the largest headerSize of all suites.
+const maxHeaderSize = nonceInHeaderOffset + 24
+
+// headerSize is the size, in bytes, of a header's plaintext contents.
+func (cs *cipherSuite) headerSize() int {
+	return 4 /* uint32 message count */ +
+		4 /* uint32 previous message count */ +
+		32 /* curve25519 ratchet public */ +
+		cs.nonceSize /* nonce for message */
+}
+
+// sealedHeaderSize is the size, in bytes, of an encrypted header.
+func (cs *cipherSuite) sealedHeaderSize() int {
+	return cs.nonceSize + cs.headerSize() + cs.overhead
+}
+
+// split cuts a message of suite s into its authenticated prefix, its
+// sealed header, nonce included, and its sealed message. A message of
+// another suite, or too small for the header of s, may belong to another
+// session: the error is then ErrCannotDecrypt.
+func (cs *cipherSuite) split(ciphertext []byte, s Suite) (prefix, sealedHeader, sealedMessage []byte, err error) {
+	if cs.versioned {
+		if len(ciphertext) < 1 {
+			return nil, nil, nil, errors.New("ratchet: message too small to be valid")
+		}
+		if Suite(ciphertext[0]) != s {
+			return nil, nil, nil, ErrCannotDecrypt
+		}
+		prefix, ciphertext = ciphertext[:1], ciphertext[1:]
+	}
+	if len(ciphertext) < cs.sealedHeaderSize() {
+		return nil, nil, nil, ErrCannotDecrypt
+	}
+	return prefix, ciphertext[:cs.sealedHeaderSize()], ciphertext[cs.sealedHeaderSize():], nil
+}
+
+// hkdfCounter ends the info of the first, and only, block of HKDF-Expand.
+var hkdfCounter = []byte{1}
+
+// deriveKey derives the key for label from secret into out, which may
+// alias secret.
+func (cs *cipherSuite) deriveKey(sc *scratch, out *[32]byte, secret, label []byte) {
+	switch cs.kdf {
+	case kdfHKDFExpand:
+		sc.mac(out, secret, label, hkdfCounter)
+	default:
+		sc.mac(out, secret, label)
+	}
+}
+
+// handshakeSecret returns the secret to derive the first keys from, given
+// the DH outputs of the key exchange: their HKDF-Extract, with no salt,
+// written to prk, or keyMaterial itself with kdfHMAC.
+func (cs *cipherSuite) handshakeSecret(sc *scratch, prk *[32]byte, keyMaterial []byte) []byte {
+	if cs.kdf != kdfHKDFExpand {
+		return keyMaterial
+	}
+	sc.mac(prk, nil, keyMaterial)
+	return prk[:]
+}
+
+// rootUpdate mixes the output of a DH ratchet step into the root key and
+// returns the secret to derive the new keys from.
+func (cs *cipherSuite) rootUpdate(sc *scratch, keyMaterial, rootKey, sharedKey *[32]byte) {
+	switch cs.kdf {
+	case kdfHKDFExpand:
+		// HKDF-Extract, with the root key as salt
+		sc.mac(keyMaterial, rootKey[:], sharedKey[:])
+	default:
+		sc.inner.Reset()
+		sc.write(sc.inner, rootKeyUpdateLabel)
+		sc.write(sc.inner, rootKey[:])
+		sc.write(sc.inner, sharedKey[:])
+		sc.inner.Sum(sc.sum[:0])
+		copy(keyMaterial[:], sc.sum[:])
+	}
+}
+
+// seal and open work like secretbox.Seal and secretbox.Open, with
+// additional data. Since secretbox has none, the suites based on it
+// replace the key by HMAC-SHA256(key, additional data) when there is
+// some; keys are unchanged otherwise, which keeps SuiteLegacy compatible
+// with older peers.
+func (cs *cipherSuite) seal(sc *scratch, out, msg, nonce []byte, key *[32]byte, ad []byte) []byte {
+	if cs.aead == aeadAESGCM {
+		return newGCM(key).Seal(out, nonce, msg, ad)
+	}
+	var n [24]byte
+	copy(n[:], nonce)
+	return secretbox.Seal(out, msg, &n, sc.secretboxKey(key, ad))
+}
+
+func (cs *cipherSuite) open(sc *scratch, out, box, nonce []byte, key *[32]byte, ad []byte) ([]byte, bool) {
+	if cs.aead == aeadAESGCM {
+		msg, err := newGCM(key).Open(out, nonce, box, ad)
+		return msg, err == nil
+	}
+	var n [24]byte
+	copy(n[:], nonce)
+	return secretbox.Open(out, box, &n, sc.secretboxKey(key, ad))
+}
+
+func newGCM(key *[32]byte) cipher.AEAD {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// cipherSuites is the registry of the known suites.
+var cipherSuites = map[Suite]*cipherSuite{
+	SuiteLegacy:    {kdf: kdfHMAC, aead: aeadSecretbox, nonceSize: 24, overhead: secretbox.Overhead},
+	SuiteSecretbox: {versioned: true, kdf: kdfHMAC, aead: aeadSecretbox, nonceSize: 24, overhead: secretbox.Overhead},
+	SuiteAESGCM:    {versioned: true, kdf: kdfHKDFExpand, aead: aeadAESGCM, nonceSize: 12, overhead: 16},
+}
+
+// scratch holds the buffers and hash states needed to encrypt or decrypt
+// a message, so that they can be reused from one message to the next.
+type scratch struct {
+	inner, outer hash.Hash
+	ipad, opad   [sha256.BlockSize]byte
+	sum, key     [32]byte
+
+	// random receives the random nonces of a message, followed by the
+	// new ratchet private key if any.
+	random [2*24 + 32]byte
+	// header receives the plaintext of a header.
+	header [maxHeaderSize]byte
+	// ad, padded and buf grow as needed.
+	ad, padded, buf []byte
+}
+
+var scratches = sync.Pool{
+	New: func() interface{} {
+		return &scratch{inner: sha256.New(), outer: sha256.New()}
+	},
+}
+
+func getScratch() *scratch {
+	return scratches.Get().(*scratch)
+}
+
+// putScratch wipes sc and returns it to the pool.
+func putScratch(sc *scratch) {
+	sc.wipe()
+	scratches.Put(sc)
+}
+
+// wipe overwrites the secrets held by sc. The hash states can only be
+// reset, which leaves their internal buffer as is.
+func (sc *scratch) wipe() {
+	sc.inner.Reset()
+	sc.outer.Reset()
+	wipe(sc.ipad[:])
+	wipe(sc.opad[:])
+	wipe(sc.sum[:])
+	wipe(sc.key[:])
+	wipe(sc.random[:])
+	wipe(sc.header[:])
+	wipe(sc.ad[:cap(sc.ad)])
+	wipe(sc.padded[:cap(sc.padded)])
+	wipe(sc.buf[:cap(sc.buf)])
+}
+
+// mac sets out to HMAC-SHA256(key, parts...). out may alias key.
+func (sc *scratch) mac(out *[32]byte, key []byte, parts ...[]byte) {
+	if len(key) > sha256.BlockSize {
+		sc.inner.Reset()
+		sc.write(sc.inner, key)
+		key = sc.inner.Sum(sc.key[:0])
+	}
+	for i := range sc.ipad {
+		sc.ipad[i], sc.opad[i] = 0x36, 0x5c
+	}
+	for i, b := range key {
+		sc.ipad[i] ^= b
+		sc.opad[i] ^= b
+	}
+
+	sc.inner.Reset()
+	sc.inner.Write(sc.ipad[:])
+	for _, part := range parts {
+		sc.write(sc.inner, part)
+	}
+	sum := sc.inner.Sum(sc.sum[:0])
+	sc.outer.Reset()
+	sc.outer.Write(sc.opad[:])
+	sc.outer.Write(sum)
+	copy(out[:], sc.outer.Sum(sc.sum[:0]))
+}
+
+// write writes p to h through sc.buf, so that p doesn't escape to the
+// heap when it's on the stack.
+func (sc *scratch) write(h hash.Hash, p []byte) {
+	sc.buf = append(sc.buf[:0], p...)
+	h.Write(sc.buf)
+}
+
+func (sc *scratch) secretboxKey(key *[32]byte, ad []byte) *[32]byte {
+	if len(ad) == 0 {
+		return key
+	}
+	sc.mac(&sc.key, key[:], ad)
+	return &sc.key
+}
@@ -0,0 +1,284 @@
+# Independent Double Ratchet (Signal spec, sections 3 and 4) producing
+# whole-conversation vectors for goax's DoubleRatchet. Run it from this
+# directory with python3: it checks the KDF vectors of
+# doubleratchet_kdf.json and rewrites doubleratchet_messages.json with new
+# random conversations.
+import hashlib, hmac, json, os, struct
+
+# ---- AES (FIPS-197) ----
+def xtime(a): return ((a << 1) ^ 0x1b) & 0xff if a & 0x80 else a << 1
+def gmul(a, b):
+    r = 0
+    while b:
+        if b & 1: r ^= a
+        a = xtime(a); b >>= 1
+    return r
+SBOX = [0]*256
+for x in range(256):
+    inv = 0 if x == 0 else next(y for y in range(1, 256) if gmul(x, y) == 1)
+    s = inv
+    for i in range(1, 5): s ^= ((inv << i) | (inv >> (8 - i))) & 0xff
+    SBOX[x] = s ^ 0x63
+INV = [0]*256
+for i, s in enumerate(SBOX): INV[s] = i
+
+def expand_key(key):
+    nk = len(key)//4; nr = nk + 6
+    w = [list(key[4*i:4*i+4]) for i in range(nk)]
+    rcon = 1
+    for i in range(nk, 4*(nr+1)):
+        t = list(w[i-1])
+        if i % nk == 0:
+            t = [SBOX[b] for b in t[1:] + t[:1]]; t[0] ^= rcon; rcon = xtime(rcon)
+        elif nk > 6 and i % nk == 4:
+            t = [SBOX[b] for b in t]
+        w.append([a ^ b for a, b in zip(w[i-nk], t)])
+    return [sum(w[4*r:4*r+4], []) for r in range(nr+1)]
+
+def add(s, k): return [a ^ b for a, b in zip(s, k)]
+def shift(s): return [s[(c + r) % 4 * 4 + r] for c in range(4) for r in range(4)]
+def ishift(s): return [s[(c - r) % 4 * 4 + r] for c in range(4) for r in range(4)]
+def mix(s, m):
+    out = []
+    for c in range(4):
+        col = s[4*c:4*c+4]
+        out += [gmul(m[r][0], col[0]) ^ gmul(m[r][1], col[1]) ^ gmul(m[r][2], col[2]) ^ gmul(m[r][3], col[3]) for r in range(4)]
+    return out
+M = [[2,3,1,1],[1,2,3,1],[1,1,2,3],[3,1,1,2]]
+IM = [[14,11,13,9],[9,14,11,13],[13,9,14,11],[11,13,9,14]]
+def aes_enc(rk, b):
+    s = add(list(b), rk[0])
+    for r in range(1, len(rk)):
+        s = shift([SBOX[x] for x in s])
+        if r != len(rk)-1: s = mix(s, M)
+        s = add(s, rk[r])
+    return bytes(s)
+def aes_dec(rk, b):
+    s = add(list(b), rk[-1])
+    for r in range(len(rk)-2, -1, -1):
+        s = [INV[x] for x in ishift(s)]
+        s = add(s, rk[r])
+        if r != 0: s = mix(s, IM)
+    return bytes(s)
+assert aes_enc(expand_key(bytes(range(32))), bytes.fromhex("00112233445566778899aabbccddeeff")).hex() == "8ea2b7ca516745bfeafc49904b496089"
+assert aes_dec(expand_key(bytes(range(32))), bytes.fromhex("8ea2b7ca516745bfeafc49904b496089")).hex() == "00112233445566778899aabbccddeeff"
+
+def xor(a, b): return bytes(x ^ y for x, y in zip(a, b))
+def cbc_enc(key, iv, pt):
+    rk, out, prev = expand_key(key), b"", iv
+    for i in range(0, len(pt), 16):
+        prev = aes_enc(rk, xor(pt[i:i+16], prev)); out += prev
+    return out
+def cbc_dec(key, iv, ct):
+    rk, out, prev = expand_key(key), b"", iv
+    for i in range(0, len(ct), 16):
+        out += xor(aes_dec(rk, ct[i:i+16]), prev); prev = ct[i:i+16]
+    return out
+
+# ---- GCM (SP 800-38D), 96-bit nonces, no AAD ----
+def ghash_mul(x, y):
+    R = 0xe1 << 120; z = 0
+    for i in range(127, -1, -1):
+        if (x >> i) & 1: z ^= y
+        y = (y >> 1) ^ R if y & 1 else y >> 1
+    return z
+def gcm(key, nonce, data, encrypt):
+    rk = expand_key(key)
+    h = int.from_bytes(aes_enc(rk, bytes(16)), "big")
+    j0 = nonce + b"\0\0\0\1"
+    def ctr(i): return aes_enc(rk, nonce + struct.pack(">I", i))
+    stream = b"".join(ctr(2 + i) for i in range((len(data) + 15)//16))
+    out = xor(data, stream)
+    ct = out if encrypt else data
+    y = 0
+    padded = ct + bytes(-len(ct) % 16)
+    for i in range(0, len(padded), 16):
+        y = ghash_mul(y ^ int.from_bytes(padded[i:i+16], "big"), h)
+    y = ghash_mul(y ^ (len(ct)*8), h)
+    tag = xor(y.to_bytes(16, "big"), aes_enc(rk, j0))
+    return out, tag
+def gcm_seal(key, nonce, pt):
+    ct, tag = gcm(key, nonce, pt, True); return ct + tag
+def gcm_open(key, nonce, sealed):
+    pt, tag = gcm(key, nonce, sealed[:-16], False)
+    return pt if hmac.compare_digest(tag, sealed[-16:]) else None
+assert gcm_seal(bytes(32), bytes(12), bytes(16)).hex() == "cea7403d4d606b6e074ec5d3baf39d18d0d1c8a799996bf0265b98b5d48ab919"
+
+# ---- X25519 (RFC 7748) ----
+P = 2**255 - 19
+def x25519(k, u):
+    k = bytearray(k); k[0] &= 248; k[31] &= 127; k[31] |= 64
+    k = int.from_bytes(k, "little"); u = int.from_bytes(u, "little") & ((1 << 255) - 1)
+    x1, x2, z2, x3, z3, swap = u, 1, 0, u, 1, 0
+    for t in range(254, -1, -1):
+        kt = (k >> t) & 1; swap ^= kt
+        if swap: x2, x3, z2, z3 = x3, x2, z3, z2
+        swap = kt
+        A = x2 + z2; AA = A*A; B = x2 - z2; BB = B*B; E = AA - BB
+        C = x3 + z3; D = x3 - z3; DA = D*A; CB = C*B
+        x3 = (DA + CB)**2 % P; z3 = x1 * (DA - CB)**2 % P
+        x2 = AA*BB % P; z2 = E*(AA + 121665*E) % P
+    if swap: x2, x3, z2, z3 = x3, x2, z3, z2
+    return (x2 * pow(z2, P-2, P) % P).to_bytes(32, "little")
+BASE = (9).to_bytes(32, "little")
+assert x25519(bytes.fromhex("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"), BASE).hex() == "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"
+
+# ---- KDFs ----
+def hkdf(salt, ikm, info, n):
+    prk = hmac.new(salt if salt else bytes(32), ikm, hashlib.sha256).digest()
+    out, t, i = b"", b"", 1
+    while len(out) < n:
+        t = hmac.new(prk, t + info + bytes([i]), hashlib.sha256).digest(); out += t; i += 1
+    return out[:n]
+ROOT_INFO, MSG_INFO = b"WhisperRatchet", b"WhisperMessageKeys"
+
+class Party:
+    def __init__(self, rand, he):
+        self.rand, self.he = rand, he
+        self.DHs = self.DHr = self.CKs = self.CKr = None
+        self.Ns = self.Nr = self.PN = 0
+        self.HKs = self.HKr = self.NHKs = self.NHKr = None
+        self.skipped = {}
+    def take(self, n):
+        b, self.rand = self.rand[:n], self.rand[n:]
+        assert len(b) == n
+        return b
+    def generate_dh(self):
+        priv = self.take(32); return (priv, x25519(priv, BASE))
+    def kdf_rk(self, rk, dh_out):
+        out = hkdf(rk, dh_out, ROOT_INFO, 96 if self.he else 64)
+        return out[:32], out[32:64], (out[64:] if self.he else None)
+    @staticmethod
+    def kdf_ck(ck):
+        return hmac.new(ck, b"\x02", hashlib.sha256).digest(), hmac.new(ck, b"\x01", hashlib.sha256).digest()
+    @staticmethod
+    def encrypt(mk, pt, ad):
+        keys = hkdf(None, mk, MSG_INFO, 80)
+        pad = 16 - len(pt) % 16
+        ct = cbc_enc(keys[:32], keys[64:], pt + bytes([pad])*pad)
+        return ct + hmac.new(keys[32:64], ad + ct, hashlib.sha256).digest()
+    @staticmethod
+    def decrypt(mk, data, ad):
+        keys = hkdf(None, mk, MSG_INFO, 80)
+        ct, tag = data[:-32], data[-32:]
+        assert hmac.compare_digest(hmac.new(keys[32:64], ad + ct, hashlib.sha256).digest(), tag)
+        pt = cbc_dec(keys[:32], keys[64:], ct)
+        return pt[:-pt[-1]]
+    @staticmethod
+    def header(dh, pn, n): return dh + struct.pack(">II", pn, n)
+
+    def ratchet_encrypt(self, pt, ad):
+        self.CKs, mk = self.kdf_ck(self.CKs)
+        h = self.header(self.DHs[1], self.PN, self.Ns)
+        if self.he:
+            nonce = self.take(12)
+            h = nonce + gcm_seal(self.HKs, nonce, h)
+        self.Ns += 1
+        return h + self.encrypt(mk, pt, ad + h)
+
+    def ratchet_decrypt(self, msg, ad):
+        hsize = 12 + 40 + 16 if self.he else 40
+        raw, ct = msg[:hsize], msg[hsize:]
+        ad = ad + raw
+        if self.he:
+            for (hk, n), mk in list(self.skipped.items()):
+                h = gcm_open(hk, raw[:12], raw[12:])
+                if h is not None and struct.unpack(">I", h[36:40])[0] == n:
+                    del self.skipped[(hk, n)]
+                    return self.decrypt(mk, ct, ad)
+            h = gcm_open(self.HKr, raw[:12], raw[12:]) if self.HKr else None
+            step = False
+            if h is None:
+                h = gcm_open(self.NHKr, raw[:12], raw[12:]); step = True
+        else:
+            h = raw
+        dh, (pn, n) = h[:32], struct.unpack(">II", h[32:40])
+        if not self.he:
+            if (dh, n) in self.skipped:
+                return self.decrypt(self.skipped.pop((dh, n)), ct, ad)
+            step = dh != self.DHr
+        if step:
+            self.skip(pn)
+            self.dh_ratchet(dh)
+        self.skip(n)
+        self.CKr, mk = self.kdf_ck(self.CKr)
+        self.Nr += 1
+        return self.decrypt(mk, ct, ad)
+
+    def skip(self, until):
+        if self.CKr is None: return
+        while self.Nr < until:
+            self.CKr, mk = self.kdf_ck(self.CKr)
+            self.skipped[(self.HKr if self.he else self.DHr, self.Nr)] = mk
+            self.Nr += 1
+
+    def dh_ratchet(self, dh):
+        self.PN, self.Ns, self.Nr = self.Ns, 0, 0
+        if self.he: self.HKs, self.HKr = self.NHKs, self.NHKr
+        self.DHr = dh
+        self.RK, self.CKr, self.NHKr = self.kdf_rk(self.RK, x25519(self.DHs[0], self.DHr))
+        self.DHs = self.generate_dh()
+        self.RK, self.CKs, self.NHKs = self.kdf_rk(self.RK, x25519(self.DHs[0], self.DHr))
+
+def alice_init(rand, he, sk, bob_pub, shka, snhkb):
+    a = Party(rand, he)
+    a.DHs = a.generate_dh(); a.DHr = bob_pub
+    a.RK, a.CKs, a.NHKs = a.kdf_rk(sk, x25519(a.DHs[0], bob_pub))
+    if he: a.HKs, a.NHKr = shka, snhkb
+    return a
+def bob_init(rand, he, sk, bob_priv, shka, snhkb):
+    b = Party(rand, he)
+    b.DHs = (bob_priv, x25519(bob_priv, BASE)); b.RK = sk
+    if he: b.NHKs, b.NHKr = snhkb, shka
+    return b
+
+# A conversation, as (op, who, index): messages are encrypted in order and
+# delivered in the order of the "d" events, out of order at times.
+SCRIPT = [("e", "alice"), ("e", "alice"), ("e", "alice"), ("d", 1), ("d", 0),
+          ("e", "bob"), ("e", "bob"), ("d", 4), ("e", "alice"), ("d", 3), ("d", 5), ("d", 2),
+          ("e", "bob"), ("e", "alice"), ("d", 6), ("d", 7)]
+
+def conversation(he, desc):
+    r = os.urandom
+    sk, bob_priv, shk, snhk, ad = r(32), r(32), r(32), r(32), r(16)
+    arand, brand = r(32*8 + 12*8), r(32*8 + 12*8)
+    alice = alice_init(arand, he, sk, x25519(bob_priv, BASE), shk, snhk)
+    bob = bob_init(brand, he, sk, bob_priv, shk, snhk)
+    parties = {"alice": alice, "bob": bob}
+    msgs, events = [], []
+    for op, x in SCRIPT:
+        if op == "e":
+            pt = r(1 + len(msgs)*5)
+            msgs.append({"sender": x, "plaintext": pt.hex(), "ciphertext": parties[x].ratchet_encrypt(pt, ad).hex()})
+            events.append({"encrypt": len(msgs)-1})
+        else:
+            m = msgs[x]
+            receiver = parties["bob" if m["sender"] == "alice" else "alice"]
+            assert receiver.ratchet_decrypt(bytes.fromhex(m["ciphertext"]), ad).hex() == m["plaintext"]
+            events.append({"decrypt": x})
+    used = lambda p, full: full[:len(full)-len(p.rand)]
+    return {"description": desc, "header_encryption": he, "shared_key": sk.hex(), "bob_private": bob_priv.hex(),
+            "shared_header_key": shk.hex() if he else "", "shared_next_header_key": snhk.hex() if he else "",
+            "associated_data": ad.hex(), "alice_random": used(alice, arand).hex(), "bob_random": used(bob, brand).hex(),
+            "messages": msgs, "events": events}
+
+# The KDF vectors, recomputed from their inputs
+vectors = json.load(open("doubleratchet_kdf.json"))
+assert (vectors["root_info"], vectors["message_info"]) == (ROOT_INFO.decode(), MSG_INFO.decode())
+x = vectors["x25519"]
+assert x25519(bytes.fromhex(x["alice_private"]), bytes.fromhex(x["bob_public"])).hex() == x["shared"]
+assert x25519(bytes.fromhex(x["bob_private"]), bytes.fromhex(x["alice_public"])).hex() == x["shared"]
+for v in vectors["kdf"]:
+    rk, dh = bytes.fromhex(v["root_key"]), bytes.fromhex(v["dh_output"])
+    assert [k.hex() for k in Party(b"", False).kdf_rk(rk, dh)[:2]] == [v["kdf_rk"]["root_key"], v["kdf_rk"]["chain_key"]]
+    he = v["kdf_rk_he"]
+    assert [k.hex() for k in Party(b"", True).kdf_rk(rk, dh)] == [he["root_key"], he["chain_key"], he["next_header_key"]]
+    ck, mk = Party.kdf_ck(bytes.fromhex(v["chain_key"]))
+    assert [ck.hex(), mk.hex()] == [v["kdf_ck"]["chain_key"], v["kdf_ck"]["message_key"]]
+    keys = hkdf(None, bytes.fromhex(v["message_key"]), MSG_INFO, 80)
+    mks = v["message_keys"]
+    assert [keys[:32].hex(), keys[32:64].hex(), keys[64:].hex()] == [mks["encryption_key"], mks["authentication_key"], mks["iv"]]
+
+out = [conversation(False, "conversation with out-of-order messages"),
+       conversation(True, "the same with header encryption")]
+json.dump(out, open("doubleratchet_messages.json", "w"), indent=2)
@@ -0,0 +1,173 @@
+package senderkey
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Receiver decrypts the messages of the sender key of another member. It
+// is not safe for concurrent use.
+type Receiver struct {
+	group      [GroupSize]byte
+	keyID      uint32
+	chain      chain
+	signingKey [32]byte
+	// skipped are the keys of the messages that weren't received yet,
+	// by iteration.
+	skipped map[uint32][32]byte
+}
+
+// NewReceiver returns the Receiver of the sender key distributed by d.
+func NewReceiver(d Distribution) *Receiver {
+	return &Receiver{
+		group:      d.Group,
+		keyID:      d.KeyID,
+		chain:      chain{iteration: d.Iteration, key: d.ChainKey},
+		signingKey: d.SigningKey,
+		skipped:    make(map[uint32][32]byte),
+	}
+}
+
+// KeyID returns the identifier of the sender key.
+func (r *Receiver) KeyID() uint32 {
+	return r.keyID
+}
+
+// Decrypt verifies and decrypts a message of the sender key of r.
+func (r *Receiver) Decrypt(msg []byte) ([]byte, error) {
+	group, keyID, err := ParseHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+	if group != r.group || keyID != r.keyID {
+		return nil, ErrWrongKey
+	}
+	signed, signature := msg[:len(msg)-ed25519.SignatureSize], msg[len(msg)-ed25519.SignatureSize:]
+	if !ed25519.Verify(r.signingKey[:], signed, signature) {
+		return nil, ErrBadSignature
+	}
+	iteration := binary.BigEndian.Uint32(msg[2+GroupSize+4:])
+	sealed := signed[messageHeaderSize:]
+
+	if iteration < r.chain.iteration {
+		messageKey, ok := r.skipped[iteration]
+		if !ok {
+			return nil, ErrDuplicateMessage
+		}
+		plaintext, err := open(sealed, &messageKey)
+		if err != nil {
+			return nil, err
+		}
+		delete(r.skipped, iteration)
+		return plaintext, nil
+	}
+	if iteration-r.chain.iteration > MaxSkip {
+		return nil, ErrTooFarAhead
+	}
+
+	// Only keep the new state if the message is authentic.
+	c := r.chain
+	var skipped [][32]byte
+	for c.iteration < iteration {
+		skipped = append(skipped, c.next())
+	}
+	messageKey := c.next()
+	plaintext, err := open(sealed, &messageKey)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range skipped {
+		r.skipped[r.chain.iteration+uint32(i)] = key
+	}
+	r.chain = c
+	r.dropSkipped()
+	return plaintext, nil
+}
+
+func open(sealed []byte, messageKey *[32]byte) ([]byte, error) {
+	key, nonce := messageSecrets(messageKey)
+	defer wipe(key[:])
+	plaintext, ok := secretbox.Open(nil, sealed, &nonce, &key)
+	if !ok {
+		return nil, errInvalidMessage
+	}
+	return plaintext, nil
+}
+
+// dropSkipped forgets the oldest skipped keys past MaxSkip.
+func (r *Receiver) dropSkipped() {
+	if len(r.skipped) <= MaxSkip {
+		return
+	}
+	iterations := make([]uint32, 0, len(r.skipped))
+	for i := range r.skipped {
+		iterations = append(iterations, i)
+	}
+	sort.Slice(iterations, func(i, j int) bool { return iterations[i] < iterations[j] })
+	for _, i := range iterations[:len(iterations)-MaxSkip] {
+		delete(r.skipped, i)
+	}
+}
+
+type receiverState struct {
+	Group      []byte         `json:"group"`
+	KeyID      uint32         `json:"key_id"`
+	Iteration  uint32         `json:"iteration"`
+	ChainKey   []byte         `json:"chain_key"`
+	SigningKey []byte         `json:"signing_key"`
+	Skipped    []skippedState `json:"skipped,omitempty"`
+}
+
+type skippedState struct {
+	Iteration uint32 `json:"iteration"`
+	Key       []byte `json:"key"`
+}
+
+// MarshalJSON makes the Receiver a json.Marshaler.
+func (r *Receiver) MarshalJSON() ([]byte, error) {
+	state := receiverState{
+		Group:      r.group[:],
+		KeyID:      r.keyID,
+		Iteration:  r.chain.iteration,
+		ChainKey:   r.chain.key[:],
+		SigningKey: r.signingKey[:],
+	}
+	for i, key := range r.skipped {
+		key := key
+		state.Skipped = append(state.Skipped, skippedState{i, key[:]})
+	}
+	sort.Slice(state.Skipped, func(i, j int) bool { return state.Skipped[i].Iteration < state.Skipped[j].Iteration })
+	return json.Marshal(state)
+}
+
+// UnmarshalJSON makes the *Receiver a json.Unmarshaler.
+func (r *Receiver) UnmarshalJSON(in []byte) error {
+	var state receiverState
+	if err := json.Unmarshal(in, &state); err != nil {
+		return err
+	}
+	invalid := errors.New("senderkey: invalid receiver state")
+	if len(state.Group) != GroupSize || len(state.ChainKey) != 32 || len(state.SigningKey) != 32 {
+		return invalid
+	}
+	copy(r.group[:], state.Group)
+	r.keyID = state.KeyID
+	r.chain.iteration = state.Iteration
+	copy(r.chain.key[:], state.ChainKey)
+	copy(r.signingKey[:], state.SigningKey)
+	r.skipped = make(map[uint32][32]byte, len(state.Skipped))
+	for _, s := range state.Skipped {
+		if len(s.Key) != 32 {
+			return invalid
+		}
+		var key [32]byte
+		copy(key[:], s.Key)
+		r.skipped[s.Iteration] = key
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package senderkey
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Sender is our sender key in a group. It is not safe for concurrent use.
+type Sender struct {
+	group      [GroupSize]byte
+	keyID      uint32
+	chain      chain
+	signingKey ed25519.PrivateKey
+}
+
+// NewSender returns a new sender key for group. Replacing the sender key
+// of a member keeps those who don't get the new distribution, like
+// removed members, from reading the next messages.
+func NewSender(rand io.Reader, group [GroupSize]byte) (*Sender, error) {
+	s := &Sender{group: group}
+	var id [4]byte
+	if _, err := io.ReadFull(rand, id[:]); err != nil {
+		return nil, err
+	}
+	s.keyID = binary.BigEndian.Uint32(id[:])
+	if _, err := io.ReadFull(rand, s.chain.key[:]); err != nil {
+		return nil, err
+	}
+	_, private, err := ed25519.GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	s.signingKey = private
+	return s, nil
+}
+
+// Distribution returns the Distribution of the current state of s. Those
+// who get it can decrypt the next messages of s, but not the previous
+// ones.
+func (s *Sender) Distribution() Distribution {
+	d := Distribution{Group: s.group, KeyID: s.keyID, Iteration: s.chain.iteration, ChainKey: s.chain.key}
+	copy(d.SigningKey[:], s.signingKey.Public().(ed25519.PublicKey))
+	return d
+}
+
+// KeyID returns the identifier of the sender key.
+func (s *Sender) KeyID() uint32 {
+	return s.keyID
+}
+
+// Encrypt returns the message for the whole group encrypting plaintext.
+//
+//	type | version | group (16) | key id (4) | iteration (4) | secretbox | signature (64)
+func (s *Sender) Encrypt(plaintext []byte) ([]byte, error) {
+	out := make([]byte, 0, messageOverhead+len(plaintext))
+	out = append(out, binaryMessageType, binaryVersion)
+	out = append(out, s.group[:]...)
+	var ints [8]byte
+	binary.BigEndian.PutUint32(ints[:4], s.keyID)
+	binary.BigEndian.PutUint32(ints[4:], s.chain.iteration)
+	out = append(out, ints[:]...)
+
+	messageKey := s.chain.next()
+	key, nonce := messageSecrets(&messageKey)
+	out = secretbox.Seal(out, plaintext, &nonce, &key)
+	wipe(messageKey[:])
+	wipe(key[:])
+	return append(out, ed25519.Sign(s.signingKey, out)...), nil
+}
+
+type senderState struct {
+	Group      []byte `json:"group"`
+	KeyID      uint32 `json:"key_id"`
+	Iteration  uint32 `json:"iteration"`
+	ChainKey   []byte `json:"chain_key"`
+	SigningKey []byte `json:"signing_key"`
+}
+
+// MarshalJSON makes the Sender a json.Marshaler.
+func (s *Sender) MarshalJSON() ([]byte, error) {
+	return json.Marshal(senderState{
+		Group:      s.group[:],
+		KeyID:      s.keyID,
+		Iteration:  s.chain.iteration,
+		ChainKey:   s.chain.key[:],
+		SigningKey: s.signingKey.Seed(),
+	})
+}
+
+// UnmarshalJSON makes the *Sender a json.Unmarshaler.
+func (s *Sender) UnmarshalJSON(in []byte) error {
+	var state senderState
+	if err := json.Unmarshal(in, &state); err != nil {
+		return err
+	}
+	if len(state.Group) != GroupSize || len(state.ChainKey) != 32 || len(state.SigningKey) != ed25519.SeedSize {
+		return errors.New("senderkey: invalid sender state")
+	}
+	copy(s.group[:], state.Group)
+	s.keyID = state.KeyID
+	s.chain.iteration = state.Iteration
+	copy(s.chain.key[:], state.ChainKey)
+	s.signingKey = ed25519.NewKeyFromSeed(state.SigningKey)
+	return nil
+}
@@ -0,0 +1,148 @@
+// Package senderkey implements Sender Keys, the group messaging scheme of
+// Signal. Each member of a group has a symmetric chain and a signing key,
+// which it distributes to the other members over pairwise sessions. A
+// message is then encrypted once for the whole group with the next key of
+// the chain of its sender, and signed.
+//
+// The chain is a hash ratchet: each message key is HMAC-SHA256(chain, 1)
+// and the next chain key is HMAC-SHA256(chain, 2), so members can't read
+// the messages sent before they got a distribution. Unlike the Double
+// Ratchet, it doesn't heal: a member who learns a chain key can read all
+// the later messages of the chain, until its sender creates a new one.
+package senderkey
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// GroupSize is the size of the identifier of a group.
+const GroupSize = 16
+
+// MaxSkip is the maximum number of message keys a Receiver keeps for
+// messages that arrive out of order, and the maximum number of messages
+// that may be missing before one it decrypts.
+const MaxSkip = 1000
+
+var (
+	// ErrBadSignature is returned by Decrypt when the signature of a
+	// message is invalid.
+	ErrBadSignature = errors.New("senderkey: bad signature")
+	// ErrWrongKey is returned by Decrypt for a message of another group
+	// or another sender key.
+	ErrWrongKey = errors.New("senderkey: message of another sender key")
+	// ErrDuplicateMessage is returned by Decrypt for a message that was
+	// already decrypted, or whose key was dropped.
+	ErrDuplicateMessage = errors.New("senderkey: duplicate message")
+	// ErrTooFarAhead is returned by Decrypt when more than MaxSkip
+	// messages are missing before the message.
+	ErrTooFarAhead = errors.New("senderkey: too many missing messages")
+
+	errInvalidDistribution = errors.New("senderkey: invalid distribution")
+	errInvalidMessage      = errors.New("senderkey: invalid message")
+)
+
+// Distribution is what a member sends to the others so that they can
+// decrypt its messages: the current state of its chain, and its public
+// signing key.
+//
+// Its binary form is:
+//
+//	type | version | group (16) | key id (4) | iteration (4) | chain key (32) | signing key (32)
+type Distribution struct {
+	Group [GroupSize]byte
+	// KeyID identifies the sender key among those of the group.
+	KeyID      uint32
+	Iteration  uint32
+	ChainKey   [32]byte
+	SigningKey [32]byte
+}
+
+const (
+	binaryDistributionType      = 0x53 // 'S'
+	binaryMessageType           = 0x47 // 'G'
+	binaryVersion               = 1
+	distributionSize            = 2 + GroupSize + 4 + 4 + 32 + 32
+	messageHeaderSize           = 2 + GroupSize + 4 + 4
+	messageOverhead             = messageHeaderSize + secretbox.Overhead + ed25519.SignatureSize
+	messageKeyLabel             = "goax sender key message"
+	chainMessageKey        byte = 1
+	chainNextKey           byte = 2
+)
+
+// MarshalBinary makes the Distribution an encoding.BinaryMarshaler.
+func (d *Distribution) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 0, distributionSize)
+	out = append(out, binaryDistributionType, binaryVersion)
+	out = append(out, d.Group[:]...)
+	var ints [8]byte
+	binary.BigEndian.PutUint32(ints[:4], d.KeyID)
+	binary.BigEndian.PutUint32(ints[4:], d.Iteration)
+	out = append(out, ints[:]...)
+	out = append(out, d.ChainKey[:]...)
+	return append(out, d.SigningKey[:]...), nil
+}
+
+// UnmarshalBinary makes the *Distribution an encoding.BinaryUnmarshaler.
+func (d *Distribution) UnmarshalBinary(in []byte) error {
+	if len(in) != distributionSize || in[0] != binaryDistributionType || in[1] != binaryVersion {
+		return errInvalidDistribution
+	}
+	in = in[2:]
+	copy(d.Group[:], in)
+	in = in[GroupSize:]
+	d.KeyID = binary.BigEndian.Uint32(in)
+	d.Iteration = binary.BigEndian.Uint32(in[4:])
+	copy(d.ChainKey[:], in[8:])
+	copy(d.SigningKey[:], in[40:])
+	return nil
+}
+
+// chain is the hash ratchet of a sender key.
+type chain struct {
+	iteration uint32
+	key       [32]byte
+}
+
+// next returns the key of the message at c.iteration, and advances c.
+func (c *chain) next() (messageKey [32]byte) {
+	mac := hmac.New(sha256.New, c.key[:])
+	mac.Write([]byte{chainMessageKey})
+	mac.Sum(messageKey[:0])
+	mac = hmac.New(sha256.New, c.key[:])
+	mac.Write([]byte{chainNextKey})
+	mac.Sum(c.key[:0])
+	c.iteration++
+	return messageKey
+}
+
+// messageSecrets derives the secretbox key and nonce of a message key.
+func messageSecrets(messageKey *[32]byte) (key [32]byte, nonce [24]byte) {
+	kdf := hkdf.New(sha256.New, messageKey[:], nil, []byte(messageKeyLabel))
+	io.ReadFull(kdf, key[:])
+	io.ReadFull(kdf, nonce[:])
+	return key, nonce
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// ParseHeader returns the group and the key id of a message, to find the
+// Receiver that decrypts it.
+func ParseHeader(msg []byte) (group [GroupSize]byte, keyID uint32, err error) {
+	if len(msg) < messageOverhead || msg[0] != binaryMessageType || msg[1] != binaryVersion {
+		return group, 0, errInvalidMessage
+	}
+	copy(group[:], msg[2:])
+	return group, binary.BigEndian.Uint32(msg[2+GroupSize:]), nil
+}
@@ -0,0 +1,125 @@
+package senderkey
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+)
+
+func newPair(t *testing.T) (*Sender, *Receiver) {
+	var group [GroupSize]byte
+	rand.Read(group[:])
+	s, err := NewSender(rand.Reader, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := s.Distribution()
+	marshalled, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Distribution
+	if err := decoded.UnmarshalBinary(marshalled); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != d {
+		t.Fatalf("Decoded distribution doesn't match: %+v", decoded)
+	}
+	return s, NewReceiver(decoded)
+}
+
+func encrypt(t *testing.T, s *Sender, msg string) []byte {
+	ciphertext, err := s.Encrypt([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func expectDecrypt(t *testing.T, r *Receiver, ciphertext []byte, expected string) {
+	t.Helper()
+	plaintext, err := r.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != expected {
+		t.Fatalf("Expected %q, got %q", expected, plaintext)
+	}
+}
+
+func TestSenderKey(t *testing.T) {
+	s, r := newPair(t)
+	m1 := encrypt(t, s, "one")
+	m2 := encrypt(t, s, "two")
+	m3 := encrypt(t, s, "three")
+
+	expectDecrypt(t, r, m3, "three")
+	expectDecrypt(t, r, m1, "one")
+	if _, err := r.Decrypt(m1); err != ErrDuplicateMessage {
+		t.Fatalf("Expected ErrDuplicateMessage, got %v", err)
+	}
+
+	// The receiver survives a round trip through JSON, skipped keys
+	// included.
+	state, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = new(Receiver)
+	if err := json.Unmarshal(state, r); err != nil {
+		t.Fatal(err)
+	}
+	expectDecrypt(t, r, m2, "two")
+
+	state, err = json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = new(Sender)
+	if err := json.Unmarshal(state, s); err != nil {
+		t.Fatal(err)
+	}
+	expectDecrypt(t, r, encrypt(t, s, "four"), "four")
+}
+
+func TestSenderKeyLateMember(t *testing.T) {
+	s, _ := newPair(t)
+	before := encrypt(t, s, "before")
+	late := NewReceiver(s.Distribution())
+	if _, err := late.Decrypt(before); err != ErrDuplicateMessage {
+		t.Fatalf("A late member decrypted a previous message: %v", err)
+	}
+	expectDecrypt(t, late, encrypt(t, s, "after"), "after")
+}
+
+func TestSenderKeyForgery(t *testing.T) {
+	s, r := newPair(t)
+	m := encrypt(t, s, "hello")
+	for _, i := range []int{messageHeaderSize - 1, messageHeaderSize, len(m) - 1} {
+		tampered := append([]byte(nil), m...)
+		tampered[i] ^= 1
+		if _, err := r.Decrypt(tampered); err != ErrBadSignature {
+			t.Fatalf("Expected ErrBadSignature with byte %d changed, got %v", i, err)
+		}
+	}
+
+	// Another sender key of the same group, as after a rekey.
+	other, err := NewSender(rand.Reader, s.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Decrypt(encrypt(t, other, "hello")); err != ErrWrongKey {
+		t.Fatalf("Expected ErrWrongKey, got %v", err)
+	}
+	expectDecrypt(t, r, m, "hello")
+}
+
+func TestSenderKeyTooFarAhead(t *testing.T) {
+	s, r := newPair(t)
+	for i := 0; i <= MaxSkip; i++ {
+		encrypt(t, s, "lost")
+	}
+	if _, err := r.Decrypt(encrypt(t, s, "too far")); err != ErrTooFarAhead {
+		t.Fatalf("Expected ErrTooFarAhead, got %v", err)
+	}
+}
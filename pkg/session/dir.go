@@ -0,0 +1,83 @@
+package session
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// RatchetBlockType is the armor type of the files of a Dir.
+const RatchetBlockType = "GOAX RATCHET"
+
+// Dir is a Store that keeps each state in an armored file of the
+// directory, named after the hex-encoded peer. It is the format of the
+// ratchets directory of goax.
+type Dir string
+
+func (d Dir) path(peer string) string {
+	return filepath.Join(string(d), hex.EncodeToString([]byte(peer)))
+}
+
+// Load implements Store.
+func (d Dir) Load(peer string) ([]byte, error) {
+	f, err := os.Open(d.path(peer))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	block, err := armor.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(block.Body)
+}
+
+// Save implements Store. The file is replaced atomically, so that a crash
+// doesn't leave a truncated state behind.
+func (d Dir) Save(peer string, state []byte) error {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, RatchetBlockType, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(state); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(string(d), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), d.path(peer))
+}
+
+// Remove deletes the state saved for peer, if any.
+func (d Dir) Remove(peer string) error {
+	err := os.Remove(d.path(peer))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
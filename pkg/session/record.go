@@ -0,0 +1,194 @@
+package session
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/rakoo/goax/pkg/ratchet"
+)
+
+// MaxPreviousSessions is the number of previous sessions kept by a Record.
+// Past that, the least recently used one is forgotten.
+const MaxPreviousSessions = 8
+
+// A Record holds the sessions with a peer: the active one, which encrypts
+// our messages, and the previous ones, replaced by a reset or a new key
+// exchange, which may still be needed to decrypt messages sent before.
+// Unlike its ratchets, a Record is not safe for concurrent use; Manager
+// serializes the operations on the record of each peer.
+type Record struct {
+	// Active is the session used to encrypt.
+	Active *ratchet.Ratchet
+	// previous are the previous sessions, most recently used first.
+	previous []previousSession
+}
+
+type previousSession struct {
+	r *ratchet.Ratchet
+	// archived is when the session stopped being the active one.
+	archived time.Time
+}
+
+// NewRecord returns a Record whose only session is active.
+func NewRecord(active *ratchet.Ratchet) *Record {
+	return &Record{Active: active}
+}
+
+// Replace makes r the active session. The active session becomes the most
+// recently used previous one, unless its key exchange wasn't complete.
+// The resets that created the replaced sessions can't be replayed to r.
+func (rec *Record) Replace(r *ratchet.Ratchet) {
+	r.Follow(rec.Active)
+	for _, p := range rec.previous {
+		r.Follow(p.r)
+	}
+	if rec.Active.State() != ratchet.AwaitingKeyExchange {
+		rec.previous = append([]previousSession{{rec.Active, time.Now()}}, rec.previous...)
+		if len(rec.previous) > MaxPreviousSessions {
+			rec.previous = rec.previous[:MaxPreviousSessions]
+		}
+	}
+	rec.Active = r
+}
+
+// Previous returns the number of previous sessions, and when the oldest
+// one was archived.
+func (rec *Record) Previous() (n int, oldest time.Time) {
+	for _, p := range rec.previous {
+		if oldest.IsZero() || p.archived.Before(oldest) {
+			oldest = p.archived
+		}
+	}
+	return len(rec.previous), oldest
+}
+
+// Expire forgets the previous sessions archived before t.
+func (rec *Record) Expire(t time.Time) {
+	kept := rec.previous[:0]
+	for _, p := range rec.previous {
+		if !p.archived.Before(t) {
+			kept = append(kept, p)
+		}
+	}
+	for i := len(kept); i < len(rec.previous); i++ {
+		rec.previous[i] = previousSession{}
+	}
+	rec.previous = kept
+}
+
+// Decrypt decrypts a message with the active session or, if it can't tell
+// the message apart from one of another session, with the previous
+// sessions in order. The previous session that succeeds becomes the active
+// one, as the peer still uses it, unless the active session is a reset:
+// then it only becomes the most recently used previous one. If none
+// succeeds, the error is the first one of a previous session that could
+// tell the message was its own, or else the one of the active session.
+func (rec *Record) Decrypt(ciphertext []byte) ([]byte, error) {
+	msg, err := rec.Active.Decrypt(ciphertext)
+	if err != ratchet.ErrCannotDecrypt && err != ratchet.ErrHandshakeNotComplete {
+		return msg, err
+	}
+	var errPrevious error
+	for i, p := range rec.previous {
+		msg, err := p.r.Decrypt(ciphertext)
+		if err == ratchet.ErrDuplicateMessage {
+			return nil, err
+		}
+		if err == ratchet.ErrCannotDecrypt {
+			continue
+		}
+		if err != nil {
+			if errPrevious == nil {
+				errPrevious = err
+			}
+			continue
+		}
+		rec.promote(i)
+		return msg, nil
+	}
+	if errPrevious != nil {
+		return nil, errPrevious
+	}
+	return nil, err
+}
+
+// promote makes the previous session i the active one, or the most
+// recently used previous one if the active session is a reset or isn't
+// complete yet.
+func (rec *Record) promote(i int) {
+	p := rec.previous[i]
+	if rec.Active.IsReset() || rec.Active.State() == ratchet.AwaitingKeyExchange {
+		copy(rec.previous[1:i+1], rec.previous[:i])
+		rec.previous[0] = p
+		return
+	}
+	p.r.Follow(rec.Active)
+	copy(rec.previous[1:i+1], rec.previous[:i])
+	rec.previous[0] = previousSession{rec.Active, time.Now()}
+	rec.Active = p.r
+}
+
+type recordState struct {
+	Active   json.RawMessage        `json:"active"`
+	Previous []previousSessionState `json:"previous,omitempty"`
+}
+
+type previousSessionState struct {
+	Archived int64           `json:"archived"`
+	Ratchet  json.RawMessage `json:"ratchet"`
+}
+
+// MarshalJSON makes the Record a json.Marshaler.
+func (rec *Record) MarshalJSON() ([]byte, error) {
+	var s recordState
+	var err error
+	if s.Active, err = json.Marshal(rec.Active); err != nil {
+		return nil, err
+	}
+	for _, p := range rec.previous {
+		state, err := json.Marshal(p.r)
+		if err != nil {
+			return nil, err
+		}
+		s.Previous = append(s.Previous, previousSessionState{p.archived.Unix(), state})
+	}
+	return json.Marshal(s)
+}
+
+// LoadRecord returns the Record serialized in state, for the identity
+// private key identity. A state holding a single ratchet, as saved by
+// older versions, is a Record without previous sessions.
+func LoadRecord(state []byte, rand io.Reader, identity [32]byte) (*Record, error) {
+	var s recordState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return nil, err
+	}
+	if s.Active == nil {
+		s.Active = state
+	}
+
+	load := func(state []byte) (*ratchet.Ratchet, error) {
+		r, err := ratchet.New(rand, identity)
+		if err != nil {
+			return nil, err
+		}
+		return r, json.Unmarshal(state, r)
+	}
+	active, err := load(s.Active)
+	if err != nil {
+		return nil, err
+	}
+	rec := NewRecord(active)
+	for _, p := range s.Previous {
+		r, err := load(p.Ratchet)
+		if err != nil {
+			return nil, err
+		}
+		rec.previous = append(rec.previous, previousSession{r, time.Unix(p.Archived, 0)})
+	}
+	if len(rec.previous) > MaxPreviousSessions {
+		rec.previous = rec.previous[:MaxPreviousSessions]
+	}
+	return rec, nil
+}
@@ -0,0 +1,255 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rakoo/goax/pkg/ratchet"
+)
+
+// pairedRatchets returns two ratchets of the identities a and b, with a
+// session between them.
+func pairedRatchets(t *testing.T, a, b [32]byte) (ra, rb *ratchet.Ratchet) {
+	return pairRatchets(t, a, b, false)
+}
+
+// pairedLegacyRatchets is like pairedRatchets, for peers that don't
+// advertise any cipher suite.
+func pairedLegacyRatchets(t *testing.T, a, b [32]byte) (ra, rb *ratchet.Ratchet) {
+	return pairRatchets(t, a, b, true)
+}
+
+func pairRatchets(t *testing.T, a, b [32]byte, legacy bool) (ra, rb *ratchet.Ratchet) {
+	ra, err := ratchet.New(rand.Reader, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb, err = ratchet.New(rand.Reader, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kxA, err := ra.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kxB, err := rb.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy {
+		kxA.Suites, kxB.Suites = 0, 0
+	}
+	if err := ra.CompleteKeyExchange(kxB); err != nil {
+		t.Fatal(err)
+	}
+	if err := rb.CompleteKeyExchange(kxA); err != nil {
+		t.Fatal(err)
+	}
+	return ra, rb
+}
+
+func encrypt(t *testing.T, r *ratchet.Ratchet, msg string) []byte {
+	ciphertext, err := r.Encrypt([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func TestRecord(t *testing.T) {
+	var alice, bob [32]byte
+	io.ReadFull(rand.Reader, alice[:])
+	io.ReadFull(rand.Reader, bob[:])
+
+	a1, b1 := pairedRatchets(t, alice, bob)
+	a2, b2 := pairedRatchets(t, alice, bob)
+	a3, b3 := pairedRatchets(t, alice, bob)
+	rec := NewRecord(b1)
+	rec.Replace(b2)
+	rec.Replace(b3)
+	if rec.Active != b3 {
+		t.Fatal("the last session isn't the active one")
+	}
+
+	late1, late2 := encrypt(t, a1, "late 1"), encrypt(t, a2, "late 2")
+	for _, m := range []struct {
+		ciphertext []byte
+		plaintext  string
+		// active and mru are the active and the most recently used
+		// previous session after the message
+		active, mru *ratchet.Ratchet
+	}{
+		{encrypt(t, a3, "active"), "active", b3, b2},
+		{late1, "late 1", b1, b3},
+		{late2, "late 2", b2, b1},
+	} {
+		msg, err := rec.Decrypt(m.ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != m.plaintext {
+			t.Fatalf("got %q, want %q", msg, m.plaintext)
+		}
+		if rec.Active != m.active || rec.previous[0].r != m.mru {
+			t.Fatalf("wrong sessions promoted after %q", m.plaintext)
+		}
+	}
+
+	if _, err := rec.Decrypt(late1); err != ratchet.ErrDuplicateMessage {
+		t.Fatalf("got %v, want ErrDuplicateMessage", err)
+	}
+	a4, _ := pairedRatchets(t, alice, bob)
+	if _, err := rec.Decrypt(encrypt(t, a4, "unknown")); err != ratchet.ErrCannotDecrypt {
+		t.Fatalf("got %v, want ErrCannotDecrypt", err)
+	}
+
+	// The record survives serialization.
+	state, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadRecord(state, rand.Reader, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := loaded.Previous(); n != 2 {
+		t.Fatalf("%d previous sessions after loading, want 2", n)
+	}
+	for _, m := range [][]byte{encrypt(t, a1, "after 1"), encrypt(t, a3, "after 3")} {
+		if _, err := loaded.Decrypt(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Previous sessions expire
+	rec.Expire(time.Now().Add(time.Minute))
+	if n, _ := rec.Previous(); n != 0 {
+		t.Fatalf("%d previous sessions after expiry, want 0", n)
+	}
+}
+
+func TestRecordSuites(t *testing.T) {
+	var alice, bob [32]byte
+	io.ReadFull(rand.Reader, alice[:])
+	io.ReadFull(rand.Reader, bob[:])
+
+	legacyA, legacyB := pairedLegacyRatchets(t, alice, bob)
+	gcmA, gcmB := pairedRatchets(t, alice, bob)
+	if legacyB.Suite() != ratchet.SuiteLegacy || gcmB.Suite() != ratchet.SuiteAESGCM {
+		t.Fatalf("sessions of suites %s and %s", legacyB.Suite(), gcmB.Suite())
+	}
+
+	// Each session gets the messages of the other from the record,
+	// whichever is active
+	for _, sessions := range [][2]*ratchet.Ratchet{{legacyB, gcmB}, {gcmB, legacyB}} {
+		rec := NewRecord(sessions[0])
+		rec.Replace(sessions[1])
+		for _, sender := range []*ratchet.Ratchet{legacyA, gcmA, legacyA} {
+			msg, err := rec.Decrypt(encrypt(t, sender, "hello"))
+			if err != nil {
+				t.Fatalf("%s message: %s", sender.Suite(), err)
+			}
+			if string(msg) != "hello" {
+				t.Fatalf("got %q", msg)
+			}
+		}
+	}
+}
+
+func TestRecordLimit(t *testing.T) {
+	var alice, bob [32]byte
+	io.ReadFull(rand.Reader, alice[:])
+	io.ReadFull(rand.Reader, bob[:])
+
+	_, b := pairedRatchets(t, alice, bob)
+	rec := NewRecord(b)
+	for i := 0; i < MaxPreviousSessions+2; i++ {
+		_, b := pairedRatchets(t, alice, bob)
+		rec.Replace(b)
+	}
+	if n, _ := rec.Previous(); n != MaxPreviousSessions {
+		t.Fatalf("%d previous sessions, want %d", n, MaxPreviousSessions)
+	}
+
+	// A session whose key exchange isn't complete isn't kept
+	pending, err := ratchet.New(rand.Reader, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = NewRecord(pending)
+	rec.Replace(b)
+	if n, _ := rec.Previous(); n != 0 {
+		t.Fatal("incomplete session kept")
+	}
+}
+
+func TestRecordReset(t *testing.T) {
+	var alice, bob [32]byte
+	io.ReadFull(rand.Reader, alice[:])
+	io.ReadFull(rand.Reader, bob[:])
+
+	a1, b1 := pairedRatchets(t, alice, bob)
+	bobPublic, _ := a1.PeerIdentity()
+	aR, err := ratchet.New(rand.Reader, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aR.MarkReset(bobPublic); err != nil {
+		t.Fatal(err)
+	}
+	bR, err := ratchet.New(rand.Reader, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kx, err := aR.GetKeyExchangeMaterial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bR.CompleteKeyExchange(kx); err != nil {
+		t.Fatal(err)
+	}
+	rec := NewRecord(b1)
+	rec.Replace(bR)
+
+	// A late message of the session a lost doesn't bring it back
+	if _, err := rec.Decrypt(encrypt(t, a1, "late")); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Active != bR || rec.previous[0].r != b1 {
+		t.Fatal("the reset session was replaced")
+	}
+
+	// The previous session tells a corrupt message of its own
+	corrupt := encrypt(t, a1, "corrupt")
+	corrupt[len(corrupt)-1] ^= 1
+	if _, err := rec.Decrypt(corrupt); err == nil || err == ratchet.ErrCannotDecrypt {
+		t.Fatalf("got %v, want the error of the previous session", err)
+	}
+}
+
+func TestLoadRecordLegacy(t *testing.T) {
+	var alice, bob [32]byte
+	io.ReadFull(rand.Reader, alice[:])
+	io.ReadFull(rand.Reader, bob[:])
+
+	a, b := pairedRatchets(t, alice, bob)
+	state, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := LoadRecord(state, rand.Reader, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := rec.Decrypt(encrypt(t, a, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, []byte("hello")) {
+		t.Fatalf("got %q", msg)
+	}
+}
@@ -0,0 +1,198 @@
+// Package session keeps the ratchets of many peers in memory, for programs
+// that run for a long time. The ratchets of a peer are kept in a Record,
+// loaded from a Store when first used, and written back to it after each
+// operation.
+package session
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/rakoo/goax/pkg/ratchet"
+)
+
+// ErrNotFound is returned by Store.Load when there is no state for a peer.
+var ErrNotFound = errors.New("session: no state for peer")
+
+// Store holds the serialized records of peers. It must be safe for
+// concurrent use with different peers.
+type Store interface {
+	// Load returns the state saved for peer, or ErrNotFound.
+	Load(peer string) ([]byte, error)
+	// Save replaces the state saved for peer.
+	Save(peer string, state []byte) error
+}
+
+// maxIdle is the number of peers whose records are kept in memory while
+// no operation uses them.
+const maxIdle = 256
+
+// Manager caches the ratchets of peers. Operations on the ratchet of a
+// peer are serialized, operations on different peers run in parallel.
+// Only the most recently used idle peers stay in memory.
+type Manager struct {
+	store    Store
+	rand     io.Reader
+	identity [32]byte
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	// idle lists the peers with no operation in progress, most
+	// recently used first.
+	idle    *list.List
+	maxIdle int
+}
+
+type session struct {
+	mu sync.Mutex
+	// rec is nil until loaded from the store.
+	rec *Record
+
+	// refs counts the operations running or waiting on mu; the session
+	// is only evicted when there are none. Guarded by Manager.mu.
+	refs int
+	elem *list.Element
+}
+
+// NewManager returns a Manager for the peers of the given identity
+// private key, whose ratchets are kept in store.
+func NewManager(store Store, rand io.Reader, identity [32]byte) *Manager {
+	return &Manager{
+		store:    store,
+		rand:     rand,
+		identity: identity,
+		sessions: make(map[string]*session),
+		idle:     list.New(),
+		maxIdle:  maxIdle,
+	}
+}
+
+// Do calls f with the active ratchet of peer, which is created if the store
+// has none. If f returns nil, the record of peer is saved to the store;
+// otherwise it is dropped from memory and loaded again on next use, so
+// that it stays the same as the stored one.
+func (m *Manager) Do(peer string, f func(r *ratchet.Ratchet) error) error {
+	return m.DoRecord(peer, func(rec *Record) error {
+		return f(rec.Active)
+	})
+}
+
+// DoRecord is like Do, with the whole record of peer.
+func (m *Manager) DoRecord(peer string, f func(rec *Record) error) error {
+	s := m.acquire(peer)
+	defer m.release(peer, s, false)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rec == nil {
+		rec, err := m.load(peer)
+		if err != nil {
+			return err
+		}
+		s.rec = rec
+	}
+
+	err := f(s.rec)
+	if err == nil {
+		err = m.save(peer, s.rec)
+	}
+	if err != nil {
+		s.rec = nil
+	}
+	return err
+}
+
+// acquire returns the session of peer, which is not evicted until
+// released.
+func (m *Manager) acquire(peer string) *session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[peer]
+	if !ok {
+		s = new(session)
+		m.sessions[peer] = s
+	}
+	if s.elem != nil {
+		m.idle.Remove(s.elem)
+		s.elem = nil
+	}
+	s.refs++
+	return s
+}
+
+// release ends an operation on the session of peer. When it was the last
+// one, the session becomes idle, or is dropped if forget is true, and the
+// least recently used idle sessions beyond maxIdle are evicted.
+func (m *Manager) release(peer string, s *session, forget bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	if forget {
+		delete(m.sessions, peer)
+		return
+	}
+	s.elem = m.idle.PushFront(peer)
+	for m.idle.Len() > m.maxIdle {
+		e := m.idle.Back()
+		m.idle.Remove(e)
+		delete(m.sessions, e.Value.(string))
+	}
+}
+
+func (m *Manager) load(peer string) (*Record, error) {
+	state, err := m.store.Load(peer)
+	if err == ErrNotFound {
+		r, err := ratchet.New(m.rand, m.identity)
+		if err != nil {
+			return nil, err
+		}
+		return NewRecord(r), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return LoadRecord(state, m.rand, m.identity)
+}
+
+func (m *Manager) save(peer string, rec *Record) error {
+	state, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return m.store.Save(peer, state)
+}
+
+// Encrypt encrypts msg for peer.
+func (m *Manager) Encrypt(peer string, msg []byte) (ciphertext []byte, err error) {
+	err = m.Do(peer, func(r *ratchet.Ratchet) error {
+		ciphertext, err = r.Encrypt(msg)
+		return err
+	})
+	return ciphertext, err
+}
+
+// Decrypt decrypts a message from peer, with any of their sessions.
+func (m *Manager) Decrypt(peer string, ciphertext []byte) (msg []byte, err error) {
+	err = m.DoRecord(peer, func(rec *Record) error {
+		msg, err = rec.Decrypt(ciphertext)
+		return err
+	})
+	return msg, err
+}
+
+// Forget drops the record of peer from memory, once the operation in
+// progress, if any, is done. It is loaded from the store again on next use.
+func (m *Manager) Forget(peer string) {
+	s := m.acquire(peer)
+	s.mu.Lock()
+	s.rec = nil
+	s.mu.Unlock()
+	m.release(peer, s, true)
+}
@@ -0,0 +1,249 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/rakoo/goax/pkg/ratchet"
+)
+
+type memStore struct {
+	mu     sync.Mutex
+	states map[string][]byte
+	saves  int
+}
+
+func newMemStore() *memStore {
+	return &memStore{states: make(map[string][]byte)}
+}
+
+func (s *memStore) Load(peer string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[peer]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return state, nil
+}
+
+func (s *memStore) Save(peer string, state []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[peer] = state
+	s.saves++
+	return nil
+}
+
+func newManager(store Store) *Manager {
+	var identity [32]byte
+	io.ReadFull(rand.Reader, identity[:])
+	return NewManager(store, rand.Reader, identity)
+}
+
+// pairedManagers returns the managers of alice and bob, with a session
+// between them.
+func pairedManagers(t *testing.T) (alice, bob *Manager) {
+	alice, bob = newManager(newMemStore()), newManager(newMemStore())
+
+	var kxAlice, kxBob ratchet.KeyExchange
+	err := alice.Do("bob", func(r *ratchet.Ratchet) (err error) {
+		kxAlice, err = r.GetKeyExchangeMaterial()
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bob.Do("alice", func(r *ratchet.Ratchet) (err error) {
+		if kxBob, err = r.GetKeyExchangeMaterial(); err != nil {
+			return err
+		}
+		return r.CompleteKeyExchange(kxAlice)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = alice.Do("bob", func(r *ratchet.Ratchet) error {
+		return r.CompleteKeyExchange(kxBob)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+func TestManager(t *testing.T) {
+	alice, bob := pairedManagers(t)
+
+	// Concurrent sends to bob are serialized, so bob can decrypt the
+	// messages in the order they were encrypted.
+	const n = 50
+	msgs := make(chan []byte, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := alice.Do("bob", func(r *ratchet.Ratchet) error {
+				msg, err := r.Encrypt([]byte(fmt.Sprint(i)))
+				msgs <- msg
+				return err
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(msgs)
+	for msg := range msgs {
+		if _, err := bob.Decrypt("alice", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bob's state was saved after every message.
+	reloaded := NewManager(bob.store, rand.Reader, bob.identity)
+	msg, err := alice.Encrypt("bob", []byte("reloaded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := reloaded.Decrypt("alice", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, []byte("reloaded")) {
+		t.Fatalf("bad message: %q", result)
+	}
+}
+
+func TestManagerPeers(t *testing.T) {
+	store := newMemStore()
+	m := newManager(store)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			err := m.Do(peer, func(r *ratchet.Ratchet) error {
+				_, err := r.GetKeyExchangeMaterial()
+				return err
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprint("peer", i))
+	}
+	wg.Wait()
+
+	if len(store.states) != 10 {
+		t.Fatalf("%d states saved, want 10", len(store.states))
+	}
+}
+
+func TestManagerEvict(t *testing.T) {
+	alice, bob := pairedManagers(t)
+	bob.maxIdle = 2
+
+	for i := 0; i < 5; i++ {
+		err := bob.Do(fmt.Sprint("peer", i), func(r *ratchet.Ratchet) error {
+			_, err := r.GetKeyExchangeMaterial()
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(bob.sessions) != 2 || bob.idle.Len() != 2 {
+		t.Fatalf("%d sessions and %d idle, want 2", len(bob.sessions), bob.idle.Len())
+	}
+	if _, ok := bob.sessions["alice"]; ok {
+		t.Fatal("least recently used session kept")
+	}
+
+	// The evicted record is loaded again from the store.
+	msg, err := alice.Encrypt("bob", []byte("evicted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Decrypt("alice", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	bob.Forget("alice")
+	if _, ok := bob.sessions["alice"]; ok || bob.idle.Len() != 1 {
+		t.Fatal("forgotten session kept")
+	}
+}
+
+func TestManagerError(t *testing.T) {
+	alice, bob := pairedManagers(t)
+	store := alice.store.(*memStore)
+
+	msg, err := alice.Encrypt("bob", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saves := store.saves
+
+	errFailed := errors.New("failed")
+	err = alice.Do("bob", func(r *ratchet.Ratchet) error {
+		if _, err := r.Encrypt([]byte("lost")); err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("got %v, want %v", err, errFailed)
+	}
+	if store.saves != saves {
+		t.Fatal("ratchet saved after an error")
+	}
+
+	// The ratchet is reloaded from the store, so the next message
+	// follows the first one.
+	next, err := alice.Encrypt("bob", []byte("next"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range [][]byte{msg, next} {
+		if _, err := bob.Decrypt("alice", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	d := Dir(t.TempDir())
+
+	if _, err := d.Load("alice"); err != ErrNotFound {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	for _, state := range []string{"first", "second"} {
+		if err := d.Save("alice", []byte(state)); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := d.Load("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(loaded) != state {
+			t.Fatalf("loaded %q, want %q", loaded, state)
+		}
+	}
+	if err := d.Remove("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Load("alice"); err != ErrNotFound {
+		t.Fatalf("got %v after Remove, want ErrNotFound", err)
+	}
+	if err := d.Remove("alice"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,184 @@
+package treekem
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Structures are encoded in the TLS presentation language, as in RFC 9420:
+// integers are big-endian, and variable-length vectors are prefixed with
+// their length as a variable-length integer of 1, 2 or 4 bytes, whose two
+// high bits tell the size.
+
+var errInvalidEncoding = errors.New("treekem: invalid encoding")
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) varint(v int) {
+	switch {
+	case v < 1<<6:
+		e.uint8(uint8(v))
+	case v < 1<<14:
+		e.uint16(uint16(v) | 0x4000)
+	default:
+		e.uint32(uint32(v) | 0x80000000)
+	}
+}
+
+// opaque encodes a variable-length vector of bytes.
+func (e *encoder) opaque(b []byte) {
+	e.varint(len(b))
+	e.buf = append(e.buf, b...)
+}
+
+// vector encodes a variable-length vector, whose elements f encodes.
+func (e *encoder) vector(f func(e *encoder)) {
+	var inner encoder
+	f(&inner)
+	e.opaque(inner.buf)
+}
+
+// optional encodes an optional value, which f encodes if present.
+func (e *encoder) optional(present bool, f func(e *encoder)) {
+	if !present {
+		e.uint8(0)
+		return
+	}
+	e.uint8(1)
+	f(e)
+}
+
+// decoder reads what encoder writes. The first error sticks, and makes
+// all the reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || len(d.buf) < n {
+		d.err = errInvalidEncoding
+		return make([]byte, n)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	return d.next(1)[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	return binary.BigEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) uint32() uint32 {
+	return binary.BigEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) uint64() uint64 {
+	return binary.BigEndian.Uint64(d.next(8))
+}
+
+func (d *decoder) varint() int {
+	if d.err != nil || len(d.buf) == 0 {
+		d.err = errInvalidEncoding
+		return 0
+	}
+	var v, min int
+	switch d.buf[0] >> 6 {
+	case 0:
+		v = int(d.uint8())
+	case 1:
+		v, min = int(d.uint16()&0x3fff), 1<<6
+	case 2:
+		v, min = int(d.uint32()&0x3fffffff), 1<<14
+	default:
+		d.err = errInvalidEncoding
+	}
+	if v < min {
+		// Not the shortest encoding
+		d.err = errInvalidEncoding
+	}
+	return v
+}
+
+// opaque decodes a variable-length vector of bytes. The result is a copy.
+func (d *decoder) opaque() []byte {
+	n := d.varint()
+	if d.err != nil {
+		return nil
+	}
+	return append([]byte(nil), d.next(n)...)
+}
+
+// key decodes a variable-length vector that must be a 32-byte key.
+func (d *decoder) key() (key [32]byte) {
+	if b := d.opaque(); len(b) == len(key) {
+		copy(key[:], b)
+	} else if d.err == nil {
+		d.err = errInvalidEncoding
+	}
+	return key
+}
+
+// vector returns a decoder for the elements of a variable-length vector.
+func (d *decoder) vector() *decoder {
+	return &decoder{buf: d.opaque(), err: d.err}
+}
+
+// optional tells if an optional value is present.
+func (d *decoder) optional() bool {
+	switch d.uint8() {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		d.err = errInvalidEncoding
+		return false
+	}
+}
+
+// more tells if there is anything left to decode.
+func (d *decoder) more() bool {
+	return d.err == nil && len(d.buf) > 0
+}
+
+// finish returns the first error, or an error if there are bytes left.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		return errInvalidEncoding
+	}
+	return d.err
+}
+
+// merge keeps the first error of sub, a decoder returned by vector.
+func (d *decoder) merge(sub *decoder) {
+	if d.err == nil {
+		d.err = sub.finish()
+	}
+}
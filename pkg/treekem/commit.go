@@ -0,0 +1,280 @@
+package treekem
+
+import "errors"
+
+// ProposalType is the type of a Proposal, with the values of RFC 9420.
+type ProposalType uint16
+
+// Types of proposals.
+const (
+	// ProposalAdd adds the member of a KeyPackage.
+	ProposalAdd ProposalType = 1
+	// ProposalUpdate replaces the leaf of a member, to refresh their
+	// encryption key.
+	ProposalUpdate ProposalType = 2
+	// ProposalRemove removes a member.
+	ProposalRemove ProposalType = 3
+)
+
+// Proposal is a change to the membership of a group, which takes effect
+// when a member commits it.
+type Proposal struct {
+	Type ProposalType
+	// KeyPackage is the new member of an Add.
+	KeyPackage *KeyPackage
+	// Sender and Leaf are the member of an Update, and their new leaf.
+	Sender uint32
+	Leaf   *LeafNode
+	// Removed is the leaf index of the member of a Remove.
+	Removed uint32
+}
+
+// AddProposal returns a Proposal to add the member of kp.
+func AddProposal(kp *KeyPackage) Proposal {
+	return Proposal{Type: ProposalAdd, KeyPackage: kp}
+}
+
+// RemoveProposal returns a Proposal to remove the member at leaf.
+func RemoveProposal(leaf uint32) Proposal {
+	return Proposal{Type: ProposalRemove, Removed: leaf}
+}
+
+func (p *Proposal) marshal(e *encoder) {
+	e.uint16(uint16(p.Type))
+	switch p.Type {
+	case ProposalAdd:
+		p.KeyPackage.marshal(e)
+	case ProposalUpdate:
+		e.uint32(p.Sender)
+		p.Leaf.marshal(e)
+	case ProposalRemove:
+		e.uint32(p.Removed)
+	}
+}
+
+func (p *Proposal) unmarshal(d *decoder) {
+	p.Type = ProposalType(d.uint16())
+	switch p.Type {
+	case ProposalAdd:
+		p.KeyPackage = new(KeyPackage)
+		p.KeyPackage.unmarshal(d)
+	case ProposalUpdate:
+		p.Sender = d.uint32()
+		p.Leaf = new(LeafNode)
+		p.Leaf.unmarshal(d)
+	case ProposalRemove:
+		p.Removed = d.uint32()
+	default:
+		d.err = errInvalidEncoding
+	}
+}
+
+// UpdatePath carries the new keys of the committer's leaf and of its
+// parents, with the path secrets of the parents encrypted to the other
+// members.
+type UpdatePath struct {
+	Leaf  LeafNode
+	Nodes []UpdatePathNode
+}
+
+// UpdatePathNode is the new key of a parent of the committer, with its path
+// secret encrypted to each node of the resolution of its other child.
+type UpdatePathNode struct {
+	EncryptionKey        [32]byte
+	EncryptedPathSecrets []HPKECiphertext
+}
+
+// Commit applies proposals to a group and starts its next epoch.
+type Commit struct {
+	GroupID []byte
+	Epoch   uint64
+	// Sender is the leaf index of the committer.
+	Sender    uint32
+	Proposals []Proposal
+	Path      UpdatePath
+	// Signature is the signature of the committer over the commit and the
+	// GroupContext of the epoch.
+	Signature []byte
+	// ConfirmationTag proves that the committer knows the secrets of the
+	// new epoch.
+	ConfirmationTag []byte
+}
+
+var (
+	// ErrWrongEpoch is returned for a Commit of another group, or of
+	// another epoch of the group.
+	ErrWrongEpoch = errors.New("treekem: commit for another epoch")
+	// ErrRemoved is returned by Process for a Commit that removes us
+	// from the group.
+	ErrRemoved = errors.New("treekem: removed from the group")
+
+	errInvalidCommit = errors.New("treekem: invalid commit")
+)
+
+func (c *Commit) marshalContent(e *encoder) {
+	e.opaque(c.GroupID)
+	e.uint64(c.Epoch)
+	e.uint32(c.Sender)
+	e.vector(func(e *encoder) {
+		for i := range c.Proposals {
+			c.Proposals[i].marshal(e)
+		}
+	})
+	c.Path.Leaf.marshal(e)
+	e.vector(func(e *encoder) {
+		for _, n := range c.Path.Nodes {
+			e.opaque(n.EncryptionKey[:])
+			e.vector(func(e *encoder) {
+				for i := range n.EncryptedPathSecrets {
+					n.EncryptedPathSecrets[i].marshal(e)
+				}
+			})
+		}
+	})
+}
+
+// tbs returns what the signature covers.
+func (c *Commit) tbs(context []byte) []byte {
+	var e encoder
+	e.uint16(ProtocolVersion)
+	e.uint16(1) // mls_public_message
+	c.marshalContent(&e)
+	e.buf = append(e.buf, context...)
+	return e.buf
+}
+
+// confirmedTranscriptHash chains the commit to the transcript of the
+// previous epochs.
+func (c *Commit) confirmedTranscriptHash(interim []byte) []byte {
+	e := encoder{buf: append([]byte(nil), interim...)}
+	c.marshalContent(&e)
+	e.opaque(c.Signature)
+	return hash(e.buf)
+}
+
+// MarshalBinary makes the Commit an encoding.BinaryMarshaler.
+func (c *Commit) MarshalBinary() ([]byte, error) {
+	var e encoder
+	c.marshalContent(&e)
+	e.opaque(c.Signature)
+	e.opaque(c.ConfirmationTag)
+	return e.buf, nil
+}
+
+// UnmarshalBinary makes the *Commit an encoding.BinaryUnmarshaler. Nothing
+// is verified until the Commit is processed.
+func (c *Commit) UnmarshalBinary(in []byte) error {
+	var decoded Commit
+	d := decoder{buf: in}
+	decoded.GroupID = d.opaque()
+	decoded.Epoch = d.uint64()
+	decoded.Sender = d.uint32()
+	proposals := d.vector()
+	for proposals.more() {
+		var p Proposal
+		p.unmarshal(proposals)
+		decoded.Proposals = append(decoded.Proposals, p)
+	}
+	d.merge(proposals)
+	decoded.Path.Leaf.unmarshal(&d)
+	nodes := d.vector()
+	for nodes.more() {
+		n := UpdatePathNode{EncryptionKey: nodes.key()}
+		secrets := nodes.vector()
+		for secrets.more() {
+			var s HPKECiphertext
+			s.unmarshal(secrets)
+			n.EncryptedPathSecrets = append(n.EncryptedPathSecrets, s)
+		}
+		nodes.merge(secrets)
+		decoded.Path.Nodes = append(decoded.Path.Nodes, n)
+	}
+	d.merge(nodes)
+	decoded.Signature = d.opaque()
+	decoded.ConfirmationTag = d.opaque()
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*c = decoded
+	return nil
+}
+
+// joiner is a member added by a commit.
+type joiner struct {
+	leaf uint32
+	kp   *KeyPackage
+}
+
+func isJoiner(joiners []joiner, x uint32) bool {
+	for _, j := range joiners {
+		if 2*j.leaf == x {
+			return true
+		}
+	}
+	return false
+}
+
+// applyProposals applies the proposals committed by the member at leaf
+// committer to tree: updates first, then removes, then adds. It returns
+// the new members.
+func applyProposals(tree *ratchetTree, groupID []byte, committer uint32, proposals []Proposal) ([]joiner, error) {
+	for _, p := range proposals {
+		if p.Type != ProposalUpdate {
+			continue
+		}
+		old := tree.leaf(p.Sender)
+		if p.Sender == committer || old == nil || p.Leaf == nil {
+			return nil, errInvalidCommit
+		}
+		if p.Leaf.Source != leafSourceUpdate || p.Leaf.SignatureKey != old.SignatureKey {
+			return nil, errInvalidCommit
+		}
+		if err := p.Leaf.verify(groupID, p.Sender); err != nil {
+			return nil, err
+		}
+		leaf := *p.Leaf
+		tree.nodes[2*p.Sender] = &node{leaf: &leaf}
+		tree.blankPath(p.Sender)
+	}
+	for _, p := range proposals {
+		if p.Type != ProposalRemove {
+			continue
+		}
+		if p.Removed == committer || tree.leaf(p.Removed) == nil {
+			return nil, errInvalidCommit
+		}
+		tree.remove(p.Removed)
+	}
+	var joiners []joiner
+	for _, p := range proposals {
+		if p.Type != ProposalAdd {
+			continue
+		}
+		if p.KeyPackage == nil {
+			return nil, errInvalidCommit
+		}
+		if err := p.KeyPackage.Verify(); err != nil {
+			return nil, err
+		}
+		leaf := p.KeyPackage.Leaf
+		joiners = append(joiners, joiner{leaf: tree.add(&leaf), kp: p.KeyPackage})
+	}
+	return joiners, nil
+}
+
+// derivePath derives the private keys of the nodes of path from the path
+// secret of the first one, and checks them against their public keys. It
+// returns the commit secret.
+func derivePath(privateKeys map[uint32][32]byte, path []uint32, keys [][32]byte, pathSecret []byte) ([]byte, error) {
+	for i, p := range path {
+		if i > 0 {
+			pathSecret = deriveSecret(pathSecret, "path")
+		}
+		priv, pub := deriveKeyPair(deriveSecret(pathSecret, "node"))
+		if pub != keys[i] {
+			return nil, errInvalidCommit
+		}
+		privateKeys[p] = priv
+	}
+	return deriveSecret(pathSecret, "path"), nil
+}
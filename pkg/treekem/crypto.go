@@ -0,0 +1,230 @@
+package treekem
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The only cipher suite is MLS_128_DHKEMX25519_AES128GCM_SHA256_Ed25519.
+const (
+	// ProtocolVersion is mls10.
+	ProtocolVersion = 1
+	// CipherSuite is MLS_128_DHKEMX25519_AES128GCM_SHA256_Ed25519.
+	CipherSuite = 1
+
+	hashSize   = sha256.Size
+	keySize    = 16
+	nonceSize  = 12
+	mlsLabel   = "MLS 1.0 "
+	hpkeLabel  = "HPKE-v1"
+	sharedSize = 32
+)
+
+var errDecrypt = errors.New("treekem: decryption failed")
+
+func extract(salt, ikm []byte) []byte {
+	return hkdf.Extract(sha256.New, ikm, salt)
+}
+
+func expand(prk, info []byte, n int) []byte {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func hash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// expandWithLabel is ExpandWithLabel of RFC 9420.
+func expandWithLabel(secret []byte, label string, context []byte, n int) []byte {
+	var e encoder
+	e.uint16(uint16(n))
+	e.opaque([]byte(mlsLabel + label))
+	e.opaque(context)
+	return expand(secret, e.buf, n)
+}
+
+// deriveSecret is DeriveSecret of RFC 9420.
+func deriveSecret(secret []byte, label string) []byte {
+	return expandWithLabel(secret, label, nil, hashSize)
+}
+
+// refHash is RefHash of RFC 9420, which names KeyPackages.
+func refHash(label string, value []byte) []byte {
+	var e encoder
+	e.opaque([]byte(label))
+	e.opaque(value)
+	return hash(e.buf)
+}
+
+func signContent(label string, content []byte) []byte {
+	var e encoder
+	e.opaque([]byte(mlsLabel + label))
+	e.opaque(content)
+	return e.buf
+}
+
+// signWithLabel is SignWithLabel of RFC 9420.
+func signWithLabel(key ed25519.PrivateKey, label string, content []byte) []byte {
+	return ed25519.Sign(key, signContent(label, content))
+}
+
+// verifyWithLabel is VerifyWithLabel of RFC 9420.
+func verifyWithLabel(key [32]byte, label string, content, signature []byte) bool {
+	return ed25519.Verify(key[:], signContent(label, content), signature)
+}
+
+func sealAEAD(key, nonce, plaintext, aad []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead.Seal(nil, nonce, plaintext, aad)
+}
+
+func openAEAD(key, nonce, ciphertext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plaintext, nil
+}
+
+// The rest is the base mode of HPKE (RFC 9180), with DHKEM(X25519,
+// HKDF-SHA256), HKDF-SHA256 and AES-128-GCM.
+
+var (
+	kemSuiteID  = []byte{'K', 'E', 'M', 0x00, 0x20}
+	hpkeSuiteID = []byte{'H', 'P', 'K', 'E', 0x00, 0x20, 0x00, 0x01, 0x00, 0x01}
+)
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	in := append([]byte(hpkeLabel), suiteID...)
+	in = append(in, label...)
+	return extract(salt, append(in, ikm...))
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, n int) []byte {
+	in := append([]byte{byte(n >> 8), byte(n)}, hpkeLabel...)
+	in = append(in, suiteID...)
+	in = append(in, label...)
+	return expand(prk, append(in, info...), n)
+}
+
+// deriveKeyPair is DeriveKeyPair of DHKEM(X25519, HKDF-SHA256).
+func deriveKeyPair(ikm []byte) (priv, pub [32]byte) {
+	prk := labeledExtract(kemSuiteID, nil, "dkp_prk", ikm)
+	copy(priv[:], labeledExpand(kemSuiteID, prk, "sk", nil, 32))
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return priv, pub
+}
+
+func generateKeyPair(rand io.Reader) (priv, pub [32]byte, err error) {
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(rand, ikm); err != nil {
+		return priv, pub, err
+	}
+	priv, pub = deriveKeyPair(ikm)
+	return priv, pub, nil
+}
+
+func kemSharedSecret(dh, enc, pkR []byte) []byte {
+	prk := labeledExtract(kemSuiteID, nil, "eae_prk", dh)
+	return labeledExpand(kemSuiteID, prk, "shared_secret", append(append([]byte(nil), enc...), pkR...), sharedSize)
+}
+
+func hpkeKeySchedule(shared, info []byte) (key, nonce []byte) {
+	context := []byte{0x00} // mode_base
+	context = append(context, labeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)...)
+	context = append(context, labeledExtract(hpkeSuiteID, nil, "info_hash", info)...)
+	secret := labeledExtract(hpkeSuiteID, shared, "secret", nil)
+	return labeledExpand(hpkeSuiteID, secret, "key", context, keySize),
+		labeledExpand(hpkeSuiteID, secret, "base_nonce", context, nonceSize)
+}
+
+// HPKECiphertext is a message sealed with HPKE to a public key.
+type HPKECiphertext struct {
+	KEMOutput  []byte
+	Ciphertext []byte
+}
+
+func (c *HPKECiphertext) marshal(e *encoder) {
+	e.opaque(c.KEMOutput)
+	e.opaque(c.Ciphertext)
+}
+
+func (c *HPKECiphertext) unmarshal(d *decoder) {
+	c.KEMOutput = d.opaque()
+	c.Ciphertext = d.opaque()
+}
+
+func hpkeSeal(rand io.Reader, pkR [32]byte, info, aad, plaintext []byte) (HPKECiphertext, error) {
+	skE, pkE, err := generateKeyPair(rand)
+	if err != nil {
+		return HPKECiphertext{}, err
+	}
+	dh, err := curve25519.X25519(skE[:], pkR[:])
+	if err != nil {
+		return HPKECiphertext{}, err
+	}
+	key, nonce := hpkeKeySchedule(kemSharedSecret(dh, pkE[:], pkR[:]), info)
+	return HPKECiphertext{KEMOutput: pkE[:], Ciphertext: sealAEAD(key, nonce, plaintext, aad)}, nil
+}
+
+func hpkeOpen(skR [32]byte, c HPKECiphertext, info, aad []byte) ([]byte, error) {
+	dh, err := curve25519.X25519(skR[:], c.KEMOutput)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	var pkR [32]byte
+	curve25519.ScalarBaseMult(&pkR, &skR)
+	key, nonce := hpkeKeySchedule(kemSharedSecret(dh, c.KEMOutput, pkR[:]), info)
+	return openAEAD(key, nonce, c.Ciphertext, aad)
+}
+
+func encryptContext(label string, context []byte) []byte {
+	var e encoder
+	e.opaque([]byte(mlsLabel + label))
+	e.opaque(context)
+	return e.buf
+}
+
+// encryptWithLabel is EncryptWithLabel of RFC 9420.
+func encryptWithLabel(rand io.Reader, pub [32]byte, label string, context, plaintext []byte) (HPKECiphertext, error) {
+	return hpkeSeal(rand, pub, encryptContext(label, context), nil, plaintext)
+}
+
+// decryptWithLabel is DecryptWithLabel of RFC 9420.
+func decryptWithLabel(priv [32]byte, label string, context []byte, c HPKECiphertext) ([]byte, error) {
+	return hpkeOpen(priv, c, encryptContext(label, context), nil)
+}
@@ -0,0 +1,351 @@
+// Package treekem implements group key agreement with a ratchet tree: the
+// members of a group are the leaves of the tree, and each Commit gives
+// fresh keys to the path from its sender to the root (TreeKEM), so that
+// adding, removing or updating a member costs a number of encryptions
+// logarithmic in the size of the group. New members get the state of the
+// group in a Welcome encrypted to their KeyPackage.
+//
+// Its structures, labels and key schedule are modeled on those of RFC
+// 9420, with the cipher suite MLS_128_DHKEMX25519_AES128GCM_SHA256_Ed25519,
+// but it is not an implementation of MLS and doesn't interoperate with
+// one: there are no extensions, pre-shared keys, external joins, nor
+// framing of handshake and application messages, whose transport is left
+// to the caller; proposals are sent by value in the Commit. The secrets of
+// an epoch are available through ExportSecret.
+//
+// Only the tree math and the basic cryptographic functions are checked
+// against vectors, of its own making. TreeKEM, the key schedule and
+// Welcome are only tested between members of this package.
+package treekem
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Group is the state of a member of a group in an epoch.
+type Group struct {
+	id           []byte
+	epoch        uint64
+	tree         *ratchetTree
+	leaf         uint32
+	signatureKey ed25519.PrivateKey
+	// privateKeys are the private keys we know in the tree, by node.
+	privateKeys map[uint32][32]byte
+	// pendingUpdates are the private keys of our Update proposals, by
+	// public key.
+	pendingUpdates map[[32]byte][32]byte
+
+	confirmedTranscriptHash []byte
+	interimTranscriptHash   []byte
+	secrets                 epochSecrets
+}
+
+// NewGroup creates a group of id whose only member is the caller.
+func NewGroup(rand io.Reader, id, identity []byte, signatureKey ed25519.PrivateKey) (*Group, error) {
+	kp, secrets, err := NewKeyPackage(rand, identity, signatureKey)
+	if err != nil {
+		return nil, err
+	}
+	initSecret := make([]byte, hashSize)
+	if _, err := io.ReadFull(rand, initSecret); err != nil {
+		return nil, err
+	}
+	g := &Group{
+		id:             append([]byte(nil), id...),
+		tree:           &ratchetTree{nodes: []*node{{leaf: &kp.Leaf}}},
+		signatureKey:   signatureKey,
+		privateKeys:    map[uint32][32]byte{0: secrets.EncryptionKey},
+		pendingUpdates: make(map[[32]byte][32]byte),
+	}
+	context := g.context()
+	g.secrets = newEpochSecrets(joinerSecret(initSecret, make([]byte, hashSize), context), context)
+	g.interimTranscriptHash = interimTranscriptHash(nil, mac(g.secrets.confirmation, nil))
+	return g, nil
+}
+
+// ID returns the id of the group.
+func (g *Group) ID() []byte {
+	return g.id
+}
+
+// Epoch returns the current epoch, which each Commit increases.
+func (g *Group) Epoch() uint64 {
+	return g.epoch
+}
+
+// Leaf returns our leaf index, by which the others remove us.
+func (g *Group) Leaf() uint32 {
+	return g.leaf
+}
+
+// Members returns the identities of the members by leaf index; blank
+// leaves have none.
+func (g *Group) Members() [][]byte {
+	members := make([][]byte, g.tree.leaves())
+	for i := range members {
+		if l := g.tree.leaf(uint32(i)); l != nil {
+			members[i] = l.Identity
+		}
+	}
+	return members
+}
+
+// ExportSecret derives a secret of length bytes for label and context
+// from the current epoch. All the members derive the same one.
+func (g *Group) ExportSecret(label string, context []byte, length int) []byte {
+	return expandWithLabel(deriveSecret(g.secrets.exporter, label), "exported", hash(context), length)
+}
+
+// EpochAuthenticator returns a secret that the members can compare out of
+// band to make sure they are in the same group.
+func (g *Group) EpochAuthenticator() []byte {
+	return g.secrets.authentication
+}
+
+func (g *Group) context() []byte {
+	return groupContext(g.id, g.epoch, g.tree.treeHash(), g.confirmedTranscriptHash)
+}
+
+// ProposeUpdate returns a proposal to replace our encryption key, for
+// another member to commit. Committing also replaces it.
+func (g *Group) ProposeUpdate(rand io.Reader) (Proposal, error) {
+	priv, pub, err := generateKeyPair(rand)
+	if err != nil {
+		return Proposal{}, err
+	}
+	old := g.tree.leaf(g.leaf)
+	leaf := &LeafNode{
+		EncryptionKey: pub,
+		SignatureKey:  old.SignatureKey,
+		Identity:      old.Identity,
+		Source:        leafSourceUpdate,
+	}
+	leaf.sign(g.signatureKey, g.id, g.leaf)
+	g.pendingUpdates[pub] = priv
+	return Proposal{Type: ProposalUpdate, Sender: g.leaf, Leaf: leaf}, nil
+}
+
+// Commit applies proposals and starts the next epoch. The Commit has to be
+// sent to all the members but the new ones, and the Welcome, if there are
+// new members, to them. The group is in the next epoch when Commit
+// returns, so the Commit must not be lost.
+func (g *Group) Commit(rand io.Reader, proposals []Proposal) (*Commit, *Welcome, error) {
+	tree := g.tree.clone()
+	joiners, err := applyProposals(tree, g.id, g.leaf, proposals)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leafSecret := make([]byte, hashSize)
+	if _, err := io.ReadFull(rand, leafSecret); err != nil {
+		return nil, nil, err
+	}
+	path, copath := tree.filteredDirectPath(g.leaf)
+	privateKeys := copyKeys(g.privateKeys)
+	leafPriv, leafPub := deriveKeyPair(deriveSecret(leafSecret, "node"))
+	privateKeys[2*g.leaf] = leafPriv
+	pathSecrets := make([][]byte, len(path))
+	keys := make([][32]byte, len(path))
+	pathSecret := leafSecret
+	for i, p := range path {
+		pathSecret = deriveSecret(pathSecret, "path")
+		pathSecrets[i] = pathSecret
+		var priv [32]byte
+		priv, keys[i] = deriveKeyPair(deriveSecret(pathSecret, "node"))
+		privateKeys[p] = priv
+	}
+	commitSecret := deriveSecret(pathSecret, "path")
+
+	old := g.tree.leaf(g.leaf)
+	leaf := LeafNode{
+		EncryptionKey: leafPub,
+		SignatureKey:  old.SignatureKey,
+		Identity:      old.Identity,
+		Source:        leafSourceCommit,
+	}
+	tree.setPath(g.leaf, &leaf, path, keys)
+	leaf.ParentHash = tree.setParentHashes(path, copath)
+	leaf.sign(g.signatureKey, g.id, g.leaf)
+
+	c := &Commit{
+		GroupID:   g.id,
+		Epoch:     g.epoch,
+		Sender:    g.leaf,
+		Proposals: proposals,
+		Path:      UpdatePath{Leaf: leaf},
+	}
+	provisional := groupContext(g.id, g.epoch+1, tree.treeHash(), g.confirmedTranscriptHash)
+	for i := range path {
+		n := UpdatePathNode{EncryptionKey: keys[i]}
+		for _, r := range tree.resolution(copath[i]) {
+			if isJoiner(joiners, r) {
+				continue
+			}
+			s, err := encryptWithLabel(rand, tree.nodes[r].encryptionKey(), "UpdatePathNode", provisional, pathSecrets[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			n.EncryptedPathSecrets = append(n.EncryptedPathSecrets, s)
+		}
+		c.Path.Nodes = append(c.Path.Nodes, n)
+	}
+	c.Signature = signWithLabel(g.signatureKey, "FramedContentTBS", c.tbs(g.context()))
+
+	next := g.next(tree, commitSecret, c, privateKeys)
+	c.ConfirmationTag = mac(next.secrets.confirmation, next.confirmedTranscriptHash)
+	next.interimTranscriptHash = interimTranscriptHash(next.confirmedTranscriptHash, c.ConfirmationTag)
+
+	var w *Welcome
+	if len(joiners) > 0 {
+		if w, err = next.welcome(rand, joiners, copath, pathSecrets, c.ConfirmationTag); err != nil {
+			return nil, nil, err
+		}
+	}
+	*g = *next
+	return c, w, nil
+}
+
+// Process applies a Commit of another member, and starts the next epoch.
+func (g *Group) Process(c *Commit) error {
+	if !bytes.Equal(c.GroupID, g.id) || c.Epoch != g.epoch {
+		return ErrWrongEpoch
+	}
+	sender := g.tree.leaf(c.Sender)
+	if c.Sender == g.leaf || sender == nil {
+		return errInvalidCommit
+	}
+	if !verifyWithLabel(sender.SignatureKey, "FramedContentTBS", c.tbs(g.context()), c.Signature) {
+		return ErrBadSignature
+	}
+	tree := g.tree.clone()
+	joiners, err := applyProposals(tree, g.id, c.Sender, c.Proposals)
+	if err != nil {
+		return err
+	}
+	privateKeys := copyKeys(g.privateKeys)
+	for _, p := range c.Proposals {
+		switch {
+		case p.Type == ProposalRemove && p.Removed == g.leaf:
+			return ErrRemoved
+		case p.Type == ProposalUpdate && p.Sender == g.leaf:
+			priv, ok := g.pendingUpdates[p.Leaf.EncryptionKey]
+			if !ok {
+				return errInvalidCommit
+			}
+			privateKeys[2*g.leaf] = priv
+		}
+	}
+
+	leaf := c.Path.Leaf
+	if leaf.Source != leafSourceCommit || leaf.SignatureKey != sender.SignatureKey {
+		return errInvalidCommit
+	}
+	if err := leaf.verify(g.id, c.Sender); err != nil {
+		return err
+	}
+	path, copath := tree.filteredDirectPath(c.Sender)
+	if len(c.Path.Nodes) != len(path) {
+		return errInvalidCommit
+	}
+	keys := make([][32]byte, len(path))
+	for i, n := range c.Path.Nodes {
+		keys[i] = n.EncryptionKey
+	}
+	tree.setPath(c.Sender, &leaf, path, keys)
+	if !bytes.Equal(tree.setParentHashes(path, copath), leaf.ParentHash) {
+		return errInvalidCommit
+	}
+
+	// The lowest node of the path above us has its path secret encrypted
+	// to a node of the resolution of its other child whose private key we
+	// know.
+	i := 0
+	for i < len(copath) && !covers(copath[i], 2*g.leaf) {
+		i++
+	}
+	if i == len(copath) {
+		return errInvalidCommit
+	}
+	var resolution []uint32
+	for _, r := range tree.resolution(copath[i]) {
+		if !isJoiner(joiners, r) {
+			resolution = append(resolution, r)
+		}
+	}
+	secrets := c.Path.Nodes[i].EncryptedPathSecrets
+	if len(secrets) != len(resolution) {
+		return errInvalidCommit
+	}
+	provisional := groupContext(g.id, g.epoch+1, tree.treeHash(), g.confirmedTranscriptHash)
+	var pathSecret []byte
+	for j, r := range resolution {
+		if priv, ok := privateKeys[r]; ok && publicKey(priv) == tree.nodes[r].encryptionKey() {
+			if pathSecret, err = decryptWithLabel(priv, "UpdatePathNode", provisional, secrets[j]); err != nil {
+				return errInvalidCommit
+			}
+			break
+		}
+	}
+	if pathSecret == nil {
+		return errInvalidCommit
+	}
+	commitSecret, err := derivePath(privateKeys, path[i:], keys[i:], pathSecret)
+	if err != nil {
+		return err
+	}
+
+	next := g.next(tree, commitSecret, c, privateKeys)
+	if !hmac.Equal(mac(next.secrets.confirmation, next.confirmedTranscriptHash), c.ConfirmationTag) {
+		return errInvalidCommit
+	}
+	next.interimTranscriptHash = interimTranscriptHash(next.confirmedTranscriptHash, c.ConfirmationTag)
+	*g = *next
+	return nil
+}
+
+// next returns the state of the epoch that c starts, with tree, the tree
+// to which c was applied. The interim transcript hash is left to set from
+// the confirmation tag.
+func (g *Group) next(tree *ratchetTree, commitSecret []byte, c *Commit, privateKeys map[uint32][32]byte) *Group {
+	next := &Group{
+		id:                      g.id,
+		epoch:                   g.epoch + 1,
+		tree:                    tree,
+		leaf:                    g.leaf,
+		signatureKey:            g.signatureKey,
+		privateKeys:             privateKeys,
+		pendingUpdates:          make(map[[32]byte][32]byte),
+		confirmedTranscriptHash: c.confirmedTranscriptHash(g.interimTranscriptHash),
+	}
+	next.prune()
+	context := next.context()
+	next.secrets = newEpochSecrets(joinerSecret(g.secrets.init, commitSecret, context), context)
+	return next
+}
+
+// prune forgets the private keys of nodes that were blanked or replaced.
+func (g *Group) prune() {
+	for x, priv := range g.privateKeys {
+		if x >= uint32(len(g.tree.nodes)) || g.tree.nodes[x] == nil || g.tree.nodes[x].encryptionKey() != publicKey(priv) {
+			delete(g.privateKeys, x)
+		}
+	}
+}
+
+func publicKey(priv [32]byte) (pub [32]byte) {
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return pub
+}
+
+func copyKeys(keys map[uint32][32]byte) map[uint32][32]byte {
+	c := make(map[uint32][32]byte, len(keys))
+	for x, k := range keys {
+		c[x] = k
+	}
+	return c
+}
@@ -0,0 +1,329 @@
+package treekem
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+func newKeyPackage(t *testing.T, name string) (*KeyPackage, *KeyPackageSecrets) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, secrets, err := NewKeyPackage(rand.Reader, []byte(name), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err := kp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded KeyPackage
+	if err := decoded.UnmarshalBinary(marshalled); err != nil {
+		t.Fatal(err)
+	}
+	return &decoded, secrets
+}
+
+func newGroup(t *testing.T, name string) *Group {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGroup(rand.Reader, []byte("group"), []byte(name), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// commit commits proposals from committer, has the others process the
+// Commit and the new members join with the Welcome, and returns the new
+// members.
+func commit(t *testing.T, committer *Group, others []*Group, proposals []Proposal, joiners []*KeyPackageSecrets) []*Group {
+	t.Helper()
+	c, w, err := committer.Commit(rand.Reader, proposals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Commit
+	if err := decoded.UnmarshalBinary(marshalled); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range others {
+		if err := g.Process(&decoded); err != nil {
+			t.Fatalf("Member %d: %v", g.Leaf(), err)
+		}
+	}
+	if len(joiners) == 0 {
+		if w != nil {
+			t.Fatal("Unexpected welcome")
+		}
+		return nil
+	}
+	marshalled, err = w.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var welcome Welcome
+	if err := welcome.UnmarshalBinary(marshalled); err != nil {
+		t.Fatal(err)
+	}
+	var joined []*Group
+	for _, p := range proposals {
+		if p.Type != ProposalAdd {
+			continue
+		}
+		g, err := Join(&welcome, p.KeyPackage, joiners[len(joined)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		joined = append(joined, g)
+	}
+	return joined
+}
+
+func expectAgree(t *testing.T, groups ...*Group) {
+	t.Helper()
+	for _, g := range groups[1:] {
+		if g.Epoch() != groups[0].Epoch() {
+			t.Fatalf("Member %d is in epoch %d, not %d", g.Leaf(), g.Epoch(), groups[0].Epoch())
+		}
+		if !bytes.Equal(g.EpochAuthenticator(), groups[0].EpochAuthenticator()) {
+			t.Fatalf("Member %d has another epoch authenticator", g.Leaf())
+		}
+		if !bytes.Equal(g.ExportSecret("test", nil, 32), groups[0].ExportSecret("test", nil, 32)) {
+			t.Fatalf("Member %d exports another secret", g.Leaf())
+		}
+		if fmt.Sprint(g.Members()) != fmt.Sprint(groups[0].Members()) {
+			t.Fatalf("Member %d has other members: %q", g.Leaf(), g.Members())
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	alice := newGroup(t, "alice")
+	bobKP, bobSecrets := newKeyPackage(t, "bob")
+	bob := commit(t, alice, nil, []Proposal{AddProposal(bobKP)}, []*KeyPackageSecrets{bobSecrets})[0]
+	expectAgree(t, alice, bob)
+
+	carolKP, carolSecrets := newKeyPackage(t, "carol")
+	daveKP, daveSecrets := newKeyPackage(t, "dave")
+	joined := commit(t, bob, []*Group{alice}, []Proposal{AddProposal(carolKP), AddProposal(daveKP)}, []*KeyPackageSecrets{carolSecrets, daveSecrets})
+	carol, dave := joined[0], joined[1]
+	expectAgree(t, alice, bob, carol, dave)
+	if fmt.Sprintf("%s", alice.Members()) != "[alice bob carol dave]" {
+		t.Fatalf("Unexpected members %s", alice.Members())
+	}
+
+	update, err := bob.ProposeUpdate(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(t, carol, []*Group{alice, bob, dave}, []Proposal{update}, nil)
+	expectAgree(t, alice, bob, carol, dave)
+
+	old := bob.ExportSecret("test", nil, 32)
+	c, _, err := dave.Commit(rand.Reader, []Proposal{RemoveProposal(bob.Leaf())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []*Group{alice, carol} {
+		if err := g.Process(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bob.Process(c); err != ErrRemoved {
+		t.Fatalf("Expected ErrRemoved, got %v", err)
+	}
+	expectAgree(t, alice, carol, dave)
+	if !bytes.Equal(bob.ExportSecret("test", nil, 32), old) {
+		t.Fatal("Bob's state changed when he was removed")
+	}
+
+	// Bob's leaf is blank, so a new member takes it.
+	erinKP, erinSecrets := newKeyPackage(t, "erin")
+	erin := commit(t, alice, []*Group{carol, dave}, []Proposal{AddProposal(erinKP)}, []*KeyPackageSecrets{erinSecrets})[0]
+	expectAgree(t, alice, carol, dave, erin)
+	if erin.Leaf() != 1 {
+		t.Fatalf("Expected erin at leaf 1, got %d", erin.Leaf())
+	}
+	commit(t, erin, []*Group{alice, carol, dave}, nil, nil)
+	expectAgree(t, alice, carol, dave, erin)
+}
+
+// TestGroupChurn adds and removes members with commits from all of them,
+// to get blank nodes and unmerged leaves in the tree.
+func TestGroupChurn(t *testing.T) {
+	groups := []*Group{newGroup(t, "0")}
+	others := func(i int) []*Group {
+		return append(append([]*Group(nil), groups[:i]...), groups[i+1:]...)
+	}
+	for i := 1; i < 12; i++ {
+		kp, secrets := newKeyPackage(t, fmt.Sprint(i))
+		committer := (i * 7) % len(groups)
+		groups = append(groups, commit(t, groups[committer], others(committer), []Proposal{AddProposal(kp)}, []*KeyPackageSecrets{secrets})...)
+		expectAgree(t, groups...)
+
+		if i%3 == 0 {
+			removed := (i * 5) % len(groups)
+			committer := (removed + 1) % len(groups)
+			leaf := groups[removed].Leaf()
+			remaining := append(others(removed)[:0:0], others(removed)...)
+			c := commitIndex(remaining, groups[committer])
+			commit(t, groups[committer], append(remaining[:c:c], remaining[c+1:]...), []Proposal{RemoveProposal(leaf)}, nil)
+			groups = remaining
+			expectAgree(t, groups...)
+		}
+	}
+	if len(groups[0].Members()) != 16 {
+		t.Fatalf("Expected 16 leaves, got %d", len(groups[0].Members()))
+	}
+}
+
+func commitIndex(groups []*Group, g *Group) int {
+	for i := range groups {
+		if groups[i] == g {
+			return i
+		}
+	}
+	panic("not in the group")
+}
+
+func TestTreeShrinks(t *testing.T) {
+	alice := newGroup(t, "alice")
+	bobKP, bobSecrets := newKeyPackage(t, "bob")
+	carolKP, carolSecrets := newKeyPackage(t, "carol")
+	joined := commit(t, alice, nil, []Proposal{AddProposal(bobKP), AddProposal(carolKP)}, []*KeyPackageSecrets{bobSecrets, carolSecrets})
+	bob := joined[0]
+	if len(alice.Members()) != 4 {
+		t.Fatalf("Expected 4 leaves, got %d", len(alice.Members()))
+	}
+	commit(t, alice, []*Group{bob}, []Proposal{RemoveProposal(2)}, nil)
+	expectAgree(t, alice, bob)
+	if fmt.Sprintf("%s", alice.Members()) != "[alice bob]" {
+		t.Fatalf("Unexpected members %s", alice.Members())
+	}
+	commit(t, bob, []*Group{alice}, nil, nil)
+	expectAgree(t, alice, bob)
+}
+
+func TestCommitRejected(t *testing.T) {
+	alice := newGroup(t, "alice")
+	bobKP, bobSecrets := newKeyPackage(t, "bob")
+	carolKP, carolSecrets := newKeyPackage(t, "carol")
+	joined := commit(t, alice, nil, []Proposal{AddProposal(bobKP), AddProposal(carolKP)}, []*KeyPackageSecrets{bobSecrets, carolSecrets})
+	bob, carol := joined[0], joined[1]
+
+	c, _, err := alice.Commit(rand.Reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := *c
+	forged.Signature = append([]byte(nil), c.Signature...)
+	forged.Signature[0] ^= 1
+	if err := bob.Process(&forged); err != ErrBadSignature {
+		t.Fatalf("Expected ErrBadSignature, got %v", err)
+	}
+	forged = *c
+	forged.ConfirmationTag = append([]byte(nil), c.ConfirmationTag...)
+	forged.ConfirmationTag[0] ^= 1
+	if err := bob.Process(&forged); err != errInvalidCommit {
+		t.Fatalf("Expected errInvalidCommit, got %v", err)
+	}
+	if _, _, err := bob.Commit(rand.Reader, []Proposal{RemoveProposal(bob.Leaf())}); err != errInvalidCommit {
+		t.Fatalf("Expected errInvalidCommit, got %v", err)
+	}
+
+	// Failures leave the state untouched.
+	if err := bob.Process(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Process(c); err != ErrWrongEpoch {
+		t.Fatalf("Expected ErrWrongEpoch, got %v", err)
+	}
+	if err := carol.Process(c); err != nil {
+		t.Fatal(err)
+	}
+	expectAgree(t, alice, bob, carol)
+}
+
+func TestWelcomeNotInvited(t *testing.T) {
+	alice := newGroup(t, "alice")
+	bobKP, _ := newKeyPackage(t, "bob")
+	carolKP, carolSecrets := newKeyPackage(t, "carol")
+	_, w, err := alice.Commit(rand.Reader, []Proposal{AddProposal(bobKP)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Join(w, carolKP, carolSecrets); err != ErrNotInvited {
+		t.Fatalf("Expected ErrNotInvited, got %v", err)
+	}
+}
+
+func TestParentHash(t *testing.T) {
+	alice := newGroup(t, "alice")
+	bobKP, bobSecrets := newKeyPackage(t, "bob")
+	carolKP, carolSecrets := newKeyPackage(t, "carol")
+	joined := commit(t, alice, nil, []Proposal{AddProposal(bobKP), AddProposal(carolKP)}, []*KeyPackageSecrets{bobSecrets, carolSecrets})
+	bob, carol := joined[0], joined[1]
+	commit(t, bob, []*Group{alice, carol}, nil, nil)
+
+	// A tree whose parent nodes weren't set by a Commit is rejected, as
+	// its keys could be known to someone else than the members.
+	for x, n := range alice.tree.nodes {
+		if n == nil || n.parent == nil {
+			continue
+		}
+		for _, tamper := range []func(p *parentNode){
+			func(p *parentNode) { p.encryptionKey[0] ^= 1 },
+			func(p *parentNode) { p.parentHash = append([]byte{1}, p.parentHash...) },
+		} {
+			tree := alice.tree.clone()
+			tamper(tree.nodes[x].parent)
+			d := decoder{buf: tree.marshal()}
+			if err := new(ratchetTree).unmarshal(&d, alice.id); err != errInvalidTree {
+				t.Fatalf("Node %d: expected errInvalidTree, got %v", x, err)
+			}
+		}
+	}
+	// So is a leaf that doesn't chain to the path of its Commit, even
+	// signed by its member.
+	tree := alice.tree.clone()
+	leaf := *tree.leaf(bob.leaf)
+	leaf.ParentHash = append([]byte{1}, leaf.ParentHash...)
+	leaf.sign(bob.signatureKey, bob.id, bob.leaf)
+	tree.nodes[2*bob.leaf] = &node{leaf: &leaf}
+	d := decoder{buf: tree.marshal()}
+	if err := new(ratchetTree).unmarshal(&d, alice.id); err != errInvalidTree {
+		t.Fatalf("Expected errInvalidTree, got %v", err)
+	}
+	d = decoder{buf: alice.tree.marshal()}
+	if err := new(ratchetTree).unmarshal(&d, alice.id); err != nil {
+		t.Fatal(err)
+	}
+
+	// The committer's leaf must chain to the path of the Commit.
+	before := *alice
+	c, _, err := alice.Commit(rand.Reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := *c
+	forged.Path.Leaf.ParentHash = append([]byte{1}, c.Path.Leaf.ParentHash...)
+	forged.Path.Leaf.sign(alice.signatureKey, alice.id, alice.leaf)
+	forged.Signature = signWithLabel(alice.signatureKey, "FramedContentTBS", forged.tbs(before.context()))
+	if err := bob.Process(&forged); err != errInvalidCommit {
+		t.Fatalf("Expected errInvalidCommit, got %v", err)
+	}
+	if err := bob.Process(c); err != nil {
+		t.Fatal(err)
+	}
+}
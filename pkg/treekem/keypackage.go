@@ -0,0 +1,118 @@
+package treekem
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io"
+)
+
+// KeyPackage is what a new member publishes so that they can be added to
+// a group without being online.
+type KeyPackage struct {
+	// InitKey is the X25519 public key to which the Welcome is encrypted.
+	InitKey   [32]byte
+	Leaf      LeafNode
+	Signature []byte
+}
+
+// KeyPackageSecrets are the private keys of a KeyPackage, needed to join
+// a group with a Welcome.
+type KeyPackageSecrets struct {
+	InitKey       [32]byte
+	EncryptionKey [32]byte
+	SignatureKey  ed25519.PrivateKey
+}
+
+var errInvalidKeyPackage = errors.New("treekem: invalid key package")
+
+// NewKeyPackage returns a KeyPackage for the member whose credential is
+// identity, and who signs with signatureKey.
+func NewKeyPackage(rand io.Reader, identity []byte, signatureKey ed25519.PrivateKey) (*KeyPackage, *KeyPackageSecrets, error) {
+	initPriv, initPub, err := generateKeyPair(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	encPriv, encPub, err := generateKeyPair(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	kp := &KeyPackage{
+		InitKey: initPub,
+		Leaf: LeafNode{
+			EncryptionKey: encPub,
+			Identity:      append([]byte(nil), identity...),
+			Source:        leafSourceKeyPackage,
+		},
+	}
+	copy(kp.Leaf.SignatureKey[:], signatureKey.Public().(ed25519.PublicKey))
+	kp.Leaf.sign(signatureKey, nil, 0)
+	kp.Signature = signWithLabel(signatureKey, "KeyPackageTBS", kp.tbs())
+	return kp, &KeyPackageSecrets{InitKey: initPriv, EncryptionKey: encPriv, SignatureKey: signatureKey}, nil
+}
+
+func (kp *KeyPackage) tbs() []byte {
+	var e encoder
+	e.uint16(ProtocolVersion)
+	e.uint16(CipherSuite)
+	e.opaque(kp.InitKey[:])
+	kp.Leaf.marshal(&e)
+	return e.buf
+}
+
+// Verify checks the signatures of the KeyPackage and of its leaf.
+func (kp *KeyPackage) Verify() error {
+	if kp.Leaf.Source != leafSourceKeyPackage || kp.InitKey == kp.Leaf.EncryptionKey {
+		return errInvalidKeyPackage
+	}
+	if err := kp.Leaf.verify(nil, 0); err != nil {
+		return err
+	}
+	if !verifyWithLabel(kp.Leaf.SignatureKey, "KeyPackageTBS", kp.tbs(), kp.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Ref is the KeyPackageRef that names kp in a Welcome.
+func (kp *KeyPackage) Ref() []byte {
+	b, _ := kp.MarshalBinary()
+	return refHash("MLS 1.0 KeyPackage Reference", b)
+}
+
+func (kp *KeyPackage) marshal(e *encoder) {
+	e.buf = append(e.buf, kp.tbs()...)
+	e.opaque(kp.Signature)
+}
+
+func (kp *KeyPackage) unmarshal(d *decoder) {
+	version, suite := d.uint16(), d.uint16()
+	if d.err == nil && (version != ProtocolVersion || suite != CipherSuite) {
+		d.err = errInvalidKeyPackage
+	}
+	kp.InitKey = d.key()
+	kp.Leaf.unmarshal(d)
+	kp.Signature = d.opaque()
+}
+
+// MarshalBinary makes the KeyPackage an encoding.BinaryMarshaler.
+func (kp *KeyPackage) MarshalBinary() ([]byte, error) {
+	var e encoder
+	kp.marshal(&e)
+	return e.buf, nil
+}
+
+// UnmarshalBinary makes the *KeyPackage an encoding.BinaryUnmarshaler. The
+// signatures are verified.
+func (kp *KeyPackage) UnmarshalBinary(in []byte) error {
+	var decoded KeyPackage
+	d := decoder{buf: in}
+	decoded.unmarshal(&d)
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if err := decoded.Verify(); err != nil {
+		return err
+	}
+	*kp = decoded
+	return nil
+}
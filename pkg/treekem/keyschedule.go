@@ -0,0 +1,64 @@
+package treekem
+
+// epochSecrets are the secrets of the key schedule of an epoch. The ones
+// of RFC 9420 that protect application and handshake messages are left
+// out, because messages are carried by other means.
+type epochSecrets struct {
+	joiner         []byte
+	welcome        []byte
+	exporter       []byte
+	confirmation   []byte
+	authentication []byte
+	// init is the init_secret of the next epoch.
+	init []byte
+}
+
+// joinerSecret derives the secret shared by the members and the joiners
+// of an epoch from the init secret of the previous epoch, and the commit
+// secret of the commit that started it.
+func joinerSecret(initSecret, commitSecret, context []byte) []byte {
+	return expandWithLabel(extract(initSecret, commitSecret), "joiner", context, hashSize)
+}
+
+// memberSecret mixes in the pre-shared keys, of which there are none.
+func memberSecret(joinerSecret []byte) []byte {
+	return extract(joinerSecret, make([]byte, hashSize))
+}
+
+func welcomeSecret(joinerSecret []byte) []byte {
+	return deriveSecret(memberSecret(joinerSecret), "welcome")
+}
+
+func newEpochSecrets(joinerSecret, context []byte) epochSecrets {
+	member := memberSecret(joinerSecret)
+	epoch := expandWithLabel(member, "epoch", context, hashSize)
+	return epochSecrets{
+		joiner:         joinerSecret,
+		welcome:        deriveSecret(member, "welcome"),
+		exporter:       deriveSecret(epoch, "exporter"),
+		confirmation:   deriveSecret(epoch, "confirm"),
+		authentication: deriveSecret(epoch, "authentication"),
+		init:           deriveSecret(epoch, "init"),
+	}
+}
+
+// groupContext is the GroupContext of RFC 9420, without extensions, that
+// binds the secrets of an epoch to the state of the group.
+func groupContext(groupID []byte, epoch uint64, treeHash, confirmedTranscriptHash []byte) []byte {
+	var e encoder
+	e.uint16(ProtocolVersion)
+	e.uint16(CipherSuite)
+	e.opaque(groupID)
+	e.uint64(epoch)
+	e.opaque(treeHash)
+	e.opaque(confirmedTranscriptHash)
+	e.opaque(nil)
+	return e.buf
+}
+
+func interimTranscriptHash(confirmedTranscriptHash, confirmationTag []byte) []byte {
+	var e encoder
+	e.buf = append(e.buf, confirmedTranscriptHash...)
+	e.opaque(confirmationTag)
+	return hash(e.buf)
+}
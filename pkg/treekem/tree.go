@@ -0,0 +1,441 @@
+package treekem
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+)
+
+// Sources of a LeafNode.
+const (
+	leafSourceKeyPackage = 1
+	leafSourceUpdate     = 2
+	leafSourceCommit     = 3
+)
+
+// LeafNode is a member in the ratchet tree.
+type LeafNode struct {
+	// EncryptionKey is the X25519 public key to which path secrets are
+	// encrypted for the member.
+	EncryptionKey [32]byte
+	// SignatureKey is the Ed25519 public key of the member.
+	SignatureKey [32]byte
+	// Identity is the basic credential of the member.
+	Identity []byte
+	Source   uint8
+	// ParentHash, for a leaf set by a Commit, chains the leaf to the
+	// parent nodes the Commit set.
+	ParentHash []byte
+	Signature  []byte
+}
+
+var (
+	// ErrBadSignature is returned when a signature is invalid.
+	ErrBadSignature = errors.New("treekem: bad signature")
+
+	errInvalidTree = errors.New("treekem: invalid ratchet tree")
+)
+
+func (l *LeafNode) marshalTBS(e *encoder) {
+	e.opaque(l.EncryptionKey[:])
+	e.opaque(l.SignatureKey[:])
+	e.opaque(l.Identity)
+	e.uint8(l.Source)
+	if l.Source == leafSourceCommit {
+		e.opaque(l.ParentHash)
+	}
+}
+
+func (l *LeafNode) marshal(e *encoder) {
+	l.marshalTBS(e)
+	e.opaque(l.Signature)
+}
+
+func (l *LeafNode) unmarshal(d *decoder) {
+	l.EncryptionKey = d.key()
+	l.SignatureKey = d.key()
+	l.Identity = d.opaque()
+	l.Source = d.uint8()
+	if l.Source == leafSourceCommit {
+		l.ParentHash = d.opaque()
+	}
+	l.Signature = d.opaque()
+	if l.Source < leafSourceKeyPackage || l.Source > leafSourceCommit {
+		d.err = errInvalidEncoding
+	}
+}
+
+// tbs returns what the signature covers. Leaves from a KeyPackage aren't
+// bound to a group yet.
+func (l *LeafNode) tbs(groupID []byte, leaf uint32) []byte {
+	var e encoder
+	l.marshalTBS(&e)
+	if l.Source != leafSourceKeyPackage {
+		e.opaque(groupID)
+		e.uint32(leaf)
+	}
+	return e.buf
+}
+
+func (l *LeafNode) sign(key ed25519.PrivateKey, groupID []byte, leaf uint32) {
+	l.Signature = signWithLabel(key, "LeafNodeTBS", l.tbs(groupID, leaf))
+}
+
+func (l *LeafNode) verify(groupID []byte, leaf uint32) error {
+	if !verifyWithLabel(l.SignatureKey, "LeafNodeTBS", l.tbs(groupID, leaf), l.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// parentNode is a node above the leaves. Its private key is known to the
+// members below it, except the unmerged leaves, which were added after the
+// key was set.
+type parentNode struct {
+	encryptionKey [32]byte
+	// parentHash chains the node to the one above it on the path of the
+	// Commit that set them, empty for the top of the path.
+	parentHash     []byte
+	unmergedLeaves []uint32
+}
+
+func (p *parentNode) marshal(e *encoder) {
+	p.marshalUnmerged(e, p.unmergedLeaves)
+}
+
+// marshalUnmerged encodes p as if its unmerged leaves were leaves.
+func (p *parentNode) marshalUnmerged(e *encoder, leaves []uint32) {
+	e.opaque(p.encryptionKey[:])
+	e.opaque(p.parentHash)
+	e.vector(func(e *encoder) {
+		for _, l := range leaves {
+			e.uint32(l)
+		}
+	})
+}
+
+func (p *parentNode) unmarshal(d *decoder) {
+	p.encryptionKey = d.key()
+	p.parentHash = d.opaque()
+	leaves := d.vector()
+	for leaves.more() {
+		p.unmergedLeaves = append(p.unmergedLeaves, leaves.uint32())
+	}
+	d.merge(leaves)
+}
+
+// node is either a leaf or a parent; blank nodes are nil.
+type node struct {
+	leaf   *LeafNode
+	parent *parentNode
+}
+
+func (n *node) encryptionKey() [32]byte {
+	if n.leaf != nil {
+		return n.leaf.EncryptionKey
+	}
+	return n.parent.encryptionKey
+}
+
+// ratchetTree is the public state of the members of a group.
+type ratchetTree struct {
+	nodes []*node
+}
+
+func (t *ratchetTree) leaves() uint32 {
+	return (uint32(len(t.nodes)) + 1) / 2
+}
+
+// leaf returns the leaf of index i, or nil if it is blank.
+func (t *ratchetTree) leaf(i uint32) *LeafNode {
+	if i >= t.leaves() || t.nodes[2*i] == nil {
+		return nil
+	}
+	return t.nodes[2*i].leaf
+}
+
+// clone copies the tree. Leaves aren't modified in place, so they are
+// shared.
+func (t *ratchetTree) clone() *ratchetTree {
+	c := &ratchetTree{nodes: make([]*node, len(t.nodes))}
+	for i, n := range t.nodes {
+		switch {
+		case n == nil:
+		case n.leaf != nil:
+			c.nodes[i] = &node{leaf: n.leaf}
+		default:
+			p := *n.parent
+			p.unmergedLeaves = append([]uint32(nil), p.unmergedLeaves...)
+			c.nodes[i] = &node{parent: &p}
+		}
+	}
+	return c
+}
+
+// add puts l in the leftmost blank leaf, extending the tree if there is
+// none, and returns its index.
+func (t *ratchetTree) add(l *LeafNode) uint32 {
+	n := t.leaves()
+	i := uint32(0)
+	for i < n && t.nodes[2*i] != nil {
+		i++
+	}
+	if i == n {
+		t.nodes = append(t.nodes, make([]*node, nodeWidth(2*n)-nodeWidth(n))...)
+	}
+	t.nodes[2*i] = &node{leaf: l}
+	for _, p := range directPath(2*i, t.leaves()) {
+		if t.nodes[p] != nil {
+			t.nodes[p].parent.unmergedLeaves = append(t.nodes[p].parent.unmergedLeaves, i)
+		}
+	}
+	return i
+}
+
+// blankPath blanks the parents of leaf i.
+func (t *ratchetTree) blankPath(i uint32) {
+	for _, p := range directPath(2*i, t.leaves()) {
+		t.nodes[p] = nil
+	}
+}
+
+// remove blanks leaf i and its parents, then shrinks the tree while its
+// right half is blank.
+func (t *ratchetTree) remove(i uint32) {
+	t.nodes[2*i] = nil
+	t.blankPath(i)
+	for n := t.leaves(); n > 1; n /= 2 {
+		for j := n / 2; j < n; j++ {
+			if t.nodes[2*j] != nil {
+				return
+			}
+		}
+		t.nodes = t.nodes[:nodeWidth(n/2)]
+	}
+}
+
+// resolution is the smallest list of nodes whose private keys cover all
+// the leaves below x.
+func (t *ratchetTree) resolution(x uint32) []uint32 {
+	n := t.nodes[x]
+	switch {
+	case n != nil && n.parent != nil:
+		res := []uint32{x}
+		for _, l := range n.parent.unmergedLeaves {
+			res = append(res, 2*l)
+		}
+		return res
+	case n != nil:
+		return []uint32{x}
+	case level(x) == 0:
+		return nil
+	default:
+		return append(t.resolution(left(x)), t.resolution(right(x))...)
+	}
+}
+
+// filteredDirectPath returns the parents of leaf i whose other child has
+// a non-empty resolution, with these children.
+func (t *ratchetTree) filteredDirectPath(i uint32) (path, copath []uint32) {
+	n := t.leaves()
+	for x, r := 2*i, root(n); x != r; x = parent(x, n) {
+		if s := sibling(x, n); len(t.resolution(s)) > 0 {
+			path = append(path, parent(x, n))
+			copath = append(copath, s)
+		}
+	}
+	return path, copath
+}
+
+// setPath replaces leaf i and its parents: the ones in path get keys, in
+// order, and the others are blanked.
+func (t *ratchetTree) setPath(i uint32, l *LeafNode, path []uint32, keys [][32]byte) {
+	t.blankPath(i)
+	t.nodes[2*i] = &node{leaf: l}
+	for j, p := range path {
+		t.nodes[p] = &node{parent: &parentNode{encryptionKey: keys[j]}}
+	}
+}
+
+// hash is the tree hash of the subtree of x, as it was before the leaves
+// in removed were added: they are blank, and not unmerged.
+func (t *ratchetTree) hash(x uint32, removed []uint32) []byte {
+	var e encoder
+	n := t.nodes[x]
+	if level(x) == 0 {
+		e.uint8(1)
+		e.uint32(x / 2)
+		e.optional(n != nil && !containsLeaf(removed, x/2), func(e *encoder) { n.leaf.marshal(e) })
+	} else {
+		e.uint8(2)
+		e.optional(n != nil, func(e *encoder) {
+			var unmerged []uint32
+			for _, l := range n.parent.unmergedLeaves {
+				if !containsLeaf(removed, l) {
+					unmerged = append(unmerged, l)
+				}
+			}
+			n.parent.marshalUnmerged(e, unmerged)
+		})
+		e.opaque(t.hash(left(x), removed))
+		e.opaque(t.hash(right(x), removed))
+	}
+	return hash(e.buf)
+}
+
+func (t *ratchetTree) treeHash() []byte {
+	return t.hash(root(t.leaves()), nil)
+}
+
+func containsLeaf(leaves []uint32, l uint32) bool {
+	for _, x := range leaves {
+		if x == l {
+			return true
+		}
+	}
+	return false
+}
+
+// parentHash is the parent hash of the parent node p whose child on the
+// other side of the path is s, for the node below it on the path.
+func (t *ratchetTree) parentHash(p, s uint32) []byte {
+	n := t.nodes[p].parent
+	var e encoder
+	e.opaque(n.encryptionKey[:])
+	e.opaque(n.parentHash)
+	e.opaque(t.hash(s, n.unmergedLeaves))
+	return hash(e.buf)
+}
+
+// setParentHashes sets the parent hashes of path, the filtered direct path
+// of a leaf whose copath is copath, from the root down, and returns the
+// parent hash of the leaf.
+func (t *ratchetTree) setParentHashes(path, copath []uint32) []byte {
+	var parentHash []byte
+	for i := len(path) - 1; i >= 0; i-- {
+		t.nodes[path[i]].parent.parentHash = parentHash
+		parentHash = t.parentHash(path[i], copath[i])
+	}
+	return parentHash
+}
+
+// nodeParentHash returns the parent hash of node x, if it has one.
+func (t *ratchetTree) nodeParentHash(x uint32) []byte {
+	n := t.nodes[x]
+	if n.leaf != nil {
+		if n.leaf.Source != leafSourceCommit {
+			return nil
+		}
+		return n.leaf.ParentHash
+	}
+	return n.parent.parentHash
+}
+
+// parentHashValid tells if the parent node p was set by a Commit along
+// with a node D below it, on the side of child c, whose parent hash
+// matches: D is in the resolution of c, and the other nodes of the
+// resolution are the leaves added below c since.
+func (t *ratchetTree) parentHashValid(p uint32) bool {
+	unmerged := t.nodes[p].parent.unmergedLeaves
+	for _, c := range []uint32{left(p), right(p)} {
+		s := right(p)
+		if c == s {
+			s = left(p)
+		}
+		want := t.parentHash(p, s)
+		res := t.resolution(c)
+		var below int
+		for _, l := range unmerged {
+			if covers(c, 2*l) {
+				below++
+			}
+		}
+		if len(res) != below+1 {
+			continue
+		}
+		for _, d := range res {
+			if !bytes.Equal(t.nodeParentHash(d), want) {
+				continue
+			}
+			valid := true
+			for _, r := range res {
+				if r != d && (level(r) != 0 || !containsLeaf(unmerged, r/2)) {
+					valid = false
+				}
+			}
+			if valid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *ratchetTree) marshal() []byte {
+	var e encoder
+	e.vector(func(e *encoder) {
+		for _, n := range t.nodes {
+			e.optional(n != nil, func(e *encoder) {
+				if n.leaf != nil {
+					n.leaf.marshal(e)
+				} else {
+					n.parent.marshal(e)
+				}
+			})
+		}
+	})
+	return e.buf
+}
+
+// unmarshal decodes a tree, and checks the signatures of its leaves and
+// the parent hashes of its parent nodes.
+func (t *ratchetTree) unmarshal(d *decoder, groupID []byte) error {
+	nodes := d.vector()
+	t.nodes = nil
+	for nodes.more() {
+		var n *node
+		if nodes.optional() {
+			if len(t.nodes)%2 == 0 {
+				n = &node{leaf: new(LeafNode)}
+				n.leaf.unmarshal(nodes)
+			} else {
+				n = &node{parent: new(parentNode)}
+				n.parent.unmarshal(nodes)
+			}
+		}
+		t.nodes = append(t.nodes, n)
+	}
+	d.merge(nodes)
+	if d.err != nil {
+		return d.err
+	}
+	leaves := t.leaves()
+	if leaves == 0 || leaves&(leaves-1) != 0 || uint32(len(t.nodes)) != nodeWidth(leaves) {
+		return errInvalidTree
+	}
+	for i := uint32(0); i < leaves; i++ {
+		if l := t.leaf(i); l != nil {
+			if err := l.verify(groupID, i); err != nil {
+				return err
+			}
+		}
+	}
+	for _, n := range t.nodes {
+		if n == nil || n.parent == nil {
+			continue
+		}
+		for _, l := range n.parent.unmergedLeaves {
+			if t.leaf(l) == nil {
+				return errInvalidTree
+			}
+		}
+	}
+	// Each parent node must have been set by a Commit, so that nobody
+	// could make up keys for the others.
+	for x, n := range t.nodes {
+		if n != nil && n.parent != nil && !t.parentHashValid(uint32(x)) {
+			return errInvalidTree
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package treekem
+
+// The ratchet tree is a full binary tree stored in an array, as in RFC 9420:
+// leaves are at even indices, and the parents at odd ones. A tree of n
+// leaves, n being a power of two, has 2n-1 nodes. These functions are the
+// ones of Appendix C of RFC 9420.
+
+// level is the height of node x above the leaves.
+func level(x uint32) uint32 {
+	if x&1 == 0 {
+		return 0
+	}
+	k := uint32(0)
+	for (x>>k)&1 == 1 {
+		k++
+	}
+	return k
+}
+
+// nodeWidth is the number of nodes of a tree of n leaves.
+func nodeWidth(n uint32) uint32 {
+	if n == 0 {
+		return 0
+	}
+	return 2*(n-1) + 1
+}
+
+// root is the root of a tree of n leaves.
+func root(n uint32) uint32 {
+	w := nodeWidth(n)
+	k := uint32(0)
+	for (uint32(1) << (k + 1)) <= w {
+		k++
+	}
+	return (1 << k) - 1
+}
+
+func left(x uint32) uint32 {
+	k := level(x)
+	return x ^ (1 << (k - 1))
+}
+
+func right(x uint32) uint32 {
+	k := level(x)
+	return x ^ (3 << (k - 1))
+}
+
+// parent is the parent of x, which isn't the root of a tree of n leaves.
+func parent(x, n uint32) uint32 {
+	k := level(x)
+	b := (x >> (k + 1)) & 1
+	return (x | (1 << k)) ^ (b << (k + 1))
+}
+
+func sibling(x, n uint32) uint32 {
+	p := parent(x, n)
+	if x < p {
+		return right(p)
+	}
+	return left(p)
+}
+
+// directPath is the list of the ancestors of x, from its parent to the root.
+func directPath(x, n uint32) []uint32 {
+	var d []uint32
+	for r := root(n); x != r; {
+		x = parent(x, n)
+		d = append(d, x)
+	}
+	return d
+}
+
+// copath is the list of the siblings of x and of its ancestors but the root.
+func copath(x, n uint32) []uint32 {
+	var c []uint32
+	for r := root(n); x != r; x = parent(x, n) {
+		c = append(c, sibling(x, n))
+	}
+	return c
+}
+
+// covers tells if x is y or one of its descendants.
+func covers(y, x uint32) bool {
+	span := uint32(1)<<level(y) - 1
+	return x+span >= y && x <= y+span
+}
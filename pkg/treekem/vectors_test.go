@@ -0,0 +1,156 @@
+package treekem
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+// The vectors in testdata are laid out like the tree-math and
+// crypto-basics vectors of the MLS interoperability suite, restricted to
+// the fields this package covers. They were computed with an independent
+// Python implementation of the tree math and labeled functions of RFC
+// 9420, whose Ed25519 was checked against RFC 8032; they are not the
+// published vectors.
+
+type hexBytes []byte
+
+func (h *hexBytes) UnmarshalJSON(in []byte) error {
+	var s string
+	if err := json.Unmarshal(in, &s); err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(s)
+	*h = b
+	return err
+}
+
+func readVectors(t *testing.T, name string, v interface{}) {
+	in, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(in, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTreeMathVectors(t *testing.T) {
+	var vectors []struct {
+		Leaves  uint32    `json:"n_leaves"`
+		Nodes   uint32    `json:"n_nodes"`
+		Root    uint32    `json:"root"`
+		Left    []*uint32 `json:"left"`
+		Right   []*uint32 `json:"right"`
+		Parent  []*uint32 `json:"parent"`
+		Sibling []*uint32 `json:"sibling"`
+	}
+	readVectors(t, "tree-math.json", &vectors)
+
+	check := func(n, x uint32, name string, expected *uint32, defined bool, f func() uint32) {
+		t.Helper()
+		if (expected != nil) != defined {
+			t.Fatalf("%d leaves: %s(%d) defined: %v", n, name, x, defined)
+		}
+		if defined && f() != *expected {
+			t.Fatalf("%d leaves: %s(%d) = %d, expected %d", n, name, x, f(), *expected)
+		}
+	}
+	for _, v := range vectors {
+		if nodeWidth(v.Leaves) != v.Nodes || root(v.Leaves) != v.Root {
+			t.Fatalf("%d leaves: bad width %d or root %d", v.Leaves, nodeWidth(v.Leaves), root(v.Leaves))
+		}
+		for x := uint32(0); x < v.Nodes; x++ {
+			isRoot := x == root(v.Leaves)
+			check(v.Leaves, x, "left", v.Left[x], level(x) > 0, func() uint32 { return left(x) })
+			check(v.Leaves, x, "right", v.Right[x], level(x) > 0, func() uint32 { return right(x) })
+			check(v.Leaves, x, "parent", v.Parent[x], !isRoot, func() uint32 { return parent(x, v.Leaves) })
+			check(v.Leaves, x, "sibling", v.Sibling[x], !isRoot, func() uint32 { return sibling(x, v.Leaves) })
+		}
+	}
+}
+
+func TestCryptoBasicsVectors(t *testing.T) {
+	var vectors []struct {
+		CipherSuite uint16 `json:"cipher_suite"`
+		RefHash     struct {
+			Label string   `json:"label"`
+			Value hexBytes `json:"value"`
+			Out   hexBytes `json:"out"`
+		} `json:"ref_hash"`
+		ExpandWithLabel struct {
+			Secret  hexBytes `json:"secret"`
+			Label   string   `json:"label"`
+			Context hexBytes `json:"context"`
+			Length  int      `json:"length"`
+			Out     hexBytes `json:"out"`
+		} `json:"expand_with_label"`
+		DeriveSecret struct {
+			Secret hexBytes `json:"secret"`
+			Label  string   `json:"label"`
+			Out    hexBytes `json:"out"`
+		} `json:"derive_secret"`
+		SignWithLabel struct {
+			Priv      hexBytes `json:"priv"`
+			Pub       hexBytes `json:"pub"`
+			Content   hexBytes `json:"content"`
+			Label     string   `json:"label"`
+			Signature hexBytes `json:"signature"`
+		} `json:"sign_with_label"`
+	}
+	readVectors(t, "crypto-basics.json", &vectors)
+
+	for _, v := range vectors {
+		if v.CipherSuite != CipherSuite {
+			continue
+		}
+		if out := refHash(v.RefHash.Label, v.RefHash.Value); !bytes.Equal(out, v.RefHash.Out) {
+			t.Fatalf("bad RefHash %x", out)
+		}
+		e := v.ExpandWithLabel
+		if out := expandWithLabel(e.Secret, e.Label, e.Context, e.Length); !bytes.Equal(out, e.Out) {
+			t.Fatalf("bad ExpandWithLabel %x", out)
+		}
+		if out := deriveSecret(v.DeriveSecret.Secret, v.DeriveSecret.Label); !bytes.Equal(out, v.DeriveSecret.Out) {
+			t.Fatalf("bad DeriveSecret %x", out)
+		}
+		s := v.SignWithLabel
+		key := ed25519.NewKeyFromSeed(s.Priv)
+		if sig := signWithLabel(key, s.Label, s.Content); !bytes.Equal(sig, s.Signature) {
+			t.Fatalf("bad SignWithLabel %x", sig)
+		}
+		var pub [32]byte
+		copy(pub[:], s.Pub)
+		if !verifyWithLabel(pub, s.Label, s.Content, s.Signature) {
+			t.Fatal("VerifyWithLabel failed")
+		}
+	}
+}
+
+func TestEncryptWithLabel(t *testing.T) {
+	priv, pub, err := generateKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := encryptWithLabel(rand.Reader, pub, "label", []byte("context"), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := decryptWithLabel(priv, "label", []byte("context"), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" {
+		t.Fatalf("Expected %q, got %q", "secret", plaintext)
+	}
+	if _, err := decryptWithLabel(priv, "label", []byte("other context"), c); err != errDecrypt {
+		t.Fatalf("Expected errDecrypt, got %v", err)
+	}
+	if _, err := decryptWithLabel(priv, "other label", []byte("context"), c); err != errDecrypt {
+		t.Fatalf("Expected errDecrypt, got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package treekem
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"io"
+)
+
+// Welcome gives new members the state of the group in the epoch that
+// added them.
+type Welcome struct {
+	Secrets []EncryptedGroupSecrets
+	// EncryptedGroupInfo is the GroupContext, the ratchet tree and the
+	// confirmation tag of the epoch, signed by the committer, and
+	// encrypted with a key derived from the joiner secret.
+	EncryptedGroupInfo []byte
+}
+
+// EncryptedGroupSecrets are the joiner secret, and the path secret of the
+// lowest parent shared by the committer and a new member, encrypted to the
+// init key of the KeyPackage of the new member.
+type EncryptedGroupSecrets struct {
+	// NewMember is the Ref of the KeyPackage.
+	NewMember []byte
+	Secrets   HPKECiphertext
+}
+
+var (
+	// ErrNotInvited is returned by Join for a Welcome that isn't for the
+	// KeyPackage.
+	ErrNotInvited = errors.New("treekem: welcome isn't for this key package")
+
+	errInvalidWelcome = errors.New("treekem: invalid welcome")
+)
+
+func welcomeKey(welcomeSecret []byte) (key, nonce []byte) {
+	return expandWithLabel(welcomeSecret, "key", nil, keySize), expandWithLabel(welcomeSecret, "nonce", nil, nonceSize)
+}
+
+// welcome returns the Welcome for joiners, from the committer, in the
+// epoch their Commit started. pathSecrets are the ones of the filtered
+// direct path of the committer, whose copath is copath.
+func (g *Group) welcome(rand io.Reader, joiners []joiner, copath []uint32, pathSecrets [][]byte, confirmationTag []byte) (*Welcome, error) {
+	var info encoder
+	info.opaque(g.context())
+	info.buf = append(info.buf, g.tree.marshal()...)
+	info.opaque(confirmationTag)
+	info.uint32(g.leaf)
+	info.opaque(signWithLabel(g.signatureKey, "GroupInfoTBS", info.buf))
+	key, nonce := welcomeKey(g.secrets.welcome)
+	w := &Welcome{EncryptedGroupInfo: sealAEAD(key, nonce, info.buf, nil)}
+
+	for _, j := range joiners {
+		i := 0
+		for !covers(copath[i], 2*j.leaf) {
+			i++
+		}
+		var secrets encoder
+		secrets.opaque(g.secrets.joiner)
+		secrets.optional(true, func(e *encoder) { e.opaque(pathSecrets[i]) })
+		s, err := encryptWithLabel(rand, j.kp.InitKey, "Welcome", w.EncryptedGroupInfo, secrets.buf)
+		if err != nil {
+			return nil, err
+		}
+		w.Secrets = append(w.Secrets, EncryptedGroupSecrets{NewMember: j.kp.Ref(), Secrets: s})
+	}
+	return w, nil
+}
+
+// Join joins the group of a Welcome for kp, whose private keys are secrets.
+func Join(w *Welcome, kp *KeyPackage, secrets *KeyPackageSecrets) (*Group, error) {
+	ref := kp.Ref()
+	var groupSecrets []byte
+	for _, s := range w.Secrets {
+		if !bytes.Equal(s.NewMember, ref) {
+			continue
+		}
+		var err error
+		if groupSecrets, err = decryptWithLabel(secrets.InitKey, "Welcome", w.EncryptedGroupInfo, s.Secrets); err != nil {
+			return nil, err
+		}
+		break
+	}
+	if groupSecrets == nil {
+		return nil, ErrNotInvited
+	}
+	d := decoder{buf: groupSecrets}
+	joinerSecret := d.opaque()
+	var pathSecret []byte
+	if d.optional() {
+		pathSecret = d.opaque()
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	key, nonce := welcomeKey(welcomeSecret(joinerSecret))
+	info, err := openAEAD(key, nonce, w.EncryptedGroupInfo, nil)
+	if err != nil {
+		return nil, err
+	}
+	d = decoder{buf: info}
+	context := d.opaque()
+	c := decoder{buf: context}
+	version, suite := c.uint16(), c.uint16()
+	g := &Group{
+		id:             c.opaque(),
+		epoch:          c.uint64(),
+		tree:           new(ratchetTree),
+		signatureKey:   secrets.SignatureKey,
+		pendingUpdates: make(map[[32]byte][32]byte),
+		privateKeys:    make(map[uint32][32]byte),
+	}
+	treeHash := c.opaque()
+	g.confirmedTranscriptHash = c.opaque()
+	extensions := c.opaque()
+	if err := c.finish(); err != nil {
+		return nil, err
+	}
+	if version != ProtocolVersion || suite != CipherSuite || len(extensions) > 0 {
+		return nil, errInvalidWelcome
+	}
+	if err := g.tree.unmarshal(&d, g.id); err != nil {
+		return nil, err
+	}
+	confirmationTag := d.opaque()
+	signer := d.uint32()
+	signed := info[:len(info)-len(d.buf)]
+	signature := d.opaque()
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(g.tree.treeHash(), treeHash) {
+		return nil, errInvalidWelcome
+	}
+	committer := g.tree.leaf(signer)
+	if committer == nil {
+		return nil, errInvalidWelcome
+	}
+	if !verifyWithLabel(committer.SignatureKey, "GroupInfoTBS", signed, signature) {
+		return nil, ErrBadSignature
+	}
+
+	g.leaf = g.tree.leaves()
+	for i := uint32(0); i < g.tree.leaves(); i++ {
+		if l := g.tree.leaf(i); l != nil && l.EncryptionKey == kp.Leaf.EncryptionKey {
+			g.leaf = i
+		}
+	}
+	if g.leaf == g.tree.leaves() || g.leaf == signer {
+		return nil, errInvalidWelcome
+	}
+	g.privateKeys[2*g.leaf] = secrets.EncryptionKey
+
+	g.secrets = newEpochSecrets(joinerSecret, context)
+	if !hmac.Equal(mac(g.secrets.confirmation, g.confirmedTranscriptHash), confirmationTag) {
+		return nil, errInvalidWelcome
+	}
+	g.interimTranscriptHash = interimTranscriptHash(g.confirmedTranscriptHash, confirmationTag)
+
+	if pathSecret != nil {
+		path, copath := g.tree.filteredDirectPath(signer)
+		i := 0
+		for i < len(copath) && !covers(copath[i], 2*g.leaf) {
+			i++
+		}
+		if i == len(copath) {
+			return nil, errInvalidWelcome
+		}
+		keys := make([][32]byte, len(path)-i)
+		for j, p := range path[i:] {
+			if g.tree.nodes[p] == nil {
+				return nil, errInvalidWelcome
+			}
+			keys[j] = g.tree.nodes[p].encryptionKey()
+		}
+		if _, err := derivePath(g.privateKeys, path[i:], keys, pathSecret); err != nil {
+			return nil, errInvalidWelcome
+		}
+	}
+	return g, nil
+}
+
+// MarshalBinary makes the Welcome an encoding.BinaryMarshaler.
+func (w *Welcome) MarshalBinary() ([]byte, error) {
+	var e encoder
+	e.uint16(CipherSuite)
+	e.vector(func(e *encoder) {
+		for _, s := range w.Secrets {
+			e.opaque(s.NewMember)
+			s.Secrets.marshal(e)
+		}
+	})
+	e.opaque(w.EncryptedGroupInfo)
+	return e.buf, nil
+}
+
+// UnmarshalBinary makes the *Welcome an encoding.BinaryUnmarshaler.
+func (w *Welcome) UnmarshalBinary(in []byte) error {
+	var decoded Welcome
+	d := decoder{buf: in}
+	if d.uint16() != CipherSuite && d.err == nil {
+		return errInvalidWelcome
+	}
+	secrets := d.vector()
+	for secrets.more() {
+		s := EncryptedGroupSecrets{NewMember: secrets.opaque()}
+		s.Secrets.unmarshal(secrets)
+		decoded.Secrets = append(decoded.Secrets, s)
+	}
+	d.merge(secrets)
+	decoded.EncryptedGroupInfo = d.opaque()
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*w = decoded
+	return nil
+}
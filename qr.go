@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rakoo/goax/pkg/ratchet"
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the width, in modules, of the light border scanners need
+// around a QR code.
+const qrQuietZone = 4
+
+// printQR prints text as a QR code. Each character holds two modules, one
+// above the other, with explicit colors so that the code reads the same
+// on light and dark terminals.
+func printQR(text string) error {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return err
+	}
+	black := func(x, y int) bool {
+		x, y = x-qrQuietZone, y-qrQuietZone
+		return x >= 0 && y >= 0 && x < code.Size && y < code.Size && code.Black(x, y)
+	}
+
+	const (
+		upperHalf = "▀"
+		reset     = "\x1b[0m"
+	)
+	size := code.Size + 2*qrQuietZone
+	var out strings.Builder
+	for y := 0; y < size; y += 2 {
+		lastColors := ""
+		for x := 0; x < size; x++ {
+			// The foreground paints the upper module, the background
+			// the lower one
+			fg, bg := 97, 107
+			if black(x, y) {
+				fg = 30
+			}
+			if black(x, y+1) {
+				bg = 40
+			}
+			if colors := fmt.Sprintf("\x1b[%d;%dm", fg, bg); colors != lastColors {
+				out.WriteString(colors)
+				lastColors = colors
+			}
+			out.WriteString(upperHalf)
+		}
+		out.WriteString(reset + "\n")
+	}
+	fmt.Print(out.String())
+	return nil
+}
+
+// keyExchangeQRText returns the text of the QR code for kx. It is a
+// block in encodingBase58, so the scanned text can be given as-is to
+// receive.
+func keyExchangeQRText(kx ratchet.KeyExchange) (string, error) {
+	content, err := kx.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return encodeBlock(encodingBase58, KEY_EXCHANGE_TYPE, content)
+}
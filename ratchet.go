@@ -2,89 +2,95 @@ package main
 
 import (
 	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
-	"os"
-	"path"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rakoo/goax/pkg/ratchet"
-	"golang.org/x/crypto/openpgp/armor"
+	"github.com/rakoo/goax/pkg/session"
 )
 
 var errNoRatchet = errors.New("No ratchet")
 
 var errInvalidRatchet = errors.New("Invalid ratchet")
 
-func openRatchet(peer string) (r *ratchet.Ratchet, err error) {
-	f, err := os.Open(path.Join("ratchets", hex.EncodeToString([]byte(peer))))
-	if err != nil {
-		return nil, errNoRatchet
-	}
-	defer f.Close()
+// ratchets stores the record of each peer: the active ratchet, and the
+// previous ones that may still decrypt late messages.
+var ratchets = session.Dir("ratchets")
 
-	myIdentityKeyPrivate := getPrivateKey()
-	var asArray [32]byte
-	copy(asArray[:], myIdentityKeyPrivate)
-	r = ratchet.New(rand.Reader, asArray)
+// previousRatchetLifetime is how long a ratchet replaced by a new one is
+// kept.
+const previousRatchetLifetime = 7 * 24 * time.Hour
 
-	armorDecoder, err := armor.Decode(f)
+func openRecord(peer string) (*session.Record, error) {
+	state, err := ratchets.Load(peer)
+	if err == session.ErrNotFound {
+		return nil, errNoRatchet
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "Error opening decoder")
+		return nil, errors.Wrap(err, "Error opening ratchet")
 	}
-	err = json.NewDecoder(armorDecoder.Body).Decode(r)
+
+	rec, err := session.LoadRecord(state, rand.Reader, identityKey())
 	if err != nil {
 		return nil, errInvalidRatchet
 	}
+	rec.Expire(time.Now().Add(-previousRatchetLifetime))
+	return rec, nil
+}
 
-	return r, nil
+func openRatchet(peer string) (r *ratchet.Ratchet, err error) {
+	rec, err := openRecord(peer)
+	if err != nil {
+		return nil, err
+	}
+	return rec.Active, nil
 }
 
 func createRatchet(peer string) (r *ratchet.Ratchet, err error) {
-	myIdentityKeyPrivate := getPrivateKey()
-	var asArray [32]byte
-	copy(asArray[:], myIdentityKeyPrivate)
-	r = ratchet.New(rand.Reader, asArray)
+	r, err = newRatchet()
+	if err != nil {
+		return nil, err
+	}
 	err = saveRatchet(r, peer)
-	markAsNew(peer)
 	return r, err
 }
 
-func saveRatchet(r *ratchet.Ratchet, peer string) error {
-	os.MkdirAll("ratchets", 0755)
-	f, err := os.Create(path.Join("ratchets", hex.EncodeToString([]byte(peer))))
+func identityKey() (key [32]byte) {
+	copy(key[:], getPrivateKey())
+	return key
+}
+
+func newRatchet() (*ratchet.Ratchet, error) {
+	r, err := ratchet.New(rand.Reader, identityKey())
 	if err != nil {
-		return errors.Wrap(err, "Couldn't create ratchet file")
+		return nil, errors.Wrap(err, "Couldn't create ratchet")
 	}
-	defer f.Close()
+	return r, nil
+}
 
-	armorEncoder, err := armor.Encode(f, "GOAX RATCHET", nil)
-	if err != nil {
-		return errors.Wrap(err, "Couldn't create armor encoder")
+// saveRatchet saves r as the active ratchet of peer.
+func saveRatchet(r *ratchet.Ratchet, peer string) error {
+	rec, err := openRecord(peer)
+	switch err {
+	case nil:
+		rec.Active = r
+	case errNoRatchet:
+		rec = session.NewRecord(r)
+	default:
+		return err
 	}
-	err = json.NewEncoder(armorEncoder).Encode(r)
+	return saveRecord(rec, peer)
+}
+
+func saveRecord(rec *session.Record, peer string) error {
+	state, err := json.Marshal(rec)
 	if err != nil {
 		return errors.Wrap(err, "Couldn't marshall ratchet")
 	}
-	err = armorEncoder.Close()
+	err = ratchets.Save(peer, state)
 	if err != nil {
-		return errors.Wrap(err, "Couldn't close armor encoder")
+		return errors.Wrap(err, "Couldn't save ratchet")
 	}
 	return nil
 }
-
-func markAsNew(peer string) {
-	os.MkdirAll("new", 0755)
-	os.Create(path.Join("new", hex.EncodeToString([]byte(peer))))
-}
-
-func isNew(peer string) bool {
-	f, err := os.Open(path.Join("new", hex.EncodeToString([]byte(peer))))
-	defer f.Close()
-
-	return err == nil
-}
-
-func deleteNew(peer string) {
-	os.Remove(path.Join("new", hex.EncodeToString([]byte(peer))))
-}
@@ -10,85 +10,469 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/rakoo/goax/pkg/device"
+	"github.com/rakoo/goax/pkg/envelope"
 	"github.com/rakoo/goax/pkg/ratchet"
+	"github.com/rakoo/goax/pkg/session"
 	"golang.org/x/crypto/openpgp/armor"
 )
 
 func receive(peer string) {
-	getRatchet := func(peer string) (r *ratchet.Ratchet) {
-		r, err := openRatchet(peer)
+	getRecord := func(s peerSession) *session.Record {
+		rec, err := openRecord(s.name())
 		if err != nil {
 			if err == errNoRatchet {
-				fmt.Fprintf(os.Stderr, "No ratchet for %s, creating one.\n", peer)
-				r, err = createRatchet(peer)
+				fmt.Fprintf(os.Stderr, "No ratchet for %s, creating one.\n", s)
+				r, err := createRatchet(s.name())
 				if err != nil {
 					log.Fatal("Couldn't create ratchet:", err)
 				}
+				rec = session.NewRecord(r)
 			} else {
 				log.Fatal(err)
 			}
 		}
-		return r
+		return rec
 
 	}
 
+	// decrypt returns the plaintext of an encrypted block of the session
+	// s, or false if it was a duplicate.
+	var lastRatchet *ratchet.Ratchet
+	decrypt := func(s peerSession, msg []byte) ([]byte, bool) {
+		rec := getRecord(s)
+		plaintext, err := rec.Decrypt(msg)
+		if err == ratchet.ErrDuplicateMessage {
+			fmt.Fprintln(os.Stderr, "Skipping a message that was already received")
+			return nil, false
+		}
+		if err != nil {
+			warnDesync(peer, rec.Active, err)
+			log.Fatal("Couldn't decrypt message: ", err)
+		}
+		if err := saveRecord(rec, s.name()); err != nil {
+			log.Fatal("Couldn't save ratchet: ", err)
+		}
+		lastRatchet = rec.Active
+		return plaintext, true
+	}
+
+	// decryptAny decrypts an encrypted block that isn't addressed, with
+	// the session of whichever device of peer sent it.
+	decryptAny := func(msg []byte) (peerSession, []byte, bool) {
+		sessions, err := peerSessions(peer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(sessions) == 1 {
+			plaintext, ok := decrypt(sessions[0], msg)
+			return sessions[0], plaintext, ok
+		}
+		for _, s := range sessions {
+			rec, err := openRecord(s.name())
+			if err == errNoRatchet {
+				continue
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			if _, err := rec.Decrypt(msg); err == nil || err == ratchet.ErrDuplicateMessage {
+				// Decrypt again with the saving and the messages of
+				// decrypt.
+				plaintext, ok := decrypt(s, msg)
+				return s, plaintext, ok
+			}
+		}
+		log.Fatalf("Couldn't decrypt message with the session of any device of %s", peer)
+		return peerSession{}, nil, false
+	}
+
 	stat, err := os.Stdin.Stat()
 	if err != nil {
 		log.Fatal("Couldn't stat stdin")
 	}
 	if (stat.Mode() & os.ModeCharDevice) != 0 {
 		// stdin is from a terminal, not from a pipe
-		fmt.Fprintln(os.Stderr, "Please paste in the message; when done, hit Ctrl-D\n")
+		fmt.Fprint(os.Stderr, "Please paste in the message; when done, hit Ctrl-D\n\n")
 	}
 	stdin, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
 		log.Fatal("Couldn't read from stdin: ", err)
 	}
 
-	blockScanner := newBlockSplitter(stdin)
-	var scannedSomething bool
-	for blockScanner.Scan() {
-		armorDecoder, err := armor.Decode(strings.NewReader(blockScanner.Text()))
+	// handleMessage handles a message decrypted with the session s.
+	handleMessage := func(s peerSession, plaintext []byte) {
+		e, err := envelope.Unmarshal(plaintext)
+		if err == envelope.ErrNotEnvelope {
+			// Sent by an older goax, there's nothing but text
+			countReceived(s)
+			fmt.Println("")
+			io.Copy(os.Stdout, bytes.NewReader(plaintext))
+			return
+		}
 		if err != nil {
-			log.Fatal("Couldn't read message from stdin: ", err)
+			log.Fatal("Invalid message: ", err)
+		}
+		switch e.Type {
+		case envelope.Ack:
+			receiveAck(s, e)
+		case envelope.Text:
+			countReceived(s)
+			printEnvelope(peer, e)
+		case envelope.File:
+			countReceived(s)
+			receiveFileDescription(peer, e)
+		case envelope.SenderKey:
+			receiveSenderKey(peer, e)
+		default:
+			log.Printf("Ignoring %s message %s", e.Type, e.ID)
+		}
+	}
+
+	handleKeyExchange := func(s peerSession, kx ratchet.KeyExchange) {
+		if s.device != ([32]byte{}) && kx.IdentityPublic != s.device {
+			log.Fatalf("The key exchange material from %s is for another device", s)
 		}
-		switch armorDecoder.Type {
+		rec := getRecord(s)
+		if kx.IsReset() && rec.Active.State() != ratchet.AwaitingKeyExchange {
+			acceptReset(s, rec, kx)
+		}
+		err := rec.Active.CompleteKeyExchange(kx)
+		if err != nil && err != ratchet.ErrHandshakeComplete {
+			log.Fatal("Invalid key exchange material: ", err)
+		}
+		if err == ratchet.ErrHandshakeComplete && rec.Active.IsNewKeyExchange(kx) {
+			fmt.Fprintf(os.Stderr, "%s sent new key exchange material, but you already have a session with them; ignoring it. If they lost their goax state, start a new session with \"goax reset %s\".\n", s, peer)
+		}
+		if err := saveRecord(rec, s.name()); err != nil {
+			log.Fatal("Couldn't save ratchet: ", err)
+		}
+		if err == nil {
+			announceQueued(peer)
+		}
+	}
+
+	var scannedSomething bool
+	var skipped int
+	handleBlock := func(blockType string, body []byte) {
+		switch blockType {
 		case ENCRYPTED_MESSAGE_TYPE:
-			msg, err := ioutil.ReadAll(armorDecoder.Body)
+			scannedSomething = true
+			if s, plaintext, ok := decryptAny(body); ok {
+				handleMessage(s, plaintext)
+			}
+		case KEY_EXCHANGE_TYPE:
+			kx, err := decodeKeyExchange(body)
 			if err != nil {
-				log.Fatal("Couldn't read message: ", err)
+				log.Fatal("Invalid key exchange material: ", err)
+			}
+			s, err := deviceSession(peer, kx.IdentityPublic)
+			if err == errUnknownDevice {
+				log.Fatalf("%s sent key exchange material from a device that isn't in their list of devices", peer)
 			}
-			r := getRatchet(peer)
-			plaintext, err := r.Decrypt(msg)
 			if err != nil {
-				log.Fatal("Couldn't decrypt message: ", err)
+				log.Fatal(err)
 			}
-			fmt.Println("")
-			io.Copy(os.Stdout, bytes.NewReader(plaintext))
-			deleteNew(peer)
+			handleKeyExchange(s, kx)
 			scannedSomething = true
-		case KEY_EXCHANGE_TYPE:
-			r := getRatchet(peer)
-			var kx ratchet.KeyExchange
-			json.NewDecoder(armorDecoder.Body).Decode(&kx)
-			err = r.CompleteKeyExchange(kx)
-			if err != nil && err != ratchet.ErrHandshakeComplete {
-				log.Fatal("Invalid key exchange material: ", err)
+		case DEVICE_MESSAGE_TYPE:
+			var m device.Message
+			if err := m.UnmarshalBinary(body); err != nil {
+				log.Fatal("Invalid device message: ", err)
 			}
-			saveRatchet(r, peer)
 			scannedSomething = true
+			if m.To != ([32]byte{}) && m.To != myDevice() {
+				skipped++
+				return
+			}
+			s, err := deviceSession(peer, m.From)
+			if err == errUnknownDevice {
+				log.Fatalf("%s sent a block from device %s, which isn't in their list of devices", peer, deviceName(m.From))
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			switch m.Kind {
+			case device.KindKeyExchange:
+				var kx ratchet.KeyExchange
+				if err := kx.UnmarshalBinary(m.Payload); err != nil {
+					log.Fatal("Invalid key exchange material: ", err)
+				}
+				handleKeyExchange(s, kx)
+			case device.KindMessage:
+				if plaintext, ok := decrypt(s, m.Payload); ok {
+					handleMessage(s, plaintext)
+				}
+			}
+		case DEVICE_LIST_TYPE:
+			var l device.List
+			if err := l.UnmarshalBinary(body); err != nil {
+				log.Fatal("Invalid device list: ", err)
+			}
+			changed, err := updatePeerDevices(peer, &l)
+			if err == device.ErrUserChanged {
+				log.Fatalf("%s sent a list of devices signed by another user key than before, ignoring it", peer)
+			}
+			if err == errForeignDevices {
+				log.Fatalf("%s sent a list of devices without the one you have a session with, ignoring it", peer)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			if changed {
+				fmt.Fprintf(os.Stderr, "%s now has %d device(s), see \"goax devices %s\"\n", peer, len(l.Devices), peer)
+			}
+			scannedSomething = true
+		case GROUP_MESSAGE_TYPE:
+			receiveGroupMessage(body)
+			scannedSomething = true
+		case DEVICE_LINK_TYPE:
+			log.Println("This links one of your devices, use \"goax link accept\" instead")
+		default:
+			log.Println("Unknown block type: ", blockType)
+		}
+	}
+
+	fragments := scanBlocks(stdin, peer, handleBlock)
+	if !fragments && !scannedSomething {
+		fmt.Fprintln(os.Stderr, "The input you provided is invalid")
+		os.Exit(1)
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d block(s) for your other devices\n", skipped)
+	}
+	if lastRatchet != nil {
+		if n := lastRatchet.ReceivedWithoutReply(); n >= maxSendsWithoutRatchet {
+			fmt.Fprintf(os.Stderr, "You received %d messages from %s without replying; \"goax ack %s\" lets them renew their keys even if you have nothing to say\n", n, peer, peer)
+		}
+	}
+}
+
+// scanBlocks calls handle with each block of input, whatever its encoding,
+// in the order they appear. Fragments are kept with those already received
+// from peer until their block is complete; it returns whether there were
+// any.
+func scanBlocks(input []byte, peer string, handle func(blockType string, body []byte)) (fragments bool) {
+	for _, part := range splitInput(input) {
+		switch part.kind {
+		case partOneLine:
+			blockType, content, err := decodeLine(part.text)
+			if err != nil {
+				log.Fatal(err)
+			}
+			handle(blockType, content)
+		case partFragment:
+			f, err := parseFragment(part.text)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fragments = true
+			stored, err := storeFragment(peer, f)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if stored == nil {
+				fmt.Fprintf(os.Stderr, "Got fragment %d/%d of %s, waiting for the others\n", f.index, f.count, f.id)
+				continue
+			}
+			blockType, content, err := joinFragments(stored)
+			if err != nil {
+				log.Fatal(err)
+			}
+			handle(blockType, content)
 		default:
-			log.Println("Unknown block type: ", armorDecoder.Type)
+			scanText([]byte(part.text), handle)
 		}
 	}
+	return fragments
+}
+
+// scanText calls handle with the blocks of text, in order: armored blocks,
+// and blocks encoded as words, which are separated by a blank line.
+func scanText(text []byte, handle func(blockType string, body []byte)) {
+	var armored bytes.Buffer
+	for _, p := range paragraphs(text) {
+		if bytes.Contains(p, []byte("-----BEGIN ")) || !looksLikeWords(string(p)) {
+			armored.Write(p)
+			continue
+		}
+		scanArmored(armored.Bytes(), handle)
+		armored.Reset()
+
+		payload, err := decodeWords(string(p))
+		if err != nil {
+			log.Fatal(err)
+		}
+		blockType, content, err := untypedPayload(payload)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handle(blockType, content)
+	}
+	scanArmored(armored.Bytes(), handle)
+}
+
+// paragraphs cuts text after each blank line and after the end of each
+// armored block, keeping everything so that armored blocks can be put back
+// together.
+func paragraphs(text []byte) [][]byte {
+	var parts [][]byte
+	start := 0
+	for _, line := range bytes.SplitAfter(text, []byte("\n")) {
+		start += len(line)
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 || bytes.HasPrefix(trimmed, []byte("-----END ")) {
+			parts = append(parts, text[:start])
+			text, start = text[start:], 0
+		}
+	}
+	if len(text) > 0 {
+		parts = append(parts, text)
+	}
+	return parts
+}
+
+func scanArmored(text []byte, handle func(blockType string, body []byte)) {
+	blockScanner := newBlockSplitter(text)
+	for blockScanner.Scan() {
+		armorDecoder, err := armor.Decode(strings.NewReader(blockScanner.Text()))
+		if err != nil {
+			log.Fatal("Couldn't read message from stdin: ", err)
+		}
+		body, err := ioutil.ReadAll(armorDecoder.Body)
+		if err != nil {
+			log.Fatal("Couldn't read message: ", err)
+		}
+		handle(armorDecoder.Type, body)
+	}
 	if err := blockScanner.Err(); err != nil {
 		log.Fatal("Error scanning blocks: ", err)
 	}
-	if !scannedSomething {
-		fmt.Fprintln(os.Stderr, "The input you provided is invalid")
-		os.Exit(1)
+}
+
+// warnDesync explains why a message from peer couldn't be decrypted with
+// r, if it looks like one of us lost or rolled back their state.
+func warnDesync(peer string, r *ratchet.Ratchet, err error) {
+	_, resetting := r.PeerIdentity()
+	switch {
+	case err == ratchet.ErrCannotDecrypt:
+		fmt.Fprintf(os.Stderr, "This message doesn't belong to your session with %s. If one of you lost their goax state or restored a backup, start a new session with \"goax reset %s\".\n", peer, peer)
+	case err == ratchet.ErrHandshakeNotComplete && !resetting:
+		fmt.Fprintf(os.Stderr, "%s sent a message, but you don't have a session with them. If you lost your goax state, start a new session with \"goax reset %s -key <their key>\", where <their key> is what \"goax mykey\" prints for them.\n", peer, peer)
+	}
+}
+
+// decodeKeyExchange decodes key exchange material in JSON or in binary
+// form.
+func decodeKeyExchange(content []byte) (kx ratchet.KeyExchange, err error) {
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		err = json.Unmarshal(content, &kx)
+	} else {
+		err = kx.UnmarshalBinary(content)
+	}
+	return kx, err
+}
+
+// countReceived counts a text or file message decrypted with the session
+// s.
+func countReceived(s peerSession) {
+	_, err := updateDeliveryStats(s.name(), func(s *deliveryStats) { s.Decrypted++ })
+	if err != nil {
+		log.Println("Couldn't update delivery stats: ", err)
+	}
+}
+
+// receiveAck keeps the count acknowledged by the device of the session s.
+func receiveAck(s peerSession, e *envelope.Envelope) {
+	decrypted, err := decodeAck(e.Content)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stats, err := updateDeliveryStats(s.name(), func(s *deliveryStats) {
+		if decrypted > s.Acked {
+			s.Acked = decrypted
+		}
+	})
+	if err != nil {
+		log.Println("Couldn't update delivery stats: ", err)
 	}
+	fmt.Fprintf(os.Stderr, "%s acknowledged %d of your %d messages\n", s, stats.Acked, stats.Sent)
+}
+
+// printEnvelope prints a message with its metadata as mail-like headers.
+func printEnvelope(peer string, e *envelope.Envelope) {
+	printHeaders(peer, e)
+	fmt.Println("")
+	os.Stdout.Write(e.Content)
+}
+
+func printHeaders(peer string, e *envelope.Envelope) {
+	fmt.Println("")
+	fmt.Printf("From: %s\n", peer)
+	fmt.Printf("Date: %s\n", e.Timestamp.Format(time.RFC1123Z))
+	fmt.Printf("Message-Id: %s\n", e.ID)
+	if e.ReplyTo != nil {
+		fmt.Printf("In-Reply-To: %s\n", e.ReplyTo)
+	}
+	if e.ContentType != "" {
+		fmt.Printf("Content-Type: %s\n", e.ContentType)
+	}
+}
+
+// announceQueued tells the user if messages were waiting for the
+// handshake to complete.
+func announceQueued(peer string) {
+	names, err := queuedMessages(peer)
+	if err != nil {
+		log.Println("Couldn't check for queued messages: ", err)
+		return
+	}
+	if len(names) > 0 {
+		fmt.Fprintf(os.Stderr, "The handshake is complete, %d queued message(s) ready to be sent with \"goax flush %s\"\n", len(names), peer)
+	}
+}
+
+// Kinds of inputPart.
+const (
+	partText = iota
+	partOneLine
+	partFragment
+)
+
+// inputPart is a piece of the input of receive: a one-line block, a
+// fragment, or the text between them, which holds armored blocks or words.
+type inputPart struct {
+	kind int
+	text string
+}
+
+// splitInput cuts input into its parts, in order.
+func splitInput(input []byte) []inputPart {
+	var parts []inputPart
+	var text strings.Builder
+	endText := func() {
+		if strings.TrimSpace(text.String()) != "" {
+			parts = append(parts, inputPart{kind: partText, text: text.String()})
+		}
+		text.Reset()
+	}
+	for _, line := range strings.SplitAfter(string(input), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, fragmentPrefix):
+			endText()
+			parts = append(parts, inputPart{kind: partFragment, text: trimmed})
+		case isOneLineBlock(trimmed):
+			endText()
+			parts = append(parts, inputPart{kind: partOneLine, text: trimmed})
+		default:
+			text.WriteString(line)
+		}
+	}
+	endText()
+	return parts
 }
 
 // A blockSplitter is a bufio.Scanner that splits the input into
@@ -100,18 +484,17 @@ type blockSplitter struct {
 func newBlockSplitter(input []byte) blockSplitter {
 	scanner := bufio.NewScanner(bytes.NewReader(input))
 	split := func(data []byte, atEof bool) (advance int, token []byte, err error) {
-		kxType := fmt.Sprintf("-----END %s-----", KEY_EXCHANGE_TYPE)
-		kxTypeIdx := bytes.Index(data, []byte(kxType))
-
-		encryptedType := fmt.Sprintf("-----END %s-----", ENCRYPTED_MESSAGE_TYPE)
-		encryptedTypeIdx := bytes.Index(data, []byte(encryptedType))
-		if kxTypeIdx != -1 {
-			advance := kxTypeIdx + len(kxType)
-			return advance, data[:advance], nil
-		}
-		if encryptedTypeIdx != -1 {
-			advance := encryptedTypeIdx + len(encryptedType)
-			return advance, data[:advance], nil
+		// Cut after the first end of block, whatever its type
+		end := -1
+		for _, blockType := range blockTypeBytes {
+			footer := fmt.Sprintf("-----END %s-----", blockType)
+			idx := bytes.Index(data, []byte(footer))
+			if idx != -1 && (end == -1 || idx+len(footer) < end) {
+				end = idx + len(footer)
+			}
+		}
+		if end != -1 {
+			return end, data[:end], nil
 		}
 
 		// No end of armored block, read more
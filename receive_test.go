@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/openpgp/armor"
+)
 
 func TestBlockSplitter(t *testing.T) {
 	b := newBlockSplitter([]byte(`-----BEGIN KEY EXCHANGE MATERIAL-----
@@ -60,3 +66,121 @@ xuldSH8eLU+slSZcuHhWZSHj72tM6dFm2ZvUQmwxVo7xXT8VRJC4fUyjMtW7LwUG
 		t.Fatal("Got an error after all scanning: ", err)
 	}
 }
+
+func TestBlockSplitterOrder(t *testing.T) {
+	msg := `-----BEGIN GOAX ENCRYPTED MESSAGE-----
+
+AAAA
+-----END GOAX ENCRYPTED MESSAGE-----`
+	kx := `-----BEGIN KEY EXCHANGE MATERIAL-----
+
+AAAA
+-----END KEY EXCHANGE MATERIAL-----`
+	b := newBlockSplitter([]byte(msg + "\n" + kx))
+
+	if !b.Scan() {
+		t.Fatal("Scanner didn't advance")
+	}
+	if b.Text() != msg {
+		t.Fatalf("invalid first block, got %v, expected %v", b.Text(), msg)
+	}
+	if !b.Scan() {
+		t.Fatal("Scanner didn't advance")
+	}
+	if b.Text() != "\n"+kx {
+		t.Fatalf("invalid second block, got %v, expected %v", b.Text(), kx)
+	}
+}
+
+func TestBlockSplitterDeviceBlocks(t *testing.T) {
+	list := `-----BEGIN GOAX DEVICE LIST-----
+
+AAAA
+-----END GOAX DEVICE LIST-----`
+	msg := `-----BEGIN GOAX DEVICE MESSAGE-----
+
+AAAA
+-----END GOAX DEVICE MESSAGE-----`
+	b := newBlockSplitter([]byte(list + "\n" + msg))
+
+	for _, expected := range []string{list, "\n" + msg} {
+		if !b.Scan() {
+			t.Fatal("Scanner didn't advance")
+		}
+		if b.Text() != expected {
+			t.Fatalf("invalid block, got %v, expected %v", b.Text(), expected)
+		}
+	}
+	if b.Scan() {
+		t.Fatal("Shouldn't advance a third time")
+	}
+}
+
+func TestSplitInputOrder(t *testing.T) {
+	kx := `-----BEGIN KEY EXCHANGE MATERIAL-----
+
+AAAA
+-----END KEY EXCHANGE MATERIAL-----
+`
+	input := kx + "goax:AAAA\n\ngoax-frag:x 1/2 AAAA\n" + kx
+	parts := splitInput([]byte(input))
+	expected := []inputPart{
+		{kind: partText, text: kx},
+		{kind: partOneLine, text: "goax:AAAA"},
+		{kind: partFragment, text: "goax-frag:x 1/2 AAAA"},
+		{kind: partText, text: kx},
+	}
+	if len(parts) != len(expected) {
+		t.Fatalf("Expected %d parts, got %q", len(expected), parts)
+	}
+	for i := range parts {
+		if parts[i] != expected[i] {
+			t.Fatalf("Part %d: expected %q, got %q", i, expected[i], parts[i])
+		}
+	}
+}
+
+func TestScanWordBlocks(t *testing.T) {
+	type block struct {
+		blockType string
+		content   []byte
+	}
+	var expected []block
+	var input bytes.Buffer
+	for i, blockType := range []string{ENCRYPTED_MESSAGE_TYPE, ENCRYPTED_MESSAGE_TYPE, KEY_EXCHANGE_TYPE, ENCRYPTED_MESSAGE_TYPE} {
+		content := make([]byte, 40+i)
+		rand.Read(content)
+		expected = append(expected, block{blockType, content})
+
+		// The third block is armored, the others are words, each followed
+		// by a blank line as writeBlock does
+		if i == 2 {
+			w, err := armor.Encode(&input, blockType, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(content)
+			w.Close()
+			input.WriteString("\n")
+			continue
+		}
+		words, err := encodeBlock(encodingWords, blockType, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input.WriteString(words + "\n\n")
+	}
+
+	var actual []block
+	scanText(input.Bytes(), func(blockType string, body []byte) {
+		actual = append(actual, block{blockType, body})
+	})
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %d blocks, got %d", len(expected), len(actual))
+	}
+	for i := range actual {
+		if actual[i].blockType != expected[i].blockType || !bytes.Equal(actual[i].content, expected[i].content) {
+			t.Fatalf("Block %d doesn't match", i)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rakoo/goax/pkg/ratchet"
+)
+
+// resend prints again the last n ciphertexts sent to peer, exactly as they
+// were first printed. If n is 0, all the kept ciphertexts are printed.
+func resend(peer string, n int, out blockWriter) {
+	sessions, err := openSessions(peer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !hasRatchet(sessions) {
+		fmt.Fprintf(os.Stderr, "No ratchet for %s, nothing to resend\n", peer)
+		os.Exit(1)
+	}
+
+	var resent bool
+	out.sendDevices(peer, false)
+	for _, s := range sessions {
+		if s.r == nil {
+			continue
+		}
+		names, err := sentMessages(s.name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(names) == 0 {
+			continue
+		}
+		if n > 0 && n < len(names) {
+			names = names[len(names)-n:]
+		}
+
+		if s.r.State() != ratchet.HandshakeConfirmed {
+			out.sendSessionRatchet(s.peerSession, s.r)
+		}
+		for _, name := range names {
+			cipherText, err := readSentMessage(s.name(), name)
+			if err != nil {
+				log.Fatal("Couldn't read sent message: ", err)
+			}
+			out.sendSessionMessage(s.peerSession, cipherText)
+		}
+		resent = true
+	}
+	if !resent {
+		fmt.Fprintf(os.Stderr, "No sent messages kept for %s\n", peer)
+	}
+}
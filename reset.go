@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/crowsonkb/base58"
+	"github.com/pkg/errors"
+	"github.com/rakoo/goax/pkg/ratchet"
+	"github.com/rakoo/goax/pkg/session"
+)
+
+// reset starts a new session with peer, to replace one that either of us
+// can't use anymore. key is the identity key of peer, as printed by "goax
+// mykey"; it is only needed if we don't have a session with them. If we
+// know the devices of peer, the sessions with all of them are reset.
+func reset(peer, key string, out blockWriter) {
+	sessions, err := peerSessions(peer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sessions[0].device != ([32]byte{}) {
+		if key != "" {
+			log.Fatalf("%s has linked devices, whose keys are in the list they sent; reset without -key", peer)
+		}
+		fmt.Fprintf(os.Stderr, "Send this to %s, then \"goax receive %s\" the key exchange material their devices send you back.\n\n", peer, peer)
+		out.sendDevices(peer, true)
+		for _, s := range sessions {
+			resetSession(s, s.device, out)
+		}
+		return
+	}
+
+	s := sessions[0]
+	rec, err := openRecord(s.name())
+	if err != nil && err != errNoRatchet {
+		log.Fatal(err)
+	}
+	var identity [32]byte
+	var known bool
+	if rec != nil {
+		identity, known = rec.Active.PeerIdentity()
+	}
+	if key != "" {
+		given, err := decodeIdentityKey(key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if known && given != identity {
+			log.Fatalf("This isn't the key %s used in your session; if they changed it, start over with \"goax send %s\"", peer, peer)
+		}
+		identity, known = given, true
+	}
+	if !known {
+		fmt.Fprintf(os.Stderr, "Ask %s for the output of \"goax mykey\", then run \"goax reset %s -key <their key>\"\n", peer, peer)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Send this to %s, then \"goax receive %s\" the key exchange material they send you back.\n\n", peer, peer)
+	out.sendDevices(peer, true)
+	resetSession(s, identity, out)
+}
+
+// resetSession replaces the active ratchet of s by a new one, whose key
+// exchange is a reset for the peer whose identity key is identity, and
+// prints it.
+func resetSession(s peerSession, identity [32]byte, out blockWriter) {
+	rec, err := openRecord(s.name())
+	if err != nil && err != errNoRatchet {
+		log.Fatal(err)
+	}
+	r, err := newRatchet()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := r.MarkReset(identity); err != nil {
+		log.Fatal("Invalid key: ", err)
+	}
+	if rec == nil {
+		rec = session.NewRecord(r)
+	} else {
+		rec.Replace(r)
+	}
+	if err := saveRecord(rec, s.name()); err != nil {
+		log.Fatal(err)
+	}
+	out.sendSessionRatchet(s, r)
+}
+
+func decodeIdentityKey(key string) (identity [32]byte, err error) {
+	decoded, err := base58.Decode(key)
+	if err != nil || len(decoded) != len(identity) {
+		return identity, errors.New("Invalid key, it should be the output of \"goax mykey\"")
+	}
+	copy(identity[:], decoded)
+	return identity, nil
+}
+
+// acceptReset replaces the active ratchet of rec, our record for the
+// session s, by a new one if kx is a reset from its peer. The key exchange
+// of the new ratchet still has to be completed.
+func acceptReset(s peerSession, rec *session.Record, kx ratchet.KeyExchange) {
+	peer := s.peer
+	err := rec.Active.CheckReset(kx)
+	if err == ratchet.ErrHandshakeComplete {
+		// We already accepted this reset.
+		return
+	}
+	if err != nil {
+		log.Fatalf("%s sent a session reset that doesn't match your session with them, ignoring it", s)
+	}
+	r, err := newRatchet()
+	if err != nil {
+		log.Fatal(err)
+	}
+	rec.Replace(r)
+	fmt.Fprintf(os.Stderr, "%s started a new session. Messages of the old one can still be read until %s.\n", s, time.Now().Add(previousRatchetLifetime).Format(time.RFC1123Z))
+	fmt.Fprintf(os.Stderr, "Your next message to %s completes the new session, or use \"goax invite %s\" if you have nothing to say.\n", peer, peer)
+}
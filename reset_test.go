@@ -0,0 +1,24 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/crowsonkb/base58"
+)
+
+func TestDecodeIdentityKey(t *testing.T) {
+	var identity [32]byte
+	io.ReadFull(rand.Reader, identity[:])
+	key, err := decodeIdentityKey(base58.Encode(identity[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != identity {
+		t.Fatalf("decoded %x, want %x", key, identity)
+	}
+	if _, err := decodeIdentityKey(base58.Encode(identity[:31])); err == nil {
+		t.Fatal("short key was accepted")
+	}
+}
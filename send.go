@@ -1,92 +1,147 @@
 package main
 
 import (
-	"bytes"
+	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path"
 
+	"github.com/rakoo/goax/pkg/envelope"
 	"github.com/rakoo/goax/pkg/ratchet"
-
-	"golang.org/x/crypto/openpgp/armor"
 )
 
-func send(peer string) {
-	r, err := openRatchet(peer)
+// sendOptions are the flags of the send command.
+type sendOptions struct {
+	// replyTo is the id of the message we're answering, if any.
+	replyTo *envelope.ID
+	out     blockWriter
+}
+
+func send(peer string, opts sendOptions) {
+	sessions, err := openSessions(peer)
 	if err != nil {
-		if err == errNoRatchet {
-			fmt.Fprintf(os.Stderr, "No ratchet for %s, please send this to the peer and \"receive\" what they send you back", peer)
-			fmt.Println("\n")
-			r, err := createRatchet(peer)
-			if err != nil {
-				log.Fatalf("Couldn't create ratchet for %s: %s", peer, err)
-			}
-			err = saveRatchet(r, peer)
-			if err != nil {
-				log.Fatal("Couldn't save ratchet, will have to try another time", err)
-			}
-			sendRatchet(r)
-			fmt.Println("")
-			return
-		} else {
-			log.Fatal(err)
-		}
+		log.Fatal(err)
 	}
 
 	fmt.Println("")
-	msg, err := ioutil.ReadAll(os.Stdin)
+	content, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
 		log.Fatal("Couldn't read all stdin")
 	}
 	fmt.Println("")
-	cipherText, err := r.Encrypt(msg)
+	e, err := envelope.New(rand.Reader, envelope.Text, http.DetectContentType(content), content)
 	if err != nil {
-		if err == ratchet.ErrHandshakeNotComplete {
-			fmt.Fprintf(os.Stderr, "\nSorry, the handshake is not complete yet; you can't send any messages. Please ask %s for their key exchange material and use \"goax receive %s\" to finish handshake.\n", peer, peer)
-			fmt.Fprintf(os.Stderr, "Here's your own key exchange material, in case you want to send it again to them:\n\n")
-			sendRatchet(r)
-			os.Exit(1)
-		} else {
-			log.Fatal(err)
-		}
-	}
-
-	if err := saveRatchet(r, peer); err != nil {
-		log.Println("Couldn't save ratchet:", err)
-		os.Remove(path.Join("ratchets", hex.EncodeToString([]byte(peer))))
-		os.Exit(1)
+		log.Fatal(err)
 	}
+	e.ReplyTo = opts.replyTo
 
-	if isNew(peer) {
-		sendRatchet(r)
+	var started []sessionRatchet
+	for i, s := range sessions {
+		if s.r != nil {
+			continue
+		}
+		r, err := createRatchet(s.name())
+		if err != nil {
+			log.Fatalf("Couldn't create ratchet for %s: %s", s, err)
+		}
+		sessions[i].r = r
+		started = append(started, sessions[i])
 	}
-
-	encoder, err := armor.Encode(os.Stdout, ENCRYPTED_MESSAGE_TYPE, nil)
-	if err != nil {
-		log.Fatal("Couldn't create armor encoder: ", err)
+	if len(started) == len(sessions) {
+		// First contact: keep the message until the handshake is done.
+		if len(content) > 0 {
+			msg, err := e.Marshal()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := queueMessage(peer, msg); err != nil {
+				log.Fatal("Couldn't queue message: ", err)
+			}
+			fmt.Fprintf(os.Stderr, "Your message was queued; \"goax flush %s\" sends it once the handshake is complete.\n", peer)
+		}
+		fmt.Fprintf(os.Stderr, "No ratchet for %s, please send this to the peer and \"receive\" what they send you back", peer)
+		fmt.Print("\n\n")
+		opts.out.sendDevices(peer, true)
+		for _, s := range started {
+			opts.out.sendSessionRatchet(s.peerSession, s.r)
+		}
+		fmt.Println("")
+		return
 	}
 
-	io.Copy(encoder, bytes.NewReader(cipherText))
-	encoder.Close()
-	fmt.Println("")
+	sendEnvelope(peer, sessions, e, opts.out)
 }
 
-func sendRatchet(r *ratchet.Ratchet) {
-	kx, err := r.GetKeyExchangeMaterial()
+// sendEnvelope encrypts e for each session with peer and prints it, or
+// queues it if no handshake is complete. Devices of peer whose handshake
+// isn't complete don't get it.
+func sendEnvelope(peer string, sessions []sessionRatchet, e *envelope.Envelope, out blockWriter) {
+	msg, err := e.Marshal()
 	if err != nil {
-		log.Fatal("Couldn't get key exchange material ", err)
+		log.Fatal(err)
 	}
-	encoder, err := armor.Encode(os.Stdout, KEY_EXCHANGE_TYPE, nil)
-	if err != nil {
-		log.Fatal("Couldn't get armor encoder")
+
+	var ready, pending []sessionRatchet
+	for _, s := range sessions {
+		switch {
+		case s.r == nil:
+		case s.r.State() == ratchet.AwaitingKeyExchange:
+			pending = append(pending, s)
+		default:
+			ready = append(ready, s)
+		}
+	}
+	if len(ready) == 0 {
+		if err := queueMessage(peer, msg); err != nil {
+			log.Fatal("Couldn't queue message: ", err)
+		}
+		fmt.Fprintf(os.Stderr, "\nThe handshake is not complete yet, so your message was queued. Please ask %s for their key exchange material and use \"goax receive %s\" to finish handshake, then \"goax flush %s\" to send it.\n", peer, peer, peer)
+		fmt.Fprintf(os.Stderr, "Here's your own key exchange material, in case you want to send it again to them:\n\n")
+		out.sendDevices(peer, true)
+		for _, s := range pending {
+			out.sendSessionRatchet(s.peerSession, s.r)
+		}
+		return
 	}
 
-	json.NewEncoder(encoder).Encode(kx)
-	encoder.Close()
-	fmt.Println("")
+	out.sendDevices(peer, false)
+	var sentWithoutRatchet uint32
+	var unacknowledged uint64
+	for _, s := range ready {
+		cipherText, err := s.r.Encrypt(msg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := saveRatchet(s.r, s.name()); err != nil {
+			log.Println("Couldn't save ratchet:", err)
+			os.Remove(path.Join("ratchets", hex.EncodeToString([]byte(s.name()))))
+			os.Exit(1)
+		}
+		if err := storeSent(s.name(), cipherText); err != nil {
+			log.Println("Couldn't keep message for resending:", err)
+		}
+		if n := s.r.SentWithoutRatchet(); n > sentWithoutRatchet {
+			sentWithoutRatchet = n
+		}
+		if n := countSent(s.peerSession).unacknowledged(); n > unacknowledged {
+			unacknowledged = n
+		}
+
+		if s.r.State() != ratchet.HandshakeConfirmed {
+			out.sendSessionRatchet(s.peerSession, s.r)
+		}
+		out.sendSessionMessage(s.peerSession, cipherText)
+	}
+	warnDeliveryHealth(peer, sentWithoutRatchet, unacknowledged)
+
+	if len(pending) > 0 {
+		fmt.Fprintf(os.Stderr, "%d device(s) of %s didn't complete the handshake and won't get this message. Here's your key exchange material for them:\n\n", len(pending), peer)
+		for _, s := range pending {
+			out.sendSessionRatchet(s.peerSession, s.r)
+		}
+	}
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Ciphertexts we send are kept for a while in sent/<hex(peer)>/ so that
+// they can be re-emitted as-is if the transport lost them. Encrypting the
+// plaintext again would advance the chain for nothing.
+const (
+	// maxSentMessages is the maximum number of ciphertexts kept per peer.
+	maxSentMessages = 32
+	// maxSentAge is how long a ciphertext is kept.
+	maxSentAge = 14 * 24 * time.Hour
+)
+
+func sentDir(peer string) string {
+	return path.Join("sent", hex.EncodeToString([]byte(peer)))
+}
+
+func storeSent(peer string, cipherText []byte) error {
+	dir := sentDir(peer)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "Couldn't create sent directory")
+	}
+	err := ioutil.WriteFile(path.Join(dir, timestampName(time.Now())), cipherText, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't write sent message")
+	}
+	return pruneSent(peer)
+}
+
+// sentMessages returns the names of the ciphertexts kept for peer, oldest
+// first.
+func sentMessages(peer string) ([]string, error) {
+	if err := pruneSent(peer); err != nil {
+		return nil, err
+	}
+	return sortedNames(sentDir(peer))
+}
+
+func readSentMessage(peer, name string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(sentDir(peer), name))
+}
+
+// pruneSent removes ciphertexts that are too old or too many.
+func pruneSent(peer string) error {
+	names, err := sortedNames(sentDir(peer))
+	if err != nil {
+		return err
+	}
+
+	oldest := time.Now().Add(-maxSentAge)
+	for i, name := range names {
+		nanos, err := strconv.ParseInt(name, 10, 64)
+		tooOld := err != nil || time.Unix(0, nanos).Before(oldest)
+		tooMany := len(names)-i > maxSentMessages
+		if !tooOld && !tooMany {
+			continue
+		}
+		if err := os.Remove(path.Join(sentDir(peer), name)); err != nil {
+			return errors.Wrap(err, "Couldn't remove old sent message")
+		}
+	}
+	return nil
+}
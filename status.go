@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/rakoo/goax/pkg/ratchet"
+)
+
+func status(peer string, out blockWriter) {
+	sessions, err := openSessions(peer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !hasRatchet(sessions) {
+		fmt.Printf("No ratchet for %s. Use \"goax send %s\" to start a handshake, or \"goax receive %s\" if they sent you their key exchange material.\n", peer, peer, peer)
+		return
+	}
+
+	var sentWithoutRatchet uint32
+	var unacknowledged uint64
+	var unconfirmed []sessionRatchet
+	for _, s := range sessions {
+		if s.r == nil {
+			fmt.Printf("%s: no ratchet yet, \"goax invite %s\" starts the handshake\n", s, peer)
+			continue
+		}
+		rec, err := openRecord(s.name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		r := rec.Active
+
+		state := r.State()
+		fmt.Printf("%s: %s\n", s, state)
+		if state != ratchet.AwaitingKeyExchange {
+			fmt.Printf("cipher suite: %s\n", r.Suite())
+		}
+		printPadding(s.String(), r)
+		if n, oldest := rec.Previous(); n > 0 {
+			fmt.Printf("%d previous session(s), the oldest kept until %s\n", n, oldest.Add(previousRatchetLifetime).Format(time.RFC1123Z))
+		}
+		if stats, err := loadDeliveryStats(s.name()); err == nil && stats.Sent+stats.Decrypted > 0 {
+			fmt.Printf("%d message(s) sent, %d acknowledged, %d received\n", stats.Sent, stats.Acked, stats.Decrypted)
+			if n := stats.unacknowledged(); n > unacknowledged {
+				unacknowledged = n
+			}
+		}
+		if n := r.SentWithoutRatchet(); n > sentWithoutRatchet {
+			sentWithoutRatchet = n
+		}
+		if state != ratchet.HandshakeConfirmed {
+			unconfirmed = append(unconfirmed, sessionRatchet{s.peerSession, r})
+		}
+	}
+	if names, err := queuedMessages(peer); err == nil && len(names) > 0 {
+		fmt.Printf("%d queued message(s)\n", len(names))
+	}
+	warnDeliveryHealth(peer, sentWithoutRatchet, unacknowledged)
+
+	if len(unconfirmed) == 0 {
+		fmt.Fprintln(os.Stderr, "The handshake is done on both sides, nothing more to do.")
+		return
+	}
+	out.sendDevices(peer, true)
+	for _, s := range unconfirmed {
+		switch s.r.State() {
+		case ratchet.AwaitingKeyExchange:
+			fmt.Fprintf(os.Stderr, "Send this to %s, then \"goax receive %s\" the key exchange material they send you back.\n\n", s, peer)
+		case ratchet.HandshakeUnconfirmed:
+			fmt.Fprintf(os.Stderr, "You can send messages, but %s may not have finished the handshake yet. Here's your key exchange material, in case they need it again:\n\n", s)
+		}
+		out.sendSessionRatchet(s.peerSession, s.r)
+	}
+}